@@ -0,0 +1,258 @@
+package gmail
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	batchPath = "/batch/gmail/v1"
+	// Gmail rejects batches of more than 100 calls
+	batchRequestLimit = 100
+	contentIdPrefix   = "item"
+)
+
+// One call's response out of a batch. err is set when the call failed, either
+// with the ApiError Gmail answered for it or because the whole batch failed.
+type batchResponse struct {
+	statusCode int
+	body       []byte
+	err        error
+}
+
+// A message fetched as part of a batch.
+type messageResult struct {
+	id      string
+	message *messagePayload
+	err     error
+}
+
+// Fetches the named headers of many messages, and none of their bodies, with
+// as few round-trips as possible, combining up to batchRequestLimit
+// messages.get calls per request. Results are in the order of msgIds.
+func (c *Client) GetMessageHeadersById(msgIds []string, headers ...string) []messageResult {
+	query := metadataQuery(headers)
+	paths := make([]string, len(msgIds))
+	for i, msgId := range msgIds {
+		paths[i] = fmt.Sprintf("messages/%s?%s", url.PathEscape(msgId), query)
+	}
+
+	results := make([]messageResult, len(msgIds))
+	for i, res := range c.batchGet(paths, "messages.get") {
+		results[i].id = msgIds[i]
+		if res.err != nil {
+			results[i].err = res.err
+			continue
+		}
+
+		var payload messagePayload
+		if err := json.Unmarshal(res.body, &payload); err != nil {
+			results[i].err = fmt.Errorf("there was an error unmarshalling the data: %v", err.Error())
+			continue
+		}
+		results[i].message = &payload
+	}
+
+	return results
+}
+
+// Issues GET calls for paths relative to the user's URL through the batch
+// endpoint and returns one response per path, in order. Calls that Gmail
+// answers with a rate limit or server error are sent again in a later batch.
+func (c *Client) batchGet(paths []string, method string) []batchResponse {
+	responses := make([]batchResponse, len(paths))
+
+	pending := make([]int, len(paths))
+	for i := range pending {
+		pending[i] = i
+	}
+
+	for attempt := 1; len(pending) > 0; attempt++ {
+		if attempt > 1 {
+			select {
+			case <-time.After(backoff(attempt - 1)):
+			case <-c.context().Done():
+				for _, index := range pending {
+					responses[index] = batchResponse{err: c.context().Err()}
+				}
+				return responses
+			}
+		}
+
+		var retry []int
+		for _, indices := range chunkIndices(pending, batchRequestLimit) {
+			batchPaths := make([]string, len(indices))
+			for i, index := range indices {
+				batchPaths[i] = paths[index]
+			}
+
+			batch, err := c.sendBatch(batchPaths, method)
+			for i, index := range indices {
+				if err != nil {
+					responses[index] = batchResponse{err: err}
+					continue
+				}
+
+				responses[index] = batch[i]
+				if attempt < maxAttempts && (batch[i].statusCode == http.StatusTooManyRequests || batch[i].statusCode >= 500 || IsRateLimited(batch[i].err)) {
+					retry = append(retry, index)
+				}
+			}
+		}
+		pending = retry
+	}
+
+	return responses
+}
+
+// Sends one batch request and demultiplexes its parts.
+func (c *Client) sendBatch(paths []string, method string) ([]batchResponse, error) {
+	userUrl, err := url.Parse(c.userUrl())
+	if err != nil {
+		return nil, fmt.Errorf("error parsing user url: %v", err.Error())
+	}
+
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	for i, path := range paths {
+		part, err := writer.CreatePart(textproto.MIMEHeader{
+			"Content-Type": {"application/http"},
+			"Content-ID":   {fmt.Sprintf("<%s%d>", contentIdPrefix, i)},
+		})
+		if err != nil {
+			return nil, fmt.Errorf("error writing batch part: %v", err.Error())
+		}
+		fmt.Fprintf(part, "GET %s/%s\r\n\r\n", userUrl.EscapedPath(), path)
+	}
+	if err := writer.Close(); err != nil {
+		return nil, fmt.Errorf("error writing batch body: %v", err.Error())
+	}
+
+	batchUrl := c.apiUrl + batchPath
+	reqMethod := "POST"
+	req, err := http.NewRequestWithContext(c.context(), reqMethod, batchUrl, &body)
+	if err != nil {
+		return nil, &requestCreationError{reqMethod, batchUrl, err.Error()}
+	}
+	req.Header.Set("Content-Type", "multipart/mixed; boundary="+writer.Boundary())
+	// a batch costs as much quota as the calls inside it
+	req = req.WithContext(withQuotaCost(req.Context(), "batch "+method, len(paths)*quotaUnitsOf(method)))
+
+	res, err := c.Do(req)
+	if err != nil {
+		return nil, &requestExecutionError{reqMethod, batchUrl, err.Error()}
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, newApiError(res)
+	}
+
+	mediaType, params, err := mime.ParseMediaType(res.Header.Get("Content-Type"))
+	if err != nil || !strings.HasPrefix(mediaType, "multipart/") {
+		return nil, fmt.Errorf("unexpected batch response content type \"%v\"", res.Header.Get("Content-Type"))
+	}
+
+	responses := make([]batchResponse, len(paths))
+	received := make([]bool, len(paths))
+	reader := multipart.NewReader(res.Body, params["boundary"])
+
+	for position := 0; ; position++ {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("error reading batch response: %v", err.Error())
+		}
+
+		// parts normally come back in order, but Content-ID is authoritative
+		index, ok := partIndex(part.Header.Get("Content-ID"))
+		if !ok {
+			index = position
+		}
+		if index < 0 || index >= len(paths) {
+			continue
+		}
+
+		subReq, _ := http.NewRequest("GET", fmt.Sprintf("%s/%s", c.userUrl(), paths[index]), nil)
+		responses[index] = readBatchPart(part, subReq)
+		received[index] = true
+	}
+
+	for i := range responses {
+		if !received[i] {
+			responses[i] = batchResponse{err: fmt.Errorf("batch response had no part for %v", paths[i])}
+		}
+	}
+
+	return responses, nil
+}
+
+// Parses one application/http part. The body is everything after the part's
+// headers; its Content-Length is not relied on, since it no longer holds for
+// parts whose bodies were scrubbed for a fixture.
+func readBatchPart(part io.Reader, req *http.Request) batchResponse {
+	buffered := bufio.NewReader(part)
+	tp := textproto.NewReader(buffered)
+
+	statusLine, err := tp.ReadLine()
+	if err != nil {
+		return batchResponse{err: fmt.Errorf("error parsing batch response part: %v", err.Error())}
+	}
+	_, status, _ := strings.Cut(statusLine, " ")
+	statusCode, err := strconv.Atoi(strings.SplitN(status, " ", 2)[0])
+	if err != nil {
+		return batchResponse{err: fmt.Errorf("error parsing batch response status \"%v\"", statusLine)}
+	}
+
+	header, err := tp.ReadMIMEHeader()
+	if err != nil && err != io.EOF {
+		return batchResponse{err: fmt.Errorf("error parsing batch response part: %v", err.Error())}
+	}
+
+	body, err := io.ReadAll(buffered)
+	if err != nil {
+		return batchResponse{statusCode: statusCode, err: fmt.Errorf("error reading batch response part: %v", err.Error())}
+	}
+
+	if statusCode != http.StatusOK {
+		res := &http.Response{StatusCode: statusCode, Header: http.Header(header), Body: io.NopCloser(bytes.NewReader(body)), Request: req}
+		return batchResponse{statusCode: statusCode, err: newApiError(res)}
+	}
+	return batchResponse{statusCode: statusCode, body: body}
+}
+
+// Maps a response Content-ID such as "<response-item3>" back to its call.
+func partIndex(contentId string) (int, bool) {
+	id := strings.Trim(contentId, "<>")
+	id = strings.TrimPrefix(id, "response-")
+	if !strings.HasPrefix(id, contentIdPrefix) {
+		return 0, false
+	}
+
+	index, err := strconv.Atoi(strings.TrimPrefix(id, contentIdPrefix))
+	return index, err == nil
+}
+
+func chunkIndices(indices []int, size int) [][]int {
+	var chunks [][]int
+	for len(indices) > size {
+		chunks = append(chunks, indices[:size])
+		indices = indices[size:]
+	}
+	if len(indices) > 0 {
+		chunks = append(chunks, indices)
+	}
+	return chunks
+}
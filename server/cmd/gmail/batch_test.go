@@ -0,0 +1,376 @@
+package gmail
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strings"
+	"testing"
+
+	"gmail-organizer/cmd/gmail/gmailtest"
+)
+
+// One part of a batch response, as the rewriting transport handles it.
+type rawPart struct {
+	header textproto.MIMEHeader
+	body   []byte
+}
+
+// Counts batch requests and rewrites the parts of successful batch responses,
+// to serve what Gmail may but the fake does not: parts out of order, missing
+// or without Content-ID.
+type batchRewriter struct {
+	base    http.RoundTripper
+	rewrite func(parts []rawPart) []rawPart
+	batches int
+}
+
+func (t *batchRewriter) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Path == batchPath {
+		t.batches++
+	}
+	res, err := t.base.RoundTrip(req)
+	if err != nil || req.URL.Path != batchPath || res.StatusCode != http.StatusOK || t.rewrite == nil {
+		return res, err
+	}
+	defer res.Body.Close()
+
+	_, params, err := mime.ParseMediaType(res.Header.Get("Content-Type"))
+	if err != nil {
+		return nil, err
+	}
+	var parts []rawPart
+	reader := multipart.NewReader(res.Body, params["boundary"])
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		body, _ := io.ReadAll(part)
+		parts = append(parts, rawPart{part.Header, body})
+	}
+
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	for _, part := range t.rewrite(parts) {
+		w, _ := writer.CreatePart(part.header)
+		w.Write(part.body)
+	}
+	writer.Close()
+
+	res.Header.Set("Content-Type", "multipart/mixed; boundary="+writer.Boundary())
+	res.Header.Del("Content-Length")
+	res.ContentLength = -1
+	res.Body = io.NopCloser(&body)
+	return res, nil
+}
+
+// Seeds n messages whose From header names their position.
+func seedBatchMessages(srv *gmailtest.Server, n int) []string {
+	ids := make([]string, n)
+	for i := range ids {
+		ids[i] = srv.AddMessage(gmailtest.Message{Headers: []gmailtest.Header{{Name: "From", Value: fmt.Sprintf("sender%d@example.com", i)}}})
+	}
+	return ids
+}
+
+func newBatchTestClient(t *testing.T, srv *gmailtest.Server, rewrite func([]rawPart) []rawPart) (*Client, *batchRewriter) {
+	transport := &batchRewriter{base: srv.Client().Transport, rewrite: rewrite}
+	return NewClient(&http.Client{Transport: transport}, &Profile{Name: "default", Dir: t.TempDir()}, srv.URL), transport
+}
+
+func batchTestClient(t *testing.T, srv *gmailtest.Server, rewrite func([]rawPart) []rawPart) *Client {
+	client, _ := newBatchTestClient(t, srv, rewrite)
+	return client
+}
+
+func fromHeader(message *messagePayload) string {
+	for _, header := range message.Payload.Headers {
+		if header.Name == "From" {
+			return header.Value
+		}
+	}
+	return ""
+}
+
+// Checks that every result is the message asked for at its position.
+func checkBatchResults(t *testing.T, ids []string, results []messageResult, failed map[int]bool) {
+	t.Helper()
+	if len(results) != len(ids) {
+		t.Fatalf("got %d results for %d messages", len(results), len(ids))
+	}
+	for i, result := range results {
+		if result.id != ids[i] {
+			t.Errorf("result %d is for message %v, want %v", i, result.id, ids[i])
+		}
+		if failed[i] {
+			if result.err == nil {
+				t.Errorf("result %d succeeded, want it to fail", i)
+			}
+			continue
+		}
+		if result.err != nil {
+			t.Errorf("result %d: %v", i, result.err)
+			continue
+		}
+		if from, want := fromHeader(result.message), fmt.Sprintf("sender%d@example.com", i); from != want {
+			t.Errorf("result %d has From %q, want %q", i, from, want)
+		}
+	}
+}
+
+func countRequests(srv *gmailtest.Server, prefix string) map[string]int {
+	counts := make(map[string]int)
+	for _, request := range srv.Requests() {
+		if strings.HasPrefix(request, prefix) {
+			counts[request]++
+		}
+	}
+	return counts
+}
+
+func TestBatchSplitsIntoRequestsOfAtMostLimit(t *testing.T) {
+	srv := gmailtest.NewServer("me@example.com")
+	defer srv.Close()
+	ids := seedBatchMessages(srv, 2*batchRequestLimit+50)
+
+	client, transport := newBatchTestClient(t, srv, nil)
+	results := client.GetMessageHeadersById(ids, "From")
+	checkBatchResults(t, ids, results, nil)
+
+	if transport.batches != 3 {
+		t.Errorf("sent %d batch requests, want 3", transport.batches)
+	}
+	if gets := len(countRequests(srv, "GET /gmail/v1/users/")); gets != len(ids) {
+		t.Errorf("fetched %d distinct messages, want %d", gets, len(ids))
+	}
+}
+
+func TestBatchEmpty(t *testing.T) {
+	srv := gmailtest.NewServer("me@example.com")
+	defer srv.Close()
+
+	if results := batchTestClient(t, srv, nil).GetMessageHeadersById(nil, "From"); len(results) != 0 {
+		t.Errorf("got %d results for no messages", len(results))
+	}
+	if requests := srv.Requests(); len(requests) != 0 {
+		t.Errorf("sent %v for no messages", requests)
+	}
+}
+
+func TestBatchPerPartClientErrors(t *testing.T) {
+	srv := gmailtest.NewServer("me@example.com")
+	defer srv.Close()
+	ids := seedBatchMessages(srv, 5)
+	ids = append(ids, "doesnotexist")
+	srv.Fail("messages/"+ids[2], http.StatusForbidden, "insufficientPermissions", 1)
+
+	results := batchTestClient(t, srv, nil).GetMessageHeadersById(ids, "From")
+	checkBatchResults(t, ids, results, map[int]bool{2: true, 5: true})
+
+	if !IsNotFound(results[5].err) {
+		t.Errorf("missing message: error = %v, want not found", results[5].err)
+	}
+	if apiErr, ok := asApiError(results[2].err); !ok || apiErr.StatusCode != http.StatusForbidden || apiErr.Reason != "insufficientPermissions" {
+		t.Errorf("forbidden message: error = %v, want the part's ApiError", results[2].err)
+	}
+	// client errors are final
+	if gets := countRequests(srv, "GET /gmail/v1/users/me/messages/"+ids[2]); gets["GET /gmail/v1/users/me/messages/"+ids[2]] != 1 {
+		t.Errorf("forbidden message fetched %v times, want once", gets)
+	}
+}
+
+func TestBatchRetriesOnlyFailedParts(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		status int
+		reason string
+	}{
+		{"server error", http.StatusInternalServerError, "backendError"},
+		{"too many requests", http.StatusTooManyRequests, "rateLimitExceeded"},
+		{"rate limit 403", http.StatusForbidden, "userRateLimitExceeded"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			srv := gmailtest.NewServer("me@example.com")
+			defer srv.Close()
+			ids := seedBatchMessages(srv, 6)
+			srv.Fail("messages/"+ids[1], test.status, test.reason, 1)
+			srv.Fail("messages/"+ids[4], test.status, test.reason, 1)
+
+			client, transport := newBatchTestClient(t, srv, nil)
+			results := client.GetMessageHeadersById(ids, "From")
+			checkBatchResults(t, ids, results, nil)
+
+			counts := countRequests(srv, "GET /gmail/v1/users/me/messages/")
+			for i, id := range ids {
+				want := 1
+				if i == 1 || i == 4 {
+					want = 2
+				}
+				if got := counts["GET /gmail/v1/users/me/messages/"+id]; got != want {
+					t.Errorf("message %d fetched %d times, want %d", i, got, want)
+				}
+			}
+			if transport.batches != 2 {
+				t.Errorf("sent %d batch requests, want the failed parts in a second one", transport.batches)
+			}
+		})
+	}
+}
+
+func TestBatchMapsReorderedParts(t *testing.T) {
+	srv := gmailtest.NewServer("me@example.com")
+	defer srv.Close()
+	ids := seedBatchMessages(srv, 7)
+
+	reverse := func(parts []rawPart) []rawPart {
+		for i, j := 0, len(parts)-1; i < j; i, j = i+1, j-1 {
+			parts[i], parts[j] = parts[j], parts[i]
+		}
+		return parts
+	}
+	results := batchTestClient(t, srv, reverse).GetMessageHeadersById(ids, "From")
+	checkBatchResults(t, ids, results, nil)
+}
+
+func TestBatchReportsMissingParts(t *testing.T) {
+	srv := gmailtest.NewServer("me@example.com")
+	defer srv.Close()
+	ids := seedBatchMessages(srv, 5)
+
+	dropThird := func(parts []rawPart) []rawPart {
+		return append(parts[:2:2], parts[3:]...)
+	}
+	results := batchTestClient(t, srv, dropThird).GetMessageHeadersById(ids, "From")
+	checkBatchResults(t, ids, results, map[int]bool{2: true})
+
+	if err := results[2].err; err == nil || !strings.Contains(err.Error(), "no part") {
+		t.Errorf("missing part: error = %v", err)
+	}
+}
+
+func TestBatchFallsBackToPositionWithoutContentId(t *testing.T) {
+	srv := gmailtest.NewServer("me@example.com")
+	defer srv.Close()
+	ids := seedBatchMessages(srv, 4)
+
+	stripIds := func(parts []rawPart) []rawPart {
+		for _, part := range parts {
+			part.header.Del("Content-ID")
+		}
+		return parts
+	}
+	results := batchTestClient(t, srv, stripIds).GetMessageHeadersById(ids, "From")
+	checkBatchResults(t, ids, results, nil)
+}
+
+func TestBatchIgnoresUnknownContentIds(t *testing.T) {
+	srv := gmailtest.NewServer("me@example.com")
+	defer srv.Close()
+	ids := seedBatchMessages(srv, 3)
+
+	extra := func(parts []rawPart) []rawPart {
+		stray := rawPart{textproto.MIMEHeader{"Content-Type": {"application/http"}, "Content-ID": {"<response-item99>"}}, []byte("HTTP/1.1 500 Internal Server Error\r\n\r\n")}
+		return append(parts, stray)
+	}
+	results := batchTestClient(t, srv, extra).GetMessageHeadersById(ids, "From")
+	checkBatchResults(t, ids, results, nil)
+}
+
+func TestBatchWholeRequestFailure(t *testing.T) {
+	srv := gmailtest.NewServer("me@example.com")
+	defer srv.Close()
+	ids := seedBatchMessages(srv, 3)
+
+	failing := &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		return &http.Response{
+			StatusCode: http.StatusBadRequest,
+			Header:     http.Header{"Content-Type": {"application/json"}},
+			Body:       io.NopCloser(strings.NewReader(`{"error":{"code":400,"errors":[{"reason":"invalidArgument"}]}}`)),
+			Request:    req,
+		}, nil
+	})}
+	client := NewClient(failing, &Profile{Name: "default", Dir: t.TempDir()}, srv.URL)
+
+	results := client.GetMessageHeadersById(ids, "From")
+	checkBatchResults(t, ids, results, map[int]bool{0: true, 1: true, 2: true})
+	if apiErr, ok := asApiError(results[0].err); !ok || apiErr.StatusCode != http.StatusBadRequest {
+		t.Errorf("error = %v, want the batch's ApiError", results[0].err)
+	}
+}
+
+func TestReadBatchPart(t *testing.T) {
+	req, _ := http.NewRequest("GET", "https://gmail.googleapis.com/gmail/v1/users/me/messages/1", nil)
+
+	for _, test := range []struct {
+		name       string
+		part       string
+		wantStatus int
+		wantBody   string
+		wantErr    string
+	}{
+		{"ok", "HTTP/1.1 200 OK\r\nContent-Type: application/json\r\nContent-Length: 2\r\n\r\n{}", 200, "{}", ""},
+		// scrubbed fixtures change bodies without fixing Content-Length
+		{"body longer than content length", "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\n{\"id\":\"1\"}", 200, `{"id":"1"}`, ""},
+		{"no headers", "HTTP/1.1 200 OK\r\n\r\n{}", 200, "{}", ""},
+		{"not found", "HTTP/1.1 404 Not Found\r\nContent-Type: application/json\r\n\r\n{\"error\":{\"code\":404,\"errors\":[{\"reason\":\"notFound\"}]}}", 404, "", "notFound"},
+		{"bad status", "HTTP/1.1 abc\r\n\r\n", 0, "", "error parsing batch response status"},
+		{"empty", "", 0, "", "error parsing batch response part"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			got := readBatchPart(strings.NewReader(test.part), req)
+			if got.statusCode != test.wantStatus {
+				t.Errorf("status = %v, want %v", got.statusCode, test.wantStatus)
+			}
+			if test.wantErr == "" {
+				if got.err != nil || string(got.body) != test.wantBody {
+					t.Errorf("readBatchPart = %q, %v; want %q", got.body, got.err, test.wantBody)
+				}
+			} else if got.err == nil || !strings.Contains(got.err.Error(), test.wantErr) {
+				t.Errorf("error = %v, want one containing %q", got.err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestPartIndex(t *testing.T) {
+	for _, test := range []struct {
+		contentId string
+		want      int
+		wantOk    bool
+	}{
+		{"<response-item0>", 0, true},
+		{"<response-item42>", 42, true},
+		{"response-item7", 7, true},
+		{"<item3>", 3, true},
+		{"<response-other1>", 0, false},
+		{"<response-itemx>", 0, false},
+		{"", 0, false},
+	} {
+		got, ok := partIndex(test.contentId)
+		if ok != test.wantOk || (ok && got != test.want) {
+			t.Errorf("partIndex(%q) = %v, %v; want %v, %v", test.contentId, got, ok, test.want, test.wantOk)
+		}
+	}
+}
+
+func TestChunkIndices(t *testing.T) {
+	indices := make([]int, 250)
+	for i := range indices {
+		indices[i] = i
+	}
+
+	chunks := chunkIndices(indices, 100)
+	if len(chunks) != 3 || len(chunks[0]) != 100 || len(chunks[2]) != 50 || chunks[2][49] != 249 {
+		t.Errorf("chunkIndices(250, 100) = %d chunks, want 100, 100 and 50", len(chunks))
+	}
+	if chunks := chunkIndices(nil, 100); len(chunks) != 0 {
+		t.Errorf("chunkIndices(nil) = %v, want none", chunks)
+	}
+}
@@ -0,0 +1,83 @@
+package gmail
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+)
+
+const (
+	defaultApiUrl = "https://gmail.googleapis.com"
+	// authorized requests only go to hosts under this domain, or to loopback
+	googleApiDomain = "googleapis.com"
+)
+
+// Endpoint decides where API calls go and what carries them.
+type Endpoint struct {
+	// API root, e.g. https://gmail.googleapis.com. Defaults to the
+	// GMAIL_API_ENDPOINT environment variable, then to Google's. Only HTTPS
+	// hosts under googleapis.com and loopback addresses are allowed.
+	Url string
+	// When set, carries every request in place of an authorized OAuth or
+	// service account client, e.g. the transport of a gmailtest.Server.
+	Transport http.RoundTripper
+	// When set, carries requests to third-party hosts, such as unsubscribe
+	// links, in place of the transport that refuses non-public addresses, e.g.
+	// to reach a local test server. Only HTTPS is still allowed.
+	WebTransport http.RoundTripper
+	// Fixture file to record every exchange into, with credentials and
+	// personal addresses scrubbed.
+	Record string
+	// Fixture file to answer every request from instead of the network. Takes
+	// the place of Transport and needs no credentials.
+	Replay string
+}
+
+var (
+	endpointMu sync.Mutex
+	endpoint   Endpoint
+)
+
+// Sends the API calls of every client built from now on to e. Passing the zero
+// Endpoint restores the default.
+func UseEndpoint(e Endpoint) {
+	endpointMu.Lock()
+	defer endpointMu.Unlock()
+	endpoint = e
+}
+
+func currentEndpoint() Endpoint {
+	endpointMu.Lock()
+	e := endpoint
+	endpointMu.Unlock()
+
+	if e.Url == "" {
+		e.Url = os.Getenv("GMAIL_API_ENDPOINT")
+	}
+	if e.Url == "" {
+		e.Url = defaultApiUrl
+	}
+	e.Url = strings.TrimSuffix(e.Url, "/")
+	return e
+}
+
+// Returns the host of the API root. The account's credentials are sent there,
+// so it has to be one of Google's HTTPS hosts or, for fake servers, a
+// loopback address.
+func (e Endpoint) host() (string, error) {
+	u, err := url.Parse(e.Url)
+	if err != nil || u.Host == "" {
+		return "", fmt.Errorf("invalid API endpoint \"%v\"", e.Url)
+	}
+
+	hostname := strings.ToLower(u.Hostname())
+	isGoogle := u.Scheme == "https" && (hostname == googleApiDomain || strings.HasSuffix(hostname, "."+googleApiDomain))
+	isLocal := (u.Scheme == "https" || u.Scheme == "http") && isLoopback(hostname)
+	if !isGoogle && !isLocal {
+		return "", fmt.Errorf("refusing API endpoint \"%v\"; only HTTPS hosts under %v and loopback addresses are allowed", e.Url, googleApiDomain)
+	}
+	return u.Host, nil
+}
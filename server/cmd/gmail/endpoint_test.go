@@ -0,0 +1,56 @@
+package gmail
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestEndpointHost(t *testing.T) {
+	for _, test := range []struct {
+		url, want string
+	}{
+		{"https://gmail.googleapis.com", "gmail.googleapis.com"},
+		{"https://GMAIL.googleapis.com:443/", "GMAIL.googleapis.com:443"},
+		{"https://googleapis.com", "googleapis.com"},
+		{"http://127.0.0.1:8080", "127.0.0.1:8080"},
+		{"https://[::1]:8443", "[::1]:8443"},
+		{"http://localhost:9000", "localhost:9000"},
+	} {
+		if got, err := (Endpoint{Url: test.url}).host(); err != nil || got != test.want {
+			t.Errorf("host of %v = %q, %v; want %q", test.url, got, err, test.want)
+		}
+	}
+
+	for _, url := range []string{
+		"https://evil.example",
+		"https://gmail.googleapis.com.evil.example",
+		"https://evilgoogleapis.com",
+		// Google's hosts only over HTTPS
+		"http://gmail.googleapis.com",
+		"ftp://127.0.0.1",
+		"https://10.0.0.1",
+		"gmail.googleapis.com",
+		"::",
+	} {
+		if host, err := (Endpoint{Url: url}).host(); err == nil {
+			t.Errorf("host of %v = %q, want it refused", url, host)
+		}
+	}
+}
+
+func TestEndpointFromEnvironmentIsChecked(t *testing.T) {
+	UseEndpoint(Endpoint{})
+	t.Setenv("GMAIL_API_ENDPOINT", "https://collector.evil.example/")
+	if _, err := currentEndpoint().host(); err == nil || !strings.Contains(err.Error(), "collector.evil.example") {
+		t.Errorf("host() = %v, want the endpoint refused", err)
+	}
+	// refused before any credentials are loaded
+	if _, _, err := main(&Profile{Name: "default", Dir: t.TempDir()}, deleteOperation); err == nil || !strings.Contains(err.Error(), "refusing API endpoint") {
+		t.Errorf("main() = %v, want the endpoint refused", err)
+	}
+
+	t.Setenv("GMAIL_API_ENDPOINT", "https://gmail.googleapis.com/")
+	if host, err := currentEndpoint().host(); err != nil || host != "gmail.googleapis.com" {
+		t.Errorf("host() = %q, %v", host, err)
+	}
+}
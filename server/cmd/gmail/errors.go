@@ -0,0 +1,191 @@
+package gmail
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// ApiError is an error response from a Google API. Gmail answers with a JSON
+// envelope such as
+//
+//	{"error": {"code": 403, "status": "PERMISSION_DENIED", "message": "...",
+//	  "errors": [{"reason": "insufficientPermissions", "message": "..."}]}}
+//
+// while the OAuth endpoints answer {"error": "invalid_token", "error_description": "..."}.
+// Both are decoded here; Reason holds the first errors[].reason, or the OAuth
+// error code.
+type ApiError struct {
+	Method     string
+	Url        string
+	StatusCode int
+	Status     string
+	Reason     string
+	Message    string
+}
+
+type errorEnvelope struct {
+	Error            json.RawMessage `json:"error"`
+	ErrorDescription string          `json:"error_description"`
+}
+
+type errorBody struct {
+	Code    int    `json:"code"`
+	Status  string `json:"status"`
+	Message string `json:"message"`
+	Errors  []struct {
+		Reason  string `json:"reason"`
+		Message string `json:"message"`
+	} `json:"errors"`
+	Details []struct {
+		Reason string `json:"reason"`
+	} `json:"details"`
+}
+
+func (e *ApiError) Error() string {
+	msg := fmt.Sprintf("%v %v: HTTP %v", e.Method, e.Url, e.StatusCode)
+	if e.Reason != "" {
+		msg += fmt.Sprintf(" (%v)", e.Reason)
+	}
+	if e.Message != "" {
+		msg += ": " + e.Message
+	}
+	return msg
+}
+
+// Builds an ApiError from a non-success response, consuming its body.
+func newApiError(res *http.Response) *ApiError {
+	apiErr := &ApiError{StatusCode: res.StatusCode}
+	if res.Request != nil {
+		apiErr.Method = res.Request.Method
+		apiErr.Url = redactUrl(res.Request.URL.String())
+	}
+
+	body, _ := io.ReadAll(io.LimitReader(res.Body, maxErrorPeek))
+	apiErr.Status, apiErr.Reason, apiErr.Message = decodeErrorBody(body)
+	if apiErr.Message == "" {
+		apiErr.Message = http.StatusText(res.StatusCode)
+	}
+	return apiErr
+}
+
+// Returns the status, reason and message of a Google error envelope, or empty
+// strings when the body is not one.
+func decodeErrorBody(body []byte) (status, reason, message string) {
+	var envelope errorEnvelope
+	if err := json.Unmarshal(body, &envelope); err != nil || len(envelope.Error) == 0 {
+		return "", "", strings.TrimSpace(string(body))
+	}
+
+	// OAuth endpoints use a bare string for the error
+	var code string
+	if err := json.Unmarshal(envelope.Error, &code); err == nil {
+		return "", code, envelope.ErrorDescription
+	}
+
+	var details errorBody
+	if err := json.Unmarshal(envelope.Error, &details); err != nil {
+		return "", "", ""
+	}
+
+	status, message = details.Status, details.Message
+	if len(details.Errors) > 0 {
+		reason = details.Errors[0].Reason
+	} else if len(details.Details) > 0 {
+		reason = details.Details[0].Reason
+	}
+	return status, reason, message
+}
+
+// Keeps access tokens passed as query parameters (tokeninfo) out of error
+// messages.
+func redactUrl(rawUrl string) string {
+	if i := strings.Index(rawUrl, "access_token="); i >= 0 {
+		end := strings.IndexByte(rawUrl[i:], '&')
+		if end < 0 {
+			return rawUrl[:i] + "access_token=REDACTED"
+		}
+		return rawUrl[:i] + "access_token=REDACTED" + rawUrl[i+end:]
+	}
+	return rawUrl
+}
+
+func asApiError(err error) (*ApiError, bool) {
+	var apiErr *ApiError
+	ok := errors.As(err, &apiErr)
+	return apiErr, ok
+}
+
+func (e *ApiError) rateLimited() bool {
+	switch e.Reason {
+	case "rateLimitExceeded", "userRateLimitExceeded", "quotaExceeded", "dailyLimitExceeded", "RATE_LIMIT_EXCEEDED":
+		return true
+	}
+	return e.StatusCode == http.StatusTooManyRequests || e.Status == "RESOURCE_EXHAUSTED"
+}
+
+// Reports whether err is Gmail refusing a request for exceeding a rate limit
+// or quota, even after retries.
+func IsRateLimited(err error) bool {
+	apiErr, ok := asApiError(err)
+	return ok && apiErr.rateLimited()
+}
+
+// Reports whether err is caused by the credentials: an expired or revoked
+// token, or a token lacking the scope the request needs.
+func IsAuth(err error) bool {
+	if imapErr, ok := asImapError(err); ok {
+		switch imapErr.codeName() {
+		case "AUTHENTICATIONFAILED", "AUTHORIZATIONFAILED", "EXPIRED":
+			return true
+		}
+		return false
+	}
+
+	apiErr, ok := asApiError(err)
+	if !ok {
+		return false
+	}
+	switch apiErr.Reason {
+	case "authError", "insufficientPermissions", "ACCESS_TOKEN_SCOPE_INSUFFICIENT", "invalid_token", "invalid_grant":
+		return true
+	}
+	return apiErr.StatusCode == http.StatusUnauthorized
+}
+
+func IsNotFound(err error) bool {
+	if imapErr, ok := asImapError(err); ok {
+		return imapErr.codeName() == "NONEXISTENT"
+	}
+
+	apiErr, ok := asApiError(err)
+	return ok && apiErr.StatusCode == http.StatusNotFound
+}
+
+// Reports whether Gmail rejected the request because of the mailbox's state,
+// e.g. a filter that already exists or a mailbox that is not enabled for Gmail.
+func IsFailedPrecondition(err error) bool {
+	apiErr, ok := asApiError(err)
+	return ok && (apiErr.Reason == "failedPrecondition" || apiErr.Status == "FAILED_PRECONDITION")
+}
+
+// Adds a hint on how to proceed to errors whose cause the user can act on.
+func explain(err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case IsAuth(err):
+		if _, ok := asImapError(err); ok {
+			return fmt.Errorf("%w; check the profile's IMAP username and password", err)
+		}
+		return fmt.Errorf("%w; run logout and sign in again to grant the required access", err)
+	case IsRateLimited(err):
+		return fmt.Errorf("%w; Gmail's quota is exhausted for now, try again later", err)
+	case IsFailedPrecondition(err):
+		return fmt.Errorf("%w; check that Gmail is enabled for this account", err)
+	}
+	return err
+}
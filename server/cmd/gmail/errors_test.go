@@ -0,0 +1,187 @@
+package gmail
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// Error bodies as Gmail and Google's OAuth endpoints send them.
+const (
+	authErrorBody = `{"error": {"code": 401, "message": "Request had invalid authentication credentials. Expected OAuth 2 access token, login cookie or other valid authentication credential.",
+		"errors": [{"message": "Invalid Credentials", "domain": "global", "reason": "authError", "location": "Authorization", "locationType": "header"}],
+		"status": "UNAUTHENTICATED"}}`
+	rateLimitExceededBody = `{"error": {"code": 403, "message": "Rate Limit Exceeded",
+		"errors": [{"message": "Rate Limit Exceeded", "domain": "usageLimits", "reason": "rateLimitExceeded"}],
+		"status": "PERMISSION_DENIED"}}`
+	userRateLimitBody = `{"error": {"code": 403, "message": "User Rate Limit Exceeded",
+		"errors": [{"message": "User Rate Limit Exceeded", "domain": "usageLimits", "reason": "userRateLimitExceeded"}],
+		"status": "PERMISSION_DENIED"}}`
+	insufficientPermissionsBody = `{"error": {"code": 403, "message": "Request had insufficient authentication scopes.",
+		"errors": [{"message": "Insufficient Permission", "domain": "global", "reason": "insufficientPermissions"}],
+		"status": "PERMISSION_DENIED",
+		"details": [{"@type": "type.googleapis.com/google.rpc.ErrorInfo", "reason": "ACCESS_TOKEN_SCOPE_INSUFFICIENT", "domain": "googleapis.com",
+			"metadata": {"service": "gmail.googleapis.com", "method": "caribou.api.proto.MailboxService.ListMessages"}}]}}`
+	scopeDetailsOnlyBody = `{"error": {"code": 403, "message": "Request had insufficient authentication scopes.", "status": "PERMISSION_DENIED",
+		"details": [{"@type": "type.googleapis.com/google.rpc.ErrorInfo", "reason": "ACCESS_TOKEN_SCOPE_INSUFFICIENT", "domain": "googleapis.com"}]}}`
+	domainPolicyBody = `{"error": {"code": 403, "message": "Delegation denied for me@corp.example",
+		"errors": [{"message": "Delegation denied for me@corp.example", "domain": "global", "reason": "forbidden"}],
+		"status": "PERMISSION_DENIED"}}`
+	concurrentBody = `{"error": {"code": 429, "message": "Too many concurrent requests for user.",
+		"errors": [{"message": "Too many concurrent requests for user.", "domain": "global", "reason": "rateLimitExceeded"}],
+		"status": "RESOURCE_EXHAUSTED"}}`
+	failedPreconditionBody = `{"error": {"code": 400, "message": "Mail service not enabled",
+		"errors": [{"message": "Mail service not enabled", "domain": "global", "reason": "failedPrecondition"}],
+		"status": "FAILED_PRECONDITION"}}`
+	invalidArgumentBody = `{"error": {"code": 400, "message": "Invalid id value",
+		"errors": [{"message": "Invalid id value", "domain": "global", "reason": "invalidArgument"}],
+		"status": "INVALID_ARGUMENT"}}`
+	notFoundBody = `{"error": {"code": 404, "message": "Requested entity was not found.",
+		"errors": [{"message": "Requested entity was not found.", "domain": "global", "reason": "notFound"}],
+		"status": "NOT_FOUND"}}`
+	invalidGrantBody = `{"error": "invalid_grant", "error_description": "Token has been expired or revoked."}`
+	badGatewayBody   = "<html><head><title>502 Bad Gateway</title></head>\n<body>Bad Gateway</body></html>\n"
+)
+
+func apiErrorFrom(status int, body string) *ApiError {
+	req, _ := http.NewRequest("GET", "https://gmail.googleapis.com/gmail/v1/users/me/messages", nil)
+	return newApiError(&http.Response{StatusCode: status, Body: io.NopCloser(strings.NewReader(body)), Request: req})
+}
+
+func TestDecodeErrorBody(t *testing.T) {
+	for _, test := range []struct {
+		name                            string
+		body                            string
+		wantStatus, wantReason, wantMsg string
+	}{
+		{"401", authErrorBody, "UNAUTHENTICATED", "authError", "Request had invalid authentication credentials. Expected OAuth 2 access token, login cookie or other valid authentication credential."},
+		{"403 rate limit", rateLimitExceededBody, "PERMISSION_DENIED", "rateLimitExceeded", "Rate Limit Exceeded"},
+		{"403 insufficient permissions", insufficientPermissionsBody, "PERMISSION_DENIED", "insufficientPermissions", "Request had insufficient authentication scopes."},
+		{"reason only in details", scopeDetailsOnlyBody, "PERMISSION_DENIED", "ACCESS_TOKEN_SCOPE_INSUFFICIENT", "Request had insufficient authentication scopes."},
+		{"429", concurrentBody, "RESOURCE_EXHAUSTED", "rateLimitExceeded", "Too many concurrent requests for user."},
+		{"400 failed precondition", failedPreconditionBody, "FAILED_PRECONDITION", "failedPrecondition", "Mail service not enabled"},
+		{"oauth", invalidGrantBody, "", "invalid_grant", "Token has been expired or revoked."},
+		{"not json", badGatewayBody, "", "", strings.TrimSpace(badGatewayBody)},
+		{"empty", "", "", "", ""},
+		{"json without an error", `{"kind": "something"}`, "", "", `{"kind": "something"}`},
+		{"error of another shape", `{"error": 42}`, "", "", ""},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			status, reason, message := decodeErrorBody([]byte(test.body))
+			if status != test.wantStatus || reason != test.wantReason || message != test.wantMsg {
+				t.Errorf("decodeErrorBody = %q, %q, %q; want %q, %q, %q", status, reason, message, test.wantStatus, test.wantReason, test.wantMsg)
+			}
+		})
+	}
+}
+
+func TestErrorClassifiers(t *testing.T) {
+	for _, test := range []struct {
+		name                                      string
+		status                                    int
+		body                                      string
+		auth, rateLimited, precondition, notFound bool
+	}{
+		{"401", 401, authErrorBody, true, false, false, false},
+		{"401 without a body", 401, "", true, false, false, false},
+		{"403 rate limit", 403, rateLimitExceededBody, false, true, false, false},
+		{"403 user rate limit", 403, userRateLimitBody, false, true, false, false},
+		{"403 insufficient permissions", 403, insufficientPermissionsBody, true, false, false, false},
+		{"403 scope in details only", 403, scopeDetailsOnlyBody, true, false, false, false},
+		// a 403 is neither a rate limit nor an auth error on its own
+		{"403 forbidden", 403, domainPolicyBody, false, false, false, false},
+		{"429", 429, concurrentBody, false, true, false, false},
+		{"429 without a body", 429, "", false, true, false, false},
+		{"400 failed precondition", 400, failedPreconditionBody, false, false, true, false},
+		{"400 invalid argument", 400, invalidArgumentBody, false, false, false, false},
+		{"404", 404, notFoundBody, false, false, false, true},
+		{"400 invalid grant", 400, invalidGrantBody, true, false, false, false},
+		{"502 html", 502, badGatewayBody, false, false, false, false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			apiErr := apiErrorFrom(test.status, test.body)
+			// flows see errors wrapped with context
+			err := fmt.Errorf("could not trash: %w", apiErr)
+
+			if got := IsAuth(err); got != test.auth {
+				t.Errorf("IsAuth = %v, want %v", got, test.auth)
+			}
+			if got := IsRateLimited(err); got != test.rateLimited {
+				t.Errorf("IsRateLimited = %v, want %v", got, test.rateLimited)
+			}
+			if got := IsFailedPrecondition(err); got != test.precondition {
+				t.Errorf("IsFailedPrecondition = %v, want %v", got, test.precondition)
+			}
+			if got := IsNotFound(err); got != test.notFound {
+				t.Errorf("IsNotFound = %v, want %v", got, test.notFound)
+			}
+		})
+	}
+}
+
+func TestApiErrorMessage(t *testing.T) {
+	err := apiErrorFrom(403, rateLimitExceededBody)
+	if got, want := err.Error(), "GET https://gmail.googleapis.com/gmail/v1/users/me/messages: HTTP 403 (rateLimitExceeded): Rate Limit Exceeded"; got != want {
+		t.Errorf("Error() = %q, want %q", got, want)
+	}
+	// without a message in the body, the status text stands in
+	if err := apiErrorFrom(503, ""); err.Message != "Service Unavailable" {
+		t.Errorf("Message = %q", err.Message)
+	}
+
+	req, _ := http.NewRequest("GET", "https://oauth2.googleapis.com/tokeninfo?access_token=ya29.secret&x=1", nil)
+	err = newApiError(&http.Response{StatusCode: 400, Body: io.NopCloser(strings.NewReader(invalidGrantBody)), Request: req})
+	if strings.Contains(err.Error(), "ya29") || !strings.Contains(err.Error(), "access_token=REDACTED&x=1") {
+		t.Errorf("Error() = %q, want the token redacted", err)
+	}
+}
+
+func TestClassifiersOnOtherErrors(t *testing.T) {
+	for _, err := range []error{nil, errors.New("HTTP 401 authError rateLimitExceeded"), &requestExecutionError{"GET", "https://gmail.googleapis.com", "EOF"}} {
+		if IsAuth(err) || IsRateLimited(err) || IsFailedPrecondition(err) || IsNotFound(err) {
+			t.Errorf("%v was classified", err)
+		}
+	}
+
+	for _, test := range []struct {
+		code           string
+		auth, notFound bool
+	}{
+		{"AUTHENTICATIONFAILED", true, false},
+		{"AUTHORIZATIONFAILED", true, false},
+		{"EXPIRED", true, false},
+		{"NONEXISTENT", false, true},
+		{"TRYCREATE", false, false},
+		{"", false, false},
+	} {
+		err := fmt.Errorf("login: %w", &ImapError{Command: "LOGIN", Status: "NO", Code: test.code})
+		if IsAuth(err) != test.auth || IsNotFound(err) != test.notFound {
+			t.Errorf("IMAP [%v]: IsAuth %v, IsNotFound %v; want %v, %v", test.code, IsAuth(err), IsNotFound(err), test.auth, test.notFound)
+		}
+	}
+}
+
+func TestExplain(t *testing.T) {
+	for _, test := range []struct {
+		err  error
+		hint string
+	}{
+		{apiErrorFrom(401, authErrorBody), "run logout"},
+		{&ImapError{Command: "LOGIN", Status: "NO", Code: "AUTHENTICATIONFAILED"}, "IMAP username and password"},
+		{apiErrorFrom(429, concurrentBody), "quota"},
+		{apiErrorFrom(400, failedPreconditionBody), "Gmail is enabled"},
+	} {
+		explained := explain(test.err)
+		if !strings.Contains(explained.Error(), test.hint) || !errors.Is(explained, test.err) {
+			t.Errorf("explain(%v) = %v, want the hint %q and the cause wrapped", test.err, explained, test.hint)
+		}
+	}
+
+	plain := apiErrorFrom(404, notFoundBody)
+	if explain(plain) != error(plain) || explain(nil) != nil {
+		t.Error("explain changed an error without a hint")
+	}
+}
@@ -0,0 +1,449 @@
+package gmail
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// A fixture file holds one JSON exchange per line, in the order the requests
+// were made. Requests are replayed by method and URL, so bodies only serve as
+// a record of what was sent.
+type fixtureExchange struct {
+	Request  fixtureRequest  `json:"request"`
+	Response fixtureResponse `json:"response"`
+}
+
+type fixtureRequest struct {
+	Method string      `json:"method"`
+	Url    string      `json:"url"`
+	Header http.Header `json:"header,omitempty"`
+	Body   string      `json:"body,omitempty"`
+}
+
+type fixtureResponse struct {
+	StatusCode int         `json:"statusCode"`
+	Header     http.Header `json:"header,omitempty"`
+	Body       string      `json:"body,omitempty"`
+	// "base64" for bodies that are not valid UTF-8
+	BodyEncoding string `json:"bodyEncoding,omitempty"`
+}
+
+var (
+	// never written to a fixture
+	sensitiveHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie"}
+	// query parameters and JSON fields that carry credentials
+	credentialParams = []string{"access_token", "refresh_token", "id_token", "key", "token", "client_secret"}
+	credentialFields = regexp.MustCompile(`("(?:access_token|refresh_token|id_token|client_secret)"\s*:\s*)"[^"]*"`)
+	bearerTokens     = regexp.MustCompile(`(?i)(bearer\s+)[A-Za-z0-9._~+/=-]+`)
+)
+
+// Replaces personal addresses with stable placeholders and removes
+// credentials. The same scrubber applied to a live request during replay
+// yields the URL it was recorded under.
+type scrubber struct {
+	mu        sync.Mutex
+	addresses []string
+}
+
+func newScrubber(addresses ...string) *scrubber {
+	s := &scrubber{}
+	for _, address := range addresses {
+		s.learn(address)
+	}
+	return s
+}
+
+// Adds an address to scrub, reporting whether it was new.
+func (s *scrubber) learn(address string) bool {
+	address = strings.ToLower(strings.TrimSpace(address))
+	if address == "" || !strings.Contains(address, "@") {
+		return false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, known := range s.addresses {
+		if known == address {
+			return false
+		}
+	}
+	s.addresses = append(s.addresses, address)
+	return true
+}
+
+func placeholder(i int) string {
+	if i == 0 {
+		return "user@example.com"
+	}
+	return fmt.Sprintf("user%d@example.com", i+1)
+}
+
+func (s *scrubber) text(text string) string {
+	s.mu.Lock()
+	addresses := append([]string{}, s.addresses...)
+	s.mu.Unlock()
+
+	for i, address := range addresses {
+		text = replaceFold(text, address, placeholder(i))
+		text = replaceFold(text, url.QueryEscape(address), url.QueryEscape(placeholder(i)))
+		text = replaceFold(text, url.PathEscape(address), url.PathEscape(placeholder(i)))
+	}
+	text = bearerTokens.ReplaceAllString(text, "${1}REDACTED")
+	return credentialFields.ReplaceAllString(text, `${1}"REDACTED"`)
+}
+
+func (s *scrubber) url(u *url.URL) string {
+	scrubbed := *u
+	query := scrubbed.Query()
+	for _, param := range credentialParams {
+		if query.Has(param) {
+			query.Set(param, "REDACTED")
+		}
+	}
+	scrubbed.RawQuery = query.Encode()
+	return s.text(scrubbed.String())
+}
+
+func (s *scrubber) header(header http.Header) http.Header {
+	scrubbed := make(http.Header, len(header))
+	for name, values := range header {
+		if isSensitiveHeader(name) {
+			continue
+		}
+		for _, value := range values {
+			scrubbed.Add(name, s.text(value))
+		}
+	}
+	if len(scrubbed) == 0 {
+		return nil
+	}
+	return scrubbed
+}
+
+// Scrubs a body, looking inside the base64 "raw" field of messages.send and
+// the "message.raw" field of drafts.create, which hold the whole outgoing
+// email. Bodies that are not valid UTF-8 are scrubbed as bytes before being
+// base64-encoded.
+func (s *scrubber) body(body []byte) (string, string) {
+	var withRaw map[string]interface{}
+	if json.Unmarshal(body, &withRaw) == nil {
+		scrubbedRaw := s.raw(withRaw)
+		if message, ok := withRaw["message"].(map[string]interface{}); ok && s.raw(message) {
+			scrubbedRaw = true
+		}
+		if scrubbedRaw {
+			if encoded, err := json.Marshal(withRaw); err == nil {
+				body = encoded
+			}
+		}
+	}
+
+	scrubbed := s.text(string(body))
+	if !utf8.ValidString(scrubbed) {
+		return base64.StdEncoding.EncodeToString([]byte(scrubbed)), "base64"
+	}
+	return scrubbed, ""
+}
+
+// Scrubs the email in the object's base64 "raw" field, if it has one.
+func (s *scrubber) raw(object map[string]interface{}) bool {
+	raw, ok := object["raw"].(string)
+	if !ok {
+		return false
+	}
+	decoded, err := base64.URLEncoding.DecodeString(raw)
+	if err != nil {
+		return false
+	}
+	object["raw"] = base64.URLEncoding.EncodeToString([]byte(s.text(string(decoded))))
+	return true
+}
+
+func isSensitiveHeader(name string) bool {
+	for _, sensitive := range sensitiveHeaders {
+		if strings.EqualFold(name, sensitive) {
+			return true
+		}
+	}
+	return false
+}
+
+// Replaces every occurrence of old, ignoring ASCII case. Only ASCII letters
+// are folded, so offsets in the folded copy hold for text that is not valid
+// UTF-8 too.
+func replaceFold(text, old, new string) string {
+	if old == "" {
+		return text
+	}
+	lower := asciiLower(text)
+	old = asciiLower(old)
+
+	var b strings.Builder
+	for {
+		i := strings.Index(lower, old)
+		if i < 0 {
+			b.WriteString(text)
+			return b.String()
+		}
+		b.WriteString(text[:i])
+		b.WriteString(new)
+		text, lower = text[i+len(old):], lower[i+len(old):]
+	}
+}
+
+func asciiLower(text string) string {
+	b := []byte(text)
+	for i, c := range b {
+		if 'A' <= c && c <= 'Z' {
+			b[i] = c + 'a' - 'A'
+		}
+	}
+	return string(b)
+}
+
+type rawExchange struct {
+	req     *http.Request
+	reqBody []byte
+	res     *http.Response
+	resBody []byte
+}
+
+// Records every exchange that passes through it to a fixture file. Exchanges
+// are appended as they happen; when a new personal address turns up, the
+// whole file is rewritten so earlier exchanges get scrubbed too.
+type recorder struct {
+	mu        sync.Mutex
+	path      string
+	scrubber  *scrubber
+	exchanges []rawExchange
+}
+
+type recordingTransport struct {
+	base     http.RoundTripper
+	recorder *recorder
+}
+
+var (
+	recordersMu sync.Mutex
+	// one recorder per fixture file, shared by every client of the run
+	recorders = make(map[string]*recorder)
+)
+
+func recorderFor(path string, profile *Profile) (*recorder, error) {
+	recordersMu.Lock()
+	defer recordersMu.Unlock()
+
+	if rec, found := recorders[path]; found {
+		rec.scrubber.learn(profile.Settings.Address)
+		return rec, nil
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("error creating fixture file: %v", err.Error())
+	}
+	f.Close()
+
+	rec := &recorder{path: path, scrubber: newScrubber(scrubAddresses(profile)...)}
+	recorders[path] = rec
+	return rec, nil
+}
+
+// Addresses scrubbed from the start: the profile's own and any listed in
+// GMAIL_SCRUB_ADDRESSES.
+func scrubAddresses(profile *Profile) []string {
+	addresses := []string{profile.Settings.Address}
+	for _, address := range strings.Split(os.Getenv("GMAIL_SCRUB_ADDRESSES"), ",") {
+		addresses = append(addresses, address)
+	}
+	return addresses
+}
+
+func (t *recordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var reqBody []byte
+	if req.Body != nil && req.Body != http.NoBody {
+		body, err := io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		reqBody = body
+		req.Body = io.NopCloser(bytes.NewReader(body))
+	}
+
+	res, err := t.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	resBody, err := io.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	res.Body = io.NopCloser(bytes.NewReader(resBody))
+
+	if err := t.recorder.add(rawExchange{req, reqBody, res, resBody}); err != nil {
+		fmt.Printf("Could not record %v %v: %v\n", req.Method, req.URL.Host, err.Error())
+	}
+	return res, nil
+}
+
+func (r *recorder) add(exchange rawExchange) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.exchanges = append(r.exchanges, exchange)
+
+	// users.getProfile reveals the account's address when settings do not
+	var profile userProfile
+	if json.Unmarshal(exchange.resBody, &profile) == nil && r.scrubber.learn(profile.EmailAddress) {
+		return r.rewrite()
+	}
+
+	f, err := os.OpenFile(r.path, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return r.write(f, exchange)
+}
+
+func (r *recorder) rewrite() error {
+	f, err := os.OpenFile(r.path, os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	for _, exchange := range r.exchanges {
+		if err := r.write(f, exchange); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *recorder) write(w io.Writer, exchange rawExchange) error {
+	reqBody, _ := r.scrubber.body(exchange.reqBody)
+	resBody, encoding := r.scrubber.body(exchange.resBody)
+
+	data, err := json.Marshal(fixtureExchange{
+		Request: fixtureRequest{
+			Method: exchange.req.Method,
+			Url:    r.scrubber.url(exchange.req.URL),
+			Header: r.scrubber.header(exchange.req.Header),
+			Body:   reqBody,
+		},
+		Response: fixtureResponse{
+			StatusCode:   exchange.res.StatusCode,
+			Header:       r.scrubber.header(exchange.res.Header),
+			Body:         resBody,
+			BodyEncoding: encoding,
+		},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(data, '\n'))
+	return err
+}
+
+// Serves the exchanges of a fixture file in place of the network. Each
+// recorded exchange answers once, in the order it was recorded among the
+// exchanges with the same method and URL.
+type replayTransport struct {
+	mu        sync.Mutex
+	scrubber  *scrubber
+	exchanges []fixtureExchange
+	used      []bool
+}
+
+func newReplayTransport(path string, profile *Profile) (*replayTransport, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("error opening fixture file: %v", err.Error())
+	}
+	defer f.Close()
+
+	var exchanges []fixtureExchange
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64<<10), 64<<20)
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var exchange fixtureExchange
+		if err := json.Unmarshal(scanner.Bytes(), &exchange); err != nil {
+			return nil, fmt.Errorf("error parsing fixture file %v line %d: %v", path, line, err.Error())
+		}
+		exchanges = append(exchanges, exchange)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading fixture file: %v", err.Error())
+	}
+
+	return &replayTransport{
+		scrubber:  newScrubber(scrubAddresses(profile)...),
+		exchanges: exchanges,
+		used:      make([]bool, len(exchanges)),
+	}, nil
+}
+
+func (t *replayTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		io.Copy(io.Discard, req.Body)
+		req.Body.Close()
+	}
+	target := t.scrubber.url(req.URL)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for i, exchange := range t.exchanges {
+		if t.used[i] || exchange.Request.Method != req.Method || exchange.Request.Url != target {
+			continue
+		}
+		t.used[i] = true
+
+		body := []byte(exchange.Response.Body)
+		if exchange.Response.BodyEncoding == "base64" {
+			decoded, err := base64.StdEncoding.DecodeString(exchange.Response.Body)
+			if err != nil {
+				return nil, fmt.Errorf("error decoding recorded body for %v %v: %v", req.Method, target, err.Error())
+			}
+			body = decoded
+		}
+
+		header := exchange.Response.Header.Clone()
+		if header == nil {
+			header = make(http.Header)
+		}
+		// scrubbing may have changed the length
+		header.Del("Content-Length")
+		return &http.Response{
+			Status:        fmt.Sprintf("%d %s", exchange.Response.StatusCode, http.StatusText(exchange.Response.StatusCode)),
+			StatusCode:    exchange.Response.StatusCode,
+			Proto:         "HTTP/1.1",
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Header:        header,
+			Body:          io.NopCloser(bytes.NewReader(body)),
+			ContentLength: int64(len(body)),
+			Request:       req,
+		}, nil
+	}
+
+	return nil, fmt.Errorf("no recorded response left for %v %v", req.Method, target)
+}
@@ -0,0 +1,281 @@
+package gmail
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gmail-organizer/cmd/gmail/gmailtest"
+)
+
+const (
+	realAddress = "Jane.Doe@RealMail.example"
+	realToken   = "ya29.a0AfH6SMBx-real_token"
+)
+
+// Checks that none of the secrets appear in the fixture file, in plain text,
+// URL-escaped or inside base64-encoded bodies.
+func checkScrubbed(t *testing.T, path string, secrets ...string) []fixtureExchange {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var exchanges []fixtureExchange
+	contents := []string{string(data)}
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		var exchange fixtureExchange
+		if err := json.Unmarshal([]byte(line), &exchange); err != nil {
+			t.Fatalf("fixture line %q: %v", line, err)
+		}
+		exchanges = append(exchanges, exchange)
+		if exchange.Response.BodyEncoding == "base64" {
+			decoded, _ := base64.StdEncoding.DecodeString(exchange.Response.Body)
+			contents = append(contents, string(decoded))
+		}
+		for _, body := range []string{exchange.Request.Body, exchange.Response.Body} {
+			var withRaw struct {
+				Raw     string
+				Message struct{ Raw string }
+			}
+			if json.Unmarshal([]byte(body), &withRaw) == nil {
+				for _, raw := range []string{withRaw.Raw, withRaw.Message.Raw} {
+					decoded, _ := base64.URLEncoding.DecodeString(raw)
+					contents = append(contents, string(decoded))
+				}
+			}
+		}
+	}
+
+	for _, content := range contents {
+		lower := strings.ToLower(content)
+		for _, secret := range secrets {
+			for _, form := range []string{secret, url.QueryEscape(secret), url.PathEscape(secret)} {
+				if strings.Contains(lower, strings.ToLower(form)) {
+					t.Errorf("fixture contains %q", form)
+				}
+			}
+		}
+	}
+	return exchanges
+}
+
+func TestScrubberBody(t *testing.T) {
+	s := newScrubber(realAddress)
+	latin1 := "Hallo J\xfcrgen, sent to " + realAddress + " with Bearer " + realToken
+
+	for _, test := range []struct {
+		name         string
+		body         string
+		wantEncoding string
+	}{
+		{"plain", "to: jane.doe@realmail.example", ""},
+		{"credential field", `{"access_token": "` + realToken + `", "expires_in": 3599}`, ""},
+		{"bearer token", "WWW-Authenticate: Bearer " + realToken, ""},
+		{"not utf-8", latin1, "base64"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			body, encoding := s.body([]byte(test.body))
+			if encoding != test.wantEncoding {
+				t.Errorf("encoding = %q, want %q", encoding, test.wantEncoding)
+			}
+			if encoding == "base64" {
+				decoded, err := base64.StdEncoding.DecodeString(body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				body = string(decoded)
+			}
+			if strings.Contains(strings.ToLower(body), strings.ToLower(realAddress)) || strings.Contains(body, realToken) {
+				t.Errorf("body = %q still holds a secret", body)
+			}
+		})
+	}
+
+	// lower-casing İ shortens it by a byte
+	if got, want := s.text("İstanbul, "+realAddress+"!"), "İstanbul, user@example.com!"; got != want {
+		t.Errorf("text = %q, want %q", got, want)
+	}
+	if body, _ := s.body([]byte(latin1)); !strings.Contains(mustDecode(t, body), "Hallo J\xfcrgen, sent to user@example.com") {
+		t.Errorf("scrubbing changed the rest of the body: %q", mustDecode(t, body))
+	}
+}
+
+func mustDecode(t *testing.T, body string) string {
+	t.Helper()
+	decoded, err := base64.StdEncoding.DecodeString(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(decoded)
+}
+
+func TestScrubberRaw(t *testing.T) {
+	s := newScrubber(realAddress)
+	email := "From: " + realAddress + "\r\nTo: leave@list.example\r\n\r\nGr\xfc\xdfe"
+	body, _ := json.Marshal(map[string]string{"raw": base64.URLEncoding.EncodeToString([]byte(email))})
+
+	scrubbed, _ := s.body(body)
+	var withRaw struct{ Raw string }
+	if err := json.Unmarshal([]byte(scrubbed), &withRaw); err != nil {
+		t.Fatal(err)
+	}
+	decoded, _ := base64.URLEncoding.DecodeString(withRaw.Raw)
+	if want := "From: user@example.com\r\nTo: leave@list.example\r\n\r\nGr\xfc\xdfe"; string(decoded) != want {
+		t.Errorf("raw = %q, want %q", decoded, want)
+	}
+}
+
+func TestScrubberDraftRaw(t *testing.T) {
+	s := newScrubber(realAddress)
+	email := "From: " + realAddress + "\r\nTo: leave@list.example\r\n\r\nunsubscribe"
+	body, _ := json.Marshal(map[string]interface{}{"message": map[string]string{"raw": base64.URLEncoding.EncodeToString([]byte(email))}})
+
+	scrubbed, _ := s.body(body)
+	var draft struct{ Message struct{ Raw string } }
+	if err := json.Unmarshal([]byte(scrubbed), &draft); err != nil {
+		t.Fatal(err)
+	}
+	decoded, _ := base64.URLEncoding.DecodeString(draft.Message.Raw)
+	if want := "From: user@example.com\r\nTo: leave@list.example\r\n\r\nunsubscribe"; string(decoded) != want {
+		t.Errorf("message.raw = %q, want %q", decoded, want)
+	}
+
+	// an answer without raw is scrubbed as text and left in shape
+	answer := `{"id": "r-1", "message": {"id": "m-1", "threadId": "t-1"}, "note": "` + realAddress + `"}`
+	if scrubbed, _ := s.body([]byte(answer)); scrubbed != `{"id": "r-1", "message": {"id": "m-1", "threadId": "t-1"}, "note": "user@example.com"}` {
+		t.Errorf("draft answer = %q", scrubbed)
+	}
+}
+
+// Records exchanges that carry the account's address and credentials in every
+// place they can turn up, then replays them.
+func TestRecordReplayRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "fixture.jsonl")
+	profile := &Profile{Name: "default", Dir: t.TempDir(), Settings: ProfileSettings{Address: realAddress}}
+	// only learned from users.getProfile
+	alias := "jd@corp.example"
+
+	base := roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		var status int
+		var body string
+		header := http.Header{"Content-Type": {"application/json"}, "Set-Cookie": {"SID=" + realToken}}
+
+		switch req.URL.Path {
+		case "/gmail/v1/users/" + url.PathEscape(realAddress) + "/profile":
+			status, body = 200, `{"emailAddress":"`+alias+`"}`
+		case "/gmail/v1/users/" + url.PathEscape(realAddress) + "/messages":
+			status, body = 200, `{"messages":[{"id":"1"}],"note":"for `+alias+` and `+realAddress+`"}`
+		case "/download":
+			header.Set("Content-Type", "text/plain; charset=iso-8859-1")
+			status, body = 200, "Gr\xfc\xdfe an "+realAddress
+		default:
+			header.Set("WWW-Authenticate", `Bearer realm="x", error="invalid_token"`)
+			status, body = 401, `{"error":"Bearer `+realToken+` expired","refresh_token":"`+realToken+`"}`
+		}
+		return &http.Response{StatusCode: status, Header: header, Body: io.NopCloser(strings.NewReader(body)), Request: req}, nil
+	})
+
+	rec, err := recorderFor(path, profile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recording := &http.Client{Transport: &recordingTransport{base, rec}}
+
+	requests := []struct{ method, url string }{
+		{"GET", "https://gmail.googleapis.com/gmail/v1/users/" + url.PathEscape(realAddress) + "/messages?q=" + url.QueryEscape("to:"+realAddress)},
+		{"GET", "https://gmail.googleapis.com/gmail/v1/users/" + url.PathEscape(realAddress) + "/profile"},
+		{"GET", "https://example.com/download?access_token=" + realToken},
+		{"POST", "https://gmail.googleapis.com/gmail/v1/users/" + url.PathEscape(realAddress) + "/messages/send"},
+	}
+	for _, r := range requests {
+		req, _ := http.NewRequest(r.method, r.url, strings.NewReader(`{"raw":"`+base64.URLEncoding.EncodeToString([]byte("From: "+realAddress+"\r\n\r\nhi"))+`"}`))
+		req.Header.Set("Authorization", "Bearer "+realToken)
+		req.Header.Set("Cookie", "SID="+realToken)
+		req.Header.Set("X-Goog-User", alias)
+		res, err := recording.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+	}
+
+	exchanges := checkScrubbed(t, path, realAddress, alias, realToken)
+	if len(exchanges) != len(requests) {
+		t.Fatalf("recorded %d exchanges, want %d", len(exchanges), len(requests))
+	}
+	for _, exchange := range exchanges {
+		for _, name := range sensitiveHeaders {
+			if exchange.Request.Header.Get(name) != "" || exchange.Response.Header.Get(name) != "" {
+				t.Errorf("%v %v: recorded the %v header", exchange.Request.Method, exchange.Request.Url, name)
+			}
+		}
+	}
+	// the alias turned up after the first exchange was written
+	if !strings.Contains(exchanges[0].Response.Body, "for user2@example.com and user@example.com") {
+		t.Errorf("earlier exchange was not rescrubbed: %q", exchanges[0].Response.Body)
+	}
+
+	replay, err := newReplayTransport(path, profile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	replaying := &http.Client{Transport: replay}
+	for i, r := range requests {
+		req, _ := http.NewRequest(r.method, r.url, nil)
+		res, err := replaying.Do(req)
+		if err != nil {
+			t.Fatalf("replaying %v %v: %v", r.method, r.url, err)
+		}
+		body, _ := io.ReadAll(res.Body)
+		res.Body.Close()
+
+		if res.StatusCode != exchanges[i].Response.StatusCode {
+			t.Errorf("replayed status %d, want %d", res.StatusCode, exchanges[i].Response.StatusCode)
+		}
+		if strings.Contains(strings.ToLower(string(body)), strings.ToLower(realAddress)) || strings.Contains(string(body), realToken) {
+			t.Errorf("replayed body %q holds a secret", body)
+		}
+		if i == 2 && string(body) != "Gr\xfc\xdfe an user@example.com" {
+			t.Errorf("body that is not UTF-8 replayed as %q", body)
+		}
+	}
+}
+
+// Records a removal run against the fake mailbox and replays it without one.
+func TestRecordReplayRemoval(t *testing.T) {
+	srv := gmailtest.NewServer(realAddress)
+	defer srv.Close()
+	srv.AddMessage(gmailtest.Message{Headers: []gmailtest.Header{{Name: "From", Value: "Boss <boss@corp.example>"}, {Name: "To", Value: realAddress}}})
+	srv.AddMessage(gmailtest.Message{Headers: []gmailtest.Header{{Name: "From", Value: "boss@corp.example"}, {Name: "Cc", Value: realAddress}}})
+
+	path := filepath.Join(t.TempDir(), "removal.jsonl")
+	defer UseEndpoint(Endpoint{})
+	auth := roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		req = req.Clone(req.Context())
+		req.Header.Set("Authorization", "Bearer "+realToken)
+		return srv.Client().Transport.RoundTrip(req)
+	})
+
+	UseEndpoint(Endpoint{Url: srv.URL, Transport: auth, Record: path})
+	profile := &Profile{Name: "default", Dir: t.TempDir(), Settings: ProfileSettings{Address: realAddress}}
+	recorded := InitMessageRemoval(context.Background(), profile, []string{"boss@corp.example"}, nil, false)
+	checkSummary(t, recorded, 2, 2, 0, 0)
+
+	checkScrubbed(t, path, realAddress, realToken)
+
+	// a fresh profile, so nothing but the fixture answers
+	UseEndpoint(Endpoint{Url: srv.URL, Replay: path})
+	srv.Close()
+	profile = &Profile{Name: "default", Dir: t.TempDir(), Settings: ProfileSettings{Address: realAddress}}
+	replayed := InitMessageRemoval(context.Background(), profile, []string{"boss@corp.example"}, nil, false)
+	checkSummary(t, replayed, 2, 2, 0, 0)
+}
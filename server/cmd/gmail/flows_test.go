@@ -0,0 +1,308 @@
+package gmail
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"gmail-organizer/cmd/gmail/gmailtest"
+)
+
+// Sends every client built during the test to a fresh fake mailbox, and
+// returns it with a profile whose files live in a temporary directory.
+func useFakeGmail(t *testing.T) (*gmailtest.Server, *Profile) {
+	t.Helper()
+	srv := gmailtest.NewServer("me@example.com")
+	t.Cleanup(srv.Close)
+
+	UseEndpoint(Endpoint{Url: srv.URL, Transport: srv.Client().Transport})
+	t.Cleanup(func() { UseEndpoint(Endpoint{}) })
+
+	return srv, &Profile{Name: "default", Dir: t.TempDir(), Settings: ProfileSettings{Address: "me@example.com"}}
+}
+
+func addFrom(srv *gmailtest.Server, from string, labels ...string) string {
+	message := gmailtest.Message{Headers: []gmailtest.Header{{Name: "From", Value: from}, {Name: "Subject", Value: "hello"}}}
+	if len(labels) > 0 {
+		message.LabelIds = labels
+	}
+	return srv.AddMessage(message)
+}
+
+func hasLabel(t *testing.T, srv *gmailtest.Server, id, label string) bool {
+	t.Helper()
+	message, found := srv.Message(id)
+	if !found {
+		t.Fatalf("message %v no longer exists", id)
+	}
+	return message.HasLabel(label)
+}
+
+func checkSummary(t *testing.T, summary Summary, processed, succeeded, failed, skipped int) {
+	t.Helper()
+	if summary.Err != nil {
+		t.Fatalf("%v: %v", summary.Operation, summary.Err)
+	}
+	if summary.Processed != processed || summary.Succeeded != succeeded || summary.Failed != failed || summary.Skipped != skipped {
+		t.Errorf("%v: processed %d, succeeded %d, failed %d, skipped %d; want %d, %d, %d, %d", summary.Operation,
+			summary.Processed, summary.Succeeded, summary.Failed, summary.Skipped, processed, succeeded, failed, skipped)
+	}
+}
+
+func TestMessageRemovalTrashesVerifiedMessagesAndUndoes(t *testing.T) {
+	srv, profile := useFakeGmail(t)
+	news := []string{addFrom(srv, "News <news@shop.com>"), addFrom(srv, "news@shop.com")}
+	// matches the search, but the address is someone else's
+	spoofed := addFrom(srv, "\"news@shop.com\" <phish@evil.example>")
+	other := addFrom(srv, "friend@example.org")
+
+	summary := InitMessageRemoval(context.Background(), profile, []string{"news@shop.com"}, nil, false)
+	checkSummary(t, summary, 3, 2, 0, 1)
+
+	for _, id := range news {
+		if !hasLabel(t, srv, id, "TRASH") {
+			t.Errorf("message %v was not trashed", id)
+		}
+	}
+	for _, id := range []string{spoofed, other} {
+		if hasLabel(t, srv, id, "TRASH") {
+			t.Errorf("message %v was trashed", id)
+		}
+	}
+
+	journals, err := ListJournals(profile)
+	if err != nil || len(journals) != 1 {
+		t.Fatalf("ListJournals = %d journals, %v; want 1", len(journals), err)
+	}
+	if got := journals[0].MessageIds; len(got) != 2 {
+		t.Errorf("journal holds %v, want the 2 trashed messages", got)
+	}
+
+	summary = Undo(context.Background(), profile, journals[0].RunId)
+	checkSummary(t, summary, 2, 2, 0, 0)
+	for _, id := range news {
+		if hasLabel(t, srv, id, "TRASH") {
+			t.Errorf("message %v is still in the trash after undo", id)
+		}
+	}
+	if journal, _ := loadJournal(profile, journals[0].RunId); journal.UndoneAt == nil {
+		t.Error("journal is not marked as undone")
+	}
+}
+
+func TestMessageRemovalAppliesFilter(t *testing.T) {
+	srv, profile := useFakeGmail(t)
+	promotion := addFrom(srv, "deals@shop.com", "INBOX", "CATEGORY_PROMOTIONS")
+	receipt := addFrom(srv, "deals@shop.com", "INBOX", "CATEGORY_UPDATES")
+
+	summary := InitMessageRemoval(context.Background(), profile, []string{"@shop.com"}, NewQuery().Category(CategoryPromotions), false)
+	checkSummary(t, summary, 1, 1, 0, 0)
+
+	if !hasLabel(t, srv, promotion, "TRASH") || hasLabel(t, srv, receipt, "TRASH") {
+		t.Error("the filter did not narrow the removal to promotions")
+	}
+}
+
+func TestMessageRemovalPermanent(t *testing.T) {
+	srv, profile := useFakeGmail(t)
+	doomed := addFrom(srv, "spam@bulk.example")
+	kept := addFrom(srv, "friend@example.org")
+
+	summary := InitMessageRemoval(context.Background(), profile, []string{"spam@bulk.example"}, nil, true)
+	checkSummary(t, summary, 1, 1, 0, 0)
+
+	if _, found := srv.Message(doomed); found {
+		t.Error("message was not deleted")
+	}
+	if _, found := srv.Message(kept); !found {
+		t.Error("another sender's message was deleted")
+	}
+
+	journals, _ := ListJournals(profile)
+	if len(journals) != 1 || !journals[0].Permanent {
+		t.Fatalf("want one permanent journal, got %v", journals)
+	}
+	if summary := Undo(context.Background(), profile, journals[0].RunId); summary.Err == nil {
+		t.Error("undoing a permanent deletion succeeded")
+	}
+}
+
+func TestMessageRemovalReportsFailedChunks(t *testing.T) {
+	srv, profile := useFakeGmail(t)
+	addFrom(srv, "news@shop.com")
+	addFrom(srv, "news@shop.com")
+	srv.Fail("messages/batchModify", http.StatusBadRequest, "invalidArgument", 1)
+
+	summary := InitMessageRemoval(context.Background(), profile, []string{"news@shop.com"}, nil, false)
+	if summary.Err == nil || summary.Processed != 2 || summary.Failed != 2 {
+		t.Errorf("summary = %+v, want 2 failed and an error", summary)
+	}
+
+	// nothing was trashed, so nothing is left to undo
+	journals, _ := ListJournals(profile)
+	if len(journals) != 1 || len(journals[0].MessageIds) != 0 {
+		t.Errorf("journal = %v, want one without messages", journals)
+	}
+}
+
+func TestTrashListUpdate(t *testing.T) {
+	srv, profile := useFakeGmail(t)
+	srv.AddFilter(gmailtest.Filter{Criteria: gmailtest.FilterCriteria{From: "old@list.example"}, Action: gmailtest.FilterAction{AddLabelIds: []string{"TRASH"}}})
+
+	senders := []string{"old@list.example", "a@list.example", "b@list.example"}
+	summary := InitTrashListUpdate(context.Background(), profile, senders)
+	checkSummary(t, summary, 2, 2, 0, 0)
+
+	filters := make(map[string][]string)
+	for _, filter := range srv.Filters() {
+		filters[filter.Criteria.From] = filter.Action.AddLabelIds
+	}
+	if len(filters) != 3 {
+		t.Errorf("filters = %v, want one per sender", filters)
+	}
+	for _, sender := range senders {
+		if labels := filters[sender]; len(labels) != 1 || labels[0] != "TRASH" {
+			t.Errorf("filter for %v adds %v, want TRASH", sender, labels)
+		}
+	}
+
+	// a second run finds every sender on the list
+	summary = InitTrashListUpdate(context.Background(), profile, senders)
+	checkSummary(t, summary, 0, 0, 0, 0)
+}
+
+func TestTrashListUpdateSkipsDuplicateFilters(t *testing.T) {
+	srv, profile := useFakeGmail(t)
+	srv.AddFilter(gmailtest.Filter{Criteria: gmailtest.FilterCriteria{From: "old@list.example"}, Action: gmailtest.FilterAction{AddLabelIds: []string{"TRASH"}}})
+	// without the list, the existing filter is only found when Gmail refuses
+	// to create it again
+	srv.Fail("settings/filters", http.StatusBadRequest, "invalidArgument", 1)
+
+	summary := InitTrashListUpdate(context.Background(), profile, []string{"old@list.example", "new@list.example"})
+	checkSummary(t, summary, 2, 1, 0, 1)
+	if filters := srv.Filters(); len(filters) != 2 {
+		t.Errorf("got %d filters, want 2", len(filters))
+	}
+}
+
+func TestTrashListUpdateRefusesImap(t *testing.T) {
+	_, profile := useFakeGmail(t)
+	profile.Settings.Imap = &ImapSettings{}
+
+	if summary := InitTrashListUpdate(context.Background(), profile, []string{"a@list.example"}); summary.Err == nil {
+		t.Error("updating the trash list of an IMAP mailbox succeeded")
+	}
+}
+
+// A third-party site that records the unsubscribe requests it receives.
+type unsubscribeSite struct {
+	*httptest.Server
+	mu       sync.Mutex
+	requests []string
+}
+
+func newUnsubscribeSite(t *testing.T) *unsubscribeSite {
+	site := &unsubscribeSite{}
+	site.Server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		site.mu.Lock()
+		site.requests = append(site.requests, r.Method+" "+r.URL.RequestURI()+" "+string(body))
+		site.mu.Unlock()
+	}))
+	t.Cleanup(site.Close)
+	return site
+}
+
+func (s *unsubscribeSite) received() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string{}, s.requests...)
+}
+
+func TestUnsubscribe(t *testing.T) {
+	srv, profile := useFakeGmail(t)
+	site := newUnsubscribeSite(t)
+	UseEndpoint(Endpoint{Url: srv.URL, Transport: srv.Client().Transport, WebTransport: site.Client().Transport})
+
+	srv.AddMessage(gmailtest.Message{Headers: []gmailtest.Header{
+		{Name: "From", Value: "Shop <news@shop.example>"},
+		{Name: "List-Unsubscribe", Value: "<mailto:leave@shop.example>, <" + site.URL + "/unsubscribe?u=42>"},
+		{Name: "List-Unsubscribe-Post", Value: "List-Unsubscribe=One-Click"},
+	}})
+	srv.AddMessage(gmailtest.Message{Headers: []gmailtest.Header{
+		{Name: "From", Value: "digest@list.example"},
+		{Name: "List-Unsubscribe", Value: "<mailto:unsubscribe@list.example?subject=stop%20digest>"},
+	}})
+
+	senders := []string{"news@shop.example", "digest@list.example"}
+	summary := InitUnsubscribe(context.Background(), profile, senders)
+	checkSummary(t, summary, 2, 2, 0, 0)
+
+	if got, want := site.received(), []string{"POST /unsubscribe?u=42 List-Unsubscribe=One-Click"}; len(got) != 1 || got[0] != want[0] {
+		t.Errorf("site received %q, want %q", got, want)
+	}
+
+	sent := srv.Sent()
+	if len(sent) != 1 {
+		t.Fatalf("sent %d emails, want 1", len(sent))
+	}
+	if to, subject := sent[0].Header("To"), sent[0].Header("Subject"); to != "<unsubscribe@list.example>" || subject != "stop digest" {
+		t.Errorf("sent email to %q about %q", to, subject)
+	}
+	if from := sent[0].Header("From"); !strings.Contains(from, "me@example.com") {
+		t.Errorf("sent email from %q, want the account's address", from)
+	}
+
+	entries, err := ListLedger(profile)
+	if err != nil || len(entries) != 2 {
+		t.Fatalf("ListLedger = %v, %v; want 2 entries", entries, err)
+	}
+	methods := make(map[string]LedgerEntry)
+	for _, entry := range entries {
+		methods[entry.Sender] = entry
+	}
+	if entry := methods["news@shop.example"]; entry.Method != unsubscribeByOneClick || entry.Status != unsubscribeConfirmed {
+		t.Errorf("one-click entry = %+v", entry)
+	}
+	if entry := methods["digest@list.example"]; entry.Method != unsubscribeByMailto || entry.Status != unsubscribeSent {
+		t.Errorf("mailto entry = %+v", entry)
+	}
+
+	// the ledger keeps a second run from asking again
+	summary = InitUnsubscribe(context.Background(), profile, senders)
+	checkSummary(t, summary, 2, 0, 0, 2)
+	if len(site.received()) != 1 || len(srv.Sent()) != 1 {
+		t.Error("a second run unsubscribed again")
+	}
+}
+
+func TestUnsubscribeDrafts(t *testing.T) {
+	srv, profile := useFakeGmail(t)
+	SetDraftUnsubscribeEmails(true)
+	defer SetDraftUnsubscribeEmails(false)
+
+	srv.AddMessage(gmailtest.Message{Headers: []gmailtest.Header{
+		{Name: "From", Value: "digest@list.example"},
+		{Name: "List-Unsubscribe", Value: "<mailto:unsubscribe@list.example>"},
+	}})
+
+	summary := InitUnsubscribe(context.Background(), profile, []string{"digest@list.example"})
+	checkSummary(t, summary, 1, 1, 0, 0)
+
+	if len(srv.Sent()) != 0 {
+		t.Error("an email was sent instead of drafted")
+	}
+	if drafts := srv.Drafts(); len(drafts) != 1 || drafts[0].Header("To") != "<unsubscribe@list.example>" {
+		t.Errorf("drafts = %v, want one to the list", drafts)
+	}
+	// the draft is waited on rather than written again
+	summary = InitUnsubscribe(context.Background(), profile, []string{"digest@list.example"})
+	checkSummary(t, summary, 1, 0, 0, 1)
+	if drafts := srv.Drafts(); len(drafts) != 1 {
+		t.Errorf("drafted %d emails, want 1", len(drafts))
+	}
+}
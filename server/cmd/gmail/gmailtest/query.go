@@ -0,0 +1,318 @@
+package gmailtest
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The subset of Gmail's search syntax the fake understands: terms separated by
+// spaces are ANDed, "OR" joins neighbouring terms, parentheses group, a
+// leading "-" negates, and values may be quoted. Supported operators are
+// from, to, subject, label, category, is, in, has, older_than, newer_than,
+// larger and smaller; a bare word matches the sender, subject or body.
+type matcher interface {
+	match(m *Message) bool
+}
+
+type andMatcher []matcher
+type orMatcher []matcher
+
+type notMatcher struct {
+	matcher
+}
+
+type termMatcher struct {
+	operator, value string
+}
+
+func (a andMatcher) match(m *Message) bool {
+	for _, child := range a {
+		if !child.match(m) {
+			return false
+		}
+	}
+	return true
+}
+
+func (o orMatcher) match(m *Message) bool {
+	for _, child := range o {
+		if child.match(m) {
+			return true
+		}
+	}
+	return false
+}
+
+func (n notMatcher) match(m *Message) bool {
+	return !n.matcher.match(m)
+}
+
+type query struct {
+	matcher
+	terms []termMatcher
+}
+
+// Reports whether the query searches trash or spam, which are otherwise left
+// out of listings.
+func (q query) mentionsTrashOrSpam() bool {
+	for _, term := range q.terms {
+		if term.operator == "in" && (term.value == "trash" || term.value == "spam" || term.value == "anywhere") {
+			return true
+		}
+		if term.operator == "label" && (term.value == "trash" || term.value == "spam") {
+			return true
+		}
+	}
+	return false
+}
+
+func parseQuery(q string) (query, error) {
+	tokens, err := tokenize(q)
+	if err != nil {
+		return query{}, err
+	}
+
+	p := &parser{tokens: tokens}
+	root, err := p.parseAnd()
+	if err != nil {
+		return query{}, err
+	}
+	if p.pos < len(p.tokens) {
+		return query{}, fmt.Errorf("unexpected %q in query", p.tokens[p.pos])
+	}
+	return query{root, p.terms}, nil
+}
+
+func tokenize(q string) ([]string, error) {
+	var tokens []string
+	var current strings.Builder
+	inQuotes := false
+
+	flush := func() {
+		if current.Len() > 0 {
+			tokens = append(tokens, current.String())
+			current.Reset()
+		}
+	}
+
+	for _, r := range q {
+		switch {
+		case r == '"':
+			inQuotes = !inQuotes
+			current.WriteRune(r)
+		case inQuotes:
+			current.WriteRune(r)
+		case r == '(' || r == ')':
+			flush()
+			tokens = append(tokens, string(r))
+		case r == ' ' || r == '\t' || r == '\n':
+			flush()
+		default:
+			current.WriteRune(r)
+		}
+	}
+	if inQuotes {
+		return nil, fmt.Errorf("unterminated quote in query %q", q)
+	}
+	flush()
+	return tokens, nil
+}
+
+type parser struct {
+	tokens []string
+	pos    int
+	terms  []termMatcher
+}
+
+func (p *parser) parseAnd() (matcher, error) {
+	var and andMatcher
+	for p.pos < len(p.tokens) && p.tokens[p.pos] != ")" {
+		operand, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		and = append(and, operand)
+	}
+	return and, nil
+}
+
+func (p *parser) parseOr() (matcher, error) {
+	first, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+
+	or := orMatcher{first}
+	for p.pos < len(p.tokens) && p.tokens[p.pos] == "OR" {
+		p.pos++
+		next, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		or = append(or, next)
+	}
+	if len(or) == 1 {
+		return first, nil
+	}
+	return or, nil
+}
+
+func (p *parser) parseUnary() (matcher, error) {
+	if p.pos >= len(p.tokens) {
+		return nil, fmt.Errorf("query ends unexpectedly")
+	}
+	token := p.tokens[p.pos]
+	p.pos++
+
+	if token == "-" || token == "-(" {
+		return nil, fmt.Errorf("unsupported negation %q", token)
+	}
+
+	negate := false
+	if strings.HasPrefix(token, "-") && len(token) > 1 {
+		negate = true
+		token = token[1:]
+	}
+
+	var result matcher
+	if token == "(" {
+		group, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		if p.pos >= len(p.tokens) || p.tokens[p.pos] != ")" {
+			return nil, fmt.Errorf("unbalanced parentheses in query")
+		}
+		p.pos++
+		result = group
+	} else {
+		term, err := parseTerm(token)
+		if err != nil {
+			return nil, err
+		}
+		p.terms = append(p.terms, term)
+		result = term
+	}
+
+	if negate {
+		return notMatcher{result}, nil
+	}
+	return result, nil
+}
+
+func parseTerm(token string) (termMatcher, error) {
+	operator, value := "", token
+	if i := strings.IndexByte(token, ':'); i > 0 && !strings.HasPrefix(token, "\"") {
+		operator, value = strings.ToLower(token[:i]), token[i+1:]
+	}
+	value = strings.ToLower(strings.Trim(value, "\""))
+
+	switch operator {
+	case "", "from", "to", "subject", "label", "category", "is", "in", "has":
+	case "older_than", "newer_than":
+		if _, err := parsePeriod(value); err != nil {
+			return termMatcher{}, err
+		}
+	case "larger", "smaller":
+		if _, err := parseSize(value); err != nil {
+			return termMatcher{}, err
+		}
+	default:
+		return termMatcher{}, fmt.Errorf("unsupported search operator %q", operator)
+	}
+	return termMatcher{operator, value}, nil
+}
+
+func (t termMatcher) match(m *Message) bool {
+	contains := func(s string) bool { return strings.Contains(strings.ToLower(s), t.value) }
+
+	switch t.operator {
+	case "":
+		return contains(m.Header("From")) || contains(m.Header("Subject")) || contains(m.Body)
+	case "from":
+		return contains(m.Header("From"))
+	case "to":
+		return contains(m.Header("To"))
+	case "subject":
+		return contains(m.Header("Subject"))
+	case "label":
+		return m.HasLabel(t.value) || m.HasLabel(strings.ReplaceAll(t.value, "-", " "))
+	case "category":
+		if t.value == "primary" {
+			return m.HasLabel("CATEGORY_PERSONAL")
+		}
+		return m.HasLabel("CATEGORY_" + strings.ToUpper(t.value))
+	case "is":
+		switch t.value {
+		case "unread":
+			return m.HasLabel("UNREAD")
+		case "read":
+			return !m.HasLabel("UNREAD")
+		case "starred":
+			return m.HasLabel("STARRED")
+		case "important":
+			return m.HasLabel("IMPORTANT")
+		}
+		return false
+	case "in":
+		if t.value == "anywhere" {
+			return true
+		}
+		return m.HasLabel(t.value)
+	case "has":
+		return t.value == "attachment" && m.HasAttachment
+	case "older_than", "newer_than":
+		period, _ := parsePeriod(t.value)
+		cutoff := time.Now().Add(-period)
+		if t.operator == "older_than" {
+			return m.Date.Before(cutoff)
+		}
+		return m.Date.After(cutoff)
+	case "larger", "smaller":
+		size, _ := parseSize(t.value)
+		if t.operator == "larger" {
+			return m.Size > size
+		}
+		return m.Size < size
+	}
+	return false
+}
+
+func parsePeriod(value string) (time.Duration, error) {
+	if len(value) < 2 {
+		return 0, fmt.Errorf("invalid period %q", value)
+	}
+	count, err := strconv.Atoi(value[:len(value)-1])
+	if err != nil || count < 0 {
+		return 0, fmt.Errorf("invalid period %q", value)
+	}
+
+	day := 24 * time.Hour
+	switch value[len(value)-1] {
+	case 'd':
+		return time.Duration(count) * day, nil
+	case 'm':
+		return time.Duration(count) * 30 * day, nil
+	case 'y':
+		return time.Duration(count) * 365 * day, nil
+	}
+	return 0, fmt.Errorf("invalid period %q", value)
+}
+
+func parseSize(value string) (int64, error) {
+	multiplier := int64(1)
+	switch {
+	case strings.HasSuffix(value, "k"):
+		multiplier, value = 1<<10, strings.TrimSuffix(value, "k")
+	case strings.HasSuffix(value, "m"):
+		multiplier, value = 1<<20, strings.TrimSuffix(value, "m")
+	}
+
+	size, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || size < 0 {
+		return 0, fmt.Errorf("invalid size %q", value)
+	}
+	return size * multiplier, nil
+}
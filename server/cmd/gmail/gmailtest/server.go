@@ -0,0 +1,856 @@
+// Package gmailtest provides an in-process fake of the parts of the Gmail API
+// this project uses, backed by an in-memory mailbox that tests seed and
+// inspect.
+//
+//	srv := gmailtest.NewServer("me@example.com")
+//	defer srv.Close()
+//	srv.AddMessage(gmailtest.Message{Headers: []gmailtest.Header{{"From", "news@shop.com"}}})
+//	gmail.UseEndpoint(gmail.Endpoint{Url: srv.URL, Transport: srv.Client().Transport})
+package gmailtest
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
+	"net/textproto"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	usersPrefix = "/gmail/v1/users/"
+	batchPath   = "/batch/gmail/v1"
+	// same limits as Gmail
+	maxPageSize = 500
+	maxBatchIds = 1000
+	maxBatch    = 100
+)
+
+var systemLabels = []string{
+	"INBOX", "SENT", "DRAFT", "TRASH", "SPAM", "STARRED", "UNREAD", "IMPORTANT",
+	"CATEGORY_PERSONAL", "CATEGORY_SOCIAL", "CATEGORY_PROMOTIONS", "CATEGORY_UPDATES", "CATEGORY_FORUMS", "CATEGORY_PURCHASES",
+}
+
+type Header struct {
+	Name, Value string
+}
+
+// Message is a message in the fake mailbox. Fields left empty when seeding are
+// filled in by AddMessage.
+type Message struct {
+	Id            string
+	ThreadId      string
+	LabelIds      []string
+	Headers       []Header
+	Body          string
+	Size          int64
+	Date          time.Time
+	HasAttachment bool
+}
+
+// Returns the value of the first header with the given name, or "".
+func (m Message) Header(name string) string {
+	for _, header := range m.Headers {
+		if strings.EqualFold(header.Name, name) {
+			return header.Value
+		}
+	}
+	return ""
+}
+
+// Reports whether the message carries the label, compared case-insensitively.
+func (m Message) HasLabel(label string) bool {
+	for _, id := range m.LabelIds {
+		if strings.EqualFold(id, label) {
+			return true
+		}
+	}
+	return false
+}
+
+type FilterCriteria struct {
+	From    string `json:"from,omitempty"`
+	To      string `json:"to,omitempty"`
+	Subject string `json:"subject,omitempty"`
+	Query   string `json:"query,omitempty"`
+}
+
+type FilterAction struct {
+	AddLabelIds    []string `json:"addLabelIds,omitempty"`
+	RemoveLabelIds []string `json:"removeLabelIds,omitempty"`
+	Forward        string   `json:"forward,omitempty"`
+}
+
+type Filter struct {
+	Id       string         `json:"id"`
+	Criteria FilterCriteria `json:"criteria"`
+	Action   FilterAction   `json:"action"`
+}
+
+// SendAs is a send-as alias of the account. The account's own address is
+// always listed first, as Gmail does.
+type SendAs struct {
+	SendAsEmail string `json:"sendAsEmail"`
+	DisplayName string `json:"displayName,omitempty"`
+	IsPrimary   bool   `json:"isPrimary,omitempty"`
+	IsDefault   bool   `json:"isDefault,omitempty"`
+	// "accepted" or "pending"; empty for the primary address
+	VerificationStatus string `json:"verificationStatus,omitempty"`
+}
+
+type failure struct {
+	path   string
+	status int
+	reason string
+	times  int
+}
+
+// Server is a fake Gmail API. Every user ID ("me" or an address) addresses the
+// same mailbox.
+type Server struct {
+	*httptest.Server
+	// returned by users.getProfile
+	Address string
+
+	mu       sync.Mutex
+	messages []*Message
+	filters  []Filter
+	sendAs   []SendAs
+	failures []*failure
+	requests []string
+	nextId   int
+}
+
+// Starts a fake server for the mailbox of address.
+func NewServer(address string) *Server {
+	s := &Server{Address: address}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+// Adds a message to the mailbox and returns its ID. Messages without labels
+// land in the inbox; messages without a date are dated one minute after the
+// previous one, so later messages are newer.
+func (s *Server) AddMessage(m Message) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.addMessage(m)
+}
+
+func (s *Server) addMessage(m Message) string {
+	s.nextId++
+	if m.Id == "" {
+		m.Id = fmt.Sprintf("%016x", s.nextId)
+	}
+	if m.ThreadId == "" {
+		m.ThreadId = m.Id
+	}
+	if m.LabelIds == nil {
+		m.LabelIds = []string{"INBOX"}
+	}
+	if m.Date.IsZero() {
+		m.Date = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC).Add(time.Duration(s.nextId) * time.Minute)
+	}
+	if m.Header("Date") == "" {
+		m.Headers = append(m.Headers, Header{"Date", m.Date.Format(time.RFC1123Z)})
+	}
+	if m.Size == 0 {
+		m.Size = int64(len(m.Body))
+		for _, header := range m.Headers {
+			m.Size += int64(len(header.Name) + len(header.Value) + 4)
+		}
+	}
+
+	s.messages = append(s.messages, &m)
+	return m.Id
+}
+
+// Returns a copy of the message, or false when it was deleted or never existed.
+func (s *Server) Message(id string) (Message, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if m := s.find(id); m != nil {
+		return copyMessage(m), true
+	}
+	return Message{}, false
+}
+
+// Returns copies of every message in the mailbox, in the order they were added.
+func (s *Server) Messages() []Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	messages := make([]Message, len(s.messages))
+	for i, m := range s.messages {
+		messages[i] = copyMessage(m)
+	}
+	return messages
+}
+
+// Returns the messages sent through messages.send.
+func (s *Server) Sent() []Message {
+	return s.labelled("SENT")
+}
+
+// Returns the messages saved through drafts.create.
+func (s *Server) Drafts() []Message {
+	return s.labelled("DRAFT")
+}
+
+func (s *Server) labelled(label string) []Message {
+	var messages []Message
+	for _, m := range s.Messages() {
+		if m.HasLabel(label) {
+			messages = append(messages, m)
+		}
+	}
+	return messages
+}
+
+// Adds a send-as alias. An alias that is the default takes that role from the
+// account's own address.
+func (s *Server) AddSendAs(alias SendAs) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if alias.IsDefault {
+		for i := range s.sendAs {
+			s.sendAs[i].IsDefault = false
+		}
+	}
+	s.sendAs = append(s.sendAs, alias)
+}
+
+func (s *Server) AddFilter(f Filter) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.nextId++
+	if f.Id == "" {
+		f.Id = fmt.Sprintf("filter%d", s.nextId)
+	}
+	s.filters = append(s.filters, f)
+}
+
+func (s *Server) Filters() []Filter {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Filter{}, s.filters...)
+}
+
+// Makes the next times calls whose path below users/{userId}/ starts with path
+// (e.g. "messages/batchDelete", or "messages" for all message calls) fail with
+// status and reason. Calls inside batch requests count too.
+func (s *Server) Fail(path string, status int, reason string, times int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures = append(s.failures, &failure{path, status, reason, times})
+}
+
+// Returns "METHOD path" for every call received so far, including the calls
+// inside batch requests.
+func (s *Server) Requests() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string{}, s.requests...)
+}
+
+func (s *Server) find(id string) *Message {
+	for _, m := range s.messages {
+		if m.Id == id {
+			return m
+		}
+	}
+	return nil
+}
+
+func copyMessage(m *Message) Message {
+	c := *m
+	c.LabelIds = append([]string{}, m.LabelIds...)
+	c.Headers = append([]Header{}, m.Headers...)
+	return c
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == batchPath && r.Method == http.MethodPost {
+		s.serveBatch(w, r)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalidArgument", err.Error())
+		return
+	}
+	s.route(w, r.Method, r.URL, body)
+}
+
+func (s *Server) route(w http.ResponseWriter, method string, u *url.URL, body []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.requests = append(s.requests, method+" "+u.Path)
+
+	if !strings.HasPrefix(u.Path, usersPrefix) {
+		writeError(w, http.StatusNotFound, "notFound", "Not Found")
+		return
+	}
+	// drop the user ID; every user shares the mailbox
+	rest := strings.TrimPrefix(u.Path, usersPrefix)
+	path := ""
+	if i := strings.IndexByte(rest, '/'); i >= 0 {
+		path = rest[i+1:]
+	}
+
+	for _, f := range s.failures {
+		if f.times > 0 && strings.HasPrefix(path, f.path) {
+			f.times--
+			writeError(w, f.status, f.reason, "injected failure")
+			return
+		}
+	}
+
+	segments := strings.Split(path, "/")
+	query := u.Query()
+
+	switch {
+	case method == "GET" && path == "profile":
+		writeJSON(w, http.StatusOK, map[string]interface{}{"emailAddress": s.Address, "messagesTotal": len(s.messages)})
+	case method == "GET" && path == "messages":
+		s.listMessages(w, query)
+	case method == "POST" && path == "messages/batchDelete":
+		s.batchDelete(w, body)
+	case method == "POST" && path == "messages/batchModify":
+		s.batchModify(w, body)
+	case method == "POST" && path == "messages/send":
+		s.send(w, body)
+	case method == "POST" && path == "drafts":
+		s.createDraft(w, body)
+	case method == "GET" && len(segments) == 2 && segments[0] == "messages":
+		s.getMessage(w, segments[1], query)
+	case method == "POST" && len(segments) == 3 && segments[0] == "messages" && (segments[2] == "trash" || segments[2] == "untrash"):
+		s.trash(w, segments[1], segments[2] == "trash")
+	case method == "GET" && path == "settings/filters":
+		s.listFilters(w)
+	case method == "POST" && path == "settings/filters":
+		s.createFilter(w, body)
+	case method == "GET" && path == "labels":
+		s.listLabels(w)
+	case method == "GET" && path == "settings/sendAs":
+		s.listSendAs(w)
+	default:
+		writeError(w, http.StatusNotFound, "notFound", fmt.Sprintf("no fake for %v %v", method, u.Path))
+	}
+}
+
+func (s *Server) listMessages(w http.ResponseWriter, query url.Values) {
+	matcher, err := parseQuery(query.Get("q"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalidArgument", err.Error())
+		return
+	}
+
+	pageSize := 100
+	if value := query.Get("maxResults"); value != "" {
+		if pageSize, err = strconv.Atoi(value); err != nil || pageSize < 1 {
+			writeError(w, http.StatusBadRequest, "invalidArgument", "Invalid maxResults")
+			return
+		}
+	}
+	if pageSize > maxPageSize {
+		pageSize = maxPageSize
+	}
+
+	offset := 0
+	if token := query.Get("pageToken"); token != "" {
+		if offset, err = strconv.Atoi(token); err != nil || offset < 0 {
+			writeError(w, http.StatusBadRequest, "invalidArgument", "Invalid pageToken")
+			return
+		}
+	}
+
+	// trash and spam only show up when asked for
+	includeSpamTrash := query.Get("includeSpamTrash") == "true" || matcher.mentionsTrashOrSpam()
+
+	var matches []*Message
+	for _, m := range s.messages {
+		if !includeSpamTrash && (m.HasLabel("TRASH") || m.HasLabel("SPAM")) {
+			continue
+		}
+		if matcher.match(m) {
+			matches = append(matches, m)
+		}
+	}
+	// newest first, like Gmail
+	sort.SliceStable(matches, func(i, j int) bool { return matches[i].Date.After(matches[j].Date) })
+
+	res := map[string]interface{}{"resultSizeEstimate": len(matches)}
+	if offset < len(matches) {
+		end := offset + pageSize
+		if end > len(matches) {
+			end = len(matches)
+		} else {
+			res["nextPageToken"] = strconv.Itoa(end)
+		}
+
+		var page []map[string]string
+		for _, m := range matches[offset:end] {
+			page = append(page, map[string]string{"id": m.Id, "threadId": m.ThreadId})
+		}
+		res["messages"] = page
+	}
+
+	writeJSON(w, http.StatusOK, res)
+}
+
+func (s *Server) getMessage(w http.ResponseWriter, id string, query url.Values) {
+	m := s.find(id)
+	if m == nil {
+		writeError(w, http.StatusNotFound, "notFound", "Requested entity was not found.")
+		return
+	}
+
+	res := map[string]interface{}{
+		"id":           m.Id,
+		"threadId":     m.ThreadId,
+		"labelIds":     m.LabelIds,
+		"sizeEstimate": m.Size,
+		"internalDate": strconv.FormatInt(m.Date.UnixMilli(), 10),
+		"snippet":      snippet(m.Body),
+	}
+
+	headers := m.Headers
+	switch format := query.Get("format"); format {
+	case "", "full":
+		res["payload"] = map[string]interface{}{
+			"mimeType": "text/plain",
+			"headers":  jsonHeaders(headers),
+			"body":     map[string]interface{}{"size": len(m.Body), "data": base64.URLEncoding.EncodeToString([]byte(m.Body))},
+		}
+	case "metadata":
+		if wanted := query["metadataHeaders"]; len(wanted) > 0 {
+			headers = nil
+			for _, header := range m.Headers {
+				for _, name := range wanted {
+					if strings.EqualFold(header.Name, name) {
+						headers = append(headers, header)
+						break
+					}
+				}
+			}
+		}
+		res["payload"] = map[string]interface{}{"mimeType": "text/plain", "headers": jsonHeaders(headers)}
+	case "minimal":
+	case "raw":
+		res["raw"] = base64.URLEncoding.EncodeToString([]byte(rawMessage(m)))
+	default:
+		writeError(w, http.StatusBadRequest, "invalidArgument", fmt.Sprintf("Invalid format %v", format))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, res)
+}
+
+type idsBody struct {
+	Ids            []string `json:"ids"`
+	AddLabelIds    []string `json:"addLabelIds"`
+	RemoveLabelIds []string `json:"removeLabelIds"`
+}
+
+func decodeIds(w http.ResponseWriter, body []byte) (*idsBody, bool) {
+	var req idsBody
+	if err := json.Unmarshal(body, &req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalidArgument", "Invalid JSON payload received.")
+		return nil, false
+	}
+	if len(req.Ids) == 0 {
+		writeError(w, http.StatusBadRequest, "invalidArgument", "No message IDs given.")
+		return nil, false
+	}
+	if len(req.Ids) > maxBatchIds {
+		writeError(w, http.StatusBadRequest, "invalidArgument", fmt.Sprintf("Too many IDs, at most %d are allowed.", maxBatchIds))
+		return nil, false
+	}
+	return &req, true
+}
+
+// Unknown IDs are ignored, as Gmail does.
+func (s *Server) batchDelete(w http.ResponseWriter, body []byte) {
+	req, ok := decodeIds(w, body)
+	if !ok {
+		return
+	}
+
+	remove := make(map[string]struct{}, len(req.Ids))
+	for _, id := range req.Ids {
+		remove[id] = struct{}{}
+	}
+
+	kept := s.messages[:0]
+	for _, m := range s.messages {
+		if _, found := remove[m.Id]; !found {
+			kept = append(kept, m)
+		}
+	}
+	s.messages = kept
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) batchModify(w http.ResponseWriter, body []byte) {
+	req, ok := decodeIds(w, body)
+	if !ok {
+		return
+	}
+
+	for _, id := range req.Ids {
+		if m := s.find(id); m != nil {
+			modifyLabels(m, req.AddLabelIds, req.RemoveLabelIds)
+		}
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) trash(w http.ResponseWriter, id string, trash bool) {
+	m := s.find(id)
+	if m == nil {
+		writeError(w, http.StatusNotFound, "notFound", "Requested entity was not found.")
+		return
+	}
+
+	if trash {
+		modifyLabels(m, []string{"TRASH"}, nil)
+	} else {
+		modifyLabels(m, nil, []string{"TRASH"})
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"id": m.Id, "threadId": m.ThreadId, "labelIds": m.LabelIds})
+}
+
+func modifyLabels(m *Message, add, remove []string) {
+	for _, label := range remove {
+		for i, id := range m.LabelIds {
+			if id == label {
+				m.LabelIds = append(m.LabelIds[:i], m.LabelIds[i+1:]...)
+				break
+			}
+		}
+	}
+	for _, label := range add {
+		if !m.HasLabel(label) {
+			m.LabelIds = append(m.LabelIds, label)
+		}
+	}
+}
+
+func (s *Server) send(w http.ResponseWriter, body []byte) {
+	var req struct {
+		Raw string `json:"raw"`
+	}
+	if err := json.Unmarshal(body, &req); err != nil || req.Raw == "" {
+		writeError(w, http.StatusBadRequest, "invalidArgument", "'raw' RFC822 payload message string or uploading message via /upload/* URL required")
+		return
+	}
+
+	m, ok := parseRaw(w, req.Raw, "SENT")
+	if !ok {
+		return
+	}
+	if m.Header("To") == "" {
+		writeError(w, http.StatusBadRequest, "invalidArgument", "Invalid To header")
+		return
+	}
+
+	id := s.addMessage(m)
+	writeJSON(w, http.StatusOK, map[string]interface{}{"id": id, "threadId": id, "labelIds": m.LabelIds})
+}
+
+func (s *Server) createDraft(w http.ResponseWriter, body []byte) {
+	var req struct {
+		Message struct {
+			Raw string `json:"raw"`
+		} `json:"message"`
+	}
+	if err := json.Unmarshal(body, &req); err != nil || req.Message.Raw == "" {
+		writeError(w, http.StatusBadRequest, "invalidArgument", "Missing draft message")
+		return
+	}
+
+	m, ok := parseRaw(w, req.Message.Raw, "DRAFT")
+	if !ok {
+		return
+	}
+
+	id := s.addMessage(m)
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"id":      "r" + id,
+		"message": map[string]interface{}{"id": id, "threadId": id, "labelIds": m.LabelIds},
+	})
+}
+
+// Decodes a base64url RFC 822 message into a Message with the given label,
+// answering with an error when it does not parse.
+func parseRaw(w http.ResponseWriter, encoded string, label string) (Message, bool) {
+	raw, err := decodeBase64(encoded)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalidArgument", "Invalid raw payload.")
+		return Message{}, false
+	}
+
+	parsed, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalidArgument", "Invalid RFC822 message.")
+		return Message{}, false
+	}
+
+	m := Message{LabelIds: []string{label}}
+	for name, values := range parsed.Header {
+		for _, value := range values {
+			m.Headers = append(m.Headers, Header{name, value})
+		}
+	}
+	sort.SliceStable(m.Headers, func(i, j int) bool { return m.Headers[i].Name < m.Headers[j].Name })
+	text, _ := io.ReadAll(parsed.Body)
+	m.Body = string(text)
+	return m, true
+}
+
+func (s *Server) listSendAs(w http.ResponseWriter) {
+	primary := SendAs{SendAsEmail: s.Address, IsPrimary: true, IsDefault: true}
+	for _, alias := range s.sendAs {
+		if alias.IsDefault {
+			primary.IsDefault = false
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"sendAs": append([]SendAs{primary}, s.sendAs...)})
+}
+
+func (s *Server) listFilters(w http.ResponseWriter) {
+	// like Gmail, an account without filters gets an empty object
+	if len(s.filters) == 0 {
+		writeJSON(w, http.StatusOK, map[string]interface{}{})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"filter": s.filters})
+}
+
+func (s *Server) createFilter(w http.ResponseWriter, body []byte) {
+	var f Filter
+	if err := json.Unmarshal(body, &f); err != nil {
+		writeError(w, http.StatusBadRequest, "invalidArgument", "Invalid JSON payload received.")
+		return
+	}
+	if f.Criteria == (FilterCriteria{}) {
+		writeError(w, http.StatusBadRequest, "invalidArgument", "Filter doesn't have any criteria")
+		return
+	}
+
+	for _, existing := range s.filters {
+		if existing.Criteria == f.Criteria && fmt.Sprint(existing.Action) == fmt.Sprint(f.Action) {
+			writeError(w, http.StatusBadRequest, "failedPrecondition", "Filter already exists")
+			return
+		}
+	}
+
+	s.nextId++
+	f.Id = fmt.Sprintf("filter%d", s.nextId)
+	s.filters = append(s.filters, f)
+	writeJSON(w, http.StatusOK, f)
+}
+
+func (s *Server) listLabels(w http.ResponseWriter) {
+	seen := make(map[string]struct{})
+	var labels []map[string]string
+
+	for _, id := range systemLabels {
+		seen[id] = struct{}{}
+		labels = append(labels, map[string]string{"id": id, "name": id, "type": "system"})
+	}
+	for _, m := range s.messages {
+		for _, id := range m.LabelIds {
+			if _, found := seen[id]; !found {
+				seen[id] = struct{}{}
+				labels = append(labels, map[string]string{"id": id, "name": id, "type": "user"})
+			}
+		}
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"labels": labels})
+}
+
+var requestLinePattern = regexp.MustCompile(`^([A-Z]+) (\S+)(?: HTTP/\d(?:\.\d)?)?$`)
+
+// Runs every call in a multipart/mixed batch request and answers with a
+// multipart/mixed body holding one application/http response per call.
+func (s *Server) serveBatch(w http.ResponseWriter, r *http.Request) {
+	mediaType, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/mixed" {
+		writeError(w, http.StatusBadRequest, "invalidArgument", "Batch requests must be multipart/mixed")
+		return
+	}
+
+	type call struct {
+		contentId string
+		recorder  *httptest.ResponseRecorder
+	}
+	var calls []call
+
+	reader := multipart.NewReader(r.Body, params["boundary"])
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			writeError(w, http.StatusBadRequest, "invalidArgument", err.Error())
+			return
+		}
+		if len(calls) == maxBatch {
+			writeError(w, http.StatusBadRequest, "invalidArgument", fmt.Sprintf("Too many requests in batch, at most %d are allowed.", maxBatch))
+			return
+		}
+
+		recorder := httptest.NewRecorder()
+		if err := s.serveBatchPart(recorder, part); err != nil {
+			recorder = httptest.NewRecorder()
+			writeError(recorder, http.StatusBadRequest, "invalidArgument", err.Error())
+		}
+		calls = append(calls, call{part.Header.Get("Content-ID"), recorder})
+	}
+
+	writer := multipart.NewWriter(w)
+	w.Header().Set("Content-Type", "multipart/mixed; boundary="+writer.Boundary())
+	w.WriteHeader(http.StatusOK)
+
+	for _, c := range calls {
+		header := textproto.MIMEHeader{"Content-Type": {"application/http"}}
+		if c.contentId != "" {
+			header.Set("Content-ID", "<response-"+strings.Trim(c.contentId, "<>")+">")
+		}
+		part, _ := writer.CreatePart(header)
+
+		res := c.recorder.Result()
+		fmt.Fprintf(part, "HTTP/1.1 %d %s\r\n", res.StatusCode, http.StatusText(res.StatusCode))
+		res.Header.Set("Content-Length", strconv.Itoa(c.recorder.Body.Len()))
+		res.Header.Write(part)
+		fmt.Fprint(part, "\r\n")
+		part.Write(c.recorder.Body.Bytes())
+	}
+	writer.Close()
+}
+
+func (s *Server) serveBatchPart(w http.ResponseWriter, part io.Reader) error {
+	buffered := bufio.NewReader(part)
+	tp := textproto.NewReader(buffered)
+
+	line, err := tp.ReadLine()
+	if err != nil {
+		return fmt.Errorf("missing request line")
+	}
+	match := requestLinePattern.FindStringSubmatch(strings.TrimSpace(line))
+	if match == nil {
+		return fmt.Errorf("malformed request line %q", line)
+	}
+
+	// headers of the inner request are not needed by any fake endpoint
+	if _, err := tp.ReadMIMEHeader(); err != nil && err != io.EOF {
+		return fmt.Errorf("malformed headers: %v", err.Error())
+	}
+	body, err := io.ReadAll(buffered)
+	if err != nil {
+		return err
+	}
+
+	target, err := url.Parse(match[2])
+	if err != nil {
+		return fmt.Errorf("malformed request target %q", match[2])
+	}
+	s.route(w, match[1], target, bytes.TrimSpace(body))
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// Writes Google's JSON error envelope.
+func writeError(w http.ResponseWriter, status int, reason, message string) {
+	writeJSON(w, status, map[string]interface{}{
+		"error": map[string]interface{}{
+			"code":    status,
+			"message": message,
+			"status":  statusName(status),
+			"errors":  []map[string]string{{"domain": "global", "reason": reason, "message": message}},
+		},
+	})
+}
+
+func statusName(status int) string {
+	switch status {
+	case http.StatusBadRequest:
+		return "INVALID_ARGUMENT"
+	case http.StatusUnauthorized:
+		return "UNAUTHENTICATED"
+	case http.StatusForbidden:
+		return "PERMISSION_DENIED"
+	case http.StatusNotFound:
+		return "NOT_FOUND"
+	case http.StatusTooManyRequests:
+		return "RESOURCE_EXHAUSTED"
+	case http.StatusServiceUnavailable:
+		return "UNAVAILABLE"
+	}
+	if status >= 500 {
+		return "INTERNAL"
+	}
+	return ""
+}
+
+func jsonHeaders(headers []Header) []map[string]string {
+	list := make([]map[string]string, len(headers))
+	for i, header := range headers {
+		list[i] = map[string]string{"name": header.Name, "value": header.Value}
+	}
+	return list
+}
+
+func rawMessage(m *Message) string {
+	var b strings.Builder
+	for _, header := range m.Headers {
+		fmt.Fprintf(&b, "%s: %s\r\n", header.Name, header.Value)
+	}
+	b.WriteString("\r\n")
+	b.WriteString(m.Body)
+	return b.String()
+}
+
+func snippet(body string) string {
+	body = strings.Join(strings.Fields(body), " ")
+	if len(body) > 100 {
+		return body[:100]
+	}
+	return body
+}
+
+// Gmail accepts both padded and unpadded URL-safe base64.
+func decodeBase64(value string) ([]byte, error) {
+	if data, err := base64.URLEncoding.DecodeString(value); err == nil {
+		return data, nil
+	}
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(value, "="))
+}
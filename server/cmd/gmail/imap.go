@@ -0,0 +1,846 @@
+package gmail
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+const (
+	imapDialTimeout    = 30 * time.Second
+	imapCommandTimeout = 2 * time.Minute
+)
+
+// base64 with "," in place of "/" and no padding, as modified UTF-7 uses it
+var mailboxEncoding = base64.NewEncoding("ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789+,").WithPadding(base64.NoPadding)
+
+// ImapError is a NO or BAD completion of an IMAP command, or a BYE sent in
+// its place. Code holds the response code without its brackets, e.g.
+// "AUTHENTICATIONFAILED" or "NONEXISTENT".
+type ImapError struct {
+	Command string
+	Status  string
+	Code    string
+	Text    string
+}
+
+func (e *ImapError) Error() string {
+	msg := fmt.Sprintf("IMAP %v: %v", e.Command, e.Status)
+	if e.Code != "" {
+		msg += fmt.Sprintf(" [%v]", e.Code)
+	}
+	if e.Text != "" {
+		msg += " " + e.Text
+	}
+	return msg
+}
+
+func asImapError(err error) (*ImapError, bool) {
+	var imapErr *ImapError
+	ok := errors.As(err, &imapErr)
+	return imapErr, ok
+}
+
+// The name of the response code, e.g. "COPYUID" for "COPYUID 38505 1:3 7:9".
+func (e *ImapError) codeName() string {
+	name, _, _ := strings.Cut(e.Code, " ")
+	return strings.ToUpper(name)
+}
+
+// A minimal IMAP4rev1 client (RFC 3501): enough to pick mailboxes, and to
+// search, fetch the headers of, move and delete messages by UID. Commands run
+// one at a time and IDLE is never used, so the connection is only busy while a
+// command is.
+type imapConn struct {
+	conn         net.Conn
+	r            *bufio.Reader
+	w            *bufio.Writer
+	tag          int
+	capabilities map[string]bool
+	// mailbox the connection has selected, with its UIDVALIDITY
+	selected    string
+	uidValidity uint32
+}
+
+// One response line, with any literals it carries read in.
+type imapResponse struct {
+	// "*" for untagged responses, "+" for continuation requests, otherwise the
+	// tag of the command completed
+	tag string
+	// status responses: OK, NO, BAD, BYE or PREAUTH, along with the response
+	// code (without brackets) and the human readable text
+	status string
+	code   string
+	text   string
+	// data responses, e.g. ["3", "FETCH", [...]]. Atoms and strings are
+	// strings, parenthesized lists []interface{} and NIL is nil.
+	fields []interface{}
+}
+
+// Sent as a synchronizing literal, which may hold anything a quoted string
+// cannot: 8-bit text, CR, LF.
+type imapLiteral string
+
+// Connects to address and reads the greeting. security is "tls" (the default)
+// for implicit TLS, "starttls" to upgrade a plain connection, or "none", which
+// is only allowed to loopback addresses since credentials would travel in the
+// clear.
+func dialImap(ctx context.Context, address string, security string) (*imapConn, error) {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, fmt.Errorf("invalid IMAP address \"%v\": %v", address, err.Error())
+	}
+
+	dialer := &net.Dialer{Timeout: imapDialTimeout}
+	var conn net.Conn
+
+	switch strings.ToLower(security) {
+	case "", "tls":
+		tlsDialer := &tls.Dialer{NetDialer: dialer, Config: &tls.Config{ServerName: host}}
+		conn, err = tlsDialer.DialContext(ctx, "tcp", address)
+	case "starttls":
+		conn, err = dialer.DialContext(ctx, "tcp", address)
+	case "none":
+		if !isLoopback(host) {
+			return nil, fmt.Errorf("refusing to send IMAP credentials to %v without TLS; use \"tls\" or \"starttls\"", host)
+		}
+		conn, err = dialer.DialContext(ctx, "tcp", address)
+	default:
+		return nil, fmt.Errorf("unknown IMAP security \"%v\", expected \"tls\", \"starttls\" or \"none\"", security)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to IMAP server %v: %v", address, err.Error())
+	}
+
+	c := newImapConn(conn)
+	conn.SetDeadline(time.Now().Add(imapCommandTimeout))
+	greeting, err := c.readResponse()
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("error reading IMAP greeting: %v", err.Error())
+	}
+	if greeting.status != "OK" && greeting.status != "PREAUTH" {
+		conn.Close()
+		return nil, &ImapError{"greeting", greeting.status, greeting.code, greeting.text}
+	}
+
+	if strings.EqualFold(security, "starttls") {
+		if _, err := c.command("STARTTLS"); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: host})
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("error negotiating TLS with %v: %v", address, err.Error())
+		}
+		c = newImapConn(tlsConn)
+	}
+
+	return c, nil
+}
+
+func newImapConn(conn net.Conn) *imapConn {
+	return &imapConn{conn: conn, r: bufio.NewReader(conn), w: bufio.NewWriter(conn)}
+}
+
+func isLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// Logs in and learns what the server supports once logged in.
+func (c *imapConn) login(username, password string) error {
+	if err := c.refreshCapabilities(); err != nil {
+		return err
+	}
+	if c.capabilities["LOGINDISABLED"] {
+		return fmt.Errorf("the IMAP server does not accept passwords over this connection; use \"tls\" or \"starttls\"")
+	}
+
+	if _, err := c.command("LOGIN", imapQuote(username), imapQuote(password)); err != nil {
+		if imapErr, ok := asImapError(err); ok {
+			// LOGIN only ever fails because of the credentials
+			imapErr.Command = "LOGIN"
+			if imapErr.Code == "" {
+				imapErr.Code = "AUTHENTICATIONFAILED"
+			}
+		}
+		return err
+	}
+
+	// capabilities often grow after logging in
+	return c.refreshCapabilities()
+}
+
+func (c *imapConn) refreshCapabilities() error {
+	untagged, err := c.command("CAPABILITY")
+	if err != nil {
+		return err
+	}
+
+	c.capabilities = make(map[string]bool)
+	for _, res := range untagged {
+		if len(res.fields) == 0 || !strings.EqualFold(atom(res.fields[0]), "CAPABILITY") {
+			continue
+		}
+		for _, field := range res.fields[1:] {
+			c.capabilities[strings.ToUpper(atom(field))] = true
+		}
+	}
+	return nil
+}
+
+func (c *imapConn) logout() error {
+	_, err := c.command("LOGOUT")
+	c.conn.Close()
+	return err
+}
+
+// Selects mailbox (in its encoded form) read-write, unless it already is.
+func (c *imapConn) selectMailbox(mailbox string) error {
+	if c.selected == mailbox {
+		return nil
+	}
+
+	untagged, err := c.command("SELECT", imapQuote(mailbox))
+	if err != nil {
+		c.selected = ""
+		return err
+	}
+
+	c.selected, c.uidValidity = mailbox, 0
+	for _, res := range untagged {
+		if name, value, _ := strings.Cut(res.code, " "); strings.EqualFold(name, "UIDVALIDITY") {
+			validity, err := strconv.ParseUint(value, 10, 32)
+			if err == nil {
+				c.uidValidity = uint32(validity)
+			}
+		}
+	}
+	return nil
+}
+
+// A mailbox as listed by the server.
+type imapMailbox struct {
+	name       string
+	attributes []string
+}
+
+func (m imapMailbox) hasAttribute(attribute string) bool {
+	for _, a := range m.attributes {
+		if strings.EqualFold(a, attribute) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *imapConn) list() ([]imapMailbox, error) {
+	untagged, err := c.command("LIST", imapQuote(""), imapQuote("*"))
+	if err != nil {
+		return nil, err
+	}
+
+	var mailboxes []imapMailbox
+	for _, res := range untagged {
+		// LIST (\HasNoChildren \Trash) "/" Trash
+		if len(res.fields) < 4 || !strings.EqualFold(atom(res.fields[0]), "LIST") {
+			continue
+		}
+		var attributes []string
+		if list, ok := res.fields[1].([]interface{}); ok {
+			for _, attribute := range list {
+				attributes = append(attributes, atom(attribute))
+			}
+		}
+		mailboxes = append(mailboxes, imapMailbox{atom(res.fields[3]), attributes})
+	}
+	return mailboxes, nil
+}
+
+// Runs UID SEARCH with the given keys and returns the matching UIDs in
+// ascending order.
+func (c *imapConn) search(keys []interface{}) ([]uint32, error) {
+	args := keys
+	if needsCharset(keys) {
+		args = append([]interface{}{"CHARSET", "UTF-8"}, keys...)
+	}
+
+	untagged, err := c.command("UID SEARCH", args...)
+	if err != nil {
+		return nil, err
+	}
+
+	var uids []uint32
+	for _, res := range untagged {
+		if len(res.fields) == 0 || !strings.EqualFold(atom(res.fields[0]), "SEARCH") {
+			continue
+		}
+		for _, field := range res.fields[1:] {
+			uid, err := strconv.ParseUint(atom(field), 10, 32)
+			if err == nil {
+				uids = append(uids, uint32(uid))
+			}
+		}
+	}
+	sort.Slice(uids, func(i, j int) bool { return uids[i] < uids[j] })
+	return uids, nil
+}
+
+// Fetches the named header fields of the messages, without marking them as
+// seen. The raw header block of each message is returned by UID; messages
+// the server no longer has are left out.
+func (c *imapConn) fetchHeaders(uids []uint32, headers []string) (map[uint32]string, error) {
+	item := "BODY.PEEK[HEADER.FIELDS (" + strings.ToUpper(strings.Join(headers, " ")) + ")]"
+	untagged, err := c.command("UID FETCH", formatUidSet(uids), "(UID "+item+")")
+	if err != nil {
+		return nil, err
+	}
+
+	blocks := make(map[uint32]string)
+	for _, res := range untagged {
+		// 12 FETCH (UID 345 BODY[HEADER.FIELDS (FROM)] {28}...)
+		if len(res.fields) < 3 || !strings.EqualFold(atom(res.fields[1]), "FETCH") {
+			continue
+		}
+		attributes, ok := res.fields[2].([]interface{})
+		if !ok {
+			continue
+		}
+
+		var uid uint64
+		var block string
+		for i := 0; i+1 < len(attributes); i += 2 {
+			name := strings.ToUpper(atom(attributes[i]))
+			switch {
+			case name == "UID":
+				uid, _ = strconv.ParseUint(atom(attributes[i+1]), 10, 32)
+			case strings.HasPrefix(name, "BODY["):
+				block = atom(attributes[i+1])
+			}
+		}
+		if uid != 0 {
+			blocks[uint32(uid)] = block
+		}
+	}
+	return blocks, nil
+}
+
+// What a COPYUID response code (RFC 4315) reports: the destination's
+// UIDVALIDITY and the new UID of each copied message by its old one.
+type copyUid struct {
+	uidValidity uint32
+	uids        map[uint32]uint32
+}
+
+// Moves messages to another mailbox, returning their new UIDs when the server
+// reports them (UIDPLUS). Servers without MOVE get a copy, followed by marking
+// and, where UIDPLUS allows it, expunging the originals.
+func (c *imapConn) move(uids []uint32, destination string) (*copyUid, error) {
+	set := formatUidSet(uids)
+
+	if c.capabilities["MOVE"] {
+		untagged, err := c.command("UID MOVE", set, imapQuote(destination))
+		if err != nil {
+			return nil, err
+		}
+		// the COPYUID code comes untagged, ahead of the expunges
+		for _, res := range untagged {
+			if copied, ok := parseCopyUid(res.code); ok {
+				return copied, nil
+			}
+		}
+		return nil, nil
+	}
+
+	tagged, err := c.commandStatus("UID COPY", set, imapQuote(destination))
+	if err != nil {
+		return nil, err
+	}
+	copied, _ := parseCopyUid(tagged.code)
+
+	if err := c.markDeleted(set); err != nil {
+		return copied, err
+	}
+	if c.capabilities["UIDPLUS"] {
+		if _, err := c.command("UID EXPUNGE", set); err != nil {
+			return copied, err
+		}
+	}
+	return copied, nil
+}
+
+// Removes messages for good. Without UIDPLUS the only way to do that is a
+// plain EXPUNGE, which would also take any other message marked deleted, so
+// it is refused.
+func (c *imapConn) delete(uids []uint32) error {
+	if !c.capabilities["UIDPLUS"] {
+		return fmt.Errorf("the IMAP server lacks UIDPLUS, so permanently deleting could also expunge unrelated messages; move them to the trash instead")
+	}
+
+	set := formatUidSet(uids)
+	if err := c.markDeleted(set); err != nil {
+		return err
+	}
+	_, err := c.command("UID EXPUNGE", set)
+	return err
+}
+
+// Adds a message to a mailbox with the given flags.
+func (c *imapConn) appendMessage(mailbox string, flags []string, message []byte) error {
+	_, err := c.command("APPEND", imapQuote(mailbox), "("+strings.Join(flags, " ")+")", imapLiteral(message))
+	return err
+}
+
+func (c *imapConn) markDeleted(set string) error {
+	_, err := c.command("UID STORE", set, "+FLAGS.SILENT", `(\Deleted)`)
+	return err
+}
+
+// Sends a command and reads responses up to its completion, returning the
+// untagged ones. A NO or BAD completion becomes an ImapError.
+func (c *imapConn) command(name string, args ...interface{}) ([]*imapResponse, error) {
+	untagged, _, err := c.run(name, args...)
+	return untagged, err
+}
+
+// Like command, but returns the tagged completion, whose response code some
+// commands (COPY) use to report results.
+func (c *imapConn) commandStatus(name string, args ...interface{}) (*imapResponse, error) {
+	_, tagged, err := c.run(name, args...)
+	return tagged, err
+}
+
+func (c *imapConn) run(name string, args ...interface{}) ([]*imapResponse, *imapResponse, error) {
+	c.tag++
+	tag := fmt.Sprintf("A%04d", c.tag)
+	c.conn.SetDeadline(time.Now().Add(imapCommandTimeout))
+
+	var untagged []*imapResponse
+	fmt.Fprintf(c.w, "%s %s", tag, name)
+	for _, arg := range args {
+		c.w.WriteByte(' ')
+		switch arg := arg.(type) {
+		case imapLiteral:
+			fmt.Fprintf(c.w, "{%d}\r\n", len(arg))
+			if err := c.w.Flush(); err != nil {
+				return nil, nil, err
+			}
+			// the server has to agree before the literal's bytes are sent
+			for {
+				res, err := c.readResponse()
+				if err != nil {
+					return nil, nil, err
+				}
+				if res.tag == "+" {
+					break
+				}
+				if res.tag == tag {
+					return untagged, res, &ImapError{name, res.status, res.code, res.text}
+				}
+				untagged = append(untagged, res)
+			}
+			c.w.WriteString(string(arg))
+		default:
+			fmt.Fprint(c.w, arg)
+		}
+	}
+	c.w.WriteString("\r\n")
+	if err := c.w.Flush(); err != nil {
+		return nil, nil, fmt.Errorf("error sending IMAP %v: %v", name, err.Error())
+	}
+
+	for {
+		res, err := c.readResponse()
+		if err != nil {
+			return nil, nil, fmt.Errorf("error reading IMAP %v response: %v", name, err.Error())
+		}
+
+		switch {
+		case res.tag == tag:
+			if res.status != "OK" {
+				return untagged, res, &ImapError{name, res.status, res.code, res.text}
+			}
+			return untagged, res, nil
+		case res.tag == "*" && res.status == "BYE" && name != "LOGOUT":
+			return untagged, nil, &ImapError{name, res.status, res.code, res.text}
+		default:
+			untagged = append(untagged, res)
+		}
+	}
+}
+
+func (c *imapConn) readResponse() (*imapResponse, error) {
+	tag, err := c.readAtom()
+	if err != nil {
+		return nil, err
+	}
+	res := &imapResponse{tag: tag}
+
+	if tag == "+" {
+		res.text, err = c.readText()
+		return res, err
+	}
+	if err := c.skipSpace(); err != nil {
+		return nil, err
+	}
+
+	first, err := c.readAtom()
+	if err != nil {
+		return nil, err
+	}
+	switch strings.ToUpper(first) {
+	case "OK", "NO", "BAD", "BYE", "PREAUTH":
+		res.status = strings.ToUpper(first)
+		res.code, res.text, err = c.readStatusText()
+		return res, err
+	}
+
+	res.fields = []interface{}{first}
+	for {
+		b, err := c.r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		switch b {
+		case '\r':
+			continue
+		case '\n':
+			return res, nil
+		case ' ':
+			value, err := c.readValue()
+			if err != nil {
+				return nil, err
+			}
+			res.fields = append(res.fields, value)
+		default:
+			return nil, fmt.Errorf("unexpected %q in IMAP response", b)
+		}
+	}
+}
+
+// Reads "[CODE args] text" up to the end of the line.
+func (c *imapConn) readStatusText() (string, string, error) {
+	text, err := c.readText()
+	if err != nil {
+		return "", "", err
+	}
+	text = strings.TrimPrefix(text, " ")
+	if !strings.HasPrefix(text, "[") {
+		return "", text, nil
+	}
+	end := strings.IndexByte(text, ']')
+	if end < 0 {
+		return "", text, nil
+	}
+	return text[1:end], strings.TrimSpace(text[end+1:]), nil
+}
+
+// Reads the rest of the line.
+func (c *imapConn) readText() (string, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func (c *imapConn) skipSpace() error {
+	b, err := c.r.ReadByte()
+	if err != nil {
+		return err
+	}
+	if b != ' ' {
+		return fmt.Errorf("expected a space in IMAP response, got %q", b)
+	}
+	return nil
+}
+
+func (c *imapConn) readValue() (interface{}, error) {
+	b, err := c.r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+
+	switch b {
+	case '(':
+		list := []interface{}{}
+		for {
+			next, err := c.r.ReadByte()
+			if err != nil {
+				return nil, err
+			}
+			switch next {
+			case ')':
+				return list, nil
+			case ' ':
+				continue
+			}
+			c.r.UnreadByte()
+			value, err := c.readValue()
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, value)
+		}
+	case '"':
+		var s strings.Builder
+		for {
+			next, err := c.r.ReadByte()
+			if err != nil {
+				return nil, err
+			}
+			switch next {
+			case '"':
+				return s.String(), nil
+			case '\\':
+				if next, err = c.r.ReadByte(); err != nil {
+					return nil, err
+				}
+			}
+			s.WriteByte(next)
+		}
+	case '{':
+		sizeText, err := c.r.ReadString('}')
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimSuffix(strings.TrimSuffix(sizeText, "}"), "+"))
+		if err != nil || size < 0 {
+			return nil, fmt.Errorf("invalid IMAP literal size %q", sizeText)
+		}
+		if _, err := c.readText(); err != nil {
+			return nil, err
+		}
+		data := make([]byte, size)
+		if _, err := io.ReadFull(c.r, data); err != nil {
+			return nil, err
+		}
+		return string(data), nil
+	}
+
+	c.r.UnreadByte()
+	value, err := c.readAtom()
+	if err != nil {
+		return nil, err
+	}
+	if strings.EqualFold(value, "NIL") {
+		return nil, nil
+	}
+	return value, nil
+}
+
+// Reads an atom. Brackets are kept together with what they enclose, spaces
+// and parentheses included, as in BODY[HEADER.FIELDS (FROM)].
+func (c *imapConn) readAtom() (string, error) {
+	var s strings.Builder
+	depth := 0
+	for {
+		b, err := c.r.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		if depth == 0 && (b == ' ' || b == '(' || b == ')' || b == '\r' || b == '\n') {
+			c.r.UnreadByte()
+			if s.Len() == 0 {
+				return "", fmt.Errorf("unexpected %q in IMAP response", b)
+			}
+			return s.String(), nil
+		}
+		switch b {
+		case '[':
+			depth++
+		case ']':
+			depth--
+		}
+		s.WriteByte(b)
+	}
+}
+
+// Renders a value as a quoted string, or as a literal when a quoted string
+// cannot carry it.
+func imapQuote(value string) interface{} {
+	for i := 0; i < len(value); i++ {
+		if value[i] < 0x20 || value[i] >= 0x7f {
+			return imapLiteral(value)
+		}
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(value) + `"`
+}
+
+func needsCharset(keys []interface{}) bool {
+	for _, key := range keys {
+		if _, ok := key.(imapLiteral); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// The string form of an atom or string field, or "" for NIL and lists.
+func atom(field interface{}) string {
+	s, _ := field.(string)
+	return s
+}
+
+// Formats UIDs as a compact set such as "1:3,7,9:12".
+func formatUidSet(uids []uint32) string {
+	sorted := append([]uint32{}, uids...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	var ranges []string
+	for i := 0; i < len(sorted); {
+		j := i
+		for j+1 < len(sorted) && sorted[j+1] <= sorted[j]+1 {
+			j++
+		}
+		if sorted[i] == sorted[j] {
+			ranges = append(ranges, strconv.FormatUint(uint64(sorted[i]), 10))
+		} else {
+			ranges = append(ranges, fmt.Sprintf("%d:%d", sorted[i], sorted[j]))
+		}
+		i = j + 1
+	}
+	return strings.Join(ranges, ",")
+}
+
+// Expands a set such as "1:3,7" in the order it is written.
+func parseUidSet(set string) ([]uint32, error) {
+	var uids []uint32
+	for _, part := range strings.Split(set, ",") {
+		from, to, isRange := strings.Cut(part, ":")
+		start, err := strconv.ParseUint(from, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid UID set \"%v\"", set)
+		}
+		end := start
+		if isRange {
+			if end, err = strconv.ParseUint(to, 10, 32); err != nil {
+				return nil, fmt.Errorf("invalid UID set \"%v\"", set)
+			}
+		}
+
+		if start <= end {
+			for uid := start; uid <= end; uid++ {
+				uids = append(uids, uint32(uid))
+			}
+		} else {
+			for uid := start; uid >= end; uid-- {
+				uids = append(uids, uint32(uid))
+			}
+		}
+	}
+	return uids, nil
+}
+
+// Parses a "COPYUID validity source destination" response code, pairing the
+// source and destination UIDs.
+func parseCopyUid(code string) (*copyUid, bool) {
+	fields := strings.Fields(code)
+	if len(fields) != 4 || !strings.EqualFold(fields[0], "COPYUID") {
+		return nil, false
+	}
+
+	validity, err := strconv.ParseUint(fields[1], 10, 32)
+	if err != nil {
+		return nil, false
+	}
+	source, err := parseUidSet(fields[2])
+	if err != nil {
+		return nil, false
+	}
+	destination, err := parseUidSet(fields[3])
+	if err != nil || len(source) != len(destination) {
+		return nil, false
+	}
+
+	copied := &copyUid{uint32(validity), make(map[uint32]uint32, len(source))}
+	for i := range source {
+		copied.uids[source[i]] = destination[i]
+	}
+	return copied, true
+}
+
+// Encodes a mailbox name in the modified UTF-7 IMAP uses (RFC 3501 5.1.3).
+func encodeMailboxName(name string) string {
+	var b strings.Builder
+	var pending []rune
+
+	flush := func() {
+		if len(pending) == 0 {
+			return
+		}
+		units := utf16.Encode(pending)
+		raw := make([]byte, 0, len(units)*2)
+		for _, unit := range units {
+			raw = append(raw, byte(unit>>8), byte(unit))
+		}
+		b.WriteByte('&')
+		b.WriteString(mailboxEncoding.EncodeToString(raw))
+		b.WriteByte('-')
+		pending = nil
+	}
+
+	for _, r := range name {
+		switch {
+		case r == '&':
+			flush()
+			b.WriteString("&-")
+		case r >= 0x20 && r <= 0x7e:
+			flush()
+			b.WriteRune(r)
+		default:
+			pending = append(pending, r)
+		}
+	}
+	flush()
+	return b.String()
+}
+
+// Decodes a modified UTF-7 mailbox name, returning it unchanged when it is not
+// validly encoded.
+func decodeMailboxName(name string) string {
+	var b strings.Builder
+	for i := 0; i < len(name); i++ {
+		if name[i] != '&' {
+			b.WriteByte(name[i])
+			continue
+		}
+
+		end := strings.IndexByte(name[i:], '-')
+		if end < 0 {
+			return name
+		}
+		encoded := name[i+1 : i+end]
+		i += end
+		if encoded == "" {
+			b.WriteByte('&')
+			continue
+		}
+
+		raw, err := mailboxEncoding.DecodeString(encoded)
+		if err != nil || len(raw)%2 != 0 {
+			return name
+		}
+		units := make([]uint16, len(raw)/2)
+		for j := range units {
+			units[j] = uint16(raw[2*j])<<8 | uint16(raw[2*j+1])
+		}
+		b.WriteString(string(utf16.Decode(units)))
+	}
+	return b.String()
+}
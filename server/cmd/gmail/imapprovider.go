@@ -0,0 +1,753 @@
+package gmail
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultImapPasswordEnv = "IMAP_PASSWORD"
+	// UIDs per FETCH, MOVE, STORE or EXPUNGE, which keeps command lines short
+	imapChunkSize = 500
+	// senders ORed together in a single SEARCH
+	imapSendersPerSearch = 50
+	imapDateLayout       = "2-Jan-2006"
+)
+
+// Mailboxes commonly used as the trash by servers that do not mark it with the
+// \Trash attribute (RFC 6154).
+var trashMailboxNames = []string{"Trash", "Deleted Items", "Deleted Messages", "INBOX.Trash", "[Gmail]/Trash"}
+
+// commonly used names of the drafts mailbox, for servers without SPECIAL-USE
+var draftsMailboxNames = []string{"Drafts", "INBOX.Drafts", "[Gmail]/Drafts"}
+
+// ImapSettings point a profile at an IMAP server instead of the Gmail API.
+// The password is read from an environment variable rather than stored with
+// the settings.
+type ImapSettings struct {
+	Host string `json:"host"`
+	// defaults to 993, or 143 with "starttls" and "none"
+	Port int `json:"port"`
+	// "tls" (the default), "starttls", or "none" for a server on this machine
+	Security string `json:"security"`
+	// defaults to the profile's address
+	Username string `json:"username"`
+	// environment variable holding the password, IMAP_PASSWORD by default
+	PasswordEnv string `json:"passwordEnv"`
+	// mailboxes searched for messages, INBOX by default. Restored messages go
+	// back to the first.
+	Mailboxes []string `json:"mailboxes"`
+	// mailbox used as the trash, found through its \Trash attribute by default
+	Trash string `json:"trash"`
+	// mailbox unsubscribe drafts are saved to, found through its \Drafts
+	// attribute by default
+	Drafts string `json:"drafts"`
+	// server that mailto unsubscribe requests are sent through, with the same
+	// credentials; without one only unsubscribe links can be followed
+	Smtp *SmtpSettings `json:"smtp"`
+}
+
+type SmtpSettings struct {
+	Host string `json:"host"`
+	// defaults to 465, or 587 with "starttls" and 25 with "none"
+	Port int `json:"port"`
+	// "tls" (the default), "starttls", or "none" for a server on this machine
+	Security string `json:"security"`
+}
+
+func (s *ImapSettings) address() string {
+	port := s.Port
+	if port == 0 {
+		port = 993
+		if strings.EqualFold(s.Security, "starttls") || strings.EqualFold(s.Security, "none") {
+			port = 143
+		}
+	}
+	return net.JoinHostPort(s.Host, strconv.Itoa(port))
+}
+
+func (s *SmtpSettings) address() string {
+	port := s.Port
+	if port == 0 {
+		switch strings.ToLower(s.Security) {
+		case "starttls":
+			port = 587
+		case "none":
+			port = 25
+		default:
+			port = 465
+		}
+	}
+	return net.JoinHostPort(s.Host, strconv.Itoa(port))
+}
+
+func (s *ImapSettings) mailboxes() []string {
+	if len(s.Mailboxes) == 0 {
+		return []string{"INBOX"}
+	}
+	return s.Mailboxes
+}
+
+// Identifies a message by mailbox, UIDVALIDITY and UID, written the way IMAP
+// URLs (RFC 5092) do: INBOX;UIDVALIDITY=385759045/;UID=20. The mailbox is
+// kept in its encoded form.
+type imapMessageId struct {
+	mailbox     string
+	uidValidity uint32
+	uid         uint32
+}
+
+func (id imapMessageId) String() string {
+	return fmt.Sprintf("%s;UIDVALIDITY=%d/;UID=%d", id.mailbox, id.uidValidity, id.uid)
+}
+
+func parseImapMessageId(id string) (imapMessageId, error) {
+	i := strings.LastIndex(id, ";UIDVALIDITY=")
+	if i < 0 {
+		return imapMessageId{}, fmt.Errorf("invalid IMAP message ID \"%v\"", id)
+	}
+	validity, uid, found := strings.Cut(id[i+len(";UIDVALIDITY="):], "/;UID=")
+	if !found {
+		return imapMessageId{}, fmt.Errorf("invalid IMAP message ID \"%v\"", id)
+	}
+
+	parsedValidity, err := strconv.ParseUint(validity, 10, 32)
+	if err != nil {
+		return imapMessageId{}, fmt.Errorf("invalid IMAP message ID \"%v\"", id)
+	}
+	parsedUid, err := strconv.ParseUint(uid, 10, 32)
+	if err != nil || parsedUid == 0 {
+		return imapMessageId{}, fmt.Errorf("invalid IMAP message ID \"%v\"", id)
+	}
+	return imapMessageId{id[:i], uint32(parsedValidity), uint32(parsedUid)}, nil
+}
+
+// Provider for any IMAP server. It holds a single connection, so calls are
+// serialized however many workers make them.
+type imapProvider struct {
+	mu       sync.Mutex
+	conn     *imapConn
+	profile  *Profile
+	settings *ImapSettings
+	password string
+	ctx      context.Context
+	// stops closing the connection when ctx is cancelled
+	stop func() bool
+	// encoded names of the trash and drafts mailboxes, once found
+	trash  string
+	drafts string
+	// follows unsubscribe links; it carries no credentials
+	web *http.Client
+}
+
+// Connects and logs in to the profile's IMAP server. Cancelling ctx closes the
+// connection, failing any command in flight.
+func newImapProvider(ctx context.Context, profile *Profile) (*imapProvider, error) {
+	settings := profile.Settings.Imap
+	if settings.Host == "" {
+		return nil, fmt.Errorf("the IMAP settings of profile \"%v\" have no host", profile.Name)
+	}
+
+	username := settings.Username
+	if username == "" {
+		username = profile.Settings.Address
+	}
+	if username == "" {
+		return nil, fmt.Errorf("the IMAP settings of profile \"%v\" need a username, or the profile an address", profile.Name)
+	}
+
+	passwordEnv := settings.PasswordEnv
+	if passwordEnv == "" {
+		passwordEnv = defaultImapPasswordEnv
+	}
+	password := os.Getenv(passwordEnv)
+	if password == "" {
+		return nil, fmt.Errorf("set %v to the IMAP password of profile \"%v\"", passwordEnv, profile.Name)
+	}
+
+	web, err := newWebClient(profile)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := dialImap(ctx, settings.address(), settings.Security)
+	if err != nil {
+		return nil, err
+	}
+	if err := conn.login(username, password); err != nil {
+		conn.conn.Close()
+		return nil, explain(err)
+	}
+
+	return &imapProvider{
+		conn:     conn,
+		profile:  profile,
+		settings: settings,
+		password: password,
+		ctx:      ctx,
+		stop:     context.AfterFunc(ctx, func() { conn.conn.Close() }),
+		web:      web,
+	}, nil
+}
+
+func (p *imapProvider) username() string {
+	if p.settings.Username != "" {
+		return p.settings.Username
+	}
+	return p.profile.Settings.Address
+}
+
+// Searches each configured mailbox for messages from the senders. IMAP servers
+// match FROM as a substring, so results still need verifySenders before
+// anything destructive.
+func (p *imapProvider) ListBySender(senderAddresses []string, filter *Query, maxResults int) ([]string, error) {
+	if len(senderAddresses) == 0 {
+		return nil, nil
+	}
+
+	filterKeys, err := imapSearchKeys(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	addresses, domains := splitSenders(senderAddresses)
+	var senderKeys [][]interface{}
+	for _, address := range addresses {
+		senderKeys = append(senderKeys, []interface{}{"FROM", imapQuote(address)})
+	}
+	for _, domain := range domains {
+		senderKeys = append(senderKeys, []interface{}{"FROM", imapQuote("@" + domain)})
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var messages []string
+mailboxes:
+	for _, mailbox := range p.settings.mailboxes() {
+		encoded := encodeMailboxName(mailbox)
+		if err := p.conn.selectMailbox(encoded); err != nil {
+			return nil, err
+		}
+
+		seen := make(map[uint32]struct{})
+		var uids []uint32
+		for start := 0; start < len(senderKeys); start += imapSendersPerSearch {
+			end := min(start+imapSendersPerSearch, len(senderKeys))
+			keys := append([]interface{}{"UNDELETED"}, filterKeys...)
+			keys = append(keys, orKeys(senderKeys[start:end])...)
+
+			found, err := p.conn.search(keys)
+			if err != nil {
+				return nil, err
+			}
+			for _, uid := range found {
+				if _, ok := seen[uid]; !ok {
+					seen[uid] = struct{}{}
+					uids = append(uids, uid)
+				}
+			}
+		}
+
+		// UIDs grow with arrival, so the highest are the newest
+		sort.Slice(uids, func(i, j int) bool { return uids[i] > uids[j] })
+		for _, uid := range uids {
+			messages = append(messages, imapMessageId{encoded, p.conn.uidValidity, uid}.String())
+			if maxResults > 0 && len(messages) >= maxResults {
+				break mailboxes
+			}
+		}
+	}
+
+	fmt.Printf("Number of emails found: %v\n", len(messages))
+
+	return messages, nil
+}
+
+func (p *imapProvider) FetchHeaders(msgIds []string, headers ...string) []messageResult {
+	results := make([]messageResult, len(msgIds))
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	groups, mailboxes := p.groupByMailbox(msgIds, func(i int, err error) {
+		results[i] = messageResult{id: msgIds[i], err: err}
+	})
+
+	for _, mailbox := range mailboxes {
+		group := groups[mailbox]
+		for _, indices := range chunkIndices(group.indices, imapChunkSize) {
+			uids := make([]uint32, len(indices))
+			for j, i := range indices {
+				uids[j] = group.ids[i].uid
+			}
+
+			blocks, err := p.conn.fetchHeaders(uids, headers)
+			for j, i := range indices {
+				results[i].id = msgIds[i]
+				if err != nil {
+					results[i].err = err
+					continue
+				}
+
+				block, found := blocks[uids[j]]
+				if !found {
+					results[i].err = &ImapError{"UID FETCH", "NO", "NONEXISTENT", fmt.Sprintf("message %v no longer exists", msgIds[i])}
+					continue
+				}
+				results[i].message = parseHeaderBlock(block, headers)
+			}
+		}
+	}
+
+	return results
+}
+
+func (p *imapProvider) Trash(msgIds []string) Outcomes {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	trash, err := p.trashMailbox()
+	if err != nil {
+		return failAll(msgIds, err)
+	}
+	return p.moveTo(msgIds, trash, "Moved to trash")
+}
+
+// Moves trashed messages to the first configured mailbox; IMAP keeps no record
+// of where a message was before it was trashed.
+func (p *imapProvider) Restore(msgIds []string) Outcomes {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.moveTo(msgIds, encodeMailboxName(p.settings.mailboxes()[0]), "Restored")
+}
+
+func (p *imapProvider) Delete(msgIds []string) Outcomes {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.applyByMailbox(msgIds, "Permanently deleted", "", func(uids []uint32) (*copyUid, error) {
+		return nil, p.conn.delete(uids)
+	})
+}
+
+func (p *imapProvider) Move(msgIds []string, mailbox string) Outcomes {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.moveTo(msgIds, encodeMailboxName(mailbox), fmt.Sprintf("Moved to %v", mailbox))
+}
+
+func (p *imapProvider) moveTo(msgIds []string, destination string, label string) Outcomes {
+	return p.applyByMailbox(msgIds, label, destination, func(uids []uint32) (*copyUid, error) {
+		return p.conn.move(uids, destination)
+	})
+}
+
+// Messages of one mailbox, in the order they were given.
+type mailboxGroup struct {
+	// positions in the original list, and the parsed ID at each
+	indices []int
+	ids     map[int]imapMessageId
+}
+
+// Groups messages by mailbox. IDs that do not parse, or whose mailbox cannot
+// be selected or has been rebuilt since they were listed, are passed to fail
+// and left out. Mailboxes are returned in order of first appearance.
+func (p *imapProvider) groupByMailbox(msgIds []string, fail func(i int, err error)) (map[string]*mailboxGroup, []string) {
+	groups := make(map[string]*mailboxGroup)
+	var mailboxes []string
+
+	for i, msgId := range msgIds {
+		id, err := parseImapMessageId(msgId)
+		if err != nil {
+			fail(i, err)
+			continue
+		}
+		group, found := groups[id.mailbox]
+		if !found {
+			group = &mailboxGroup{ids: make(map[int]imapMessageId)}
+			groups[id.mailbox] = group
+			mailboxes = append(mailboxes, id.mailbox)
+		}
+		group.indices = append(group.indices, i)
+		group.ids[i] = id
+	}
+
+	var usable []string
+	for _, mailbox := range mailboxes {
+		group := groups[mailbox]
+		if err := p.conn.selectMailbox(mailbox); err != nil {
+			for _, i := range group.indices {
+				fail(i, err)
+			}
+			continue
+		}
+
+		// UIDs only hold while UIDVALIDITY does
+		var valid []int
+		for _, i := range group.indices {
+			if group.ids[i].uidValidity != p.conn.uidValidity {
+				fail(i, &ImapError{"SELECT", "NO", "NONEXISTENT", fmt.Sprintf("mailbox %v was rebuilt since message %v was listed", decodeMailboxName(mailbox), msgIds[i])})
+				continue
+			}
+			valid = append(valid, i)
+		}
+		group.indices = valid
+		if len(valid) > 0 {
+			usable = append(usable, mailbox)
+		}
+	}
+
+	return groups, usable
+}
+
+// Calls apply with the UIDs of each mailbox's messages, at most imapChunkSize
+// at a time, and records an outcome for every message. Messages a call moved
+// are named by their ID in destination when the server reported it. As with
+// applyInChunks, once a call fails in a way every later call would too
+// (rejected credentials, a dropped connection), the rest fail without being
+// sent.
+func (p *imapProvider) applyByMailbox(msgIds []string, label string, destination string, apply func(uids []uint32) (*copyUid, error)) Outcomes {
+	progress := newProgress(label, len(msgIds))
+	outcomes := make(Outcomes, len(msgIds))
+	for i, msgId := range msgIds {
+		outcomes[i].Item = msgId
+	}
+
+	groups, mailboxes := p.groupByMailbox(msgIds, func(i int, err error) {
+		outcomes[i].Err = err
+		progress.fail(1)
+	})
+
+	var stopErr error
+	for _, mailbox := range mailboxes {
+		group := groups[mailbox]
+
+		for _, indices := range chunkIndices(group.indices, imapChunkSize) {
+			if stopErr != nil {
+				for _, i := range indices {
+					outcomes[i].Err = fmt.Errorf("not sent after an earlier failure: %w", stopErr)
+				}
+				progress.fail(len(indices))
+				continue
+			}
+
+			// a chunk may span several selections when a stop was not needed
+			if err := p.conn.selectMailbox(mailbox); err != nil {
+				for _, i := range indices {
+					outcomes[i].Err = err
+				}
+				progress.fail(len(indices))
+				continue
+			}
+
+			uids := make([]uint32, len(indices))
+			for j, i := range indices {
+				uids[j] = group.ids[i].uid
+			}
+
+			copied, err := apply(uids)
+			if err != nil {
+				for _, i := range indices {
+					outcomes[i].Err = err
+				}
+				progress.fail(len(indices))
+
+				if _, isImapErr := asImapError(err); !isImapErr || IsAuth(err) {
+					stopErr = err
+				}
+				continue
+			}
+
+			for j, i := range indices {
+				if copied != nil {
+					if newUid, found := copied.uids[uids[j]]; found {
+						outcomes[i].Item = imapMessageId{destination, copied.uidValidity, newUid}.String()
+					}
+				}
+			}
+			progress.add(len(indices))
+		}
+	}
+
+	return outcomes
+}
+
+// Finds the trash through the configured name, its \Trash attribute or a name
+// commonly used for it.
+func (p *imapProvider) trashMailbox() (string, error) {
+	return p.specialMailbox(&p.trash, p.settings.Trash, `\Trash`, trashMailboxNames, "trash")
+}
+
+func (p *imapProvider) draftsMailbox() (string, error) {
+	return p.specialMailbox(&p.drafts, p.settings.Drafts, `\Drafts`, draftsMailboxNames, "drafts")
+}
+
+// Finds a special-use mailbox (RFC 6154) and remembers it in found.
+func (p *imapProvider) specialMailbox(found *string, configured string, attribute string, names []string, setting string) (string, error) {
+	if *found != "" {
+		return *found, nil
+	}
+	if configured != "" {
+		*found = encodeMailboxName(configured)
+		return *found, nil
+	}
+
+	mailboxes, err := p.conn.list()
+	if err != nil {
+		return "", err
+	}
+	for _, mailbox := range mailboxes {
+		if mailbox.hasAttribute(attribute) {
+			*found = mailbox.name
+			return *found, nil
+		}
+	}
+	for _, name := range names {
+		for _, mailbox := range mailboxes {
+			if strings.EqualFold(decodeMailboxName(mailbox.name), name) {
+				*found = mailbox.name
+				return *found, nil
+			}
+		}
+	}
+
+	return "", fmt.Errorf("could not find the %v mailbox of profile \"%v\"; name it in the \"%v\" IMAP setting", setting, p.profile.Name, setting)
+}
+
+// Sends the unsubscribe request through the profile's SMTP server, or saves it
+// to the drafts mailbox when draft is set.
+func (p *imapProvider) UnsubscribeByMailtoAddress(mailto unsubscribeTarget, draft bool) error {
+	from := p.senderAddress()
+	message, err := buildUnsubscribeEmail(from, mailto, time.Now())
+	if err != nil {
+		return err
+	}
+
+	if !draft {
+		return p.sendMail(from.Address, mailto.addresses, message)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	drafts, err := p.draftsMailbox()
+	if err != nil {
+		return err
+	}
+	return p.conn.appendMessage(drafts, []string{`\Draft`, `\Seen`}, message)
+}
+
+// The profile's send-as alias, address or IMAP username, in that order.
+func (p *imapProvider) senderAddress() *mail.Address {
+	for _, address := range []string{p.profile.Settings.SendAs, p.profile.Settings.Address} {
+		if address != "" {
+			return &mail.Address{Address: address}
+		}
+	}
+	return &mail.Address{Address: p.username()}
+}
+
+func (p *imapProvider) UnsubscribeByHttpAddress(link unsubscribeTarget, oneClick bool) (int, error) {
+	return unsubscribeByHttpAddress(p.ctx, p.web, link, oneClick)
+}
+
+func (p *imapProvider) sendMail(from string, to []string, message []byte) error {
+	settings := p.settings.Smtp
+	if settings == nil {
+		return fmt.Errorf("profile \"%v\" has no SMTP server to send the unsubscribe email through", p.profile.Name)
+	}
+
+	client, err := dialSmtp(p.ctx, settings)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	if ok, _ := client.Extension("AUTH"); ok {
+		if err := client.Auth(smtp.PlainAuth("", p.username(), p.password, settings.Host)); err != nil {
+			return fmt.Errorf("error authenticating to SMTP server: %v", err.Error())
+		}
+	}
+	if err := client.Mail(from); err != nil {
+		return fmt.Errorf("error sending email from %v: %v", from, err.Error())
+	}
+	for _, recipient := range to {
+		if err := client.Rcpt(recipient); err != nil {
+			return fmt.Errorf("error sending email to %v: %v", recipient, err.Error())
+		}
+	}
+
+	w, err := client.Data()
+	if err != nil {
+		return fmt.Errorf("error sending email: %v", err.Error())
+	}
+	if _, err := w.Write(message); err != nil {
+		return fmt.Errorf("error sending email: %v", err.Error())
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("error sending email: %v", err.Error())
+	}
+
+	return client.Quit()
+}
+
+func dialSmtp(ctx context.Context, settings *SmtpSettings) (*smtp.Client, error) {
+	address := settings.address()
+	dialer := &net.Dialer{Timeout: imapDialTimeout}
+
+	switch strings.ToLower(settings.Security) {
+	case "", "tls":
+		tlsDialer := &tls.Dialer{NetDialer: dialer, Config: &tls.Config{ServerName: settings.Host}}
+		conn, err := tlsDialer.DialContext(ctx, "tcp", address)
+		if err != nil {
+			return nil, fmt.Errorf("error connecting to SMTP server %v: %v", address, err.Error())
+		}
+		return smtp.NewClient(conn, settings.Host)
+	case "starttls", "none":
+		if strings.EqualFold(settings.Security, "none") && !isLoopback(settings.Host) {
+			return nil, fmt.Errorf("refusing to send SMTP credentials to %v without TLS; use \"tls\" or \"starttls\"", settings.Host)
+		}
+
+		conn, err := dialer.DialContext(ctx, "tcp", address)
+		if err != nil {
+			return nil, fmt.Errorf("error connecting to SMTP server %v: %v", address, err.Error())
+		}
+		client, err := smtp.NewClient(conn, settings.Host)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		if strings.EqualFold(settings.Security, "starttls") {
+			if err := client.StartTLS(&tls.Config{ServerName: settings.Host}); err != nil {
+				client.Close()
+				return nil, fmt.Errorf("error negotiating TLS with %v: %v", address, err.Error())
+			}
+		}
+		return client, nil
+	}
+	return nil, fmt.Errorf("unknown SMTP security \"%v\", expected \"tls\", \"starttls\" or \"none\"", settings.Security)
+}
+
+func (p *imapProvider) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.stop()
+	return p.conn.logout()
+}
+
+// ORs search keys together. OR takes exactly two keys, so longer lists nest:
+// OR a OR b c.
+func orKeys(keys [][]interface{}) []interface{} {
+	if len(keys) == 1 {
+		return keys[0]
+	}
+	or := append([]interface{}{"OR"}, keys[0]...)
+	return append(or, orKeys(keys[1:])...)
+}
+
+// Translates the terms of a Query into IMAP search keys. Labels, categories and
+// attachments have no IMAP equivalent; they are rejected rather than dropped,
+// since dropping a term would widen the selection.
+func imapSearchKeys(query *Query) ([]interface{}, error) {
+	if query == nil {
+		return nil, nil
+	}
+	if query.err != nil {
+		return nil, query.err
+	}
+
+	var keys []interface{}
+	for _, term := range query.terms {
+		negated := strings.HasPrefix(term, "-")
+		name, value, _ := strings.Cut(strings.TrimPrefix(term, "-"), ":")
+		value = strings.Trim(value, "\"")
+
+		var key []interface{}
+		switch {
+		case name == "subject":
+			key = []interface{}{"SUBJECT", imapQuote(value)}
+		case name == "older_than" || name == "newer_than":
+			since, err := periodStart(value)
+			if err != nil {
+				return nil, err
+			}
+			key = []interface{}{"BEFORE", since.Format(imapDateLayout)}
+			if name == "newer_than" {
+				key[0] = "SINCE"
+			}
+		case name == "larger":
+			key = []interface{}{"LARGER", value}
+		case name == "smaller":
+			key = []interface{}{"SMALLER", value}
+		case name == "is" && value == "unread":
+			key = []interface{}{"UNSEEN"}
+		case name == "is" && value == "starred":
+			key = []interface{}{"FLAGGED"}
+		default:
+			return nil, fmt.Errorf("\"%v\" cannot be searched for over IMAP", term)
+		}
+
+		if negated {
+			key = append([]interface{}{"NOT"}, key...)
+		}
+		keys = append(keys, key...)
+	}
+	return keys, nil
+}
+
+// Start of a period such as "90d", "6m" or "1y" counted back from now.
+func periodStart(period string) (time.Time, error) {
+	if !periodPattern.MatchString(period) {
+		return time.Time{}, fmt.Errorf("invalid period \"%v\", expected a count followed by d, m or y", period)
+	}
+	count, _ := strconv.Atoi(period[:len(period)-1])
+
+	now := time.Now()
+	switch period[len(period)-1] {
+	case 'd':
+		return now.AddDate(0, 0, -count), nil
+	case 'm':
+		return now.AddDate(0, -count, 0), nil
+	}
+	return now.AddDate(-count, 0, 0), nil
+}
+
+// Turns a header block as returned by BODY[HEADER.FIELDS (...)] into the
+// payload Gmail would have returned for the same headers.
+func parseHeaderBlock(block string, headers []string) *messagePayload {
+	header, err := textproto.NewReader(bufio.NewReader(strings.NewReader(block + "\r\n"))).ReadMIMEHeader()
+	if err != nil && err != io.EOF {
+		header = textproto.MIMEHeader{}
+	}
+
+	decoder := new(mime.WordDecoder)
+	var payload messagePayload
+	for _, name := range headers {
+		for _, value := range header.Values(name) {
+			if decoded, err := decoder.DecodeHeader(value); err == nil {
+				value = decoded
+			}
+			payload.Payload.Headers = append(payload.Payload.Headers, messageHeader{name, value})
+		}
+	}
+	return &payload
+}
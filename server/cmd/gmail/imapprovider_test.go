@@ -0,0 +1,351 @@
+package gmail
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+
+	"gmail-organizer/cmd/gmail/imaptest"
+)
+
+// Connects a provider to the fake server, searching the given mailboxes.
+func newTestImapProvider(t *testing.T, srv *imaptest.Server, mailboxes ...string) *imapProvider {
+	t.Helper()
+	t.Setenv(defaultImapPasswordEnv, "secret")
+	profile := &Profile{Name: "imap", Dir: t.TempDir(), Settings: ProfileSettings{
+		Address: "me@example.com",
+		Imap:    &ImapSettings{Host: "127.0.0.1", Port: srv.Port(), Security: "none", Mailboxes: mailboxes},
+	}}
+
+	p, err := newImapProvider(context.Background(), profile)
+	if err != nil {
+		t.Fatalf("newImapProvider: %v", err)
+	}
+	t.Cleanup(func() { p.Close() })
+	return p
+}
+
+func newImapTestServer(t *testing.T) *imaptest.Server {
+	srv := imaptest.NewServer("me@example.com", "secret")
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func addImapFrom(srv *imaptest.Server, mailbox, from string, flags ...string) uint32 {
+	return srv.AddMessage(mailbox, imaptest.Message{Headers: []imaptest.Header{{Name: "From", Value: from}, {Name: "Subject", Value: "hello"}}, Flags: flags})
+}
+
+func countCommands(srv *imaptest.Server, name string) int {
+	count := 0
+	for _, command := range srv.Commands() {
+		if command == name {
+			count++
+		}
+	}
+	return count
+}
+
+func uidsOf(messages []imaptest.Message) []uint32 {
+	uids := make([]uint32, len(messages))
+	for i, message := range messages {
+		uids[i] = message.Uid
+	}
+	return uids
+}
+
+func parseIds(t *testing.T, ids []string) []imapMessageId {
+	t.Helper()
+	parsed := make([]imapMessageId, len(ids))
+	for i, id := range ids {
+		var err error
+		if parsed[i], err = parseImapMessageId(id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return parsed
+}
+
+func TestImapListBySenderChunksSenders(t *testing.T) {
+	srv := newImapTestServer(t)
+	var senders []string
+	for i := 0; i < 2*imapSendersPerSearch+20; i++ {
+		senders = append(senders, fmt.Sprintf("sender%03d@list.example", i))
+	}
+	first := addImapFrom(srv, "INBOX", "First <sender000@list.example>")
+	addImapFrom(srv, "INBOX", "friend@example.org")
+	middle := addImapFrom(srv, "INBOX", "sender060@list.example")
+	// FROM matches substrings, so the display name alone gets it listed
+	spoofed := addImapFrom(srv, "INBOX", `"sender005@list.example" <phish@evil.example>`)
+	last := addImapFrom(srv, "INBOX", "Last <SENDER119@LIST.EXAMPLE>")
+	addImapFrom(srv, "INBOX", "sender000@list.example", `\Deleted`)
+
+	p := newTestImapProvider(t, srv)
+	ids, err := p.ListBySender(senders, nil, 0)
+	if err != nil {
+		t.Fatalf("ListBySender: %v", err)
+	}
+
+	var uids []uint32
+	for _, id := range parseIds(t, ids) {
+		if id.mailbox != "INBOX" {
+			t.Errorf("listed %v outside INBOX", id)
+		}
+		uids = append(uids, id.uid)
+	}
+	if want := []uint32{last, spoofed, middle, first}; fmt.Sprint(uids) != fmt.Sprint(want) {
+		t.Errorf("listed UIDs %v, want %v newest first", uids, want)
+	}
+	if searches := countCommands(srv, "UID SEARCH"); searches != 3 {
+		t.Errorf("ran %d searches for %d senders, want 3", searches, len(senders))
+	}
+
+	verified, mismatches, err := verifySenders(p, ids, senders)
+	if err != nil {
+		t.Fatalf("verifySenders: %v", err)
+	}
+	if len(verified) != 3 || len(mismatches) != 1 || !strings.Contains(mismatches[0].from, "phish@evil.example") {
+		t.Errorf("verifySenders kept %v and excluded %v, want the spoofed message excluded", verified, mismatches)
+	}
+}
+
+func TestImapListBySenderAcrossMailboxes(t *testing.T) {
+	srv := newImapTestServer(t)
+	srv.AddMailbox("Archive")
+	addImapFrom(srv, "INBOX", "news@shop.example")
+	archived := addImapFrom(srv, "Archive", "Shop <news@shop.example>", `\Seen`)
+	addImapFrom(srv, "Archive", "deals@shop.example")
+
+	p := newTestImapProvider(t, srv, "INBOX", "Archive")
+
+	ids, err := p.ListBySender([]string{"@shop.example"}, nil, 0)
+	if err != nil || len(ids) != 3 {
+		t.Fatalf("ListBySender = %v, %v; want 3 messages", ids, err)
+	}
+
+	ids, err = p.ListBySender([]string{"@shop.example"}, NewQuery().IsUnread(), 0)
+	if err != nil {
+		t.Fatalf("ListBySender unread: %v", err)
+	}
+	for _, id := range parseIds(t, ids) {
+		if id.mailbox == "Archive" && id.uid == archived {
+			t.Errorf("listed the read message %v", id)
+		}
+	}
+	if len(ids) != 2 {
+		t.Errorf("listed %v, want the 2 unread messages", ids)
+	}
+
+	ids, err = p.ListBySender([]string{"news@shop.example", "deals@shop.example"}, nil, 1)
+	if err != nil || len(ids) != 1 {
+		t.Fatalf("ListBySender with a limit = %v, %v; want 1 message", ids, err)
+	}
+	if id := parseIds(t, ids)[0]; id.mailbox != "INBOX" {
+		t.Errorf("limited listing returned %v, want the first mailbox's newest", id)
+	}
+
+	if _, err := p.ListBySender([]string{"news@shop.example"}, NewQuery().Label("Receipts"), 0); err == nil {
+		t.Error("a label filter was accepted over IMAP")
+	}
+}
+
+func TestImapFetchHeaders(t *testing.T) {
+	srv := newImapTestServer(t)
+	uid := srv.AddMessage("INBOX", imaptest.Message{Headers: []imaptest.Header{
+		{Name: "From", Value: "=?UTF-8?Q?Caf=C3=A9?= <news@cafe.example>"},
+		{Name: "Subject", Value: "menu"},
+		{Name: "List-Unsubscribe", Value: "<mailto:leave@cafe.example>,\r\n <https://cafe.example/u>"},
+	}})
+	gone := addImapFrom(srv, "INBOX", "old@cafe.example")
+
+	p := newTestImapProvider(t, srv)
+	ids, err := p.ListBySender([]string{"@cafe.example"}, nil, 0)
+	if err != nil || len(ids) != 2 {
+		t.Fatalf("ListBySender = %v, %v", ids, err)
+	}
+	idOf := make(map[uint32]string)
+	for i, id := range parseIds(t, ids) {
+		idOf[id.uid] = ids[i]
+	}
+	if outcomes := p.Delete([]string{idOf[gone]}); outcomes.Err() != nil {
+		t.Fatal(outcomes.Err())
+	}
+
+	stale := imapMessageId{"INBOX", 1, uid}.String()
+	results := p.FetchHeaders([]string{idOf[uid], idOf[gone], "not an id", stale}, "From", "List-Unsubscribe")
+
+	if results[0].err != nil {
+		t.Fatalf("FetchHeaders: %v", results[0].err)
+	}
+	if from := headerValue(results[0].message, "From"); from != "Café <news@cafe.example>" {
+		t.Errorf("From = %q, want it decoded", from)
+	}
+	if value := headerValue(results[0].message, "List-Unsubscribe"); !strings.Contains(value, "https://cafe.example/u") {
+		t.Errorf("List-Unsubscribe = %q, want it unfolded", value)
+	}
+	if headerValue(results[0].message, "Subject") != "" {
+		t.Error("returned a header that was not asked for")
+	}
+	if !IsNotFound(results[1].err) {
+		t.Errorf("deleted message: error = %v, want not found", results[1].err)
+	}
+	if results[2].err == nil {
+		t.Error("an invalid ID was fetched")
+	}
+	if !IsNotFound(results[3].err) {
+		t.Errorf("ID from an older UIDVALIDITY: error = %v, want not found", results[3].err)
+	}
+	for i, result := range results {
+		if result.id == "" {
+			t.Errorf("result %d has no ID", i)
+		}
+	}
+}
+
+func TestImapTrashAndRestore(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		disable  []string
+		commands []string
+		// whether the trashed messages can be named in the trash
+		copyUid bool
+	}{
+		{"move", nil, []string{"UID MOVE"}, true},
+		{"copy without move", []string{"MOVE"}, []string{"UID COPY", "UID STORE", "UID EXPUNGE"}, true},
+		{"copy without move or uidplus", []string{"MOVE", "UIDPLUS"}, []string{"UID COPY", "UID STORE"}, false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			srv := newImapTestServer(t)
+			for _, capability := range test.disable {
+				srv.Disable(capability)
+			}
+			addImapFrom(srv, "INBOX", "news@shop.example")
+			addImapFrom(srv, "INBOX", "news@shop.example")
+			kept := addImapFrom(srv, "INBOX", "friend@example.org")
+
+			p := newTestImapProvider(t, srv)
+			ids, err := p.ListBySender([]string{"news@shop.example"}, nil, 0)
+			if err != nil || len(ids) != 2 {
+				t.Fatalf("ListBySender = %v, %v", ids, err)
+			}
+
+			outcomes := p.Trash(ids)
+			if err := outcomes.Err(); err != nil {
+				t.Fatalf("Trash: %v", err)
+			}
+			for _, command := range test.commands {
+				if countCommands(srv, command) == 0 {
+					t.Errorf("trashing did not use %v", command)
+				}
+			}
+			if trash := srv.Messages("Trash"); len(trash) != 2 {
+				t.Errorf("trash holds %d messages, want 2", len(trash))
+			}
+
+			// the originals are gone, or at least no longer listed
+			if remaining, _ := p.ListBySender([]string{"news@shop.example"}, nil, 0); len(remaining) != 0 {
+				t.Errorf("still listed %v after trashing", remaining)
+			}
+			var inbox []uint32
+			for _, message := range srv.Messages("INBOX") {
+				if !strings.Contains(strings.Join(message.Flags, " "), `\Deleted`) {
+					inbox = append(inbox, message.Uid)
+				}
+			}
+			if fmt.Sprint(inbox) != fmt.Sprint([]uint32{kept}) {
+				t.Errorf("INBOX holds %v, want only %v", inbox, kept)
+			}
+
+			trashed := outcomes.Succeeded()
+			if !test.copyUid {
+				// without COPYUID the messages keep their old IDs, which undo cannot use
+				if fmt.Sprint(trashed) != fmt.Sprint(ids) {
+					t.Errorf("outcomes name %v, want the original IDs %v", trashed, ids)
+				}
+				return
+			}
+
+			trashUids := uidsOf(srv.Messages("Trash"))
+			var named []uint32
+			for _, id := range parseIds(t, trashed) {
+				if id.mailbox != "Trash" {
+					t.Errorf("trashed message named %v, want an ID in Trash", id)
+				}
+				named = append(named, id.uid)
+			}
+			sort.Slice(named, func(i, j int) bool { return named[i] < named[j] })
+			if fmt.Sprint(named) != fmt.Sprint(trashUids) {
+				t.Errorf("outcomes name UIDs %v, trash holds %v", named, trashUids)
+			}
+
+			if outcomes := p.Restore(trashed); outcomes.Err() != nil {
+				t.Fatalf("Restore: %v", outcomes.Err())
+			}
+			if restored, _ := p.ListBySender([]string{"news@shop.example"}, nil, 0); len(restored) != 2 {
+				t.Errorf("listed %v after restoring, want 2 messages", restored)
+			}
+			for _, message := range srv.Messages("Trash") {
+				if !strings.Contains(strings.Join(message.Flags, " "), `\Deleted`) {
+					t.Errorf("message %v is still in the trash", message.Uid)
+				}
+			}
+		})
+	}
+}
+
+func TestImapDelete(t *testing.T) {
+	srv := newImapTestServer(t)
+	addImapFrom(srv, "INBOX", "spam@bulk.example")
+	// marked deleted by another client, and not ours to expunge
+	other := addImapFrom(srv, "INBOX", "friend@example.org", `\Deleted`)
+
+	p := newTestImapProvider(t, srv)
+	ids, _ := p.ListBySender([]string{"spam@bulk.example"}, nil, 0)
+	if outcomes := p.Delete(ids); outcomes.Err() != nil || len(outcomes.Succeeded()) != 1 {
+		t.Fatalf("Delete = %v", outcomes)
+	}
+
+	if inbox := uidsOf(srv.Messages("INBOX")); fmt.Sprint(inbox) != fmt.Sprint([]uint32{other}) {
+		t.Errorf("INBOX holds %v, want only the other client's %v", inbox, other)
+	}
+	if countCommands(srv, "EXPUNGE") != 0 {
+		t.Error("deleting ran a plain EXPUNGE")
+	}
+}
+
+func TestImapDeleteWithoutUidplus(t *testing.T) {
+	srv := newImapTestServer(t)
+	srv.Disable("UIDPLUS")
+	addImapFrom(srv, "INBOX", "spam@bulk.example")
+	addImapFrom(srv, "INBOX", "friend@example.org", `\Deleted`)
+
+	p := newTestImapProvider(t, srv)
+	ids, _ := p.ListBySender([]string{"spam@bulk.example"}, nil, 0)
+	outcomes := p.Delete(ids)
+	if err := outcomes.Err(); err == nil || !strings.Contains(err.Error(), "UIDPLUS") {
+		t.Errorf("Delete without UIDPLUS: error = %v", err)
+	}
+	if inbox := srv.Messages("INBOX"); len(inbox) != 2 {
+		t.Errorf("INBOX holds %d messages, want both untouched", len(inbox))
+	}
+	if countCommands(srv, "UID STORE")+countCommands(srv, "EXPUNGE") != 0 {
+		t.Error("refused deletion still changed the mailbox")
+	}
+}
+
+func TestImapTrashReportsFailures(t *testing.T) {
+	srv := newImapTestServer(t)
+	addImapFrom(srv, "INBOX", "news@shop.example")
+	srv.Fail("UID MOVE", 1)
+
+	p := newTestImapProvider(t, srv)
+	ids, _ := p.ListBySender([]string{"news@shop.example"}, nil, 0)
+	outcomes := p.Trash(append(ids, "not an id"))
+	if len(outcomes.Failed()) != 2 {
+		t.Errorf("Trash = %v, want both to fail", outcomes)
+	}
+	if _, isImapErr := asImapError(outcomes[0].Err); !isImapErr {
+		t.Errorf("error = %v, want the server's NO", outcomes[0].Err)
+	}
+}
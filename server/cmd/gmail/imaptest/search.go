@@ -0,0 +1,199 @@
+package imaptest
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// matches the message at sequence index i (zero based)
+type matcher func(i int, m *Message) bool
+
+// Parses search keys into a matcher that requires all of them.
+func (ss *session) parseSearch(args []interface{}) (matcher, error) {
+	var matchers []matcher
+	for len(args) > 0 {
+		var (
+			m   matcher
+			err error
+		)
+		m, args, err = ss.parseKey(args)
+		if err != nil {
+			return nil, err
+		}
+		matchers = append(matchers, m)
+	}
+
+	return func(i int, m *Message) bool {
+		for _, match := range matchers {
+			if !match(i, m) {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
+
+// Parses the first search key off args, returning the rest.
+func (ss *session) parseKey(args []interface{}) (matcher, []interface{}, error) {
+	if list, ok := args[0].([]interface{}); ok {
+		m, err := ss.parseSearch(list)
+		return m, args[1:], err
+	}
+
+	key := strings.ToUpper(text(args[0]))
+	args = args[1:]
+
+	// a key followed by one value
+	value := func() (string, error) {
+		if len(args) == 0 {
+			return "", fmt.Errorf("%s needs a value", key)
+		}
+		v := text(args[0])
+		args = args[1:]
+		return v, nil
+	}
+
+	flagKeys := map[string]struct {
+		flag string
+		set  bool
+	}{
+		"ANSWERED": {`\Answered`, true}, "UNANSWERED": {`\Answered`, false},
+		"DELETED": {`\Deleted`, true}, "UNDELETED": {`\Deleted`, false},
+		"DRAFT": {`\Draft`, true}, "UNDRAFT": {`\Draft`, false},
+		"FLAGGED": {`\Flagged`, true}, "UNFLAGGED": {`\Flagged`, false},
+		"SEEN": {`\Seen`, true}, "UNSEEN": {`\Seen`, false},
+	}
+	if flag, found := flagKeys[key]; found {
+		return func(_ int, m *Message) bool { return m.hasFlag(flag.flag) == flag.set }, args, nil
+	}
+
+	switch key {
+	case "ALL":
+		return func(int, *Message) bool { return true }, args, nil
+	case "NEW", "RECENT", "OLD":
+		// nothing is ever recent here
+		return func(int, *Message) bool { return key == "OLD" }, args, nil
+	case "NOT":
+		if len(args) == 0 {
+			return nil, nil, fmt.Errorf("NOT needs a key")
+		}
+		m, rest, err := ss.parseKey(args)
+		if err != nil {
+			return nil, nil, err
+		}
+		return func(i int, msg *Message) bool { return !m(i, msg) }, rest, nil
+	case "OR":
+		if len(args) == 0 {
+			return nil, nil, fmt.Errorf("OR needs two keys")
+		}
+		left, rest, err := ss.parseKey(args)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(rest) == 0 {
+			return nil, nil, fmt.Errorf("OR needs two keys")
+		}
+		right, rest, err := ss.parseKey(rest)
+		if err != nil {
+			return nil, nil, err
+		}
+		return func(i int, msg *Message) bool { return left(i, msg) || right(i, msg) }, rest, nil
+	case "FROM", "TO", "CC", "BCC", "SUBJECT":
+		v, err := value()
+		if err != nil {
+			return nil, nil, err
+		}
+		name := strings.ToLower(key[:1]) + strings.ToLower(key[1:])
+		return func(_ int, m *Message) bool { return contains(m.Header(name), v) }, args, nil
+	case "HEADER":
+		name, err := value()
+		if err != nil {
+			return nil, nil, err
+		}
+		v, err := value()
+		if err != nil {
+			return nil, nil, err
+		}
+		return func(_ int, m *Message) bool {
+			for _, header := range m.Headers {
+				if strings.EqualFold(header.Name, name) && contains(header.Value, v) {
+					return true
+				}
+			}
+			return false
+		}, args, nil
+	case "BODY":
+		v, err := value()
+		if err != nil {
+			return nil, nil, err
+		}
+		return func(_ int, m *Message) bool { return contains(m.Body, v) }, args, nil
+	case "TEXT":
+		v, err := value()
+		if err != nil {
+			return nil, nil, err
+		}
+		return func(_ int, m *Message) bool { return contains(m.raw(), v) }, args, nil
+	case "BEFORE", "SINCE", "ON":
+		v, err := value()
+		if err != nil {
+			return nil, nil, err
+		}
+		day, err := time.Parse("2-Jan-2006", v)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid date %s", v)
+		}
+		return func(_ int, m *Message) bool {
+			date := m.Date.UTC().Truncate(24 * time.Hour)
+			switch key {
+			case "BEFORE":
+				return date.Before(day)
+			case "SINCE":
+				return !date.Before(day)
+			}
+			return date.Equal(day)
+		}, args, nil
+	case "LARGER", "SMALLER":
+		v, err := value()
+		if err != nil {
+			return nil, nil, err
+		}
+		size, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid size %s", v)
+		}
+		return func(_ int, m *Message) bool {
+			if key == "LARGER" {
+				return len(m.raw()) > size
+			}
+			return len(m.raw()) < size
+		}, args, nil
+	case "UID":
+		v, err := value()
+		if err != nil {
+			return nil, nil, err
+		}
+		set, err := ss.messageSet(v, true)
+		if err != nil {
+			return nil, nil, err
+		}
+		return func(_ int, m *Message) bool { _, found := set[m.Uid]; return found }, args, nil
+	}
+
+	// anything else must be a sequence set
+	if key != "" && strings.Trim(key, "0123456789:,*") == "" {
+		set, err := ss.messageSet(key, false)
+		if err != nil {
+			return nil, nil, err
+		}
+		return func(_ int, m *Message) bool { _, found := set[m.Uid]; return found }, args, nil
+	}
+	return nil, nil, fmt.Errorf("unsupported search key %s", key)
+}
+
+// Case-insensitive substring match, as IMAP searches are.
+func contains(s, substr string) bool {
+	return strings.Contains(strings.ToLower(s), strings.ToLower(substr))
+}
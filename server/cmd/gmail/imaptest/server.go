@@ -0,0 +1,986 @@
+// Package imaptest provides an in-process IMAP server backed by in-memory
+// mailboxes, and an SMTP server that records what it is sent, so the
+// organizer's IMAP provider can be run without a real mail provider.
+//
+//	srv := imaptest.NewServer("me@example.com", "secret")
+//	defer srv.Close()
+//	srv.AddMessage("INBOX", imaptest.Message{Headers: []imaptest.Header{{"From", "news@shop.com"}}})
+//
+// and a profile pointing at it:
+//
+//	{"address": "me@example.com", "imap": {"host": "127.0.0.1", "port": <srv.Port()>, "security": "none"}}
+package imaptest
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/mail"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// mailbox hierarchy delimiter
+	delimiter = "/"
+	// marks messages to be removed by the next expunge
+	deletedFlag = `\Deleted`
+	seenFlag    = `\Seen`
+)
+
+var defaultCapabilities = []string{"IMAP4rev1", "UIDPLUS", "MOVE", "SPECIAL-USE"}
+
+type Header struct {
+	Name, Value string
+}
+
+// Message is a message in a fake mailbox. Fields left empty when seeding are
+// filled in by AddMessage.
+type Message struct {
+	Uid     uint32
+	Headers []Header
+	Body    string
+	Flags   []string
+	// the internal date, which BEFORE and SINCE search by
+	Date time.Time
+}
+
+// Returns the value of the first header with the given name, or "".
+func (m Message) Header(name string) string {
+	for _, header := range m.Headers {
+		if strings.EqualFold(header.Name, name) {
+			return header.Value
+		}
+	}
+	return ""
+}
+
+func (m *Message) hasFlag(flag string) bool {
+	for _, f := range m.Flags {
+		if strings.EqualFold(f, flag) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *Message) setFlag(flag string, set bool) {
+	if m.hasFlag(flag) == set {
+		return
+	}
+	if set {
+		m.Flags = append(m.Flags, flag)
+		return
+	}
+	var kept []string
+	for _, f := range m.Flags {
+		if !strings.EqualFold(f, flag) {
+			kept = append(kept, f)
+		}
+	}
+	m.Flags = kept
+}
+
+// The message as sent over the wire.
+func (m *Message) raw() string {
+	return m.header() + m.Body
+}
+
+func (m *Message) header() string {
+	var b strings.Builder
+	for _, header := range m.Headers {
+		fmt.Fprintf(&b, "%s: %s\r\n", header.Name, header.Value)
+	}
+	b.WriteString("\r\n")
+	return b.String()
+}
+
+// Only the named header lines, in message order, as HEADER.FIELDS returns them.
+func (m *Message) headerFields(names []string) string {
+	var b strings.Builder
+	for _, header := range m.Headers {
+		for _, name := range names {
+			if strings.EqualFold(header.Name, name) {
+				fmt.Fprintf(&b, "%s: %s\r\n", header.Name, header.Value)
+				break
+			}
+		}
+	}
+	b.WriteString("\r\n")
+	return b.String()
+}
+
+type mailbox struct {
+	name        string
+	attributes  []string
+	uidValidity uint32
+	uidNext     uint32
+	messages    []*Message
+}
+
+type failure struct {
+	command string
+	times   int
+}
+
+// Server is a fake IMAP server with a single account.
+type Server struct {
+	listener           net.Listener
+	username, password string
+
+	mu           sync.Mutex
+	mailboxes    map[string]*mailbox
+	order        []string
+	capabilities []string
+	failures     []*failure
+	commands     []string
+	conns        map[net.Conn]struct{}
+	wg           sync.WaitGroup
+}
+
+// Starts a fake server on a loopback port for the account username, which
+// logs in with password. It has an INBOX, a Trash marked \Trash and Drafts
+// marked \Drafts.
+func NewServer(username, password string) *Server {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(fmt.Sprintf("imaptest: failed to listen: %v", err))
+	}
+
+	s := &Server{
+		listener:     listener,
+		username:     username,
+		password:     password,
+		mailboxes:    make(map[string]*mailbox),
+		capabilities: append([]string{}, defaultCapabilities...),
+		conns:        make(map[net.Conn]struct{}),
+	}
+	s.AddMailbox("INBOX")
+	s.AddMailbox("Trash", `\Trash`)
+	s.AddMailbox("Drafts", `\Drafts`)
+
+	s.wg.Add(1)
+	go s.serve()
+	return s
+}
+
+// Address the server listens on, e.g. 127.0.0.1:54321.
+func (s *Server) Addr() string {
+	return s.listener.Addr().String()
+}
+
+func (s *Server) Port() int {
+	return s.listener.Addr().(*net.TCPAddr).Port
+}
+
+// Stops listening and drops every connection.
+func (s *Server) Close() {
+	s.listener.Close()
+	s.mu.Lock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+}
+
+// Adds an empty mailbox with the given attributes, such as \Archive. Adding a
+// mailbox that exists does nothing.
+func (s *Server) AddMailbox(name string, attributes ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, found := s.mailboxes[strings.ToUpper(name)]; found {
+		return
+	}
+	s.mailboxes[strings.ToUpper(name)] = &mailbox{
+		name:        name,
+		attributes:  attributes,
+		uidValidity: uint32(1000 + len(s.order)),
+		uidNext:     1,
+	}
+	s.order = append(s.order, name)
+}
+
+// Adds a message to a mailbox, creating the mailbox if needed, and returns its
+// UID. Messages without a date are dated one minute after the previous one.
+func (s *Server) AddMessage(mailboxName string, m Message) uint32 {
+	s.AddMailbox(mailboxName)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	mb := s.mailboxes[strings.ToUpper(mailboxName)]
+	if m.Date.IsZero() {
+		count := 0
+		for _, other := range s.mailboxes {
+			count += len(other.messages)
+		}
+		m.Date = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC).Add(time.Duration(count+1) * time.Minute)
+	}
+	if m.Header("Date") == "" {
+		m.Headers = append(m.Headers, Header{"Date", m.Date.Format(time.RFC1123Z)})
+	}
+	m.Headers = append([]Header{}, m.Headers...)
+	m.Flags = append([]string{}, m.Flags...)
+	return mb.add(&m)
+}
+
+func (mb *mailbox) add(m *Message) uint32 {
+	m.Uid = mb.uidNext
+	mb.uidNext++
+	mb.messages = append(mb.messages, m)
+	return m.Uid
+}
+
+// Returns copies of the messages in a mailbox, in UID order.
+func (s *Server) Messages(mailboxName string) []Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	mb, found := s.mailboxes[strings.ToUpper(mailboxName)]
+	if !found {
+		return nil
+	}
+	messages := make([]Message, len(mb.messages))
+	for i, m := range mb.messages {
+		messages[i] = copyMessage(m)
+	}
+	return messages
+}
+
+func copyMessage(m *Message) Message {
+	c := *m
+	c.Headers = append([]Header{}, m.Headers...)
+	c.Flags = append([]string{}, m.Flags...)
+	return c
+}
+
+// Stops advertising and accepting a capability such as MOVE or UIDPLUS.
+func (s *Server) Disable(capability string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var kept []string
+	for _, c := range s.capabilities {
+		if !strings.EqualFold(c, capability) {
+			kept = append(kept, c)
+		}
+	}
+	s.capabilities = kept
+}
+
+// Makes the next times commands named command (e.g. "UID MOVE") fail with NO.
+func (s *Server) Fail(command string, times int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures = append(s.failures, &failure{strings.ToUpper(command), times})
+}
+
+// Returns the name of every command received so far, e.g. "UID SEARCH".
+func (s *Server) Commands() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string{}, s.commands...)
+}
+
+func (s *Server) hasCapability(capability string) bool {
+	for _, c := range s.capabilities {
+		if strings.EqualFold(c, capability) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		s.mu.Lock()
+		s.conns[conn] = struct{}{}
+		s.mu.Unlock()
+
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			newSession(s, conn).run()
+
+			s.mu.Lock()
+			delete(s.conns, conn)
+			s.mu.Unlock()
+			conn.Close()
+		}()
+	}
+}
+
+// An atom as opposed to a quoted string or literal, so that search keys and
+// flags can be told apart from the values they apply to.
+type atom string
+
+type session struct {
+	s             *Server
+	conn          net.Conn
+	r             *bufio.Reader
+	w             *bufio.Writer
+	authenticated bool
+	selected      *mailbox
+	readOnly      bool
+}
+
+func newSession(s *Server, conn net.Conn) *session {
+	return &session{s: s, conn: conn, r: bufio.NewReader(conn), w: bufio.NewWriter(conn)}
+}
+
+func (ss *session) run() {
+	ss.write("* OK [CAPABILITY %s] imaptest ready", strings.Join(ss.capabilities(), " "))
+	for {
+		args, err := ss.readLine()
+		if err != nil {
+			return
+		}
+		if len(args) < 2 {
+			ss.write("* BAD missing command")
+			continue
+		}
+
+		tag, _ := args[0].(atom)
+		name, _ := args[1].(atom)
+		command := strings.ToUpper(string(name))
+		args = args[2:]
+		if command == "UID" && len(args) > 0 {
+			sub, _ := args[0].(atom)
+			command += " " + strings.ToUpper(string(sub))
+			args = args[1:]
+		}
+
+		if !ss.handle(string(tag), command, args) {
+			return
+		}
+	}
+}
+
+func (ss *session) capabilities() []string {
+	ss.s.mu.Lock()
+	defer ss.s.mu.Unlock()
+	return append([]string{}, ss.s.capabilities...)
+}
+
+func (ss *session) write(format string, args ...interface{}) {
+	fmt.Fprintf(ss.w, format+"\r\n", args...)
+	ss.w.Flush()
+}
+
+// Handles one command, reporting whether the session goes on.
+func (ss *session) handle(tag, command string, args []interface{}) bool {
+	s := ss.s
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.commands = append(s.commands, command)
+	for _, f := range s.failures {
+		if f.times > 0 && f.command == command {
+			f.times--
+			ss.write("%s NO [SERVERBUG] injected failure", tag)
+			return true
+		}
+	}
+
+	switch command {
+	case "CAPABILITY":
+		ss.write("* CAPABILITY %s", strings.Join(s.capabilities, " "))
+		ss.write("%s OK CAPABILITY completed", tag)
+		return true
+	case "NOOP":
+		ss.write("%s OK NOOP completed", tag)
+		return true
+	case "LOGOUT":
+		ss.write("* BYE logging out")
+		ss.write("%s OK LOGOUT completed", tag)
+		return false
+	case "LOGIN":
+		if len(args) != 2 || text(args[0]) != s.username || text(args[1]) != s.password {
+			ss.write("%s NO [AUTHENTICATIONFAILED] Invalid credentials", tag)
+			return true
+		}
+		ss.authenticated = true
+		ss.write("%s OK LOGIN completed", tag)
+		return true
+	}
+
+	if !ss.authenticated {
+		ss.write("%s BAD log in first", tag)
+		return true
+	}
+
+	switch command {
+	case "LIST":
+		for _, name := range s.order {
+			mb := s.mailboxes[strings.ToUpper(name)]
+			ss.write("* LIST (%s) %q %q", strings.Join(mb.attributes, " "), delimiter, mb.name)
+		}
+		ss.write("%s OK LIST completed", tag)
+	case "SELECT", "EXAMINE":
+		ss.selectMailbox(tag, command, args)
+	case "APPEND":
+		ss.append(tag, args)
+	case "CLOSE", "UNSELECT":
+		if command == "CLOSE" && ss.selected != nil && !ss.readOnly {
+			ss.expunge(nil, false)
+		}
+		ss.selected = nil
+		ss.write("%s OK %s completed", tag, command)
+	case "SEARCH", "UID SEARCH", "FETCH", "UID FETCH", "STORE", "UID STORE", "COPY", "UID COPY", "MOVE", "UID MOVE", "EXPUNGE", "UID EXPUNGE":
+		if ss.selected == nil {
+			ss.write("%s BAD no mailbox selected", tag)
+			return true
+		}
+		ss.handleSelected(tag, command, args)
+	default:
+		ss.write("%s BAD unknown command %s", tag, command)
+	}
+	return true
+}
+
+func (ss *session) selectMailbox(tag, command string, args []interface{}) {
+	ss.selected = nil
+	if len(args) != 1 {
+		ss.write("%s BAD %s takes a mailbox", tag, command)
+		return
+	}
+	mb, found := ss.s.mailboxes[strings.ToUpper(text(args[0]))]
+	if !found {
+		ss.write("%s NO [NONEXISTENT] no mailbox %s", tag, text(args[0]))
+		return
+	}
+
+	ss.selected, ss.readOnly = mb, command == "EXAMINE"
+	ss.write(`* FLAGS (\Answered \Flagged \Deleted \Seen \Draft)`)
+	ss.write("* %d EXISTS", len(mb.messages))
+	ss.write("* 0 RECENT")
+	ss.write("* OK [UIDVALIDITY %d] UIDs valid", mb.uidValidity)
+	ss.write("* OK [UIDNEXT %d] predicted next UID", mb.uidNext)
+	if ss.readOnly {
+		ss.write("%s OK [READ-ONLY] EXAMINE completed", tag)
+	} else {
+		ss.write("%s OK [READ-WRITE] SELECT completed", tag)
+	}
+}
+
+// Adds a message given as "mailbox [(flags)] [date] literal".
+func (ss *session) append(tag string, args []interface{}) {
+	if len(args) < 2 {
+		ss.write("%s BAD APPEND takes a mailbox and a message", tag)
+		return
+	}
+	mb, found := ss.s.mailboxes[strings.ToUpper(text(args[0]))]
+	if !found {
+		ss.write("%s NO [TRYCREATE] no mailbox %s", tag, text(args[0]))
+		return
+	}
+
+	m := &Message{Date: time.Now()}
+	for _, arg := range args[1 : len(args)-1] {
+		if flags, ok := arg.([]interface{}); ok {
+			for _, flag := range flags {
+				m.Flags = append(m.Flags, text(flag))
+			}
+		} else if date, err := time.Parse("02-Jan-2006 15:04:05 -0700", text(arg)); err == nil {
+			m.Date = date
+		}
+	}
+
+	parsed, err := mail.ReadMessage(strings.NewReader(text(args[len(args)-1])))
+	if err != nil {
+		ss.write("%s BAD invalid message: %v", tag, err)
+		return
+	}
+	for name, values := range parsed.Header {
+		for _, value := range values {
+			m.Headers = append(m.Headers, Header{name, value})
+		}
+	}
+	sort.SliceStable(m.Headers, func(i, j int) bool { return m.Headers[i].Name < m.Headers[j].Name })
+	body, _ := io.ReadAll(parsed.Body)
+	m.Body = string(body)
+
+	uid := mb.add(m)
+	if ss.s.hasCapability("UIDPLUS") {
+		ss.write("%s OK [APPENDUID %d %d] APPEND completed", tag, mb.uidValidity, uid)
+		return
+	}
+	ss.write("%s OK APPEND completed", tag)
+}
+
+func (ss *session) handleSelected(tag, command string, args []interface{}) {
+	byUid := strings.HasPrefix(command, "UID ")
+	name := strings.TrimPrefix(command, "UID ")
+
+	if ss.readOnly && name != "SEARCH" && name != "FETCH" {
+		ss.write("%s NO [READ-ONLY] mailbox is read-only", tag)
+		return
+	}
+
+	switch name {
+	case "SEARCH":
+		ss.search(tag, command, byUid, args)
+	case "FETCH":
+		ss.fetch(tag, command, byUid, args)
+	case "STORE":
+		ss.store(tag, command, byUid, args)
+	case "COPY", "MOVE":
+		ss.copy(tag, command, byUid, args, name == "MOVE")
+	case "EXPUNGE":
+		if !byUid {
+			ss.expunge(nil, true)
+			ss.write("%s OK EXPUNGE completed", tag)
+			return
+		}
+		if !ss.s.hasCapability("UIDPLUS") || len(args) != 1 {
+			ss.write("%s BAD UID EXPUNGE not supported", tag)
+			return
+		}
+		set, err := ss.messageSet(text(args[0]), true)
+		if err != nil {
+			ss.write("%s BAD %v", tag, err)
+			return
+		}
+		ss.expunge(set, true)
+		ss.write("%s OK UID EXPUNGE completed", tag)
+	}
+}
+
+func (ss *session) search(tag, command string, byUid bool, args []interface{}) {
+	if len(args) >= 2 {
+		if key, ok := args[0].(atom); ok && strings.EqualFold(string(key), "CHARSET") {
+			args = args[2:]
+		}
+	}
+
+	matcher, err := ss.parseSearch(args)
+	if err != nil {
+		ss.write("%s BAD %v", tag, err)
+		return
+	}
+
+	var found []string
+	for i, m := range ss.selected.messages {
+		if matcher(i, m) {
+			if byUid {
+				found = append(found, strconv.FormatUint(uint64(m.Uid), 10))
+			} else {
+				found = append(found, strconv.Itoa(i+1))
+			}
+		}
+	}
+	if len(found) == 0 {
+		ss.write("* SEARCH")
+	} else {
+		ss.write("* SEARCH %s", strings.Join(found, " "))
+	}
+	ss.write("%s OK %s completed", tag, command)
+}
+
+func (ss *session) fetch(tag, command string, byUid bool, args []interface{}) {
+	if len(args) != 2 {
+		ss.write("%s BAD FETCH takes a set and items", tag)
+		return
+	}
+	set, err := ss.messageSet(text(args[0]), byUid)
+	if err != nil {
+		ss.write("%s BAD %v", tag, err)
+		return
+	}
+
+	items, ok := args[1].([]interface{})
+	if !ok {
+		items = []interface{}{args[1]}
+	}
+	if byUid && !hasItem(items, "UID") {
+		items = append([]interface{}{atom("UID")}, items...)
+	}
+
+	for i, m := range ss.selected.messages {
+		if _, found := set[m.Uid]; !found {
+			continue
+		}
+
+		var parts []string
+		for _, item := range items {
+			name := strings.ToUpper(text(item))
+			switch {
+			case name == "UID":
+				parts = append(parts, fmt.Sprintf("UID %d", m.Uid))
+			case name == "FLAGS":
+				parts = append(parts, fmt.Sprintf("FLAGS (%s)", strings.Join(m.Flags, " ")))
+			case name == "RFC822.SIZE":
+				parts = append(parts, fmt.Sprintf("RFC822.SIZE %d", len(m.raw())))
+			case name == "INTERNALDATE":
+				parts = append(parts, fmt.Sprintf("INTERNALDATE %q", m.Date.Format("02-Jan-2006 15:04:05 -0700")))
+			case strings.HasPrefix(name, "BODY[") || strings.HasPrefix(name, "BODY.PEEK["):
+				section := name[strings.IndexByte(name, '[')+1 : strings.LastIndexByte(name, ']')]
+				data, err := m.section(section)
+				if err != nil {
+					ss.write("%s BAD %v", tag, err)
+					return
+				}
+				if strings.HasPrefix(name, "BODY[") {
+					m.setFlag(seenFlag, true)
+				}
+				parts = append(parts, fmt.Sprintf("BODY[%s] {%d}\r\n%s", section, len(data), data))
+			default:
+				ss.write("%s BAD unsupported fetch item %s", tag, name)
+				return
+			}
+		}
+		ss.write("* %d FETCH (%s)", i+1, strings.Join(parts, " "))
+	}
+	ss.write("%s OK %s completed", tag, command)
+}
+
+func hasItem(items []interface{}, name string) bool {
+	for _, item := range items {
+		if strings.EqualFold(text(item), name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Contents of a BODY[section], for the sections the fake understands: the
+// whole message, HEADER, TEXT and HEADER.FIELDS (...).
+func (m *Message) section(section string) (string, error) {
+	switch {
+	case section == "":
+		return m.raw(), nil
+	case section == "HEADER":
+		return m.header(), nil
+	case section == "TEXT":
+		return m.Body, nil
+	case strings.HasPrefix(section, "HEADER.FIELDS ("):
+		names := strings.Fields(strings.TrimSuffix(strings.TrimPrefix(section, "HEADER.FIELDS ("), ")"))
+		return m.headerFields(names), nil
+	}
+	return "", fmt.Errorf("unsupported section %s", section)
+}
+
+func (ss *session) store(tag, command string, byUid bool, args []interface{}) {
+	if len(args) != 3 {
+		ss.write("%s BAD STORE takes a set, an operation and flags", tag)
+		return
+	}
+	set, err := ss.messageSet(text(args[0]), byUid)
+	if err != nil {
+		ss.write("%s BAD %v", tag, err)
+		return
+	}
+
+	operation := strings.ToUpper(text(args[1]))
+	silent := strings.HasSuffix(operation, ".SILENT")
+	operation = strings.TrimSuffix(operation, ".SILENT")
+
+	var flags []string
+	if list, ok := args[2].([]interface{}); ok {
+		for _, flag := range list {
+			flags = append(flags, text(flag))
+		}
+	} else {
+		flags = []string{text(args[2])}
+	}
+
+	for i, m := range ss.selected.messages {
+		if _, found := set[m.Uid]; !found {
+			continue
+		}
+		switch operation {
+		case "FLAGS":
+			m.Flags = append([]string{}, flags...)
+		case "+FLAGS", "-FLAGS":
+			for _, flag := range flags {
+				m.setFlag(flag, operation == "+FLAGS")
+			}
+		default:
+			ss.write("%s BAD unknown STORE operation %s", tag, operation)
+			return
+		}
+		if !silent {
+			ss.write("* %d FETCH (UID %d FLAGS (%s))", i+1, m.Uid, strings.Join(m.Flags, " "))
+		}
+	}
+	ss.write("%s OK %s completed", tag, command)
+}
+
+func (ss *session) copy(tag, command string, byUid bool, args []interface{}, move bool) {
+	if move && !ss.s.hasCapability("MOVE") {
+		ss.write("%s BAD MOVE not supported", tag)
+		return
+	}
+	if len(args) != 2 {
+		ss.write("%s BAD %s takes a set and a mailbox", tag, command)
+		return
+	}
+	set, err := ss.messageSet(text(args[0]), byUid)
+	if err != nil {
+		ss.write("%s BAD %v", tag, err)
+		return
+	}
+	destination, found := ss.s.mailboxes[strings.ToUpper(text(args[1]))]
+	if !found {
+		ss.write("%s NO [TRYCREATE] no mailbox %s", tag, text(args[1]))
+		return
+	}
+
+	var source, copied []string
+	for _, m := range ss.selected.messages {
+		if _, found := set[m.Uid]; !found {
+			continue
+		}
+		c := copyMessage(m)
+		c.setFlag(deletedFlag, false)
+		source = append(source, strconv.FormatUint(uint64(m.Uid), 10))
+		copied = append(copied, strconv.FormatUint(uint64(destination.add(&c)), 10))
+	}
+
+	code := ""
+	if len(source) > 0 && ss.s.hasCapability("UIDPLUS") {
+		code = fmt.Sprintf("[COPYUID %d %s %s] ", destination.uidValidity, strings.Join(source, ","), strings.Join(copied, ","))
+	}
+
+	if !move {
+		ss.write("%s OK %s%s completed", tag, code, command)
+		return
+	}
+
+	if code != "" {
+		ss.write("* OK %smoved", code)
+	}
+	ss.remove(set)
+	ss.write("%s OK %s completed", tag, command)
+}
+
+// Expunges the messages marked deleted, or only those in set when it is not
+// nil, announcing each removal when announce is set.
+func (ss *session) expunge(set map[uint32]struct{}, announce bool) {
+	deleted := make(map[uint32]struct{})
+	for _, m := range ss.selected.messages {
+		_, inSet := set[m.Uid]
+		if m.hasFlag(deletedFlag) && (set == nil || inSet) {
+			deleted[m.Uid] = struct{}{}
+		}
+	}
+	if announce {
+		ss.remove(deleted)
+	} else {
+		ss.drop(deleted)
+	}
+}
+
+// Removes messages from the selected mailbox with an EXPUNGE response for
+// each, highest sequence number first so the numbers stay valid.
+func (ss *session) remove(set map[uint32]struct{}) {
+	messages := ss.selected.messages
+	for i := len(messages) - 1; i >= 0; i-- {
+		if _, found := set[messages[i].Uid]; found {
+			ss.write("* %d EXPUNGE", i+1)
+		}
+	}
+	ss.drop(set)
+}
+
+func (ss *session) drop(set map[uint32]struct{}) {
+	var kept []*Message
+	for _, m := range ss.selected.messages {
+		if _, found := set[m.Uid]; !found {
+			kept = append(kept, m)
+		}
+	}
+	ss.selected.messages = kept
+}
+
+// Resolves a sequence set or, with byUid, a UID set such as "1:3,7,9:*" to the
+// UIDs it names in the selected mailbox.
+func (ss *session) messageSet(set string, byUid bool) (map[uint32]struct{}, error) {
+	messages := ss.selected.messages
+	uids := make(map[uint32]struct{})
+
+	var largest uint32
+	if byUid && len(messages) > 0 {
+		largest = messages[len(messages)-1].Uid
+	} else if !byUid {
+		largest = uint32(len(messages))
+	}
+
+	number := func(value string) (uint32, error) {
+		if value == "*" {
+			return largest, nil
+		}
+		n, err := strconv.ParseUint(value, 10, 32)
+		if err != nil || n == 0 {
+			return 0, fmt.Errorf("invalid set %s", set)
+		}
+		return uint32(n), nil
+	}
+
+	for _, part := range strings.Split(set, ",") {
+		from, to, isRange := strings.Cut(part, ":")
+		start, err := number(from)
+		if err != nil {
+			return nil, err
+		}
+		end := start
+		if isRange {
+			if end, err = number(to); err != nil {
+				return nil, err
+			}
+		}
+		if start > end {
+			start, end = end, start
+		}
+
+		for i, m := range messages {
+			n := uint32(i + 1)
+			if byUid {
+				n = m.Uid
+			}
+			if n >= start && n <= end {
+				uids[m.Uid] = struct{}{}
+			}
+		}
+	}
+	return uids, nil
+}
+
+// Reads one command line into atoms, strings (quoted or literal) and lists.
+// Literals are acknowledged with a continuation request before being read.
+func (ss *session) readLine() ([]interface{}, error) {
+	var stack [][]interface{}
+	current := []interface{}{}
+
+	for {
+		b, err := ss.r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+
+		switch b {
+		case ' ', '\r':
+		case '\n':
+			return current, nil
+		case '(':
+			stack = append(stack, current)
+			current = []interface{}{}
+		case ')':
+			if len(stack) == 0 {
+				return nil, fmt.Errorf("unbalanced parentheses")
+			}
+			list := current
+			current = append(stack[len(stack)-1], list)
+			stack = stack[:len(stack)-1]
+		case '"':
+			value, err := ss.readQuoted()
+			if err != nil {
+				return nil, err
+			}
+			current = append(current, value)
+		case '{':
+			value, err := ss.readLiteral()
+			if err != nil {
+				return nil, err
+			}
+			current = append(current, value)
+		default:
+			ss.r.UnreadByte()
+			value, err := ss.readAtom()
+			if err != nil {
+				return nil, err
+			}
+			current = append(current, atom(value))
+		}
+	}
+}
+
+func (ss *session) readQuoted() (string, error) {
+	var b strings.Builder
+	for {
+		c, err := ss.r.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		switch c {
+		case '"':
+			return b.String(), nil
+		case '\\':
+			if c, err = ss.r.ReadByte(); err != nil {
+				return "", err
+			}
+		}
+		b.WriteByte(c)
+	}
+}
+
+func (ss *session) readLiteral() (string, error) {
+	sizeText, err := ss.r.ReadString('}')
+	if err != nil {
+		return "", err
+	}
+	nonSync := strings.HasSuffix(sizeText, "+}")
+	size, err := strconv.Atoi(strings.TrimSuffix(strings.TrimSuffix(sizeText, "}"), "+"))
+	if err != nil || size < 0 {
+		return "", fmt.Errorf("invalid literal size %s", sizeText)
+	}
+	if _, err := ss.r.ReadString('\n'); err != nil {
+		return "", err
+	}
+	if !nonSync {
+		ss.write("+ ready for literal")
+	}
+
+	data := make([]byte, size)
+	if _, err := io.ReadFull(ss.r, data); err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// Reads an atom, keeping brackets together with what they enclose, as in
+// BODY.PEEK[HEADER.FIELDS (FROM)].
+func (ss *session) readAtom() (string, error) {
+	var b strings.Builder
+	depth := 0
+	for {
+		c, err := ss.r.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		if depth == 0 && (c == ' ' || c == '(' || c == ')' || c == '\r' || c == '\n') {
+			ss.r.UnreadByte()
+			return b.String(), nil
+		}
+		switch c {
+		case '[':
+			depth++
+		case ']':
+			depth--
+		}
+		b.WriteByte(c)
+	}
+}
+
+// The text of an atom or string argument.
+func text(arg interface{}) string {
+	switch arg := arg.(type) {
+	case atom:
+		return string(arg)
+	case string:
+		return arg
+	}
+	return ""
+}
@@ -0,0 +1,184 @@
+package imaptest
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+)
+
+// Mail is a message handed to the fake SMTP server.
+type Mail struct {
+	From string
+	To   []string
+	Data string
+}
+
+// SMTPServer is a fake submission server that records the mail it accepts.
+// It speaks plain SMTP, so profiles reach it with security "none".
+type SMTPServer struct {
+	listener           net.Listener
+	username, password string
+
+	mu   sync.Mutex
+	sent []Mail
+	wg   sync.WaitGroup
+}
+
+// Starts a fake SMTP server on a loopback port that accepts AUTH PLAIN with
+// the given credentials. Mail is only accepted after authenticating.
+func NewSMTPServer(username, password string) *SMTPServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(fmt.Sprintf("imaptest: failed to listen: %v", err))
+	}
+
+	s := &SMTPServer{listener: listener, username: username, password: password}
+	s.wg.Add(1)
+	go s.serve()
+	return s
+}
+
+func (s *SMTPServer) Addr() string {
+	return s.listener.Addr().String()
+}
+
+func (s *SMTPServer) Port() int {
+	return s.listener.Addr().(*net.TCPAddr).Port
+}
+
+func (s *SMTPServer) Close() {
+	s.listener.Close()
+	s.wg.Wait()
+}
+
+// Returns the mail accepted so far.
+func (s *SMTPServer) Sent() []Mail {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Mail{}, s.sent...)
+}
+
+func (s *SMTPServer) serve() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			defer conn.Close()
+			s.handle(conn)
+		}()
+	}
+}
+
+func (s *SMTPServer) handle(conn net.Conn) {
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+	reply := func(format string, args ...interface{}) {
+		fmt.Fprintf(w, format+"\r\n", args...)
+		w.Flush()
+	}
+
+	var (
+		authenticated bool
+		mail          Mail
+	)
+	reply("220 imaptest ESMTP ready")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		verb, arg, _ := strings.Cut(line, " ")
+
+		switch strings.ToUpper(verb) {
+		case "EHLO", "HELO":
+			reply("250-imaptest")
+			reply("250 AUTH PLAIN")
+		case "AUTH":
+			mechanism, initial, _ := strings.Cut(arg, " ")
+			if !strings.EqualFold(mechanism, "PLAIN") {
+				reply("504 unsupported mechanism")
+				continue
+			}
+			if initial == "" {
+				reply("334 ")
+				if initial, err = r.ReadString('\n'); err != nil {
+					return
+				}
+				initial = strings.TrimRight(initial, "\r\n")
+			}
+			decoded, err := base64.StdEncoding.DecodeString(initial)
+			parts := strings.Split(string(decoded), "\x00")
+			if err != nil || len(parts) != 3 || parts[1] != s.username || parts[2] != s.password {
+				reply("535 authentication failed")
+				continue
+			}
+			authenticated = true
+			reply("235 authenticated")
+		case "MAIL":
+			if !authenticated {
+				reply("530 authentication required")
+				continue
+			}
+			mail = Mail{From: address(arg)}
+			reply("250 OK")
+		case "RCPT":
+			if mail.From == "" {
+				reply("503 MAIL first")
+				continue
+			}
+			mail.To = append(mail.To, address(arg))
+			reply("250 OK")
+		case "DATA":
+			if len(mail.To) == 0 {
+				reply("503 RCPT first")
+				continue
+			}
+			reply("354 end with .")
+			var data strings.Builder
+			for {
+				line, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if strings.TrimRight(line, "\r\n") == "." {
+					break
+				}
+				// undo dot-stuffing
+				data.WriteString(strings.TrimPrefix(line, "."))
+			}
+			mail.Data = data.String()
+
+			s.mu.Lock()
+			s.sent = append(s.sent, mail)
+			s.mu.Unlock()
+			mail = Mail{}
+			reply("250 OK queued")
+		case "RSET":
+			mail = Mail{}
+			reply("250 OK")
+		case "NOOP":
+			reply("250 OK")
+		case "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("502 unknown command")
+		}
+	}
+}
+
+// The address in a MAIL FROM:<a> or RCPT TO:<a> argument.
+func address(arg string) string {
+	_, value, _ := strings.Cut(arg, ":")
+	value, _, _ = strings.Cut(strings.TrimSpace(value), " ")
+	return strings.Trim(value, "<>")
+}
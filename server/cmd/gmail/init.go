@@ -2,14 +2,16 @@ package gmail
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
-	"gmail-organizer/cmd/gpt"
 	"gmail-organizer/utils"
+	"io"
 	"log"
+	"net/mail"
 	"net/http"
 	"os"
 	"strings"
+	"sync"
 
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
@@ -19,6 +21,55 @@ import (
 
 type Client struct {
 	*http.Client
+	profile *Profile
+	// carried by every request, so cancelling it stops work in flight
+	ctx context.Context
+	// API root, e.g. https://gmail.googleapis.com
+	apiUrl string
+	// shared by copies, so the address is looked up once
+	identity *senderIdentity
+	// for third-party hosts; it never carries the account's credentials
+	web *http.Client
+}
+
+// The address unsubscribe emails are sent from, looked up on first use and
+// kept once a lookup succeeds.
+type senderIdentity struct {
+	mu      sync.Mutex
+	address *mail.Address
+}
+
+// Builds a client that sends the profile's requests to apiUrl through
+// httpClient as is, e.g. to call a gmailtest.Server directly. Third-party
+// requests go through a separate client that only reaches public addresses.
+func NewClient(httpClient *http.Client, profile *Profile, apiUrl string) *Client {
+	return &Client{httpClient, profile, context.Background(), strings.TrimSuffix(apiUrl, "/"), &senderIdentity{}, webClient(guardedTransport())}
+}
+
+// Returns a shallow copy of the client whose requests use ctx.
+func (c *Client) WithContext(ctx context.Context) *Client {
+	clone := *c
+	clone.ctx = ctx
+	return &clone
+}
+
+// Upper bound on concurrent per-sender and per-message calls. Every call still
+// waits on the mailbox's shared quota limiter.
+const DefaultWorkers = 8
+
+var workers = DefaultWorkers
+
+func SetWorkers(n int) {
+	if n > 0 {
+		workers = n
+	}
+}
+
+func (c *Client) context() context.Context {
+	if c.ctx == nil {
+		return context.Background()
+	}
+	return c.ctx
 }
 
 type UnsubscribeMessage struct {
@@ -26,53 +77,71 @@ type UnsubscribeMessage struct {
 	id string
 }
 
-type UnsubscribeSuccessList struct {
-	Address string
-	MessageId string
-	MailtoAddress string
-	HttpAddress string
-	SuccessMessage string
+// A sender's newest message together with its headers.
+type unsubscribeCandidate struct {
+	message UnsubscribeMessage
+	data *messagePayload
 }
 
-type UnsubscribeErrorList struct {
-	Address string
-	MessageId string
-	MailtoAddress string
-	HttpAddress string
-	ErrorMessage string
-}
+// Retrieve a token, saves the token, then returns the generated client. When the
+// stored token lacks a scope the operation needs, the user is offered a consent
+// prompt that adds it to the scopes already granted.
+func getClient(config *oauth2.Config, store CredentialStore, op operation) (*http.Client, error) {
+	ctx := context.Background()
 
-// Retrieve a token, saves the token, then returns the generated client.
-func getClient(config *oauth2.Config) *http.Client {
-	// The file token.json stores the user's access and refresh tokens, and is
-	// created automatically when the authorization flow completes for the first
+	// The credential store holds the user's access and refresh tokens, which are
+	// saved automatically when the authorization flow completes for the first
 	// time.
-	tokFile := "token.json"
-	tok, err := tokenFromFile(tokFile)
-	if err != nil {
+	tok, err := store.LoadToken()
+	if errors.Is(err, os.ErrNotExist) {
+					config.Scopes = op.scopes
 					tok = getTokenFromWeb(config)
-					saveToken(tokFile, tok)
+					saveToken(store, tok)
+	} else if err != nil {
+		// a wrong passphrase or a damaged file must not be replaced by a new grant
+		return nil, fmt.Errorf("unable to load stored token: %v", err.Error())
 	}
-	return config.Client(context.Background(), tok)
-}
 
-// Request a token from the web, then returns the retrieved token.
-func getTokenFromWeb(config *oauth2.Config) *oauth2.Token {
-	authURL := config.AuthCodeURL("state-token", oauth2.AccessTypeOffline)
-	fmt.Printf("Go to the following link in your browser then type the "+
-					"authorization code: \n%v\n", authURL)
-
-	err := utils.OpenURL(authURL)
+	src := newPersistingTokenSource(ctx, config, store, tok)
+	granted, err := src.grantedScopes()
 	if err != nil {
-		fmt.Printf("Failed to automatically open URL %s. Manually copy the link above.", authURL)
+		return nil, err
 	}
 
-	var authCode string
-	if _, err := fmt.Scan(&authCode); err != nil {
-					log.Fatalf("Unable to read authorization code: %v", err)
+	if missing := missingScopes(granted, op.scopes); len(missing) > 0 {
+		confirmationMsg := utils.ConfirmationMsg(fmt.Sprintf("\"%v\" needs access that has not been granted yet:\n- %v\nOpen the consent page to grant it?", op.name, strings.Join(missing, "\n- ")))
+		isConfirmed, err := confirmationMsg.AskForConfirmation()
+		if err != nil {
+			return nil, err
+		} else if !isConfirmed {
+			return nil, &insufficientScopeError{op.name, missing}
+		}
+
+		config.Scopes = unionScopes(granted, op.scopes)
+		tok = getTokenFromWeb(config)
+		saveToken(store, tok)
+
+		src = newPersistingTokenSource(ctx, config, store, tok)
+		granted, err = src.grantedScopes()
+		if err != nil {
+			return nil, err
+		}
+
+		// the consent screen lets users untick individual scopes
+		if missing := missingScopes(granted, op.scopes); len(missing) > 0 {
+			return nil, &insufficientScopeError{op.name, missing}
+		}
 	}
 
-	tok, err := config.Exchange(context.TODO(), authCode)
+	// a consent flow re-run after a revoked grant asks for everything held so far
+	config.Scopes = unionScopes(granted, op.scopes)
+
+	return oauth2.NewClient(ctx, src), nil
+}
+
+// Request a token from the web through a loopback redirect, then returns the retrieved token.
+func getTokenFromWeb(config *oauth2.Config) *oauth2.Token {
+	tok, err := tokenFromLoopback(context.Background(), config, utils.OpenURL, loopbackTimeout)
 	if err != nil {
 					log.Fatalf("Unable to retrieve token from web: %v", err)
 	}
@@ -86,200 +155,481 @@ func tokenFromFile(file string) (*oauth2.Token, error) {
 					return nil, err
 	}
 	defer f.Close()
-	tok := &oauth2.Token{}
-	err = json.NewDecoder(f).Decode(tok)
-	return tok, err
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	return unmarshalToken(data)
+}
+
+// Saves a token to the credential store.
+func saveToken(store CredentialStore, token *oauth2.Token) {
+	fmt.Println("Saving credentials")
+	if err := store.SaveToken(token); err != nil {
+					log.Fatalf("Unable to cache oauth token: %v", err)
+	}
 }
 
-// Saves a token to a file path.
-func saveToken(path string, token *oauth2.Token) {
-	fmt.Printf("Saving credential file to: %s\n", path)
+// Writes a token to a file path, readable only by the current user.
+func writeToken(path string, token *oauth2.Token) error {
 	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
 	if err != nil {
-					log.Fatalf("Unable to cache oauth token: %v", err)
+		return err
 	}
 	defer f.Close()
-	json.NewEncoder(f).Encode(token)
+
+	data, err := marshalToken(token)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	return err
 }
 
-func InitMessageRemoval(senderAddresses []string) {
-	client, _ := main()
+// Moves every message from the senders that also matches filter to the trash,
+// or deletes them for good when permanent is set. filter may narrow the
+// selection further (e.g. by category or age) and may be nil. Each run is
+// journaled so that trashed messages can be restored with Undo.
+func InitMessageRemoval(ctx context.Context, profile *Profile, senderAddresses []string, filter *Query, permanent bool) Summary {
+	op := trashOperation
+	if permanent {
+		op = deleteOperation
+	}
+	summary := Summary{Account: profile.Name, Operation: op.name}
+
+	provider, err := openProvider(ctx, profile, op)
+	if err != nil {
+		summary.Err = err
+		return summary
+	}
+	defer provider.Close()
+
+	if filter == nil {
+		filter = NewQuery()
+	}
+	// the selection as the journal records it
+	query := filter.Clone().FromSenders(senderAddresses)
+
+	messages, err := provider.ListBySender(senderAddresses, filter, 0)
+	if err != nil {
+		summary.Err = fmt.Errorf("could not successfully retrieve emails: %v", explain(err).Error())
+		return summary
+	}
+	summary.Processed = len(messages)
 
-	messages, err := client.ListMessagesFromSender(senderAddresses, 500)
+	messages, mismatches, err := verifySenders(provider, messages, senderAddresses)
 	if err != nil {
-		log.Fatalf("Could not successfully retrieve emails: %v", err.Error())
+		summary.Err = fmt.Errorf("could not verify senders: %v", explain(err).Error())
+		return summary
 	}
+	printSenderMismatches(mismatches)
+	summary.Skipped = len(mismatches)
 
 	if len(messages) > 0 {
-		// apiClient.RemoveMessages(messages)
-		
-		err := client.BatchPermanentlyDeleteMessages(messages)
-		if err != nil {
-			log.Fatalf("Could not successfully delete messages: %v", err.Error())
+		journal := newJournal(profile, permanent, senderAddresses, query, messages)
+		if err := journal.save(profile); err != nil {
+			summary.Err = fmt.Errorf("could not write journal, no messages were touched: %v", err.Error())
+			return summary
+		}
+
+		var outcomes Outcomes
+		if permanent {
+			outcomes = provider.Delete(messages)
+		} else {
+			outcomes = provider.Trash(messages)
+		}
+		outcomes.summarize(&summary)
+
+		// only what the server accepted can (or needs to) be undone, and under
+		// the IDs the messages have in the trash
+		journal.MessageIds = outcomes.Succeeded()
+		if err := journal.save(profile); err != nil {
+			fmt.Printf("Could not update journal %v: %v\n", journal.RunId, err.Error())
+		}
+
+		if permanent {
+			fmt.Printf("Run %v permanently deleted %v of %v messages.\n", journal.RunId, summary.Succeeded, len(messages))
+		} else if summary.Succeeded > 0 {
+			fmt.Printf("Run %v moved %v of %v messages to the trash. Restore them with: undo %v\n", journal.RunId, summary.Succeeded, len(messages), journal.RunId)
 		}
 	}
+
+	return summary
 }
 
-func InitTrashListUpdate(senderAddresses []string) {
-	client, _ := main()
+func InitTrashListUpdate(ctx context.Context, profile *Profile, senderAddresses []string) Summary {
+	summary := Summary{Account: profile.Name, Operation: trashListOperation.name}
 
-	trashList, err := client.RetrieveTrashList()
+	if profile.Settings.Imap != nil {
+		summary.Err = fmt.Errorf("the trash list is kept as Gmail filters, which IMAP mailboxes do not have")
+		return summary
+	}
+
+	client, _, err := main(profile, trashListOperation)
 	if err != nil {
+		summary.Err = err
+		return summary
+	}
+	client = client.WithContext(ctx)
+
+	trashList, err := client.RetrieveTrashList()
+	if IsAuth(err) || IsRateLimited(err) {
+		summary.Err = fmt.Errorf("could not retrieve trash list: %v", explain(err).Error())
+		return summary
+	} else if err != nil {
 		fmt.Printf("error occurred: %v", err.Error())
 	}
 
-	for i := 0; i < len(senderAddresses); i++ {
-		if _, found := trashList[senderAddresses[i]]; found {
-			continue
+	var pending []string
+	for _, senderAddress := range senderAddresses {
+		if _, found := trashList[senderAddress]; !found {
+			pending = append(pending, senderAddress)
+		}
+	}
+	summary.Processed = len(pending)
+
+	// every remaining sender would fail the same way, so stop handing them out
+	poolCtx, stop := context.WithCancel(ctx)
+	defer stop()
+	var stopErr error
+	var stopOnce sync.Once
+
+	results := utils.RunPool(poolCtx, pending, workers, func(ctx context.Context, senderAddress string) (*Filter, error) {
+		filter, err := client.WithContext(ctx).AssignSenderToTrashList(senderAddress)
+		if IsAuth(err) || IsRateLimited(err) {
+			stopOnce.Do(func() {
+				stopErr = err
+				stop()
+			})
+		}
+		return filter, err
+	})
+
+	for i, result := range results {
+		if IsFailedPrecondition(result.Err) {
+			// Gmail refuses to create a filter identical to an existing one
+			fmt.Printf("%v is already on the trash list\n", pending[i])
+			summary.Skipped++
+		} else if result.Err != nil {
+			fmt.Printf("Could not successfully assign %v to trash list: %v\n", pending[i], result.Err.Error())
+			summary.Failed++
+		} else {
+			fmt.Printf("Filtered successfully applied: %v\n", *result.Value)
+			summary.Succeeded++
 		}
+	}
 
-		filter, err := client.AssignSenderToTrashList(senderAddresses[i])
-		if err != nil {
-			log.Fatalf("Could not successfully assign senders to trash list: %v\n", err.Error())
+	if stopErr != nil {
+		summary.Err = fmt.Errorf("stopped assigning senders to trash list: %v", explain(stopErr).Error())
+	} else if ctx.Err() != nil {
+		summary.Err = ctx.Err()
+	}
+
+	return summary
+}
+
+// Finds the newest message from each sender, concurrently. Senders whose
+// listing failed are reported and left out.
+func latestMessages(ctx context.Context, provider Provider, senderAddresses []string) []UnsubscribeMessage {
+	listings := utils.RunPool(ctx, senderAddresses, workers, func(ctx context.Context, senderAddress string) ([]string, error) {
+		return provider.ListBySender([]string{senderAddress}, nil, 1)
+	})
+
+	var messages []UnsubscribeMessage
+	for i, listing := range listings {
+		if listing.Err != nil {
+			fmt.Printf("Could not successfully retrieve email from %s: %v\n", senderAddresses[i], listing.Err.Error())
+		}
+		if len(listing.Value) == 1 {
+			messages = append(messages, UnsubscribeMessage{senderAddresses[i], listing.Value[0]})
 		}
-		fmt.Printf("Filtered successfully applied: %v\n", *filter)
 	}
+	return messages
 }
 
-func InitUnsubscribeWithWebDriver(senderAddresses []string) {
-	client, _ := main()
+func InitUnsubscribeWithWebDriver(ctx context.Context, profile *Profile, senderAddresses []string) Summary {
+	summary := Summary{Account: profile.Name, Operation: webDriverOperation.name}
 
-	var messages []string
+	if profile.Settings.Imap != nil {
+		summary.Err = fmt.Errorf("unsubscribing through the browser needs Gmail's web interface, which IMAP mailboxes do not have")
+		return summary
+	}
 
-	for _, senderAddress := range senderAddresses {
-		retrievedMessages, err := client.ListMessagesFromSender([]string{senderAddress}, 1)
-		if err != nil {
-			fmt.Printf("Could not successfully retrieve email from %s: %v", senderAddress, err.Error())
-		}
-		messages = append(messages, retrievedMessages...)
+	client, _, err := main(profile, webDriverOperation)
+	if err != nil {
+		summary.Err = err
+		return summary
+	}
+	client = client.WithContext(ctx)
+
+	ledger, err := openLedger(profile)
+	if err != nil {
+		summary.Err = err
+		return summary
+	}
+	senderAddresses = ledger.pending(senderAddresses, &summary)
+
+	var messages []string
+	senders := make(map[string]string)
+	for _, message := range latestMessages(ctx, client, senderAddresses) {
+		messages = append(messages, message.id)
+		senders[message.id] = message.sender
 	}
+	summary.Processed = len(messages) + summary.Skipped
 
+	// a single browser session, so the clicking itself stays sequential
 	if len(messages) > 0 {
-		err := client.UnsubscribeWithWebDriver(messages)
+		outcomes, err := client.UnsubscribeWithWebDriver(messages)
+		outcomes.summarize(&summary)
+		for _, outcome := range outcomes {
+			if outcome.Err != nil {
+				fmt.Printf("Could not unsubscribe through the browser: %v\n", outcome.Err)
+				ledger.recordAttempt(senders[outcome.Item], outcome.Item, unsubscribeByBrowser, "", outcome.Err.Error(), unsubscribeFailed)
+			} else {
+				ledger.recordAttempt(senders[outcome.Item], outcome.Item, unsubscribeByBrowser, "", "clicked", unsubscribeSent)
+			}
+		}
+
+		// messages the browser never got to count as failed too
+		summary.Failed = summary.Processed - summary.Succeeded - summary.Skipped
 		if err != nil {
-			log.Fatalf("Could not unsubscribe: \n%s", err)
+			summary.Err = fmt.Errorf("could not unsubscribe: \n%s", err)
 		}
 	}
-}
 
-func InitUnsubscribe(senderAddresses []string) {
-	client, _ := main()
+	return summary
+}
 
-	var messages []UnsubscribeMessage
+func InitUnsubscribe(ctx context.Context, profile *Profile, senderAddresses []string) Summary {
+	op := unsubscribeOp()
+	summary := Summary{Account: profile.Name, Operation: op.name}
 
-	for _, senderAddress := range senderAddresses {
-		retrievedMessages, err := client.ListMessagesFromSender([]string{senderAddress}, 1)
-		if err != nil {
-			fmt.Printf("Could not successfully retrieve email from %s: %v", senderAddress, err.Error())
-		}
+	provider, err := openProvider(ctx, profile, op)
+	if err != nil {
+		summary.Err = err
+		return summary
+	}
+	defer provider.Close()
 
-		if len(retrievedMessages) == 1 {
-			messages = append(messages, UnsubscribeMessage{senderAddress, retrievedMessages[0]})
-		}
+	ledger, err := openLedger(profile)
+	if err != nil {
+		summary.Err = err
+		return summary
 	}
+	senderAddresses = ledger.pending(senderAddresses, &summary)
 
-	var successfulUnsubscribeList, webDriverUnsubscribeList, blockList []string
+	messages := latestMessages(ctx, provider, senderAddresses)
+	summary.Processed = len(messages) + summary.Skipped
 
-	for _, message := range messages {
+	var successfulUnsubscribeList, webDriverUnsubscribeList, blockList []string
 
-		// retrieve basic info regarding current sender
-		data, err := client.GetOriginalMessageById(message.id)
-		if err != nil {
-			log.Fatalf("error occurred: %v", err.Error())
+	// retrieve the headers of every sender's message, without bodies, in as few requests as possible
+	msgIds := make([]string, len(messages))
+	for i, message := range messages {
+		msgIds[i] = message.id
+	}
+	results := provider.FetchHeaders(msgIds, unsubscribeHeaders...)
+
+	var candidates []unsubscribeCandidate
+	for i, message := range messages {
+		data, err := results[i].message, results[i].err
+		if IsNotFound(err) {
+			// deleted since it was listed
+			fmt.Printf("Message %v from %v no longer exists, skipping\n", message.id, message.sender)
+			summary.Skipped++
+			continue
+		} else if err != nil {
+			summary.Err = fmt.Errorf("error occurred: %v", explain(err).Error())
+			return summary
 		}
-		headersList := data.Payload.Headers
+		candidates = append(candidates, unsubscribeCandidate{message, data})
+	}
+
+	attempts := utils.RunPool(ctx, candidates, workers, func(ctx context.Context, candidate unsubscribeCandidate) (struct{}, error) {
+		message := candidate.message
+		headersList := candidate.data.Payload.Headers
 
-		var unsubscribeMailtoAddress, unsubscribeHttpAddress string
+		var targets []unsubscribeTarget
+		var oneClick bool
 
 		for _, header := range headersList {
-			if header.Name == "List-Unsubscribe" {
-				unsubscribeAddresses := strings.Split(header.Value, ",")
-				if len(unsubscribeAddresses) > 1 {
-					if unsubscribeAddresses[0][1:8] == "mailto:" {
-						unsubscribeMailtoAddress = unsubscribeAddresses[0]
-						unsubscribeHttpAddress = unsubscribeAddresses[1]
-					} else {
-						unsubscribeMailtoAddress = unsubscribeAddresses[1]
-						unsubscribeHttpAddress = unsubscribeAddresses[0]
-					}
-				} else {
-					unsubscribeHttpAddress = unsubscribeAddresses[0]
-				}
+			if strings.EqualFold(header.Name, "List-Unsubscribe") {
+				targets = parseListUnsubscribe(header.Value)
+			} else if strings.EqualFold(header.Name, "List-Unsubscribe-Post") {
+				// RFC 8058 allows exactly this value
+				oneClick = strings.TrimSpace(header.Value) == oneClickBody
 			}
 		}
+		mailto, link := firstUnsubscribeTargets(targets)
 
 		// after obtaining basic info, attempt to unsubscribe
-		err = client.attemptUnsubscribeWithGoogleApi(unsubscribeMailtoAddress, unsubscribeHttpAddress, message.sender)
-		if err != nil {
-			webDriverUnsubscribeList = append(webDriverUnsubscribeList, message.sender)
+		return struct{}{}, attemptUnsubscribe(provider, ledger, message, mailto, link, oneClick)
+	})
+
+	for i, attempt := range attempts {
+		if attempt.Err != nil {
+			webDriverUnsubscribeList = append(webDriverUnsubscribeList, candidates[i].message.sender)
 		} else {
-			successfulUnsubscribeList = append(successfulUnsubscribeList, message.sender)
+			successfulUnsubscribeList = append(successfulUnsubscribeList, candidates[i].message.sender)
+		}
+	}
+
+	var webDriverSummary Summary
+	// the browser fallback works through Gmail's web interface only
+	if ctx.Err() == nil && profile.Settings.Imap == nil {
+		webDriverSummary = InitUnsubscribeWithWebDriver(ctx, profile, webDriverUnsubscribeList) // obtain blockList if unsuccessful
+		if webDriverSummary.Err != nil {
+			fmt.Printf("\n%v", webDriverSummary.Err)
 		}
 	}
-		
-	InitUnsubscribeWithWebDriver(webDriverUnsubscribeList) // obtain blockList if unsuccessful
 
-	fmt.Printf("\nInitiating blocking of following email address: %v", blockList)
-	InitTrashListUpdate(blockList);
+	if len(blockList) > 0 {
+		fmt.Printf("\nInitiating blocking of following email address: %v", blockList)
+		InitTrashListUpdate(ctx, profile, blockList);
+	}
 	
 	fmt.Printf("\nSuccessfully unsubscribed from the following email addresses: %v", successfulUnsubscribeList)
+
+	summary.Succeeded = len(successfulUnsubscribeList) + webDriverSummary.Succeeded
+	summary.Failed = summary.Processed - summary.Succeeded - summary.Skipped
+	if ctx.Err() != nil {
+		summary.Err = ctx.Err()
+	}
+	return summary
 }
 
-func (c *Client) attemptUnsubscribeWithGoogleApi(unsubscribeMailtoAddress string, unsubscribeHttpAddress string, sender string) error {
-	if unsubscribeMailtoAddress != "" {
-		err := c.UnsubscribeByMailtoAddress(unsubscribeMailtoAddress)
-		if err != nil {
-			c.attemptUnsubscribeWithGoogleApi("", unsubscribeHttpAddress, sender)
+// Tries the sender's List-Unsubscribe targets from most to least reliable: an
+// RFC 8058 one-click link, then the mailto address, then opening the link.
+// Every request made is recorded in the ledger.
+func attemptUnsubscribe(provider Provider, ledger *ledger, message UnsubscribeMessage, mailto *unsubscribeTarget, link *unsubscribeTarget, oneClick bool) error {
+	sender := message.sender
+
+	if oneClick && link != nil {
+		statusCode, err := provider.UnsubscribeByHttpAddress(*link, true)
+		recordHttpAttempt(ledger, message, unsubscribeByOneClick, *link, statusCode, err)
+		if err == nil {
+			return nil
 		}
-	} else if unsubscribeHttpAddress != "" {
-		msg, err := c.UnsubscribeByHttpAddress(unsubscribeHttpAddress)
-		if err != nil {
-			c.attemptUnsubscribeWithGoogleApi("", "", sender)
-		} else {
-			unsubscribed := gpt.DetermineUnsubscribeStatus(msg)
-			fmt.Printf("unsubscribed status: %v", unsubscribed)
-			if unsubscribed != "true" {
-				c.attemptUnsubscribeWithGoogleApi("", "", sender)
+		fmt.Printf("Could not unsubscribe %v with one click: %v\n", sender, err.Error())
+	}
+
+	if mailto != nil {
+		err := provider.UnsubscribeByMailtoAddress(*mailto, draftUnsubscribeEmails)
+		if err == nil {
+			if draftUnsubscribeEmails {
+				ledger.recordAttempt(sender, message.id, unsubscribeByMailto, mailto.uri, "saved as draft", unsubscribeDrafted)
+				fmt.Printf("Saved the unsubscribe email for %v as a draft; review and send it to finish\n", sender)
+			} else {
+				ledger.recordAttempt(sender, message.id, unsubscribeByMailto, mailto.uri, "sent", unsubscribeSent)
 			}
+			return nil
+		}
+		ledger.recordAttempt(sender, message.id, unsubscribeByMailto, mailto.uri, explain(err).Error(), unsubscribeFailed)
+		fmt.Printf("Could not send unsubscribe email for %v: %v\n", sender, explain(err).Error())
+	}
+
+	if !oneClick && link != nil {
+		statusCode, err := provider.UnsubscribeByHttpAddress(*link, false)
+		recordHttpAttempt(ledger, message, unsubscribeByHttp, *link, statusCode, err)
+		if err == nil {
+			return nil
+		}
+		fmt.Printf("Could not unsubscribe %v through its link: %v\n", sender, err.Error())
+	}
+
+	return fmt.Errorf("could not unsubscribe %s through its List-Unsubscribe header", sender)
+}
+
+func recordHttpAttempt(ledger *ledger, message UnsubscribeMessage, method unsubscribeMethod, link unsubscribeTarget, statusCode int, err error) {
+	outcome := fmt.Sprintf("HTTP %d", statusCode)
+	status := unsubscribeConfirmed
+	if err != nil {
+		status = unsubscribeErrorStatus(err)
+		if statusCode == 0 {
+			outcome = err.Error()
 		}
-	} else {
-		return fmt.Errorf("could not unsubscribe %s from through Google API", sender)
 	}
-	return nil
+	ledger.recordAttempt(message.sender, message.id, method, link.uri, outcome, status)
 }
 
-func main() (*Client, *gmail.Service) {
-	ctx := context.Background()
-	b, err := os.ReadFile("credentials.json")
+// Builds a client from the OAuth token in the profile's credential store,
+// running the consent flow when there is none.
+func getOAuthClient(profile *Profile, op operation) (*http.Client, error) {
+	store, err := newCredentialStore(profile)
 	if err != nil {
-					log.Fatalf("Unable to read client secret file: %v", err)
+		return nil, fmt.Errorf("unable to open credential store: %v", err.Error())
 	}
 
-	// If modifying these scopes, delete your previously saved token.json.
-	config, err := google.ConfigFromJSON(b, gmail.MailGoogleComScope, gmail.GmailSettingsBasicScope)
+	b, err := store.LoadCredentials()
 	if err != nil {
-					log.Fatalf("Unable to parse client secret file to config: %v", err)
+		return nil, fmt.Errorf("unable to read client secret file: %v", err.Error())
 	}
-	client := getClient(config)
 
-	srv, err := gmail.NewService(ctx, option.WithHTTPClient(client))
+	// scopes are settled by getClient once the stored token has been inspected
+	config, err := google.ConfigFromJSON(b)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse client secret file to config: %v", err.Error())
+	}
+
+	return getClient(config, store, op)
+}
+
+// Builds an API client for the profile that holds at least the scopes the
+// operation declares.
+func main(profile *Profile, op operation) (*Client, *gmail.Service, error) {
+	ctx := context.Background()
+	endpoint := currentEndpoint()
+
+	apiHost, err := endpoint.host()
 	if err != nil {
-					log.Fatalf("Unable to retrieve Gmail client: %v", err)
+		return nil, nil, err
+	}
+
+	if endpoint.Replay != "" {
+		endpoint.Transport, err = newReplayTransport(endpoint.Replay, profile)
+		if err != nil {
+			return nil, nil, err
+		}
 	}
 
-	user := "me"
-	r, err := srv.Users.Labels.List(user).Do()
+	var client *http.Client
+	if endpoint.Transport != nil {
+		// fake servers need no credentials
+		client = &http.Client{Transport: endpoint.Transport}
+	} else if profile.Settings.ServiceAccountKey != "" {
+		client, err = getServiceAccountClient(ctx, profile, op.scopes)
+	} else {
+		client, err = getOAuthClient(profile, op)
+	}
 	if err != nil {
-					log.Fatalf("Unable to retrieve labels: %v", err)
+		return nil, nil, err
+	}
+
+	// every request, including those made through the Gmail service, shares the
+	// mailbox's quota and is retried on rate limits and server errors
+	client = &http.Client{
+		Transport: newRetryTransport(client.Transport, limiterFor(profile), apiHost),
+		Timeout:   client.Timeout,
+	}
+
+	// outermost, so each exchange is recorded once whatever the retries
+	if endpoint.Record != "" {
+		rec, err := recorderFor(endpoint.Record, profile)
+		if err != nil {
+			return nil, nil, err
+		}
+		client.Transport = &recordingTransport{client.Transport, rec}
 	}
-	if len(r.Labels) == 0 {
-					fmt.Println("No labels found.")
-					return nil, nil
+
+	srv, err := gmail.NewService(ctx, option.WithHTTPClient(client), option.WithEndpoint(endpoint.Url+"/"))
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to retrieve Gmail client: %v", err.Error())
 	}
-	fmt.Println("Labels:")
-	for _, l := range r.Labels {
-					fmt.Printf("- %s\n", l.Name) // fmt.Printf("- %s: %s\n", l.Name, l.Id)
+
+	web, err := newWebClient(profile)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	return &Client{client}, srv
-}
\ No newline at end of file
+	return &Client{client, profile, ctx, endpoint.Url, &senderIdentity{}, web}, srv, nil
+}
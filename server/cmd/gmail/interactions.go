@@ -2,11 +2,14 @@ package gmail
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"net/mail"
 	"net/url"
 	"os"
 	"strconv"
@@ -41,12 +44,19 @@ type messageObj struct {
 
 type unmarshalledRes struct {
 	Messages []messageObj `json:"messages"`
+	NextPageToken string `json:"nextPageToken"`
 }
 
 type batchDeleteBody struct {
 	Ids []string `json:"ids"`
 }
 
+type batchModifyBody struct {
+	Ids []string `json:"ids"`
+	AddLabelIds []string `json:"addLabelIds,omitempty"`
+	RemoveLabelIds []string `json:"removeLabelIds,omitempty"`
+}
+
 type requestCreationError struct {
 	method, url, err string
 }
@@ -55,11 +65,66 @@ type requestExecutionError struct {
 	method, url, err string
 }
 
+// the body of an RFC 8058 one-click unsubscribe request
+const oneClickBody = "List-Unsubscribe=One-Click"
+
+// unsubscribeStatus classifies how a sender answered an unsubscribe request.
+type unsubscribeStatus string
+
+const (
+	unsubscribeConfirmed unsubscribeStatus = "confirmed"
+	// the link opened, but the page may still need a person to finish
+	unsubscribeUnconfirmed unsubscribeStatus = "unconfirmed"
+	// the link is no longer known to the sender (404, 410)
+	unsubscribeExpired unsubscribeStatus = "expired"
+	// the sender refused the request (any other 3xx or 4xx)
+	unsubscribeRejected unsubscribeStatus = "rejected"
+	// the sender could not take the request right now (429, 5xx)
+	unsubscribeUnavailable unsubscribeStatus = "unavailable"
+	// an email or Gmail's own button was used, which senders do not answer
+	unsubscribeSent unsubscribeStatus = "sent"
+	// the email was saved as a draft, and is not sent until the user does so
+	unsubscribeDrafted unsubscribeStatus = "drafted"
+	// the request could not be made, or got no answer
+	unsubscribeFailed unsubscribeStatus = "failed"
+)
+
+// An unsubscribe request that was answered, but not with a confirmation.
+type unsubscribeError struct {
+	method, url string
+	statusCode  int
+	status      unsubscribeStatus
+}
+
+type sendAs struct {
+	SendAsEmail        string `json:"sendAsEmail"`
+	DisplayName        string `json:"displayName"`
+	IsPrimary          bool   `json:"isPrimary"`
+	IsDefault          bool   `json:"isDefault"`
+	VerificationStatus string `json:"verificationStatus"`
+}
+
+type sendAsList struct {
+	SendAs []sendAs `json:"sendAs"`
+}
+
+type userProfile struct {
+	EmailAddress string `json:"emailAddress"`
+}
+
+type messageHeader struct {
+	Name string `json:"name"`
+	Value string `json:"value"`
+}
+
 type messagePayload struct {
-	Payload struct{Headers []struct{Name string `json:"name"`; Value string `json:"value"`} `json:"headers"`} `json:"payload"`
+	Payload struct{Headers []messageHeader `json:"headers"`} `json:"payload"`
 }
 
-const baseUrl = "https://gmail.googleapis.com/gmail/v1/users/me"
+const usersPath = "/gmail/v1/users"
+
+// Headers the unsubscribe and verification steps read from a message.
+var unsubscribeHeaders = []string{"From", "List-Unsubscribe", "List-Unsubscribe-Post", "List-Id", "Date", "Subject"}
 
 var (
 	chromeDriverPath 	string
@@ -76,72 +141,129 @@ func (r *requestExecutionError) Error() string {
  return fmt.Sprintf("error executing %v request for url \"%v\": %v", r.method, r.url, r.err)
 }
 
-func (c *Client) ListMessagesFromSender(senderAddresses []string, maxResults int) ([]string, error) {
-	query := senderAddresses[0]
-	for i := 1; i < len(senderAddresses); i++ {
-		query += fmt.Sprintf(" OR %v", senderAddresses[i])
+func (u *unsubscribeError) Error() string {
+	return fmt.Sprintf("%v request for url \"%v\" %v: HTTP %v", u.method, u.url, u.status, u.statusCode)
+}
+
+// Query asking messages.get for the metadata format, limited to the headers.
+func metadataQuery(headers []string) string {
+	query := url.Values{"format": {"metadata"}}
+	for _, header := range headers {
+		query.Add("metadataHeaders", header)
 	}
+	return query.Encode()
+}
+
+// URL of the profile's mailbox, e.g. https://gmail.googleapis.com/gmail/v1/users/me
+func (c *Client) userUrl() string {
+	return fmt.Sprintf("%s%s/%s", c.apiUrl, usersPath, url.PathEscape(c.profile.userId()))
+}
+
+// Lists messages matching the query, running each part separately when the
+// query had to be split. A maxResults of 0 or less walks every page of results.
+func (c *Client) ListMessages(query *Query, maxResults int) ([]string, error) {
+	queries, err := query.Build()
+	if err != nil {
+		return nil, fmt.Errorf("invalid query: %v", err.Error())
+	}
+
+	var messages []string
+	seen := make(map[string]struct{})
+
+	for _, q := range queries {
+		it := c.IterateMessages(q, maxResults - len(messages))
+		for it.Next() {
+			// split queries can overlap when a message matches several senders
+			if _, found := seen[it.Id()]; found {
+				continue
+			}
+			seen[it.Id()] = struct{}{}
+			messages = append(messages, it.Id())
+		}
+		if err := it.Err(); err != nil {
+			return nil, err
+		}
+
+		if maxResults > 0 && len(messages) >= maxResults {
+			break
+		}
+	}
+
+	fmt.Printf("Number of emails found: %v\n", len(messages))
+
+	return messages, nil
+}
+
+// Retrieves a single page of message IDs matching query, along with the token
+// for the next page ("" on the last page).
+func (c *Client) listMessagesPage(query string, pageSize int, pageToken string) ([]string, string, error) {
 	encodedQuery := url.QueryEscape(query)
 	
-	url := fmt.Sprintf("%s/messages?maxResults=%d&q=%s", baseUrl, maxResults, encodedQuery)
+	url := fmt.Sprintf("%s/messages?maxResults=%d&q=%s", c.userUrl(), pageSize, encodedQuery)
+	if pageToken != "" {
+		url += fmt.Sprintf("&pageToken=%s", pageToken)
+	}
 	reqMethod := "GET"
 
-	req, err := http.NewRequest(reqMethod, url, nil)
+	req, err := http.NewRequestWithContext(c.context(), reqMethod, url, nil)
 	if err != nil {
-		return nil, &requestCreationError{reqMethod, url, err.Error()}
+		return nil, "", &requestCreationError{reqMethod, url, err.Error()}
 	}
 
 	res, err := c.Do(req)
 	if err != nil {
-		return nil, &requestExecutionError{reqMethod, url, err.Error()}
+		return nil, "", &requestExecutionError{reqMethod, url, err.Error()}
 	}
 	defer res.Body.Close()
 
 	if res.StatusCode != http.StatusOK {
-    // body, _ := io.ReadAll(res.Body)
-    return nil, fmt.Errorf("HTTP status %v for url %v", res.Status, url)
+		return nil, "", newApiError(res)
 	}
 
 	body, err := io.ReadAll(res.Body)
 	if err != nil {
-		return nil, fmt.Errorf("error reading response body for url %v: %v", url, err.Error())
+		return nil, "", fmt.Errorf("error reading response body for url %v: %v", url, err.Error())
 	}
 
 	var unmarshalledRes unmarshalledRes
 
 	err = json.Unmarshal(body, &unmarshalledRes)
 	if err != nil {
-		return nil, fmt.Errorf("error unmarshalling JSON response for url %v: %v", url, err.Error())
+		return nil, "", fmt.Errorf("error unmarshalling JSON response for url %v: %v", url, err.Error())
 	}
 
-	fmt.Printf("Number of emails found: %v\n", len(unmarshalledRes.Messages))
-
 	messages := make([]string, len(unmarshalledRes.Messages))
 	for idx, message := range unmarshalledRes.Messages {
 		messages[idx] = message.Id
 	}
 
-	return messages, nil
+	return messages, unmarshalledRes.NextPageToken, nil
 }
 
-func (c *Client) UnsubscribeWithWebDriver(msgIds []string) error {
+// Clicks Gmail's own unsubscribe button for each message. The outcomes cover
+// the messages handled before any error that stopped the browser session.
+func (c *Client) UnsubscribeWithWebDriver(msgIds []string) (Outcomes, error) {
 	chromeDriverPath 	= os.Getenv("CHROME_DRIVER_PATH")
 	port             	= os.Getenv("WEB_DRIVER_PORT")
 	userDataDirectory = os.Getenv("CHROME_USER_DATA_DIRECTORY")
 	profile 				 	= os.Getenv("CHROME_PROFILE")
 
+	if c.profile.Settings.ChromeProfile != "" {
+		profile = c.profile.Settings.ChromeProfile
+	}
+
 	opts := []selenium.ServiceOption{
 		selenium.ChromeDriver(chromeDriverPath),
 	}
 
 	portInt, err := strconv.Atoi(port)
 	if err != nil {
-		return fmt.Errorf("error converting port string value to int: %s", err.Error())
+		return nil, fmt.Errorf("error converting port string value to int: %s", err.Error())
 	}
 
 	service, err := selenium.NewChromeDriverService(chromeDriverPath, portInt, opts...)
 	if err != nil {
-		return fmt.Errorf("error starting ChromeDriver server: %s", err.Error())
+		return nil, fmt.Errorf("error starting ChromeDriver server: %s", err.Error())
 	}
 	defer service.Stop()
 
@@ -162,7 +284,7 @@ func (c *Client) UnsubscribeWithWebDriver(msgIds []string) error {
 
 	wd, err := selenium.NewRemote(capabilities, fmt.Sprintf("http://localhost:%d/wd/hub", portInt))
 	if err != nil {
-		return fmt.Errorf("error connecting to WebDriver server: %s", err.Error())
+		return nil, fmt.Errorf("error connecting to WebDriver server: %s", err.Error())
 	}
 	defer func() {
 		if closeBrowser {
@@ -170,7 +292,7 @@ func (c *Client) UnsubscribeWithWebDriver(msgIds []string) error {
 		}
 	}()
 
-	var failedMsgIds []string
+	var outcomes Outcomes
 	newTabs := 0
 
 	for idx, msgId := range msgIds {
@@ -181,23 +303,27 @@ func (c *Client) UnsubscribeWithWebDriver(msgIds []string) error {
 
 		_, err := wd.ExecuteScript("window.open('about:blank','_blank');", nil)
 		if err != nil {
-			return fmt.Errorf("error opening new tab: %s", err.Error())
+			return outcomes, fmt.Errorf("error opening new tab: %s", err.Error())
 		}
 		
 		// Switch to the new tab
 		windowHandles, err = wd.WindowHandles()
 		if err != nil {
-			return fmt.Errorf("error getting window handles: %s", err.Error())
+			return outcomes, fmt.Errorf("error getting window handles: %s", err.Error())
 		}
 		
 		newTabHandle = windowHandles[len(windowHandles)-1]
 		if err := wd.SwitchWindow(newTabHandle); err != nil {
-			return fmt.Errorf("error switching to new tab: %s", err.Error())
+			return outcomes, fmt.Errorf("error switching to new tab: %s", err.Error())
 		}
 
 		messageUrl := fmt.Sprintf("https://mail.google.com/mail/u/0/#inbox/%s", msgId)
+		if c.profile.Settings.Address != "" {
+			// authuser picks the signed-in account regardless of its position in the account switcher
+			messageUrl = fmt.Sprintf("https://mail.google.com/mail/?authuser=%s#inbox/%s", url.QueryEscape(c.profile.Settings.Address), msgId)
+		}
 		if err := wd.Get(messageUrl); err != nil {
-			failedMsgIds = append(failedMsgIds, fmt.Sprintf("error navigating to URL for message ID %s: %s", msgId, err.Error()))
+			outcomes = append(outcomes, Outcome{msgId, fmt.Errorf("error navigating to URL for message ID %s: %s", msgId, err.Error())})
 			continue
 		}
 
@@ -206,13 +332,13 @@ func (c *Client) UnsubscribeWithWebDriver(msgIds []string) error {
 		xpath := `//span[contains(@class, 'Ca') and contains(text(), 'Unsubscribe')]`
 		elem, err := wd.FindElement(selenium.ByXPATH, xpath)
 		if err != nil {
-			failedMsgIds = append(failedMsgIds, fmt.Sprintf("error trying to find \"Unsubscribe\" span element for message ID %s: %s", msgId, err.Error()))
+			outcomes = append(outcomes, Outcome{msgId, fmt.Errorf("error trying to find \"Unsubscribe\" span element for message ID %s: %s", msgId, err.Error())})
 			closeBrowser = false
 			continue
 		}
 
 		if err := elem.Click(); err != nil {
-			failedMsgIds = append(failedMsgIds, fmt.Sprintf("error trying to click \"Unsubscribe\" span element for message ID %s: %s", msgId, err.Error()))
+			outcomes = append(outcomes, Outcome{msgId, fmt.Errorf("error trying to click \"Unsubscribe\" span element for message ID %s: %s", msgId, err.Error())})
 			closeBrowser = false
 			continue
 		}
@@ -223,23 +349,25 @@ func (c *Client) UnsubscribeWithWebDriver(msgIds []string) error {
 			xpath = `//button[contains(text(), 'Go to website')]`
 			elem, err = wd.FindElement(selenium.ByXPATH, xpath)
 			if err != nil {	
-				failedMsgIds = append(failedMsgIds, fmt.Sprintf("error trying to find \"Unsubscribe\" or \"Go to website\" button element for message ID %s: %s", msgId, err.Error())) // should probably split the logic into 2 separate conditions
+				outcomes = append(outcomes, Outcome{msgId, fmt.Errorf("error trying to find \"Unsubscribe\" or \"Go to website\" button element for message ID %s: %s", msgId, err.Error())}) // should probably split the logic into 2 separate conditions
 				closeBrowser = false
 				continue
 			}
 		}
 
 		if err := elem.Click(); err != nil {
-			failedMsgIds = append(failedMsgIds, fmt.Sprintf("error trying to click \"Unsubscribe\" button element for message ID %s: %s", msgId, err.Error()))
+			outcomes = append(outcomes, Outcome{msgId, fmt.Errorf("error trying to click \"Unsubscribe\" button element for message ID %s: %s", msgId, err.Error())})
 			closeBrowser = false
 			continue
 		}
 
+		outcomes = append(outcomes, Outcome{msgId, nil})
+
 		time.Sleep(2 * time.Second)
 
 		windowHandles, err = wd.WindowHandles()
 		if err != nil {
-			return fmt.Errorf("error getting window handles: %s", err.Error())
+			return outcomes, fmt.Errorf("error getting window handles: %s", err.Error())
 		}
 		currentTabCount := len(windowHandles)
 		if initialTabCount != currentTabCount {
@@ -247,11 +375,11 @@ func (c *Client) UnsubscribeWithWebDriver(msgIds []string) error {
 
 			_, err = wd.ExecuteScript("window.close();", nil)
 			if err != nil {
-					return fmt.Errorf("error closing tab: %s", err.Error())
+					return outcomes, fmt.Errorf("error closing tab: %s", err.Error())
 			} else {
 				windowHandles, err = wd.WindowHandles()
 				if err != nil {
-					return fmt.Errorf("error getting window handles: %s", err.Error())
+					return outcomes, fmt.Errorf("error getting window handles: %s", err.Error())
 				}
 			}	
 		}
@@ -260,166 +388,261 @@ func (c *Client) UnsubscribeWithWebDriver(msgIds []string) error {
 		if idx == len(msgIds) - 1 {
 			switchToTab = windowHandles[0]
 			if err := wd.SwitchWindow(switchToTab); err != nil {
-				return fmt.Errorf("error switching back to original tab: %s", err.Error())
+				return outcomes, fmt.Errorf("error switching back to original tab: %s", err.Error())
 			}
 
 			_, err = wd.ExecuteScript("window.close();", nil)
 			if err != nil {
-					return fmt.Errorf("error closing tab: %s", err.Error())
+					return outcomes, fmt.Errorf("error closing tab: %s", err.Error())
 			}
 		} else {
 			if err := wd.SwitchWindow(windowHandles[len(windowHandles) - 1 - newTabs]); err != nil {
-				return fmt.Errorf("error switching back to original tab: %s", err.Error())
+				return outcomes, fmt.Errorf("error switching back to original tab: %s", err.Error())
 			}
 		}
 	}
 
-	if len(failedMsgIds) > 0 {
-		errorMsgAsStr := "The following errors occurred:"
-		for _, failedMsgId := range failedMsgIds {
-			errorMsgAsStr += fmt.Sprintf("\n- %s", failedMsgId)
-		}
-		return fmt.Errorf("%s", errorMsgAsStr)
-	}
+	return outcomes, nil
+}
 
-	return nil
+func (c *Client) UnsubscribeByHttpAddress(link unsubscribeTarget, oneClick bool) (int, error) {
+	return unsubscribeByHttpAddress(c.context(), c.web, link, oneClick)
 }
 
-func (c *Client) GetOriginalMessageById(msgId string) (*messagePayload, error) {
-	url := fmt.Sprintf("%v/messages/%s?format=%s", baseUrl, msgId, "full")
-	reqMethod := "GET"
+// Follows an unsubscribe link through client, for any provider. With oneClick
+// the sender advertised RFC 8058 (List-Unsubscribe-Post: List-Unsubscribe=One-Click),
+// so the link gets the exact form-encoded POST that standard defines; otherwise
+// it is only opened. Returns the status code of the answer, or 0 when there was
+// none, and a nil error once the sender confirmed the request, judged by the
+// status code alone.
+func unsubscribeByHttpAddress(ctx context.Context, client *http.Client, link unsubscribeTarget, oneClick bool) (int, error) {
+	method := "GET"
+	address := link.uri
+
+	var body io.Reader
+	if oneClick {
+		// RFC 8058 requires HTTPS for one-click requests
+		if link.scheme != "https" {
+			return 0, fmt.Errorf("one-click unsubscribe link %v is not HTTPS", address)
+		}
+		method = "POST"
+		body = strings.NewReader(oneClickBody)
+	}
 
-	req, err := http.NewRequest(reqMethod, url, nil)
+	req, err := http.NewRequestWithContext(ctx, method, address, body)
 	if err != nil {
-		return nil, &requestCreationError{reqMethod, url, err.Error()}
+		return 0, &requestCreationError{method, address, err.Error()}
+	}
+	if oneClick {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 	}
 
-	res, err := c.Do(req)
+	res, err := client.Do(req)
 	if err != nil {
-		return nil, &requestCreationError{reqMethod, url, err.Error()}
+		return 0, &requestExecutionError{method, address, err.Error()}
 	}
 	defer res.Body.Close()
+	// drain a little so the connection can be reused; the content is not used
+	io.Copy(io.Discard, io.LimitReader(res.Body, 64<<10))
 
-	body, err := io.ReadAll(res.Body)
-	if err != nil {
-		return nil, fmt.Errorf("there was an error reading the response's body: %v", err.Error())
+	status := classifyUnsubscribeResponse(res.StatusCode, oneClick)
+	if status != unsubscribeConfirmed {
+		return res.StatusCode, &unsubscribeError{method, address, res.StatusCode, status}
 	}
+	return res.StatusCode, nil
+}
 
-	var randomInterface messagePayload
-	err = json.Unmarshal(body, &randomInterface)
-	if err != nil {
-		return nil, fmt.Errorf("there was an error unmarshalling the data: %v", err.Error())
+// Classifies the answer to an unsubscribe request by its status code. Only a
+// one-click request is confirmed by success; an opened link usually shows a
+// page that still has to be submitted by hand.
+func classifyUnsubscribeResponse(statusCode int, oneClick bool) unsubscribeStatus {
+	switch {
+	case statusCode >= 200 && statusCode < 300:
+		if oneClick {
+			return unsubscribeConfirmed
+		}
+		return unsubscribeUnconfirmed
+	case statusCode == http.StatusNotFound || statusCode == http.StatusGone:
+		return unsubscribeExpired
+	case statusCode == http.StatusTooManyRequests || statusCode >= 500:
+		return unsubscribeUnavailable
 	}
-
-	return &randomInterface, nil
+	return unsubscribeRejected
 }
 
-func (c *Client) UnsubscribeByHttpAddress(httpAddress string) (string, error) {
-	method := "POST"
-	address := httpAddress[1:len(httpAddress) - 1]
-	// fmt.Printf("%v\n", address)
-
-	req, err := http.NewRequest(method, address, nil)
-	if err != nil {
-		return "", &requestCreationError{method, address, err.Error()}
+// Classifies a failed unsubscribe request by the answer it got, if any.
+func unsubscribeErrorStatus(err error) unsubscribeStatus {
+	var unsubscribeErr *unsubscribeError
+	if errors.As(err, &unsubscribeErr) {
+		return unsubscribeErr.status
 	}
+	return unsubscribeFailed
+}
 
-	res, err := c.Do(req)
+// Sends the email the mailto target asks for from the account's send-as
+// identity, or saves it as a draft when draft is set.
+func (c *Client) UnsubscribeByMailtoAddress(mailto unsubscribeTarget, draft bool) error {
+	from, err := c.senderAddress()
 	if err != nil {
-		return "", &requestExecutionError{method, address, err.Error()}
+		return fmt.Errorf("error determining sender address: %s", err.Error())
 	}
-	defer res.Body.Close()
 
-	if res.StatusCode != http.StatusOK {
-    return "", fmt.Errorf("HTTP status %v for url %v", res.Status, address)
-	}
-
-	data, err := io.ReadAll(res.Body)
+	rawEmail, err := buildUnsubscribeEmail(from, mailto, time.Now())
 	if err != nil {
-		return "", fmt.Errorf("error reading response body: %s", err.Error())
-	}
-	
-	var dataInterface interface{}
-	err = json.Unmarshal(data, &dataInterface)
-	if err != nil {
-		return fmt.Sprintf("\n%v\n", string(data)), nil
+		return err
 	}
+	encodedRawEmail := base64.URLEncoding.EncodeToString(rawEmail)
 
-	return "\nMay need to manually open link\n", nil
-}
-
-func (c *Client) UnsubscribeByMailtoAddress(mailtoAddress string) error {
-	address := strings.TrimSpace(mailtoAddress)[8:len(mailtoAddress) - 1]
+	url := fmt.Sprintf("%v/messages/send", c.userUrl())
+	var body interface{} = map[string]string{"raw": encodedRawEmail}
+	if draft {
+		url = fmt.Sprintf("%v/drafts", c.userUrl())
+		body = map[string]interface{}{"message": map[string]string{"raw": encodedRawEmail}}
+	}
 	method := "POST"
-	url := fmt.Sprintf("%v/messages/send", baseUrl)
 
-	rawEmail := fmt.Sprintf("From: mikitosaarna@gmail.com\r\nTo: %s\r\nSubject: Unsubscribe Request\r\n\r\nPlease unsubscribe me from this mailing list.", address)
-	encodedRawEmail := base64.URLEncoding.EncodeToString([]byte(rawEmail))
-	body := map[string]string{"raw": encodedRawEmail}
-	
 	marshalledBody, err := json.Marshal(body)
 	if err != nil {
 		return fmt.Errorf("error marshalling body: %s", err.Error())
 	}
 	reader := bytes.NewReader(marshalledBody)
 
-	req, err := http.NewRequest(method, url , reader)
+	req, err := http.NewRequestWithContext(c.context(), method, url , reader)
 	if err != nil {
 		return &requestCreationError{method, url, err.Error()}
 	}
 	req.Header.Set("Content-Type", "application/json")
 
-	_, err = c.Do(req)
+	res, err := c.Do(req)
 	if err != nil {
 		return &requestExecutionError{method, url, err.Error()}
 	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return newApiError(res)
+	}
 
 	return nil
 }
 
-func (c *Client) RemoveMessages(messages []messageObj) {
-	for _, message := range messages {
-		url := fmt.Sprintf("%s/messages/%v/trash", baseUrl, message.Id)
+// Returns the address unsubscribe emails come from: the profile's send-as
+// alias when it has one, otherwise the account's default send-as address.
+// A failed lookup is tried again on the next call.
+func (c *Client) senderAddress() (*mail.Address, error) {
+	c.identity.mu.Lock()
+	defer c.identity.mu.Unlock()
+	if c.identity.address != nil {
+		return c.identity.address, nil
+	}
 
-		req, err := http.NewRequest("POST", url, nil)
-		if err != nil {
-			fmt.Printf("error creating post request for url %s: %v", url, err.Error())
-			return
-		}
+	address, err := c.lookupSenderAddress()
+	if err != nil {
+		return nil, err
+	}
+	c.identity.address = address
+	return address, nil
+}
 
-		resp, err := c.Do(req)
-		if err != nil {
-			fmt.Printf("error executing post request for url %s: %v", url, err.Error())
-			return
-		}
-		defer resp.Body.Close()
+func (c *Client) lookupSenderAddress() (*mail.Address, error) {
+	url := fmt.Sprintf("%v/settings/sendAs", c.userUrl())
+	reqMethod := "GET"
 
-		if resp.StatusCode != http.StatusOK {
-			body, _ := io.ReadAll(resp.Body)
-			fmt.Printf("HTTP status: %v\nResponse body: %s", resp.Status, string(body))
-			return
-		}
+	req, err := http.NewRequestWithContext(c.context(), reqMethod, url, nil)
+	if err != nil {
+		return nil, &requestCreationError{reqMethod, url, err.Error()}
+	}
 
-		body, err := io.ReadAll(resp.Body)
-		if err != nil {
-			fmt.Printf("error reading response body for url %s: %v", url, err.Error())
-			return
-		}
+	res, err := c.Do(req)
+	if err != nil {
+		return nil, &requestExecutionError{reqMethod, url, err.Error()}
+	}
+	defer res.Body.Close()
 
-		var unmarshalledMessageObj messageObj
+	if res.StatusCode != http.StatusOK {
+		return nil, newApiError(res)
+	}
 
-		err = json.Unmarshal(body, &unmarshalledMessageObj)
-		if err != nil {
-			fmt.Printf("error unmarshalling JSON response from url %s: %v", url, err.Error())
-			return
+	var list sendAsList
+	if err := json.NewDecoder(res.Body).Decode(&list); err != nil {
+		return nil, fmt.Errorf("error unmarshalling send-as addresses: %v", err.Error())
+	}
+
+	alias := c.profile.Settings.SendAs
+	for _, sendAs := range list.SendAs {
+		if alias != "" && !strings.EqualFold(sendAs.SendAsEmail, alias) {
+			continue
 		}
+		if alias == "" && !sendAs.IsDefault {
+			continue
+		}
+		// the primary address has no verification status
+		if sendAs.VerificationStatus != "" && sendAs.VerificationStatus != "accepted" {
+			return nil, fmt.Errorf("send-as address %v is not verified", sendAs.SendAsEmail)
+		}
+		return &mail.Address{Name: sendAs.DisplayName, Address: sendAs.SendAsEmail}, nil
+	}
 
-		fmt.Printf("removed email with id: %v\n", unmarshalledMessageObj.Id)
+	if alias != "" {
+		return nil, fmt.Errorf("%v is not a send-as address of the account", alias)
 	}
+	return nil, fmt.Errorf("the account has no default send-as address")
+}
+
+// Moves the messages to the trash, where Gmail keeps them for 30 days, split
+// into batchModify calls of at most batchDeleteLimit IDs each.
+func (c *Client) RemoveMessages(messageIds []string) Outcomes {
+	return applyInChunks(messageIds, batchDeleteLimit, "Moved to trash", func(ids []string) error {
+		return c.batchModifyChunk(ids, []string{"TRASH"}, nil)
+	})
 }
 
-func (c *Client) BatchPermanentlyDeleteMessages(messageIds []string) (error) {
-	url := fmt.Sprintf("%v/messages/batchDelete", baseUrl)
+// Takes the messages back out of the trash.
+func (c *Client) RestoreMessages(messageIds []string) Outcomes {
+	return applyInChunks(messageIds, batchDeleteLimit, "Restored", func(ids []string) error {
+		return c.batchModifyChunk(ids, nil, []string{"TRASH"})
+	})
+}
+
+func (c *Client) batchModifyChunk(messageIds []string, addLabelIds []string, removeLabelIds []string) error {
+	url := fmt.Sprintf("%v/messages/batchModify", c.userUrl())
+	reqBody := batchModifyBody{messageIds, addLabelIds, removeLabelIds}
+	reqMethod := "POST"
+
+	data, err := json.Marshal(reqBody)
+	if err != nil {
+		return fmt.Errorf("error marshalling reqBody: %v\nreqBody: %v", err.Error(), reqBody)
+	}
+	reader := bytes.NewReader(data)
+
+	req, err := http.NewRequestWithContext(c.context(), reqMethod, url, reader)
+	if err != nil {
+		return &requestCreationError{reqMethod, url, err.Error()}
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := c.Do(req)
+	if err != nil {
+		return &requestExecutionError{reqMethod, url, err.Error()}
+	}
+	defer res.Body.Close()
+
+	// batchModify answers 204 No Content on success
+	if res.StatusCode != http.StatusOK && res.StatusCode != http.StatusNoContent {
+		return newApiError(res)
+	}
+
+	return nil
+}
+
+// Permanently deletes the messages, split into batchDelete calls of at most
+// batchDeleteLimit IDs each.
+func (c *Client) BatchPermanentlyDeleteMessages(messageIds []string) Outcomes {
+	return applyInChunks(messageIds, batchDeleteLimit, "Permanently deleted", c.batchPermanentlyDeleteChunk)
+}
+
+func (c *Client) batchPermanentlyDeleteChunk(messageIds []string) (error) {
+	url := fmt.Sprintf("%v/messages/batchDelete", c.userUrl())
 	reqBody := batchDeleteBody{ Ids: messageIds }
 	reqMethod := "POST"
 
@@ -429,7 +652,7 @@ func (c *Client) BatchPermanentlyDeleteMessages(messageIds []string) (error) {
 	}
 	reader := bytes.NewReader((data))
 
-	req, err := http.NewRequest(reqMethod, url, reader)
+	req, err := http.NewRequestWithContext(c.context(), reqMethod, url, reader)
 	if err != nil {
 		return &requestCreationError{reqMethod, url, err.Error()}
 	}
@@ -437,18 +660,13 @@ func (c *Client) BatchPermanentlyDeleteMessages(messageIds []string) (error) {
 
 	resp, err := c.Do(req)
 	if err != nil {
-		return &requestCreationError{reqMethod, url, err.Error()}
+		return &requestExecutionError{reqMethod, url, err.Error()}
 	}
 	defer resp.Body.Close()
 
-	// if resp.StatusCode != http.StatusOK {
-	// 	fmt.Printf("an error occurred, status code: %v", resp.StatusCode)
-	// 	return
-	// }
-
-	fmt.Printf("Permanently deleted emails with ID:")
-	for _, id := range messageIds {
-		fmt.Printf("\n-%s", id)
+	// batchDelete answers 204 No Content on success
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent {
+		return newApiError(resp)
 	}
 
 	return nil
@@ -476,10 +694,10 @@ func (c *Client) RetrieveTrashList() (TrashList, error) {
 }
 
 func (c *Client) RetrieveAllFilters() ([]Filter, error) {
-	url := fmt.Sprintf("%v/settings/filters", baseUrl)
+	url := fmt.Sprintf("%v/settings/filters", c.userUrl())
 	reqMethod := "GET"
 
-	req, err := http.NewRequest(reqMethod, url, nil)
+	req, err := http.NewRequestWithContext(c.context(), reqMethod, url, nil)
 	if err != nil {
 		return nil, &requestCreationError{reqMethod, url, err.Error()}
 	}
@@ -491,7 +709,7 @@ func (c *Client) RetrieveAllFilters() ([]Filter, error) {
 	defer res.Body.Close()
 
 	if res.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("HTTP status %v for url %v", res.Status, url)
+		return nil, newApiError(res)
 	}
 
 	body, err := io.ReadAll(res.Body)
@@ -509,7 +727,7 @@ func (c *Client) RetrieveAllFilters() ([]Filter, error) {
 }
 
 func (c *Client) AssignSenderToTrashList(sender string) (*Filter, error) {
-	url := fmt.Sprintf("%v/settings/filters", baseUrl)
+	url := fmt.Sprintf("%v/settings/filters", c.userUrl())
 	reqMethod := "POST"
 	reqBody := Filter{
 		criteria{sender},
@@ -531,7 +749,7 @@ func (c *Client) AssignSenderToTrashList(sender string) (*Filter, error) {
 	}
 	reader := bytes.NewReader((data))
 
-	req, err := http.NewRequest(reqMethod, url, reader)
+	req, err := http.NewRequestWithContext(c.context(), reqMethod, url, reader)
 	if err != nil {
 		return nil, &requestCreationError{reqMethod, url, err.Error()}
 	}
@@ -546,7 +764,7 @@ func (c *Client) AssignSenderToTrashList(sender string) (*Filter, error) {
 
 	// res.StatusCode validation necessary?
 	if res.StatusCode != http.StatusOK {
-    return nil, fmt.Errorf("HTTP status %v for url %v", res.Status, url)
+		return nil, newApiError(res)
 	}
 
 
@@ -566,3 +784,42 @@ func (c *Client) AssignSenderToTrashList(sender string) (*Filter, error) {
 	// return res.body
 	return &unmarshalledFilter, nil
 }
+
+// Returns the profile's configured address, falling back to the address of the
+// account the token belongs to.
+func (c *Client) GetEmailAddress() (string, error) {
+	if c.profile.Settings.Address != "" {
+		return c.profile.Settings.Address, nil
+	}
+
+	url := fmt.Sprintf("%v/profile", c.userUrl())
+	reqMethod := "GET"
+
+	req, err := http.NewRequestWithContext(c.context(), reqMethod, url, nil)
+	if err != nil {
+		return "", &requestCreationError{reqMethod, url, err.Error()}
+	}
+
+	res, err := c.Do(req)
+	if err != nil {
+		return "", &requestExecutionError{reqMethod, url, err.Error()}
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return "", newApiError(res)
+	}
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return "", fmt.Errorf("error reading response body for url %v: %v", url, err.Error())
+	}
+
+	var profile userProfile
+	err = json.Unmarshal(body, &profile)
+	if err != nil {
+		return "", fmt.Errorf("error unmarshalling JSON response for url %v: %v", url, err.Error())
+	}
+
+	return profile.EmailAddress, nil
+}
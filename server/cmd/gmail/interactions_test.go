@@ -0,0 +1,142 @@
+package gmail
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"gmail-organizer/cmd/gmail/gmailtest"
+)
+
+func TestClassifyUnsubscribeResponse(t *testing.T) {
+	for _, test := range []struct {
+		statusCode    int
+		oneClick, get unsubscribeStatus
+	}{
+		// only a one-click POST is confirmed by success
+		{200, unsubscribeConfirmed, unsubscribeUnconfirmed},
+		{202, unsubscribeConfirmed, unsubscribeUnconfirmed},
+		{204, unsubscribeConfirmed, unsubscribeUnconfirmed},
+		// redirects that were not followed
+		{301, unsubscribeRejected, unsubscribeRejected},
+		{302, unsubscribeRejected, unsubscribeRejected},
+		{304, unsubscribeRejected, unsubscribeRejected},
+		{400, unsubscribeRejected, unsubscribeRejected},
+		{401, unsubscribeRejected, unsubscribeRejected},
+		{403, unsubscribeRejected, unsubscribeRejected},
+		{405, unsubscribeRejected, unsubscribeRejected},
+		{404, unsubscribeExpired, unsubscribeExpired},
+		{410, unsubscribeExpired, unsubscribeExpired},
+		{429, unsubscribeUnavailable, unsubscribeUnavailable},
+		{500, unsubscribeUnavailable, unsubscribeUnavailable},
+		{503, unsubscribeUnavailable, unsubscribeUnavailable},
+	} {
+		if got := classifyUnsubscribeResponse(test.statusCode, true); got != test.oneClick {
+			t.Errorf("one-click %d = %v, want %v", test.statusCode, got, test.oneClick)
+		}
+		if got := classifyUnsubscribeResponse(test.statusCode, false); got != test.get {
+			t.Errorf("GET %d = %v, want %v", test.statusCode, got, test.get)
+		}
+	}
+}
+
+func TestUnsubscribeByHttpAddress(t *testing.T) {
+	var method, contentType, body string
+	statusCode := http.StatusOK
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		method, contentType, body = r.Method, r.Header.Get("Content-Type"), string(data)
+		w.WriteHeader(statusCode)
+	}))
+	defer server.Close()
+	link := unsubscribeTarget{scheme: "https", uri: server.URL + "/u?id=1"}
+
+	for _, test := range []struct {
+		statusCode int
+		oneClick   bool
+		want       unsubscribeStatus
+	}{
+		{200, true, unsubscribeConfirmed},
+		{200, false, unsubscribeUnconfirmed},
+		{410, true, unsubscribeExpired},
+		{403, false, unsubscribeRejected},
+		{503, true, unsubscribeUnavailable},
+	} {
+		statusCode = test.statusCode
+		got, err := unsubscribeByHttpAddress(context.Background(), server.Client(), link, test.oneClick)
+		if got != test.statusCode {
+			t.Errorf("%d, one-click %v: status code = %d", test.statusCode, test.oneClick, got)
+		}
+		if test.want == unsubscribeConfirmed {
+			if err != nil {
+				t.Errorf("%d, one-click %v: %v", test.statusCode, test.oneClick, err)
+			}
+		} else if status := unsubscribeErrorStatus(err); status != test.want {
+			t.Errorf("%d, one-click %v: status = %v (%v), want %v", test.statusCode, test.oneClick, status, err, test.want)
+		}
+
+		if test.oneClick && (method != "POST" || contentType != "application/x-www-form-urlencoded" || body != oneClickBody) {
+			t.Errorf("one-click request was %v %q with %q", method, body, contentType)
+		} else if !test.oneClick && (method != "GET" || body != "") {
+			t.Errorf("opened link was %v %q", method, body)
+		}
+	}
+
+	// one-click needs HTTPS, and without an answer nothing is known
+	if _, err := unsubscribeByHttpAddress(context.Background(), server.Client(), unsubscribeTarget{scheme: "http", uri: "http://example.com/u"}, true); err == nil {
+		t.Error("one-click over HTTP was sent")
+	} else if status := unsubscribeErrorStatus(err); status != unsubscribeFailed {
+		t.Errorf("one-click over HTTP = %v", status)
+	}
+	server.Close()
+	got, err := unsubscribeByHttpAddress(context.Background(), server.Client(), link, false)
+	var unsubscribeErr *unsubscribeError
+	if got != 0 || err == nil || errors.As(err, &unsubscribeErr) || unsubscribeErrorStatus(err) != unsubscribeFailed {
+		t.Errorf("closed server = %d, %v", got, err)
+	}
+}
+
+func TestSenderAddressRetriesFailedLookups(t *testing.T) {
+	srv := gmailtest.NewServer("me@example.com")
+	defer srv.Close()
+	c := NewClient(srv.Client(), &Profile{Name: "default", Dir: t.TempDir()}, srv.URL)
+	lookups := func() int {
+		n := 0
+		for _, request := range srv.Requests() {
+			if strings.HasSuffix(request, "/settings/sendAs") {
+				n++
+			}
+		}
+		return n
+	}
+
+	// a cancelled run shares the client's identity, but not its failure
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := c.WithContext(ctx).senderAddress(); err == nil {
+		t.Fatal("lookup with a cancelled context succeeded")
+	}
+
+	srv.Fail("settings/sendAs", 503, "backendError", 1)
+	if _, err := c.senderAddress(); err == nil {
+		t.Fatal("lookup succeeded despite a 503")
+	}
+
+	for i := 0; i < 2; i++ {
+		from, err := c.senderAddress()
+		if err != nil {
+			t.Fatalf("lookup %d after the failure: %v", i, err)
+		}
+		if from.Address != "me@example.com" {
+			t.Errorf("sender = %v", from)
+		}
+	}
+	// the failed and the first successful lookup reached the mailbox
+	if n := lookups(); n != 2 {
+		t.Errorf("sendAs was requested %d times, want 2", n)
+	}
+}
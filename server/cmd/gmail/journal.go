@@ -0,0 +1,201 @@
+package gmail
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	journalDir       = "journal"
+	runIdTimeLayout  = "20060102-150405"
+	journalExtension = ".json"
+)
+
+// Journal records the messages a removal run touched, so that a run that moved
+// them to the trash can be undone.
+type Journal struct {
+	RunId      string     `json:"runId"`
+	Account    string     `json:"account"`
+	Permanent  bool       `json:"permanent"`
+	Senders    []string   `json:"senders"`
+	Query      string     `json:"query"`
+	MessageIds []string   `json:"messageIds"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	UndoneAt   *time.Time `json:"undoneAt,omitempty"`
+}
+
+func newJournal(profile *Profile, permanent bool, senderAddresses []string, query *Query, messageIds []string) *Journal {
+	now := time.Now()
+
+	// runs started within the same second get a numeric suffix
+	runId := now.Format(runIdTimeLayout)
+	for i := 2; ; i++ {
+		if _, err := os.Stat(journalPath(profile, runId)); errors.Is(err, os.ErrNotExist) {
+			break
+		}
+		runId = fmt.Sprintf("%v-%d", now.Format(runIdTimeLayout), i)
+	}
+
+	return &Journal{
+		RunId:      runId,
+		Account:    profile.Name,
+		Permanent:  permanent,
+		Senders:    senderAddresses,
+		Query:      query.String(),
+		MessageIds: messageIds,
+		CreatedAt:  now,
+	}
+}
+
+func journalPath(profile *Profile, runId string) string {
+	return filepath.Join(profile.path(journalDir), runId+journalExtension)
+}
+
+// Writes the journal into the profile's journal directory. It is written before
+// the messages are touched, so even an interrupted run can be undone.
+func (j *Journal) save(profile *Profile) error {
+	if err := os.MkdirAll(profile.path(journalDir), 0700); err != nil {
+		return fmt.Errorf("error creating journal directory: %v", err.Error())
+	}
+
+	data, err := json.MarshalIndent(j, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error marshalling journal: %v", err.Error())
+	}
+
+	return os.WriteFile(journalPath(profile, j.RunId), data, 0600)
+}
+
+// Loads one of the profile's journals, refusing one written for another
+// account, whose message IDs belong to a different mailbox.
+func loadJournal(profile *Profile, runId string) (*Journal, error) {
+	journal, err := readJournal(profile, runId)
+	if err != nil {
+		return nil, err
+	}
+	if !journal.belongsTo(profile) {
+		return nil, fmt.Errorf("run \"%v\" was made for account \"%v\", not profile \"%v\"", runId, journal.Account, profile.Name)
+	}
+	return journal, nil
+}
+
+// Whether the journal was written for the profile. Impersonated users are
+// named by their address, which may be typed in any case.
+func (j *Journal) belongsTo(profile *Profile) bool {
+	return strings.EqualFold(j.Account, profile.Name)
+}
+
+func readJournal(profile *Profile, runId string) (*Journal, error) {
+	// run IDs become file names, so keep them from pointing elsewhere
+	if runId == "" || strings.ContainsAny(runId, `/\`) || strings.Contains(runId, "..") {
+		return nil, fmt.Errorf("invalid run ID \"%v\"", runId)
+	}
+
+	data, err := os.ReadFile(journalPath(profile, runId))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("no run \"%v\" found for profile \"%v\"", runId, profile.Name)
+	} else if err != nil {
+		return nil, fmt.Errorf("error reading journal: %v", err.Error())
+	}
+
+	var journal Journal
+	if err := json.Unmarshal(data, &journal); err != nil {
+		return nil, fmt.Errorf("error unmarshalling journal: %v", err.Error())
+	}
+	return &journal, nil
+}
+
+// Lists the profile's journals, newest first, leaving out those of other
+// accounts that share its directory.
+func ListJournals(profile *Profile) ([]*Journal, error) {
+	entries, err := os.ReadDir(profile.path(journalDir))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("error reading journal directory: %v", err.Error())
+	}
+
+	var journals []*Journal
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), journalExtension) {
+			continue
+		}
+
+		journal, err := readJournal(profile, strings.TrimSuffix(entry.Name(), journalExtension))
+		if err != nil {
+			return nil, err
+		}
+		if journal.belongsTo(profile) {
+			journals = append(journals, journal)
+		}
+	}
+
+	sort.Slice(journals, func(i, j int) bool {
+		return journals[i].CreatedAt.After(journals[j].CreatedAt)
+	})
+	return journals, nil
+}
+
+func PrintJournals(profile *Profile, journals []*Journal) {
+	if len(journals) == 0 {
+		fmt.Printf("No runs recorded for profile \"%v\".\n", profile.Name)
+		return
+	}
+
+	fmt.Printf("Runs recorded for profile \"%v\":\n", profile.Name)
+	for _, journal := range journals {
+		status := "trashed"
+		if journal.Permanent {
+			status = "permanently deleted"
+		} else if journal.UndoneAt != nil {
+			status = fmt.Sprintf("restored %v", journal.UndoneAt.Format(time.DateTime))
+		}
+		fmt.Printf("- %v  %6d messages  %v\n", journal.RunId, len(journal.MessageIds), status)
+	}
+}
+
+// Takes the messages of a trash run back out of the trash.
+func Undo(ctx context.Context, profile *Profile, runId string) Summary {
+	summary := Summary{Account: profile.Name, Operation: undoOperation.name}
+
+	journal, err := loadJournal(profile, runId)
+	if err != nil {
+		summary.Err = err
+		return summary
+	}
+	summary.Processed = len(journal.MessageIds)
+
+	if journal.Permanent {
+		summary.Err = fmt.Errorf("run %v permanently deleted its messages, which cannot be undone", runId)
+		return summary
+	}
+
+	provider, err := openProvider(ctx, profile, undoOperation)
+	if err != nil {
+		summary.Err = err
+		return summary
+	}
+	defer provider.Close()
+
+	outcomes := provider.Restore(journal.MessageIds)
+	outcomes.summarize(&summary)
+	if summary.Failed > 0 {
+		// the run stays undoable so the rest can be retried
+		return summary
+	}
+
+	now := time.Now()
+	journal.UndoneAt = &now
+	if err := journal.save(profile); err != nil {
+		fmt.Printf("Messages were restored, but the journal could not be updated: %v\n", err.Error())
+	}
+
+	return summary
+}
@@ -0,0 +1,71 @@
+package gmail
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A directory that an older version shared between accounts can hold another
+// account's runs, whose message IDs mean nothing in this mailbox.
+func TestJournalsOfOtherAccountsAreRefused(t *testing.T) {
+	srv, profile := useFakeGmail(t)
+	id := addFrom(srv, "news@shop.example", "TRASH")
+
+	other := &Journal{RunId: "20260101-000000", Account: "someone@corp.example", MessageIds: []string{id}, CreatedAt: time.Now()}
+	if err := other.save(profile); err != nil {
+		t.Fatal(err)
+	}
+	own := &Journal{RunId: "20260102-000000", Account: profile.Name, MessageIds: []string{id}, CreatedAt: time.Now()}
+	if err := own.save(profile); err != nil {
+		t.Fatal(err)
+	}
+
+	journals, err := ListJournals(profile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(journals) != 1 || journals[0].RunId != own.RunId {
+		t.Errorf("ListJournals = %+v, want only the profile's own run", journals)
+	}
+
+	summary := Undo(context.Background(), profile, other.RunId)
+	if summary.Err == nil || !strings.Contains(summary.Err.Error(), "someone@corp.example") {
+		t.Fatalf("Undo of another account's run: error = %v", summary.Err)
+	}
+	if summary.Processed != 0 || !hasLabel(t, srv, id, "TRASH") {
+		t.Error("another account's run was replayed")
+	}
+	if len(srv.Requests()) != 0 {
+		t.Errorf("Undo reached the mailbox: %q", srv.Requests())
+	}
+
+	checkSummary(t, Undo(context.Background(), profile, own.RunId), 1, 1, 0, 0)
+	if hasLabel(t, srv, id, "TRASH") {
+		t.Error("the profile's own run was not undone")
+	}
+}
+
+func TestJournalAccountIgnoresCase(t *testing.T) {
+	profile := &Profile{Name: "alice@corp.example", Dir: t.TempDir()}
+	journal := &Journal{RunId: "20260101-000000", Account: "Alice@Corp.example", CreatedAt: time.Now()}
+	if err := journal.save(profile); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadJournal(profile, journal.RunId); err != nil {
+		t.Errorf("loadJournal: %v", err)
+	}
+}
+
+func TestLoadJournalRejectsPaths(t *testing.T) {
+	profile := &Profile{Name: "default", Dir: t.TempDir()}
+	for _, runId := range []string{"", "../settings", "a/b", `a\b`, ".."} {
+		if _, err := loadJournal(profile, runId); err == nil || !strings.Contains(err.Error(), "invalid run ID") {
+			t.Errorf("loadJournal(%q): error = %v, want it refused", runId, err)
+		}
+	}
+	if _, err := loadJournal(profile, "20260101-000000"); err == nil || !strings.Contains(err.Error(), "no run") {
+		t.Errorf("loadJournal of a missing run: error = %v", err)
+	}
+}
@@ -0,0 +1,222 @@
+package gmail
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+const ledgerFile = "unsubscribeLedger.jsonl"
+
+// How long an emailed request, or a click on Gmail's button, is given to take
+// effect, and a drafted request to be sent by hand. Nothing confirms any of
+// them, so after this the sender is asked again.
+const unsubscribeGracePeriod = 14 * 24 * time.Hour
+
+// How an unsubscribe request was made.
+type unsubscribeMethod string
+
+const (
+	// an RFC 8058 POST to the List-Unsubscribe link
+	unsubscribeByOneClick unsubscribeMethod = "one-click"
+	// opening the List-Unsubscribe link
+	unsubscribeByHttp unsubscribeMethod = "http"
+	// an email to the List-Unsubscribe mailto address
+	unsubscribeByMailto unsubscribeMethod = "mailto"
+	// Gmail's unsubscribe button, clicked through the web driver
+	unsubscribeByBrowser unsubscribeMethod = "browser"
+)
+
+// LedgerEntry is one unsubscribe attempt, successful or not.
+type LedgerEntry struct {
+	Sender    string            `json:"sender"`
+	MessageId string            `json:"messageId"`
+	Method    unsubscribeMethod `json:"method"`
+	// the List-Unsubscribe URI; empty for the browser, which clicks Gmail's
+	// own button
+	Target string `json:"target,omitempty"`
+	// what came back, e.g. "HTTP 200", "sent" or an error message
+	Outcome string            `json:"outcome"`
+	Status  unsubscribeStatus `json:"status"`
+	At      time.Time         `json:"at"`
+}
+
+// Whether the sender confirmed the entry's request.
+func (e *LedgerEntry) unsubscribed() bool {
+	return e.Status == unsubscribeConfirmed
+}
+
+// Whether the entry is a request that went unanswered, or was drafted for the
+// user to send, but is still within its grace period at the given time.
+func (e *LedgerEntry) awaiting(now time.Time) bool {
+	return (e.Status == unsubscribeSent || e.Status == unsubscribeDrafted) && now.Sub(e.At) < unsubscribeGracePeriod
+}
+
+// The entry's status, with unanswered requests marked as unconfirmed.
+func (e *LedgerEntry) describeStatus() string {
+	if e.Status == unsubscribeSent {
+		return "sent (unconfirmed)"
+	}
+	return string(e.Status)
+}
+
+// The profile's record of every unsubscribe attempt, one JSON entry per line.
+// Entries are only ever appended, so that the history survives every run.
+type ledger struct {
+	path    string
+	mu      sync.Mutex
+	entries []LedgerEntry
+}
+
+// Loads the profile's ledger, which is empty until the first attempt.
+func openLedger(profile *Profile) (*ledger, error) {
+	l := &ledger{path: profile.path(ledgerFile)}
+
+	f, err := os.Open(l.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return l, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("error opening unsubscribe ledger: %v", err.Error())
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64<<10), 1<<20)
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var entry LedgerEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, fmt.Errorf("error parsing unsubscribe ledger %v line %d: %v", l.path, line, err.Error())
+		}
+		l.entries = append(l.entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading unsubscribe ledger: %v", err.Error())
+	}
+
+	return l, nil
+}
+
+// Returns the entry that shows the sender needs no new request at the given
+// time: a confirmed unsubscribe, or else the latest request still awaiting an
+// effect. Returns nil if there is neither.
+func (l *ledger) settled(sender string, now time.Time) *LedgerEntry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	sender = normalizeAddress(sender)
+	var awaiting *LedgerEntry
+	for i := range l.entries {
+		entry := &l.entries[i]
+		if normalizeAddress(entry.Sender) != sender {
+			continue
+		}
+		if entry.unsubscribed() {
+			return entry
+		}
+		if entry.awaiting(now) {
+			awaiting = entry
+		}
+	}
+	return awaiting
+}
+
+// Leaves out the senders the ledger shows were unsubscribed, or were asked
+// recently enough that the request may not have taken effect yet, counting
+// them as skipped.
+func (l *ledger) pending(senderAddresses []string, summary *Summary) []string {
+	now := time.Now()
+	var pending []string
+	for _, senderAddress := range senderAddresses {
+		entry := l.settled(senderAddress, now)
+		switch {
+		case entry == nil:
+			pending = append(pending, senderAddress)
+			continue
+		case entry.unsubscribed():
+			fmt.Printf("Already unsubscribed from %v on %v (%v), skipping\n", senderAddress, entry.At.Format(time.DateOnly), entry.Method)
+		case entry.Status == unsubscribeDrafted:
+			fmt.Printf("Drafted an email asking %v to unsubscribe on %v, waiting to be sent; skipping until %v\n", senderAddress, entry.At.Format(time.DateOnly), entry.At.Add(unsubscribeGracePeriod).Format(time.DateOnly))
+		default:
+			fmt.Printf("Asked %v to unsubscribe on %v (%v), unconfirmed; skipping until %v\n", senderAddress, entry.At.Format(time.DateOnly), entry.Method, entry.At.Add(unsubscribeGracePeriod).Format(time.DateOnly))
+		}
+		summary.Skipped++
+	}
+	return pending
+}
+
+// Appends the entry to the ledger file. Attempts run concurrently, so this is
+// safe to call from any worker.
+func (l *ledger) record(entry LedgerEntry) error {
+	if entry.At.IsZero() {
+		entry.At = time.Now()
+	}
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("error marshalling ledger entry: %v", err.Error())
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("error opening unsubscribe ledger: %v", err.Error())
+	}
+	defer f.Close()
+
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("error writing unsubscribe ledger: %v", err.Error())
+	}
+	l.entries = append(l.entries, entry)
+	return nil
+}
+
+// Records an attempt, reporting rather than returning a failure to write it,
+// since the request itself has already been made.
+func (l *ledger) recordAttempt(sender, messageId string, method unsubscribeMethod, target, outcome string, status unsubscribeStatus) {
+	entry := LedgerEntry{
+		Sender:    sender,
+		MessageId: messageId,
+		Method:    method,
+		Target:    target,
+		Outcome:   outcome,
+		Status:    status,
+	}
+	if err := l.record(entry); err != nil {
+		fmt.Printf("Could not record the unsubscribe attempt for %v: %v\n", sender, err.Error())
+	}
+}
+
+// Lists the profile's unsubscribe attempts, oldest first.
+func ListLedger(profile *Profile) ([]LedgerEntry, error) {
+	l, err := openLedger(profile)
+	if err != nil {
+		return nil, err
+	}
+	return l.entries, nil
+}
+
+func PrintLedger(profile *Profile, entries []LedgerEntry) {
+	if len(entries) == 0 {
+		fmt.Printf("No unsubscribe attempts recorded for profile \"%v\".\n", profile.Name)
+		return
+	}
+
+	fmt.Printf("Unsubscribe attempts recorded for profile \"%v\":\n", profile.Name)
+	fmt.Printf("%-19s %-40s %-9s %-18s %v\n", "Time", "Sender", "Method", "Status", "Outcome")
+	for _, entry := range entries {
+		fmt.Printf("%-19s %-40s %-9s %-18s %v\n", entry.At.Local().Format(time.DateTime), entry.Sender, entry.Method, entry.describeStatus(), entry.Outcome)
+		if entry.Target != "" {
+			fmt.Printf("    %v\n", entry.Target)
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package gmail
+
+import (
+	"context"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"gmail-organizer/cmd/gmail/gmailtest"
+)
+
+func TestLedgerPending(t *testing.T) {
+	profile := &Profile{Name: "default", Dir: t.TempDir()}
+	l, err := openLedger(profile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	for _, entry := range []LedgerEntry{
+		{Sender: "Confirmed@Shop.example", Method: unsubscribeByOneClick, Status: unsubscribeConfirmed, At: now.Add(-365 * 24 * time.Hour)},
+		{Sender: "recent@list.example", Method: unsubscribeByMailto, Status: unsubscribeSent, At: now.Add(-time.Hour)},
+		{Sender: "stale@list.example", Method: unsubscribeByMailto, Status: unsubscribeSent, At: now.Add(-unsubscribeGracePeriod - time.Hour)},
+		{Sender: "clicked@list.example", Method: unsubscribeByBrowser, Status: unsubscribeSent, At: now.Add(-unsubscribeGracePeriod - time.Hour)},
+		{Sender: "clicked@list.example", Method: unsubscribeByBrowser, Status: unsubscribeSent, At: now.Add(-24 * time.Hour)},
+		{Sender: "failed@list.example", Method: unsubscribeByOneClick, Status: unsubscribeFailed, At: now},
+		{Sender: "opened@list.example", Method: unsubscribeByHttp, Status: unsubscribeUnconfirmed, At: now},
+		{Sender: "drafted@list.example", Method: unsubscribeByMailto, Status: unsubscribeDrafted, At: now},
+		{Sender: "old-draft@list.example", Method: unsubscribeByMailto, Status: unsubscribeDrafted, At: now.Add(-unsubscribeGracePeriod - time.Hour)},
+		{Sender: "later@list.example", Method: unsubscribeByMailto, Status: unsubscribeSent, At: now.Add(-unsubscribeGracePeriod - time.Hour)},
+		{Sender: "later@list.example", Method: unsubscribeByOneClick, Status: unsubscribeConfirmed, At: now},
+	} {
+		if err := l.record(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var summary Summary
+	got := l.pending([]string{
+		"confirmed@shop.example",
+		"recent@list.example",
+		"stale@list.example",
+		"clicked@list.example",
+		"failed@list.example",
+		"opened@list.example",
+		"drafted@list.example",
+		"old-draft@list.example",
+		"later@list.example",
+		"new@list.example",
+	}, &summary)
+
+	// a draft waits for the user to send it like a sent email waits for an effect
+	want := []string{"stale@list.example", "failed@list.example", "opened@list.example", "old-draft@list.example", "new@list.example"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("pending = %q, want %q", got, want)
+	}
+	if summary.Skipped != 5 {
+		t.Errorf("skipped %d, want 5", summary.Skipped)
+	}
+
+	// the latest unanswered request is the one waited on
+	if entry := l.settled("clicked@list.example", now); entry == nil || !entry.At.Equal(now.Add(-24*time.Hour)) {
+		t.Errorf("settled = %+v, want the latest click", entry)
+	}
+	// and a confirmation outranks it
+	if entry := l.settled("later@list.example", now); entry == nil || entry.Status != unsubscribeConfirmed {
+		t.Errorf("settled = %+v, want the confirmation", entry)
+	}
+	if entry := l.settled("recent@list.example", now.Add(unsubscribeGracePeriod)); entry != nil {
+		t.Errorf("settled after the grace period = %+v, want nil", entry)
+	}
+}
+
+func TestLedgerPersists(t *testing.T) {
+	profile := &Profile{Name: "default", Dir: t.TempDir()}
+	l, err := openLedger(profile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.recordAttempt("news@shop.example", "m1", unsubscribeByOneClick, "https://shop.example/u", "HTTP 200", unsubscribeConfirmed)
+	l.recordAttempt("digest@list.example", "m2", unsubscribeByMailto, "mailto:leave@list.example", "sent", unsubscribeSent)
+
+	entries, err := ListLedger(profile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].Sender != "news@shop.example" || entries[1].Status != unsubscribeSent {
+		t.Fatalf("entries = %+v", entries)
+	}
+	for _, entry := range entries {
+		if entry.At.IsZero() {
+			t.Errorf("entry %+v has no time", entry)
+		}
+	}
+
+	f, err := os.OpenFile(profile.path(ledgerFile), os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString("\n{not json\n")
+	f.Close()
+	if _, err := ListLedger(profile); err == nil || !strings.Contains(err.Error(), "line 4") {
+		t.Errorf("error = %v, want the bad line reported", err)
+	}
+}
+
+func TestLedgerStatusMarksSentAsUnconfirmed(t *testing.T) {
+	for _, test := range []struct {
+		status unsubscribeStatus
+		want   string
+	}{
+		{unsubscribeConfirmed, "confirmed"},
+		{unsubscribeSent, "sent (unconfirmed)"},
+		{unsubscribeUnconfirmed, "unconfirmed"},
+		{unsubscribeFailed, "failed"},
+	} {
+		entry := LedgerEntry{Status: test.status}
+		if got := entry.describeStatus(); got != test.want {
+			t.Errorf("describeStatus of %v = %q, want %q", test.status, got, test.want)
+		}
+	}
+}
+
+// An email sent longer ago than the grace period did not stop the mail, so
+// the sender is written to again.
+func TestUnsubscribeRetriesSentAfterGracePeriod(t *testing.T) {
+	srv, profile := useFakeGmail(t)
+	srv.AddMessage(gmailtest.Message{Headers: []gmailtest.Header{
+		{Name: "From", Value: "digest@list.example"},
+		{Name: "List-Unsubscribe", Value: "<mailto:unsubscribe@list.example>"},
+	}})
+
+	l, err := openLedger(profile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = l.record(LedgerEntry{
+		Sender: "digest@list.example",
+		Method: unsubscribeByMailto,
+		Target: "mailto:unsubscribe@list.example",
+		Status: unsubscribeSent,
+		At:     time.Now().Add(-unsubscribeGracePeriod - time.Hour),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	summary := InitUnsubscribe(context.Background(), profile, []string{"digest@list.example"})
+	checkSummary(t, summary, 1, 1, 0, 0)
+	if len(srv.Sent()) != 1 {
+		t.Fatalf("sent %d emails, want 1", len(srv.Sent()))
+	}
+
+	// the new email starts another grace period
+	summary = InitUnsubscribe(context.Background(), profile, []string{"digest@list.example"})
+	checkSummary(t, summary, 1, 0, 0, 1)
+	if len(srv.Sent()) != 1 {
+		t.Error("asked again within the grace period")
+	}
+}
@@ -0,0 +1,186 @@
+package gmail
+
+import (
+	"net/url"
+	"strings"
+)
+
+// unsubscribeTarget is one URI from a List-Unsubscribe header.
+type unsubscribeTarget struct {
+	// "mailto", "http" or "https"
+	scheme string
+	// the URI as sent, without angle brackets and the whitespace of folding
+	uri string
+	// mailto only: the decoded recipients, including those of "to" fields
+	addresses []string
+	// decoded query parameters; for mailto these are the header fields and
+	// body of RFC 6068, with lowercase names
+	params url.Values
+}
+
+func (t unsubscribeTarget) isMailto() bool {
+	return t.scheme == "mailto"
+}
+
+func (t unsubscribeTarget) isHttp() bool {
+	return t.scheme == "http" || t.scheme == "https"
+}
+
+// Parses a List-Unsubscribe header (RFC 2369) into its mailto and HTTP(S)
+// targets, in the sender's order of preference. URIs are enclosed in angle
+// brackets, separated by commas and may be followed by comments; whitespace
+// inside the brackets comes from folding and is dropped. URIs with other
+// schemes, and ones that do not parse, are left out. Senders that omit the
+// brackets are accepted too, as long as their URIs contain no commas.
+func parseListUnsubscribe(value string) []unsubscribeTarget {
+	var targets []unsubscribeTarget
+	add := func(uri string) {
+		if target, ok := parseUnsubscribeTarget(uri); ok {
+			targets = append(targets, target)
+		}
+	}
+
+	for i := 0; i < len(value); {
+		switch c := value[i]; {
+		case c == '<':
+			end := strings.IndexByte(value[i+1:], '>')
+			if end < 0 {
+				// unterminated, so take the rest
+				end = len(value) - i - 1
+			}
+			add(removeWhitespace(value[i+1 : i+1+end]))
+			i += end + 2
+		case c == '(':
+			i = skipComment(value, i)
+		case c == ',' || isHeaderSpace(c):
+			i++
+		default:
+			end := strings.IndexAny(value[i:], ",<( \t\r\n")
+			if end < 0 {
+				end = len(value) - i
+			}
+			add(value[i : i+end])
+			i += end
+		}
+	}
+	return targets
+}
+
+// Returns the index just past the comment that starts at value[start], which
+// may contain nested comments and backslash escapes.
+func skipComment(value string, start int) int {
+	depth := 0
+	for i := start; i < len(value); i++ {
+		switch value[i] {
+		case '\\':
+			i++
+		case '(':
+			depth++
+		case ')':
+			if depth--; depth == 0 {
+				return i + 1
+			}
+		}
+	}
+	return len(value)
+}
+
+func isHeaderSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\r' || c == '\n'
+}
+
+func removeWhitespace(value string) string {
+	return strings.Map(func(r rune) rune {
+		if r < 0x80 && isHeaderSpace(byte(r)) {
+			return -1
+		}
+		return r
+	}, value)
+}
+
+func parseUnsubscribeTarget(uri string) (unsubscribeTarget, bool) {
+	parsed, err := url.Parse(uri)
+	if err != nil {
+		return unsubscribeTarget{}, false
+	}
+
+	target := unsubscribeTarget{scheme: strings.ToLower(parsed.Scheme), uri: uri}
+	switch {
+	case target.isMailto():
+		return parseMailtoTarget(target, parsed)
+	case target.isHttp():
+		if parsed.Host == "" {
+			return unsubscribeTarget{}, false
+		}
+		target.params = parsed.Query()
+		return target, true
+	}
+	return unsubscribeTarget{}, false
+}
+
+// Decodes a mailto URI (RFC 6068). Unlike in HTTP queries "+" is not a space
+// there, so fields are unescaped as paths.
+func parseMailtoTarget(target unsubscribeTarget, parsed *url.URL) (unsubscribeTarget, bool) {
+	to := parsed.Opaque
+	if to == "" {
+		// "mailto://a@b.com" parses with a host, and the local part as a user
+		to = parsed.Host + parsed.Path
+		if parsed.User != nil {
+			to = parsed.User.String() + "@" + to
+		}
+		to = strings.TrimPrefix(to, "/")
+	}
+	target.addresses = appendMailtoAddresses(target.addresses, to)
+
+	target.params = url.Values{}
+	for _, field := range strings.Split(parsed.RawQuery, "&") {
+		if field == "" {
+			continue
+		}
+		name, value, _ := strings.Cut(field, "=")
+		name, err := url.PathUnescape(name)
+		if err != nil {
+			continue
+		}
+		value, err = url.PathUnescape(value)
+		if err != nil {
+			continue
+		}
+
+		name = strings.ToLower(name)
+		if name == "to" {
+			target.addresses = appendMailtoAddresses(target.addresses, value)
+			continue
+		}
+		target.params.Add(name, value)
+	}
+
+	// a mailto URI without anyone to write to is of no use
+	return target, len(target.addresses) > 0
+}
+
+func appendMailtoAddresses(addresses []string, to string) []string {
+	to, err := url.PathUnescape(to)
+	if err != nil {
+		return addresses
+	}
+	for _, address := range strings.Split(to, ",") {
+		if address = strings.TrimSpace(address); strings.Contains(address, "@") {
+			addresses = append(addresses, address)
+		}
+	}
+	return addresses
+}
+
+// Picks the first mailto and the first HTTP(S) target, which is all the
+// unsubscribe flows use; either is nil when the header has none.
+func firstUnsubscribeTargets(targets []unsubscribeTarget) (mailto *unsubscribeTarget, link *unsubscribeTarget) {
+	for i := range targets {
+		if targets[i].isMailto() && mailto == nil {
+			mailto = &targets[i]
+		} else if targets[i].isHttp() && link == nil {
+			link = &targets[i]
+		}
+	}
+	return mailto, link
+}
@@ -0,0 +1,187 @@
+package gmail
+
+import (
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseListUnsubscribe(t *testing.T) {
+	for _, test := range []struct {
+		name  string
+		value string
+		want  []unsubscribeTarget
+	}{
+		{"empty", "", nil},
+		{
+			"mailto and https",
+			"<mailto:leave@list.example?subject=unsubscribe>, <https://list.example/u?id=42&t=abc>",
+			[]unsubscribeTarget{
+				{scheme: "mailto", uri: "mailto:leave@list.example?subject=unsubscribe", addresses: []string{"leave@list.example"}, params: url.Values{"subject": {"unsubscribe"}}},
+				{scheme: "https", uri: "https://list.example/u?id=42&t=abc", params: url.Values{"id": {"42"}, "t": {"abc"}}},
+			},
+		},
+		{
+			"sender's order is kept",
+			"<https://list.example/u>,<mailto:leave@list.example>",
+			[]unsubscribeTarget{
+				{scheme: "https", uri: "https://list.example/u", params: url.Values{}},
+				{scheme: "mailto", uri: "mailto:leave@list.example", addresses: []string{"leave@list.example"}, params: url.Values{}},
+			},
+		},
+		{
+			"folded inside brackets",
+			"<https://list.example/unsubscribe?id=\r\n 42&list=news>",
+			[]unsubscribeTarget{{scheme: "https", uri: "https://list.example/unsubscribe?id=42&list=news", params: url.Values{"id": {"42"}, "list": {"news"}}}},
+		},
+		{
+			"folded between targets",
+			"<mailto:leave@list.example>,\r\n\t<http://list.example/u>",
+			[]unsubscribeTarget{
+				{scheme: "mailto", uri: "mailto:leave@list.example", addresses: []string{"leave@list.example"}, params: url.Values{}},
+				{scheme: "http", uri: "http://list.example/u", params: url.Values{}},
+			},
+		},
+		{
+			"comma inside brackets",
+			"<https://list.example/u?lists=a,b,c>, <mailto:a@list.example,b@list.example>",
+			[]unsubscribeTarget{
+				{scheme: "https", uri: "https://list.example/u?lists=a,b,c", params: url.Values{"lists": {"a,b,c"}}},
+				{scheme: "mailto", uri: "mailto:a@list.example,b@list.example", addresses: []string{"a@list.example", "b@list.example"}, params: url.Values{}},
+			},
+		},
+		{
+			"comments",
+			"(first choice) <mailto:leave@list.example> (or (nested \\) comment)), <https://list.example/u>",
+			[]unsubscribeTarget{
+				{scheme: "mailto", uri: "mailto:leave@list.example", addresses: []string{"leave@list.example"}, params: url.Values{}},
+				{scheme: "https", uri: "https://list.example/u", params: url.Values{}},
+			},
+		},
+		{
+			"bracketless",
+			"mailto:leave@list.example, https://list.example/u?id=1",
+			[]unsubscribeTarget{
+				{scheme: "mailto", uri: "mailto:leave@list.example", addresses: []string{"leave@list.example"}, params: url.Values{}},
+				{scheme: "https", uri: "https://list.example/u?id=1", params: url.Values{"id": {"1"}}},
+			},
+		},
+		{
+			"unterminated bracket",
+			"<mailto:leave@list.example>, <https://list.example/u",
+			[]unsubscribeTarget{
+				{scheme: "mailto", uri: "mailto:leave@list.example", addresses: []string{"leave@list.example"}, params: url.Values{}},
+				{scheme: "https", uri: "https://list.example/u", params: url.Values{}},
+			},
+		},
+		{
+			"scheme in capitals",
+			"<MAILTO:Leave@List.example>, <HTTPS://list.example/u>",
+			[]unsubscribeTarget{
+				{scheme: "mailto", uri: "MAILTO:Leave@List.example", addresses: []string{"Leave@List.example"}, params: url.Values{}},
+				{scheme: "https", uri: "HTTPS://list.example/u", params: url.Values{}},
+			},
+		},
+		{
+			"other schemes and junk are left out",
+			"<ftp://list.example/u>, <javascript:alert(1)>, <https:///no-host>, <mailto:?subject=nobody>, <%zz>, <https://list.example/u>",
+			[]unsubscribeTarget{{scheme: "https", uri: "https://list.example/u", params: url.Values{}}},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if got := parseListUnsubscribe(test.value); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("parseListUnsubscribe(%q)\n got %+v\nwant %+v", test.value, got, test.want)
+			}
+		})
+	}
+}
+
+func TestParseMailtoTarget(t *testing.T) {
+	for _, test := range []struct {
+		name          string
+		uri           string
+		wantAddresses []string
+		wantParams    url.Values
+	}{
+		{"plain", "mailto:leave@list.example", []string{"leave@list.example"}, url.Values{}},
+		{"escaped address", "mailto:leave%2Bnews@list.example", []string{"leave+news@list.example"}, url.Values{}},
+		// RFC 6068 has no form encoding, so "+" stays a plus
+		{"plus is literal", "mailto:leave@list.example?subject=stop+it&body=a%20b", []string{"leave@list.example"}, url.Values{"subject": {"stop+it"}, "body": {"a b"}}},
+		{"field names are lowercased", "mailto:leave@list.example?Subject=x&BODY=y", []string{"leave@list.example"}, url.Values{"subject": {"x"}, "body": {"y"}}},
+		{"to fields add recipients", "mailto:a@list.example?to=b@list.example,%20c@list.example&subject=x", []string{"a@list.example", "b@list.example", "c@list.example"}, url.Values{"subject": {"x"}}},
+		{"only a to field", "mailto:?to=leave@list.example", []string{"leave@list.example"}, url.Values{}},
+		// kept in params, but never written into the email
+		{"cc is a param", "mailto:leave@list.example?cc=boss@corp.example", []string{"leave@list.example"}, url.Values{"cc": {"boss@corp.example"}}},
+		{"with a host", "mailto://leave@list.example", []string{"leave@list.example"}, url.Values{}},
+		{"bad escapes are skipped", "mailto:leave@list.example?subject=%zz&body=ok", []string{"leave@list.example"}, url.Values{"body": {"ok"}}},
+		{"repeated fields", "mailto:leave@list.example?body=a&body=b", []string{"leave@list.example"}, url.Values{"body": {"a", "b"}}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			target, ok := parseUnsubscribeTarget(test.uri)
+			if !ok {
+				t.Fatalf("parseUnsubscribeTarget(%q) failed", test.uri)
+			}
+			if !target.isMailto() || target.isHttp() {
+				t.Errorf("scheme = %q, want mailto", target.scheme)
+			}
+			if !reflect.DeepEqual(target.addresses, test.wantAddresses) {
+				t.Errorf("addresses = %q, want %q", target.addresses, test.wantAddresses)
+			}
+			if !reflect.DeepEqual(target.params, test.wantParams) {
+				t.Errorf("params = %v, want %v", target.params, test.wantParams)
+			}
+		})
+	}
+}
+
+func TestFirstUnsubscribeTargets(t *testing.T) {
+	targets := parseListUnsubscribe("<https://list.example/1>, <mailto:a@list.example>, <http://list.example/2>, <mailto:b@list.example>")
+	mailto, link := firstUnsubscribeTargets(targets)
+	if mailto == nil || mailto.uri != "mailto:a@list.example" {
+		t.Errorf("mailto = %+v, want the first", mailto)
+	}
+	if link == nil || link.uri != "https://list.example/1" {
+		t.Errorf("link = %+v, want the first", link)
+	}
+
+	mailto, link = firstUnsubscribeTargets(parseListUnsubscribe("<mailto:a@list.example>"))
+	if mailto == nil || link != nil {
+		t.Errorf("mailto only: got %+v and %+v", mailto, link)
+	}
+}
+
+func FuzzParseListUnsubscribe(f *testing.F) {
+	f.Add("<mailto:leave@list.example?subject=unsubscribe>, <https://list.example/u?id=42>")
+	f.Add("mailto:leave@list.example, https://list.example/u")
+
+	f.Fuzz(func(t *testing.T, value string) {
+		for _, target := range parseListUnsubscribe(value) {
+			if !target.isMailto() && !target.isHttp() {
+				t.Fatalf("target %q has scheme %q", target.uri, target.scheme)
+			}
+			if strings.ContainsAny(target.uri, " \t\r\n") {
+				t.Fatalf("target %q kept folding whitespace", target.uri)
+			}
+			if target.params == nil {
+				t.Fatalf("target %q has nil params", target.uri)
+			}
+			if target.isMailto() {
+				if len(target.addresses) == 0 {
+					t.Fatalf("mailto target %q has no recipients", target.uri)
+				}
+				for _, address := range target.addresses {
+					if !strings.Contains(address, "@") {
+						t.Fatalf("mailto target %q has recipient %q", target.uri, address)
+					}
+				}
+			}
+
+			// a target's URI parses back into the same target
+			again, ok := parseUnsubscribeTarget(target.uri)
+			if !ok || !reflect.DeepEqual(again, target) {
+				t.Fatalf("target %q parses back as %+v, %v", target.uri, again, ok)
+			}
+		}
+	})
+}
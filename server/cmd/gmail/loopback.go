@@ -0,0 +1,141 @@
+package gmail
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+const (
+	loopbackHost     = "127.0.0.1"
+	loopbackPath     = "/oauth2/callback"
+	loopbackTimeout  = 3 * time.Minute
+	shutdownTimeout  = 5 * time.Second
+	stateTokenLength = 32
+)
+
+type authorizationResult struct {
+	code string
+	err  error
+}
+
+type authorizationError struct {
+	code, description string
+}
+
+func (a *authorizationError) Error() string {
+	if a.description == "" {
+		return fmt.Sprintf("authorization server returned error \"%v\"", a.code)
+	}
+	return fmt.Sprintf("authorization server returned error \"%v\": %v", a.code, a.description)
+}
+
+// Runs the authorization code flow (with PKCE) against a temporary listener on
+// the loopback interface and returns the exchanged token. openURL is called
+// with the consent page URL; it is a parameter so the flow can be driven by a
+// fake authorization server.
+func tokenFromLoopback(ctx context.Context, config *oauth2.Config, openURL func(string) error, timeout time.Duration) (*oauth2.Token, error) {
+	listener, err := net.Listen("tcp", net.JoinHostPort(loopbackHost, "0"))
+	if err != nil {
+		return nil, fmt.Errorf("error starting loopback listener: %v", err.Error())
+	}
+
+	state, err := randomStateToken()
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+	verifier := oauth2.GenerateVerifier()
+
+	// work on a copy so the redirect URL of the shared config is left untouched
+	loopbackConfig := *config
+	loopbackConfig.RedirectURL = fmt.Sprintf("http://%s%s", listener.Addr().String(), loopbackPath)
+
+	results := make(chan authorizationResult, 1)
+	deliver := func(result authorizationResult) {
+		select {
+		case results <- result:
+		default:
+		}
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(loopbackPath, func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+
+		// a mismatched state is never ours, so reject it without ending the flow
+		if query.Get("state") != state {
+			http.Error(w, "Invalid state parameter.", http.StatusBadRequest)
+			return
+		}
+
+		if code := query.Get("error"); code != "" {
+			http.Error(w, "Authorization was not granted. You may close this window.", http.StatusForbidden)
+			deliver(authorizationResult{err: &authorizationError{code, query.Get("error_description")}})
+			return
+		}
+
+		code := query.Get("code")
+		if code == "" {
+			http.Error(w, "Missing authorization code.", http.StatusBadRequest)
+			deliver(authorizationResult{err: errors.New("redirect did not contain an authorization code")})
+			return
+		}
+
+		fmt.Fprintln(w, "Authorization complete. You may close this window and return to the terminal.")
+		deliver(authorizationResult{code: code})
+	})
+
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go server.Serve(listener)
+	defer func() {
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+
+	// include_granted_scopes makes the new token cover earlier grants as well,
+	// so scopes can be added one operation at a time
+	authURL := loopbackConfig.AuthCodeURL(state, oauth2.AccessTypeOffline, oauth2.S256ChallengeOption(verifier), oauth2.SetAuthURLParam("include_granted_scopes", "true"))
+	fmt.Printf("Go to the following link in your browser to authorize access: \n%v\n", authURL)
+
+	if err := openURL(authURL); err != nil {
+		fmt.Printf("Failed to automatically open URL. Manually copy the link above.\n")
+	}
+
+	waitCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	select {
+	case result := <-results:
+		if result.err != nil {
+			return nil, result.err
+		}
+
+		tok, err := loopbackConfig.Exchange(waitCtx, result.code, oauth2.VerifierOption(verifier))
+		if err != nil {
+			return nil, fmt.Errorf("error exchanging authorization code: %v", err.Error())
+		}
+		return tok, nil
+	case <-waitCtx.Done():
+		if errors.Is(waitCtx.Err(), context.DeadlineExceeded) {
+			return nil, fmt.Errorf("timed out after %v waiting for the authorization redirect", timeout)
+		}
+		return nil, waitCtx.Err()
+	}
+}
+
+func randomStateToken() (string, error) {
+	b := make([]byte, stateTokenLength)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("error generating state token: %v", err.Error())
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
@@ -0,0 +1,293 @@
+package gmail
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// fakeAuthServer plays Google's authorization server: openURL reads the
+// consent URL the flow builds and redirects back to it, and the token endpoint
+// checks the PKCE verifier against the challenge it was given.
+type fakeAuthServer struct {
+	*httptest.Server
+
+	mu        sync.Mutex
+	challenge string
+	verifier  string
+	// answers refresh grants with this status, or issues a token when zero
+	refreshStatus int
+	refreshes     int
+}
+
+func newFakeAuthServer(t *testing.T) *fakeAuthServer {
+	s := &fakeAuthServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/token" {
+			http.NotFound(w, r)
+			return
+		}
+		r.ParseForm()
+		if r.Form.Get("grant_type") == "refresh_token" {
+			s.refresh(w, r)
+			return
+		}
+
+		s.mu.Lock()
+		s.verifier = r.Form.Get("code_verifier")
+		challenge := s.challenge
+		s.mu.Unlock()
+
+		sum := sha256.Sum256([]byte(r.Form.Get("code_verifier")))
+		if r.Form.Get("code") != "the-code" || base64.RawURLEncoding.EncodeToString(sum[:]) != challenge {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"invalid_grant"}`))
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token":  "access",
+			"refresh_token": "refresh",
+			"token_type":    "Bearer",
+			"expires_in":    3600,
+		})
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *fakeAuthServer) refresh(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.refreshes++
+	status := s.refreshStatus
+	s.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	switch {
+	case status == http.StatusBadRequest:
+		w.WriteHeader(status)
+		w.Write([]byte(`{"error":"invalid_grant","error_description":"Token has been expired or revoked."}`))
+	case status != 0:
+		w.WriteHeader(status)
+		w.Write([]byte(`{"error":"internal_failure"}`))
+	case r.Form.Get("refresh_token") != "refresh":
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error":"invalid_request"}`))
+	default:
+		// like Google, without repeating the scopes
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": "refreshed",
+			"token_type":   "Bearer",
+			"expires_in":   3600,
+		})
+	}
+}
+
+func (s *fakeAuthServer) config() *oauth2.Config {
+	return &oauth2.Config{
+		ClientID:     "client",
+		ClientSecret: "secret",
+		Endpoint:     oauth2.Endpoint{AuthURL: s.URL + "/auth", TokenURL: s.URL + "/token", AuthStyle: oauth2.AuthStyleInParams},
+		Scopes:       []string{"scope"},
+	}
+}
+
+// The statuses the loopback listener answered redirects with.
+type redirectLog struct {
+	done     chan struct{}
+	statuses []int
+}
+
+// Returns an openURL that follows the consent URL back to the loopback
+// listener with the query each redirect builds, and logs the answers.
+func (s *fakeAuthServer) browser(t *testing.T, redirects ...func(consent url.Values) url.Values) (func(string) error, *redirectLog) {
+	log := &redirectLog{done: make(chan struct{})}
+	return func(authURL string) error {
+		parsed, err := url.Parse(authURL)
+		if err != nil {
+			t.Errorf("unparsable consent URL %v", authURL)
+			return err
+		}
+		consent := parsed.Query()
+		if consent.Get("code_challenge_method") != "S256" {
+			t.Errorf("code_challenge_method = %q, want S256", consent.Get("code_challenge_method"))
+		}
+
+		s.mu.Lock()
+		s.challenge = consent.Get("code_challenge")
+		s.mu.Unlock()
+
+		// the flow waits on the redirect, so follow it in the background
+		go func() {
+			defer close(log.done)
+			for _, redirect := range redirects {
+				res, err := http.Get(consent.Get("redirect_uri") + "?" + redirect(consent).Encode())
+				if err != nil {
+					t.Errorf("redirect failed: %v", err)
+					return
+				}
+				res.Body.Close()
+				log.statuses = append(log.statuses, res.StatusCode)
+			}
+		}()
+		return nil
+	}, log
+}
+
+func grantCode(consent url.Values) url.Values {
+	return url.Values{"code": {"the-code"}, "state": {consent.Get("state")}}
+}
+
+func TestTokenFromLoopback(t *testing.T) {
+	server := newFakeAuthServer(t)
+	openURL, _ := server.browser(t, grantCode)
+
+	tok, err := tokenFromLoopback(context.Background(), server.config(), openURL, 5*time.Second)
+	if err != nil {
+		t.Fatalf("tokenFromLoopback: %v", err)
+	}
+	if tok.AccessToken != "access" || tok.RefreshToken != "refresh" {
+		t.Errorf("token = %+v, want the one the server issued", tok)
+	}
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if server.verifier == "" {
+		t.Error("the code exchange carried no PKCE verifier")
+	}
+}
+
+func TestTokenFromLoopbackConsentURL(t *testing.T) {
+	server := newFakeAuthServer(t)
+	config := server.config()
+
+	var consent url.Values
+	openURL := func(authURL string) error {
+		parsed, _ := url.Parse(authURL)
+		consent = parsed.Query()
+		return errors.New("no browser")
+	}
+	tokenFromLoopback(context.Background(), config, openURL, 10*time.Millisecond)
+
+	for _, param := range []string{"state", "code_challenge"} {
+		if consent.Get(param) == "" {
+			t.Errorf("consent URL has no %v", param)
+		}
+	}
+	if consent.Get("access_type") != "offline" || consent.Get("include_granted_scopes") != "true" {
+		t.Errorf("consent URL query = %v, want offline access including granted scopes", consent)
+	}
+	if redirect := consent.Get("redirect_uri"); !strings.HasPrefix(redirect, "http://"+loopbackHost+":") || !strings.HasSuffix(redirect, loopbackPath) {
+		t.Errorf("redirect_uri = %v, want the loopback listener", redirect)
+	}
+	if config.RedirectURL != "" {
+		t.Errorf("the shared config's RedirectURL was changed to %v", config.RedirectURL)
+	}
+}
+
+func TestTokenFromLoopbackStateMismatch(t *testing.T) {
+	server := newFakeAuthServer(t)
+	forged := func(consent url.Values) url.Values {
+		return url.Values{"code": {"the-code"}, "state": {"forged"}}
+	}
+	// a forged redirect is refused without ending the flow, so the real one
+	// that follows still completes it
+	openURL, log := server.browser(t, forged, grantCode)
+
+	tok, err := tokenFromLoopback(context.Background(), server.config(), openURL, 5*time.Second)
+	if err != nil {
+		t.Fatalf("tokenFromLoopback: %v", err)
+	}
+	if tok.AccessToken != "access" {
+		t.Errorf("token = %+v, want the one the server issued", tok)
+	}
+	<-log.done
+	if len(log.statuses) == 0 || log.statuses[0] != http.StatusBadRequest {
+		t.Errorf("redirect statuses = %v, want %v first", log.statuses, http.StatusBadRequest)
+	}
+}
+
+func TestTokenFromLoopbackStateMismatchOnly(t *testing.T) {
+	server := newFakeAuthServer(t)
+	forged := func(consent url.Values) url.Values {
+		return url.Values{"code": {"the-code"}, "state": {consent.Get("state") + "x"}}
+	}
+	openURL, log := server.browser(t, forged)
+
+	_, err := tokenFromLoopback(context.Background(), server.config(), openURL, 200*time.Millisecond)
+	<-log.done
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Errorf("error = %v, want a timeout since only a forged redirect arrived", err)
+	}
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if server.verifier != "" {
+		t.Error("a forged redirect's code was exchanged")
+	}
+}
+
+func TestTokenFromLoopbackErrorRedirect(t *testing.T) {
+	server := newFakeAuthServer(t)
+	denied := func(consent url.Values) url.Values {
+		return url.Values{"error": {"access_denied"}, "error_description": {"The user denied access"}, "state": {consent.Get("state")}}
+	}
+	openURL, _ := server.browser(t, denied)
+
+	_, err := tokenFromLoopback(context.Background(), server.config(), openURL, 5*time.Second)
+	var authErr *authorizationError
+	if !errors.As(err, &authErr) {
+		t.Fatalf("error = %v, want an authorizationError", err)
+	}
+	if authErr.code != "access_denied" || authErr.description != "The user denied access" {
+		t.Errorf("authorizationError = %+v", authErr)
+	}
+}
+
+func TestTokenFromLoopbackMissingCode(t *testing.T) {
+	server := newFakeAuthServer(t)
+	empty := func(consent url.Values) url.Values {
+		return url.Values{"state": {consent.Get("state")}}
+	}
+	openURL, _ := server.browser(t, empty)
+
+	_, err := tokenFromLoopback(context.Background(), server.config(), openURL, 5*time.Second)
+	if err == nil || !strings.Contains(err.Error(), "authorization code") {
+		t.Errorf("error = %v, want a missing code error", err)
+	}
+}
+
+func TestTokenFromLoopbackTimeout(t *testing.T) {
+	server := newFakeAuthServer(t)
+	openURL := func(string) error { return nil }
+
+	_, err := tokenFromLoopback(context.Background(), server.config(), openURL, 50*time.Millisecond)
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Errorf("error = %v, want a timeout", err)
+	}
+}
+
+func TestTokenFromLoopbackCancel(t *testing.T) {
+	server := newFakeAuthServer(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	openURL := func(string) error {
+		cancel()
+		return nil
+	}
+
+	_, err := tokenFromLoopback(ctx, server.config(), openURL, 5*time.Second)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("error = %v, want context.Canceled", err)
+	}
+}
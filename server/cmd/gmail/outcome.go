@@ -0,0 +1,70 @@
+package gmail
+
+import (
+	"fmt"
+)
+
+// Outcome is the result of a mutating call for a single item: a message ID, a
+// sender or an unsubscribe address. Err is nil when Gmail confirmed the change.
+type Outcome struct {
+	Item string
+	Err  error
+}
+
+type Outcomes []Outcome
+
+func failAll(items []string, err error) Outcomes {
+	outcomes := make(Outcomes, len(items))
+	for i, item := range items {
+		outcomes[i] = Outcome{item, err}
+	}
+	return outcomes
+}
+
+func succeedAll(items []string) Outcomes {
+	return failAll(items, nil)
+}
+
+func (o Outcomes) Succeeded() []string {
+	var items []string
+	for _, outcome := range o {
+		if outcome.Err == nil {
+			items = append(items, outcome.Item)
+		}
+	}
+	return items
+}
+
+func (o Outcomes) Failed() Outcomes {
+	var failed Outcomes
+	for _, outcome := range o {
+		if outcome.Err != nil {
+			failed = append(failed, outcome)
+		}
+	}
+	return failed
+}
+
+// Returns the first failure, noting how many items failed in total, or nil
+// when every item succeeded.
+func (o Outcomes) Err() error {
+	failed := o.Failed()
+	if len(failed) == 0 {
+		return nil
+	}
+
+	err := explain(failed[0].Err)
+	if len(failed) == 1 {
+		return fmt.Errorf("%v: %v", failed[0].Item, err.Error())
+	}
+	return fmt.Errorf("%v of %v items failed, first error: %v", len(failed), len(o), err.Error())
+}
+
+// Fills in the summary's counts from the outcomes.
+func (o Outcomes) summarize(summary *Summary) {
+	summary.Succeeded += len(o.Succeeded())
+	summary.Failed += len(o.Failed())
+	if err := o.Err(); err != nil && summary.Err == nil {
+		summary.Err = err
+	}
+}
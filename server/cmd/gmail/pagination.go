@@ -0,0 +1,149 @@
+package gmail
+
+import "fmt"
+
+const (
+	// largest page messages.list will return
+	listPageLimit = 500
+	// most IDs messages.batchDelete and messages.batchModify accept per call
+	batchDeleteLimit = 1000
+)
+
+// MessageIterator walks every page of a messages.list query, fetching the next
+// page only once the current one has been consumed.
+//
+//	it := client.IterateMessages(query, 0)
+//	for it.Next() {
+//		id := it.Id()
+//	}
+//	if err := it.Err(); err != nil { ... }
+type MessageIterator struct {
+	client    *Client
+	query     string
+	limit     int
+	returned  int
+	page      []string
+	pageToken string
+	current   string
+	started   bool
+	err       error
+}
+
+// Returns an iterator over the IDs of messages matching query. A limit of 0 or
+// less walks every page.
+func (c *Client) IterateMessages(query string, limit int) *MessageIterator {
+	return &MessageIterator{client: c, query: query, limit: limit}
+}
+
+func (it *MessageIterator) Next() bool {
+	if it.err != nil || (it.limit > 0 && it.returned >= it.limit) {
+		return false
+	}
+
+	for len(it.page) == 0 {
+		// the first page has no token; any later page without one was the last
+		if it.started && it.pageToken == "" {
+			return false
+		}
+		it.started = true
+
+		pageSize := listPageLimit
+		if it.limit > 0 && it.limit-it.returned < pageSize {
+			pageSize = it.limit - it.returned
+		}
+
+		it.page, it.pageToken, it.err = it.client.listMessagesPage(it.query, pageSize, it.pageToken)
+		if it.err != nil {
+			return false
+		}
+	}
+
+	it.current, it.page = it.page[0], it.page[1:]
+	it.returned++
+	return true
+}
+
+// ID of the message the last call to Next advanced to.
+func (it *MessageIterator) Id() string {
+	return it.current
+}
+
+func (it *MessageIterator) Err() error {
+	return it.err
+}
+
+// Splits ids into consecutive chunks of at most size IDs.
+func chunk(ids []string, size int) [][]string {
+	var chunks [][]string
+	for size < len(ids) {
+		ids, chunks = ids[size:], append(chunks, ids[:size])
+	}
+	if len(ids) > 0 {
+		chunks = append(chunks, ids)
+	}
+	return chunks
+}
+
+// Prints a running count for long bulk operations.
+type progress struct {
+	label               string
+	done, failed, total int
+}
+
+func newProgress(label string, total int) *progress {
+	return &progress{label: label, total: total}
+}
+
+func (p *progress) add(n int) {
+	p.done += n
+	p.print()
+}
+
+// Counts messages Gmail did not accept, so the line still ends once every
+// message is accounted for.
+func (p *progress) fail(n int) {
+	p.failed += n
+	p.print()
+}
+
+func (p *progress) print() {
+	fmt.Printf("\r%v %v/%v messages", p.label, p.done, p.total)
+	if p.failed > 0 {
+		fmt.Printf(" (%v failed)", p.failed)
+	}
+	if p.done+p.failed >= p.total {
+		fmt.Println()
+	}
+}
+
+// Calls apply with each chunk of at most size message IDs and records an
+// outcome for every ID. Once a chunk fails in a way every later chunk would
+// too (revoked access, exhausted quota), the rest are failed without sending.
+func applyInChunks(messageIds []string, size int, label string, apply func([]string) error) Outcomes {
+	progress := newProgress(label, len(messageIds))
+	chunks := chunk(messageIds, size)
+
+	var outcomes Outcomes
+	for i, ids := range chunks {
+		err := apply(ids)
+		if err == nil {
+			outcomes = append(outcomes, succeedAll(ids)...)
+			progress.add(len(ids))
+			continue
+		}
+
+		outcomes = append(outcomes, failAll(ids, err)...)
+		progress.fail(len(ids))
+
+		if IsAuth(err) || IsRateLimited(err) {
+			skipped := fmt.Errorf("not sent after an earlier failure: %w", err)
+			for _, rest := range chunks[i+1:] {
+				outcomes = append(outcomes, failAll(rest, skipped)...)
+				progress.fail(len(rest))
+			}
+			break
+		}
+	}
+
+	return outcomes
+}
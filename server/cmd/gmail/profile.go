@@ -0,0 +1,171 @@
+package gmail
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	profilesDir        = "profiles"
+	impersonatedDir    = "impersonated"
+	defaultProfileName = "default"
+	settingsFile       = "settings.json"
+	deletionListFile   = "deletionList.json"
+)
+
+// Profile is a named account with its own token, deletion list and settings.
+// Profiles live in profiles/<name>/; the default profile uses the files in the
+// working directory so single-account setups keep working unchanged, and users
+// impersonated by a service account get impersonated/<address>/.
+type Profile struct {
+	Name     string
+	Dir      string
+	Settings ProfileSettings
+	// path of the deletion list when it is not kept in Dir, as for users
+	// impersonated by a service account
+	deletionList string
+}
+
+type ProfileSettings struct {
+	// Address of the account, used as the Gmail user ID, to pick the account in
+	// the web UI and as the sender of unsubscribe emails.
+	Address string `json:"address"`
+	// Chrome profile directory used for the web driver, overriding CHROME_PROFILE.
+	ChromeProfile string `json:"chromeProfile"`
+	// Path to a service account key. When set, Address is impersonated through
+	// domain-wide delegation instead of using a stored OAuth token.
+	ServiceAccountKey string `json:"serviceAccountKey"`
+	// Send-as alias that unsubscribe emails come from instead of the account's
+	// default address. For Gmail it has to be a verified alias of the account.
+	SendAs string `json:"sendAs"`
+	// When set, the mailbox is reached over IMAP instead of the Gmail API.
+	Imap *ImapSettings `json:"imap"`
+}
+
+// Summary is the outcome of one operation against one account.
+type Summary struct {
+	Account   string
+	Operation string
+	Processed int
+	Succeeded int
+	Failed    int
+	// items that matched the selection but were deliberately left alone
+	Skipped int
+	Err     error
+}
+
+// Loads the named profile, or the default profile when name is empty.
+func LoadProfile(name string) (*Profile, error) {
+	if name == "" || name == defaultProfileName {
+		return loadProfileFrom(defaultProfileName, ".")
+	}
+
+	dir := filepath.Join(profilesDir, name)
+	info, err := os.Stat(dir)
+	if err != nil || !info.IsDir() {
+		return nil, fmt.Errorf("profile \"%v\" not found, expected a directory at %v", name, dir)
+	}
+
+	return loadProfileFrom(name, dir)
+}
+
+// Lists every profile under profiles/, sorted by name. Falls back to the
+// default profile when none have been created.
+func ListProfiles() ([]*Profile, error) {
+	entries, err := os.ReadDir(profilesDir)
+	if errors.Is(err, os.ErrNotExist) {
+		profile, err := LoadProfile("")
+		if err != nil {
+			return nil, err
+		}
+		return []*Profile{profile}, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("error reading %v: %v", profilesDir, err.Error())
+	}
+
+	var names []string
+	for _, entry := range entries {
+		if entry.IsDir() && !strings.HasPrefix(entry.Name(), ".") {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names)
+
+	if len(names) == 0 {
+		profile, err := LoadProfile("")
+		if err != nil {
+			return nil, err
+		}
+		return []*Profile{profile}, nil
+	}
+
+	profiles := make([]*Profile, 0, len(names))
+	for _, name := range names {
+		profile, err := LoadProfile(name)
+		if err != nil {
+			return nil, err
+		}
+		profiles = append(profiles, profile)
+	}
+
+	return profiles, nil
+}
+
+func loadProfileFrom(name, dir string) (*Profile, error) {
+	profile := &Profile{Name: name, Dir: dir}
+
+	data, err := os.ReadFile(profile.path(settingsFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return profile, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("error reading settings for profile \"%v\": %v", name, err.Error())
+	}
+
+	if err := json.Unmarshal(data, &profile.Settings); err != nil {
+		return nil, fmt.Errorf("error unmarshalling settings for profile \"%v\": %v", name, err.Error())
+	}
+
+	return profile, nil
+}
+
+func (p *Profile) path(file string) string {
+	return filepath.Join(p.Dir, file)
+}
+
+func (p *Profile) DeletionListPath() string {
+	if p.deletionList != "" {
+		return p.deletionList
+	}
+	return p.path(deletionListFile)
+}
+
+// Gmail user ID for API paths; "me" resolves to whoever the token belongs to.
+func (p *Profile) userId() string {
+	if p.Settings.Address != "" {
+		return p.Settings.Address
+	}
+	return "me"
+}
+
+// Prints one line per account and operation, followed by the totals.
+func PrintSummaries(summaries []Summary) {
+	var processed, succeeded, failed, skipped int
+
+	fmt.Printf("\n%-32s %-22s %10s %10s %10s %10s\n", "Account", "Operation", "Processed", "Succeeded", "Failed", "Skipped")
+	for _, summary := range summaries {
+		fmt.Printf("%-32s %-22s %10d %10d %10d %10d\n", summary.Account, summary.Operation, summary.Processed, summary.Succeeded, summary.Failed, summary.Skipped)
+		if summary.Err != nil {
+			fmt.Printf("  error: %v\n", summary.Err)
+		}
+		processed += summary.Processed
+		succeeded += summary.Succeeded
+		failed += summary.Failed
+		skipped += summary.Skipped
+	}
+	fmt.Printf("%-32s %-22s %10d %10d %10d %10d\n", "Total", "", processed, succeeded, failed, skipped)
+}
@@ -0,0 +1,166 @@
+package gmail
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeSettings(t *testing.T, dir, settings string) {
+	t.Helper()
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, settingsFile), []byte(settings), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadProfile(t *testing.T) {
+	inTempDir(t)
+
+	for _, name := range []string{"", defaultProfileName} {
+		profile, err := LoadProfile(name)
+		if err != nil {
+			t.Fatalf("LoadProfile(%q): %v", name, err)
+		}
+		if profile.Name != defaultProfileName || profile.Dir != "." || profile.Settings != (ProfileSettings{}) {
+			t.Errorf("LoadProfile(%q) = %+v, want the empty default profile", name, profile)
+		}
+	}
+
+	writeSettings(t, ".", `{"address": "me@example.com", "sendAs": "alias@example.com"}`)
+	if profile, err := LoadProfile(""); err != nil || profile.Settings.Address != "me@example.com" || profile.Settings.SendAs != "alias@example.com" {
+		t.Errorf("default profile = %+v, %v; want its settings loaded", profile, err)
+	}
+
+	writeSettings(t, filepath.Join(profilesDir, "work"), `{"address": "me@corp.example", "chromeProfile": "Profile 2"}`)
+	profile, err := LoadProfile("work")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if profile.Name != "work" || profile.Dir != filepath.Join(profilesDir, "work") || profile.Settings.Address != "me@corp.example" || profile.Settings.ChromeProfile != "Profile 2" {
+		t.Errorf("LoadProfile(\"work\") = %+v", profile)
+	}
+	if got, want := profile.DeletionListPath(), filepath.Join(profilesDir, "work", deletionListFile); got != want {
+		t.Errorf("DeletionListPath = %v, want %v", got, want)
+	}
+
+	// a profile without settings still loads, and uses "me" as its user
+	os.MkdirAll(filepath.Join(profilesDir, "bare"), 0700)
+	if profile, err := LoadProfile("bare"); err != nil || profile.userId() != "me" {
+		t.Errorf("LoadProfile(\"bare\") = %+v, %v", profile, err)
+	}
+
+	if _, err := LoadProfile("missing"); err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Errorf("LoadProfile(\"missing\"): error = %v, want not found", err)
+	}
+	os.WriteFile(filepath.Join(profilesDir, "file"), nil, 0600)
+	if _, err := LoadProfile("file"); err == nil {
+		t.Error("a file under profiles/ loaded as a profile")
+	}
+
+	writeSettings(t, filepath.Join(profilesDir, "broken"), `{"address": `)
+	if _, err := LoadProfile("broken"); err == nil || !strings.Contains(err.Error(), "broken") {
+		t.Errorf("LoadProfile(\"broken\"): error = %v, want the profile named", err)
+	}
+}
+
+func TestListProfiles(t *testing.T) {
+	inTempDir(t)
+
+	names := func() []string {
+		t.Helper()
+		profiles, err := ListProfiles()
+		if err != nil {
+			t.Fatalf("ListProfiles: %v", err)
+		}
+		var names []string
+		for _, profile := range profiles {
+			names = append(names, profile.Name)
+		}
+		return names
+	}
+
+	// without profiles/, or with an empty one, the working directory is used
+	if got := names(); len(got) != 1 || got[0] != defaultProfileName {
+		t.Errorf("without profiles/: %q", got)
+	}
+	os.Mkdir(profilesDir, 0700)
+	os.Mkdir(filepath.Join(profilesDir, ".hidden"), 0700)
+	if got := names(); len(got) != 1 || got[0] != defaultProfileName {
+		t.Errorf("with an empty profiles/: %q", got)
+	}
+
+	writeSettings(t, filepath.Join(profilesDir, "work"), `{"address": "me@corp.example"}`)
+	writeSettings(t, filepath.Join(profilesDir, "home"), `{"address": "me@home.example"}`)
+	os.WriteFile(filepath.Join(profilesDir, "notes.txt"), nil, 0600)
+	if got := names(); strings.Join(got, ",") != "home,work" {
+		t.Errorf("profiles = %q, want home and work, sorted", got)
+	}
+
+	writeSettings(t, filepath.Join(profilesDir, "broken"), `not json`)
+	if _, err := ListProfiles(); err == nil {
+		t.Error("a profile with broken settings was listed")
+	}
+}
+
+// Runs the removal once per profile, as --all-accounts does: each run works
+// on its own account, and reports and journals only its own messages.
+func TestRemovalRunsOncePerProfile(t *testing.T) {
+	srv, _ := useFakeGmail(t)
+	inTempDir(t)
+	writeSettings(t, filepath.Join(profilesDir, "home"), `{"address": "me@home.example"}`)
+	writeSettings(t, filepath.Join(profilesDir, "work"), `{"address": "me@corp.example"}`)
+
+	addFrom(srv, "news@shop.example")
+	addFrom(srv, "news@shop.example")
+	addFrom(srv, "digest@list.example")
+	deletionLists := map[string][]string{
+		"home": {"news@shop.example"},
+		"work": {"digest@list.example"},
+	}
+
+	profiles, err := ListProfiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var summaries []Summary
+	for _, profile := range profiles {
+		summaries = append(summaries, InitMessageRemoval(context.Background(), profile, deletionLists[profile.Name], nil, false))
+	}
+
+	if len(summaries) != 2 || summaries[0].Account != "home" || summaries[1].Account != "work" {
+		t.Fatalf("summaries = %+v, want one per profile", summaries)
+	}
+	checkSummary(t, summaries[0], 2, 2, 0, 0)
+	checkSummary(t, summaries[1], 1, 1, 0, 0)
+
+	// each run addressed its own account
+	var home, work int
+	for _, request := range srv.Requests() {
+		switch {
+		case strings.Contains(request, "/users/me@home.example/"):
+			home++
+		case strings.Contains(request, "/users/me@corp.example/"):
+			work++
+		default:
+			t.Errorf("request %q names neither account", request)
+		}
+	}
+	if home == 0 || work == 0 {
+		t.Errorf("%d requests for home and %d for work, want both", home, work)
+	}
+
+	for i, profile := range profiles {
+		journals, err := ListJournals(profile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(journals) != 1 || journals[0].Account != profile.Name || len(journals[0].MessageIds) != summaries[i].Succeeded {
+			t.Errorf("%v journals = %+v, want its one run", profile.Name, journals)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package gmail
+
+import (
+	"context"
+	"fmt"
+)
+
+// Provider is a mailbox the removal and unsubscribe flows can run against:
+// Gmail through its REST API (Client), or any IMAP server. Messages are named
+// by provider specific IDs, which are only meaningful to the provider that
+// returned them.
+type Provider interface {
+	// Lists messages from any of the senders that also match filter, which may
+	// be nil, newest first. A maxResults of 0 or less lists every match.
+	ListBySender(senderAddresses []string, filter *Query, maxResults int) ([]string, error)
+	// Fetches only the named headers of each message. Results are in the order
+	// of msgIds.
+	FetchHeaders(msgIds []string, headers ...string) []messageResult
+	// Moves messages to the trash. Successful outcomes name each message by the
+	// ID it has in the trash, which is what Restore takes.
+	Trash(msgIds []string) Outcomes
+	// Takes trashed messages back out of the trash.
+	Restore(msgIds []string) Outcomes
+	// Deletes messages for good.
+	Delete(msgIds []string) Outcomes
+	// Moves messages out of the inbox into a mailbox (IMAP) or label (Gmail).
+	// Successful outcomes name each message by its ID after the move.
+	Move(msgIds []string, mailbox string) Outcomes
+
+	// act on List-Unsubscribe targets on the mailbox owner's behalf; a link is
+	// sent an RFC 8058 one-click request when oneClick is set, and an email is
+	// only saved as a draft when draft is set; links also return the status
+	// code of the answer, or 0 when there was none
+	UnsubscribeByMailtoAddress(mailto unsubscribeTarget, draft bool) error
+	UnsubscribeByHttpAddress(link unsubscribeTarget, oneClick bool) (int, error)
+
+	// Releases the connection, if the provider holds one.
+	Close() error
+}
+
+// Opens the profile's mailbox: its IMAP server when one is configured,
+// otherwise Gmail with at least the scopes the operation declares. Calls on the
+// returned provider stop once ctx is cancelled.
+func openProvider(ctx context.Context, profile *Profile, op operation) (Provider, error) {
+	if profile.Settings.Imap != nil {
+		return newImapProvider(ctx, profile)
+	}
+
+	client, _, err := main(profile, op)
+	if err != nil {
+		return nil, err
+	}
+	return client.WithContext(ctx), nil
+}
+
+// Gmail implementation of Provider
+
+func (c *Client) ListBySender(senderAddresses []string, filter *Query, maxResults int) ([]string, error) {
+	// an empty query would match the whole mailbox
+	if len(senderAddresses) == 0 {
+		return nil, nil
+	}
+	if filter == nil {
+		filter = NewQuery()
+	}
+	return c.ListMessages(filter.Clone().FromSenders(senderAddresses), maxResults)
+}
+
+func (c *Client) FetchHeaders(msgIds []string, headers ...string) []messageResult {
+	return c.GetMessageHeadersById(msgIds, headers...)
+}
+
+func (c *Client) Trash(msgIds []string) Outcomes {
+	return c.RemoveMessages(msgIds)
+}
+
+func (c *Client) Restore(msgIds []string) Outcomes {
+	return c.RestoreMessages(msgIds)
+}
+
+func (c *Client) Delete(msgIds []string) Outcomes {
+	return c.BatchPermanentlyDeleteMessages(msgIds)
+}
+
+// Labels the messages with labelId and takes them out of the inbox and the
+// trash, which is what moving means for Gmail's labels.
+func (c *Client) Move(msgIds []string, labelId string) Outcomes {
+	var remove []string
+	for _, label := range []string{"INBOX", "TRASH"} {
+		if label != labelId {
+			remove = append(remove, label)
+		}
+	}
+
+	return applyInChunks(msgIds, batchDeleteLimit, fmt.Sprintf("Moved to %v", labelId), func(ids []string) error {
+		return c.batchModifyChunk(ids, []string{labelId}, remove)
+	})
+}
+
+func (c *Client) Close() error {
+	return nil
+}
@@ -0,0 +1,291 @@
+package gmail
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Gmail does not document a hard limit; long queries start failing or
+// silently truncating somewhere past this length.
+const maxQueryLength = 1500
+
+type Category string
+
+const (
+	CategoryPrimary    Category = "primary"
+	CategorySocial     Category = "social"
+	CategoryPromotions Category = "promotions"
+	CategoryUpdates    Category = "updates"
+	CategoryForums     Category = "forums"
+	CategoryPurchases  Category = "purchases"
+)
+
+var (
+	categories = []Category{CategoryPrimary, CategorySocial, CategoryPromotions, CategoryUpdates, CategoryForums, CategoryPurchases}
+	// older_than/newer_than accept a count of days, months or years
+	periodPattern = regexp.MustCompile(`^[1-9][0-9]*[dmy]$`)
+	sizePattern   = regexp.MustCompile(`^([0-9]+)([KMG]?)B?$`)
+	// characters that end a bare search term or change its meaning
+	specialCharacters = " \t\r\n\"(){}:"
+)
+
+// Query is a typed Gmail search query. Terms are ANDed together, except for
+// senders and sender domains, which form a single OR group. When that group
+// makes the query too long, Build splits it over several queries that share
+// the remaining terms.
+//
+//	NewQuery().From("news@shop.com").Category(CategoryPromotions).OlderThan("90d")
+type Query struct {
+	senders []string
+	terms   []string
+	negate  bool
+	err     error
+}
+
+func NewQuery() *Query {
+	return &Query{}
+}
+
+// Returns an independent copy that further terms can be added to.
+func (q *Query) Clone() *Query {
+	clone := *q
+	clone.senders = append([]string{}, q.senders...)
+	clone.terms = append([]string{}, q.terms...)
+	return &clone
+}
+
+// Matches messages sent from exactly one of the addresses.
+func (q *Query) From(addresses ...string) *Query {
+	for _, address := range addresses {
+		value, err := quoteValue(address)
+		if err != nil {
+			return q.fail(err)
+		}
+		q.addSender("from:" + value)
+	}
+	return q
+}
+
+// Matches messages sent from any address at one of the domains.
+func (q *Query) FromDomain(domains ...string) *Query {
+	for _, domain := range domains {
+		value, err := escapeValue("@" + strings.TrimPrefix(domain, "@"))
+		if err != nil {
+			return q.fail(err)
+		}
+		q.addSender("from:" + value)
+	}
+	return q
+}
+
+// Matches a sender list as found in deletionList.json, where "@domain" entries
+// match any address at that domain.
+func (q *Query) FromSenders(senderAddresses []string) *Query {
+	addresses, domains := splitSenders(senderAddresses)
+	return q.From(addresses...).FromDomain(domains...)
+}
+
+// Negates the term added next, e.g. NewQuery().Not().IsStarred(). Senders
+// cannot be negated, as they are ORed together rather than ANDed.
+func (q *Query) Not() *Query {
+	q.negate = true
+	return q
+}
+
+func (q *Query) Subject(subject string) *Query {
+	value, err := quoteValue(subject)
+	if err != nil {
+		return q.fail(err)
+	}
+	return q.add("subject:" + value)
+}
+
+func (q *Query) Label(label string) *Query {
+	value, err := escapeValue(label)
+	if err != nil {
+		return q.fail(err)
+	}
+	return q.add("label:" + value)
+}
+
+func (q *Query) Category(category Category) *Query {
+	if _, err := ParseCategory(string(category)); err != nil {
+		return q.fail(err)
+	}
+	return q.add("category:" + string(category))
+}
+
+// Matches messages older than a period such as "90d", "6m" or "1y".
+func (q *Query) OlderThan(period string) *Query {
+	if !periodPattern.MatchString(period) {
+		return q.fail(fmt.Errorf("invalid period \"%v\", expected a count followed by d, m or y", period))
+	}
+	return q.add("older_than:" + period)
+}
+
+// Matches messages newer than a period such as "90d", "6m" or "1y".
+func (q *Query) NewerThan(period string) *Query {
+	if !periodPattern.MatchString(period) {
+		return q.fail(fmt.Errorf("invalid period \"%v\", expected a count followed by d, m or y", period))
+	}
+	return q.add("newer_than:" + period)
+}
+
+func (q *Query) LargerThan(bytes int64) *Query {
+	return q.add(fmt.Sprintf("larger:%d", bytes))
+}
+
+func (q *Query) SmallerThan(bytes int64) *Query {
+	return q.add(fmt.Sprintf("smaller:%d", bytes))
+}
+
+func (q *Query) HasAttachment() *Query {
+	return q.add("has:attachment")
+}
+
+func (q *Query) IsUnread() *Query {
+	return q.add("is:unread")
+}
+
+func (q *Query) IsStarred() *Query {
+	return q.add("is:starred")
+}
+
+func (q *Query) add(term string) *Query {
+	if q.negate {
+		term = "-" + term
+		q.negate = false
+	}
+	q.terms = append(q.terms, term)
+	return q
+}
+
+func (q *Query) addSender(term string) {
+	if q.negate {
+		q.fail(fmt.Errorf("cannot negate %v: senders are matched as a group of alternatives", term))
+		return
+	}
+	q.senders = append(q.senders, term)
+}
+
+func (q *Query) fail(err error) *Query {
+	if q.err == nil {
+		q.err = err
+	}
+	q.negate = false
+	return q
+}
+
+// Renders the query, splitting the sender group so that each query stays
+// within maxQueryLength. Always returns at least one query.
+func (q *Query) Build() ([]string, error) {
+	if q.err != nil {
+		return nil, q.err
+	}
+
+	base := strings.Join(q.terms, " ")
+	if len(q.senders) == 0 {
+		return []string{base}, nil
+	}
+
+	var queries []string
+	var group []string
+
+	for _, sender := range q.senders {
+		if len(group) > 0 && len(joinGroup(base, append(group, sender))) > maxQueryLength {
+			queries = append(queries, joinGroup(base, group))
+			group = nil
+		}
+		group = append(group, sender)
+	}
+	queries = append(queries, joinGroup(base, group))
+
+	return queries, nil
+}
+
+func (q *Query) String() string {
+	queries, err := q.Build()
+	if err != nil {
+		return fmt.Sprintf("invalid query: %v", err.Error())
+	}
+	return strings.Join(queries, " | ")
+}
+
+func joinGroup(base string, group []string) string {
+	senders := group[0]
+	if len(group) > 1 {
+		senders = "(" + strings.Join(group, " OR ") + ")"
+	}
+
+	if base == "" {
+		return senders
+	}
+	return senders + " " + base
+}
+
+// Wraps a value in quotes so Gmail treats it as one exact term. Gmail has no
+// escape for quotes inside a quoted term, so values containing any are
+// refused rather than searched for as something else.
+func quoteValue(value string) (string, error) {
+	value = strings.TrimSpace(value)
+	if strings.Contains(value, "\"") {
+		return "", fmt.Errorf("cannot search for %v: Gmail search terms cannot contain quotes", value)
+	}
+	return "\"" + value + "\"", nil
+}
+
+// Quotes a value only when it would otherwise be split or misread.
+func escapeValue(value string) (string, error) {
+	value = strings.TrimSpace(value)
+	if value == "" || strings.ContainsAny(value, specialCharacters) || strings.HasPrefix(value, "-") {
+		return quoteValue(value)
+	}
+	return value, nil
+}
+
+func ParseCategory(value string) (Category, error) {
+	for _, category := range categories {
+		if strings.EqualFold(value, string(category)) {
+			return category, nil
+		}
+	}
+	return "", fmt.Errorf("unknown category \"%v\"", value)
+}
+
+// Parses sizes such as "500K", "10M" or "2000000" into bytes.
+func ParseSize(value string) (int64, error) {
+	match := sizePattern.FindStringSubmatch(strings.ToUpper(strings.TrimSpace(value)))
+	if match == nil {
+		return 0, fmt.Errorf("invalid size \"%v\", expected bytes or a number followed by K, M or G", value)
+	}
+
+	size, err := strconv.ParseInt(match[1], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size \"%v\": %v", value, err.Error())
+	}
+
+	switch match[2] {
+	case "K":
+		size <<= 10
+	case "M":
+		size <<= 20
+	case "G":
+		size <<= 30
+	}
+	return size, nil
+}
+
+// Splits a sender list into exact addresses and "@domain" entries.
+func splitSenders(senderAddresses []string) (addresses []string, domains []string) {
+	for _, sender := range senderAddresses {
+		sender = strings.TrimSpace(sender)
+		if strings.HasPrefix(sender, "@") {
+			domains = append(domains, strings.TrimPrefix(sender, "@"))
+		} else if sender != "" {
+			addresses = append(addresses, sender)
+		}
+	}
+	return addresses, domains
+}
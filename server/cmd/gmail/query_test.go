@@ -0,0 +1,160 @@
+package gmail
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestQueryBuild(t *testing.T) {
+	for _, test := range []struct {
+		name  string
+		query *Query
+		want  []string
+	}{
+		{"empty", NewQuery(), []string{""}},
+		{"one sender", NewQuery().From("news@shop.com"), []string{`from:"news@shop.com"`}},
+		{"senders are ORed", NewQuery().From("a@x.com", "b@y.com"), []string{`(from:"a@x.com" OR from:"b@y.com")`}},
+		{"domain", NewQuery().FromDomain("shop.com"), []string{"from:@shop.com"}},
+		{"domain with @", NewQuery().FromDomain("@shop.com"), []string{"from:@shop.com"}},
+		{"deletion list", NewQuery().FromSenders([]string{" a@x.com ", "@shop.com", ""}), []string{`(from:"a@x.com" OR from:@shop.com)`}},
+		{"terms are ANDed", NewQuery().From("a@x.com").Category(CategoryPromotions).OlderThan("90d").IsUnread(), []string{`from:"a@x.com" category:promotions older_than:90d is:unread`}},
+		{"negated term", NewQuery().Not().IsStarred(), []string{"-is:starred"}},
+		{"negation applies once", NewQuery().Not().Label("keep").HasAttachment(), []string{"-label:keep has:attachment"}},
+		{"negation after senders", NewQuery().From("x@y.com").Not().IsStarred(), []string{`from:"x@y.com" -is:starred`}},
+		{"subject is quoted", NewQuery().Subject(" weekly deals "), []string{`subject:"weekly deals"`}},
+		{"plain label", NewQuery().Label("Receipts"), []string{"label:Receipts"}},
+		{"label with space", NewQuery().Label("My Label"), []string{`label:"My Label"`}},
+		{"label with dash", NewQuery().Label("-x"), []string{`label:"-x"`}},
+		{"label with colon", NewQuery().Label("a:b"), []string{`label:"a:b"`}},
+		{"sizes", NewQuery().LargerThan(500 << 10).SmallerThan(10 << 20), []string{"larger:512000 smaller:10485760"}},
+		{"newer than", NewQuery().NewerThan("1y"), []string{"newer_than:1y"}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := test.query.Build()
+			if err != nil {
+				t.Fatalf("Build: %v", err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("Build = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestQueryBuildErrors(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		query   *Query
+		wantErr string
+	}{
+		{"negated sender", NewQuery().Not().From("x@y.com").IsStarred(), "cannot negate"},
+		{"negated domain", NewQuery().Not().FromDomain("shop.com"), "cannot negate"},
+		{"negated deletion list", NewQuery().Not().FromSenders([]string{"@shop.com"}), "cannot negate"},
+		{"quote in address", NewQuery().From(`we"ird@x.com`), "quotes"},
+		{"quote in domain", NewQuery().FromDomain(`sh"op.com`), "quotes"},
+		{"quote in subject", NewQuery().Subject(`say "hi"`), "quotes"},
+		{"quote in label", NewQuery().Label(`a"b`), "quotes"},
+		{"unknown category", NewQuery().Category("spam"), "unknown category"},
+		{"bad period", NewQuery().OlderThan("90"), "invalid period"},
+		{"zero period", NewQuery().NewerThan("0d"), "invalid period"},
+		{"first error wins", NewQuery().OlderThan("x").Category("spam"), "invalid period"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			queries, err := test.query.Build()
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("Build = %q, %v; want an error containing %q", queries, err, test.wantErr)
+			}
+			if !strings.HasPrefix(test.query.String(), "invalid query: ") {
+				t.Errorf("String = %q, want it to report the error", test.query.String())
+			}
+		})
+	}
+}
+
+// A failed negation must not carry over to the next term.
+func TestQueryNegationDoesNotLeak(t *testing.T) {
+	query := NewQuery().Not().Category("spam").IsStarred()
+	query.err = nil
+
+	got, _ := query.Build()
+	if want := []string{"is:starred"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Build = %q, want %q", got, want)
+	}
+}
+
+func TestQueryBuildSplitsSenders(t *testing.T) {
+	var senders []string
+	for i := 0; i < 200; i++ {
+		senders = append(senders, fmt.Sprintf("sender%03d@example.com", i))
+	}
+
+	queries, err := NewQuery().From(senders...).IsUnread().Build()
+	if err != nil {
+		t.Fatalf("Build: %v", err)
+	}
+	if len(queries) < 2 {
+		t.Fatalf("Build returned %d query, want the senders split over several", len(queries))
+	}
+
+	var seen []string
+	for _, query := range queries {
+		if len(query) > maxQueryLength {
+			t.Errorf("query of %d characters exceeds %d", len(query), maxQueryLength)
+		}
+		if !strings.HasSuffix(query, ") is:unread") {
+			t.Errorf("query %q does not end with the shared terms", query)
+		}
+		for _, term := range strings.Split(strings.TrimSuffix(strings.TrimPrefix(query, "("), ") is:unread"), " OR ") {
+			seen = append(seen, strings.Trim(strings.TrimPrefix(term, "from:"), `"`))
+		}
+	}
+	if !reflect.DeepEqual(seen, senders) {
+		t.Errorf("the split queries cover %d senders, want all %d in order", len(seen), len(senders))
+	}
+}
+
+func TestQueryClone(t *testing.T) {
+	base := NewQuery().Category(CategoryUpdates)
+	clone := base.Clone().From("a@x.com").IsUnread()
+
+	if got := base.String(); got != "category:updates" {
+		t.Errorf("base = %q after adding to its clone", got)
+	}
+	if got := clone.String(); got != `from:"a@x.com" category:updates is:unread` {
+		t.Errorf("clone = %q", got)
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	for _, test := range []struct {
+		value   string
+		want    int64
+		wantErr bool
+	}{
+		{"2000000", 2000000, false},
+		{"500K", 500 << 10, false},
+		{"10m", 10 << 20, false},
+		{"1GB", 1 << 30, false},
+		{" 3M ", 3 << 20, false},
+		{"", 0, true},
+		{"10T", 0, true},
+		{"1.5M", 0, true},
+		{"-1", 0, true},
+	} {
+		got, err := ParseSize(test.value)
+		if (err != nil) != test.wantErr || got != test.want {
+			t.Errorf("ParseSize(%q) = %v, %v; want %v, error %v", test.value, got, err, test.want, test.wantErr)
+		}
+	}
+}
+
+func TestParseCategory(t *testing.T) {
+	if got, err := ParseCategory("Promotions"); err != nil || got != CategoryPromotions {
+		t.Errorf("ParseCategory(Promotions) = %v, %v", got, err)
+	}
+	if _, err := ParseCategory("spam"); err == nil {
+		t.Error("ParseCategory(spam) succeeded")
+	}
+}
@@ -0,0 +1,164 @@
+package gmail
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"golang.org/x/oauth2"
+	"google.golang.org/api/gmail/v1"
+)
+
+const tokenInfoUrl = "https://oauth2.googleapis.com/tokeninfo"
+
+// operation names a command and the narrowest scopes it can run with.
+type operation struct {
+	name   string
+	scopes []string
+}
+
+var (
+	trashOperation = operation{"Move emails to trash", []string{gmail.GmailModifyScope}}
+	undoOperation  = operation{"Undo", []string{gmail.GmailModifyScope}}
+	// permanent deletion is the only thing that needs full mail access
+	deleteOperation    = operation{"Delete emails", []string{gmail.MailGoogleComScope}}
+	trashListOperation = operation{"Update TRASH list", []string{gmail.GmailSettingsBasicScope}}
+	// reads headers and sends mailto unsubscribe requests
+	unsubscribeOperation = operation{"Unsubscribe", []string{gmail.GmailReadonlyScope, gmail.GmailSendScope}}
+	// saves unsubscribe emails as drafts instead of sending them
+	unsubscribeDraftOperation = operation{"Unsubscribe (drafts)", []string{gmail.GmailReadonlyScope, gmail.GmailComposeScope}}
+	webDriverOperation        = operation{"Unsubscribe (browser)", []string{gmail.GmailReadonlyScope}}
+	// works on an exported file and never reaches Gmail
+	analyzeOperation = operation{"Analyze Takeout export", nil}
+)
+
+// Scopes that are also satisfied by a broader granted scope.
+var impliedScopes = map[string][]string{
+	gmail.MailGoogleComScope: {
+		gmail.GmailModifyScope, gmail.GmailReadonlyScope, gmail.GmailComposeScope,
+		gmail.GmailSendScope, gmail.GmailInsertScope, gmail.GmailLabelsScope, gmail.GmailMetadataScope,
+	},
+	gmail.GmailModifyScope: {
+		gmail.GmailReadonlyScope, gmail.GmailComposeScope, gmail.GmailSendScope,
+		gmail.GmailInsertScope, gmail.GmailLabelsScope, gmail.GmailMetadataScope,
+	},
+	gmail.GmailReadonlyScope: {gmail.GmailMetadataScope},
+	gmail.GmailComposeScope:  {gmail.GmailSendScope},
+}
+
+type insufficientScopeError struct {
+	operation string
+	missing   []string
+}
+
+func (e *insufficientScopeError) Error() string {
+	return fmt.Sprintf("\"%v\" needs access that the stored token was not granted (%v); run it again and accept the consent prompt, or run logout and sign in again", e.operation, strings.Join(e.missing, ", "))
+}
+
+// token file layout: the oauth2 token plus the scopes it was granted, which
+// the oauth2 package does not persist on its own
+type storedToken struct {
+	oauth2.Token
+	Scopes []string `json:"scopes,omitempty"`
+}
+
+func marshalToken(tok *oauth2.Token) ([]byte, error) {
+	return json.Marshal(storedToken{*tok, tokenScopes(tok)})
+}
+
+func unmarshalToken(data []byte) (*oauth2.Token, error) {
+	var stored storedToken
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return nil, err
+	}
+	return withScopes(&stored.Token, stored.Scopes), nil
+}
+
+// Scopes recorded on a token, either from the token endpoint's "scope" field or
+// from the token file.
+func tokenScopes(tok *oauth2.Token) []string {
+	scope, _ := tok.Extra("scope").(string)
+	return strings.Fields(scope)
+}
+
+func withScopes(tok *oauth2.Token, scopes []string) *oauth2.Token {
+	if len(scopes) == 0 {
+		return tok
+	}
+	return tok.WithExtra(map[string]interface{}{"scope": strings.Join(scopes, " ")})
+}
+
+// Returns the required scopes that none of the granted scopes satisfy.
+func missingScopes(granted, required []string) []string {
+	satisfied := make(map[string]struct{})
+	for _, scope := range granted {
+		satisfied[scope] = struct{}{}
+		for _, implied := range impliedScopes[scope] {
+			satisfied[implied] = struct{}{}
+		}
+	}
+
+	var missing []string
+	for _, scope := range required {
+		if _, found := satisfied[scope]; !found {
+			missing = append(missing, scope)
+		}
+	}
+	return missing
+}
+
+func unionScopes(a, b []string) []string {
+	set := make(map[string]struct{})
+	for _, scope := range append(append([]string{}, a...), b...) {
+		set[scope] = struct{}{}
+	}
+
+	scopes := make([]string, 0, len(set))
+	for scope := range set {
+		scopes = append(scopes, scope)
+	}
+	sort.Strings(scopes)
+	return scopes
+}
+
+// Asks Google which scopes an access token carries. Only needed for tokens
+// saved before scopes were recorded alongside them. The token is posted as a
+// form, so it never appears in a URL that proxies or servers might log.
+func lookupTokenScopes(client *http.Client, tok *oauth2.Token) ([]string, error) {
+	form := url.Values{"access_token": {tok.AccessToken}}
+	reqMethod := "POST"
+
+	req, err := http.NewRequest(reqMethod, tokenInfoUrl, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, &requestCreationError{reqMethod, tokenInfoUrl, err.Error()}
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, &requestExecutionError{reqMethod, tokenInfoUrl, err.Error()}
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, newApiError(res)
+	}
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error reading response body for url %v: %v", tokenInfoUrl, err.Error())
+	}
+
+	var info struct {
+		Scope string `json:"scope"`
+	}
+	if err := json.Unmarshal(body, &info); err != nil {
+		return nil, fmt.Errorf("error unmarshalling JSON response for url %v: %v", tokenInfoUrl, err.Error())
+	}
+
+	return strings.Fields(info.Scope), nil
+}
@@ -0,0 +1,196 @@
+package gmail
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+	"google.golang.org/api/gmail/v1"
+)
+
+func TestMissingScopes(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		granted  []string
+		required []string
+		want     []string
+	}{
+		{"nothing granted", nil, []string{gmail.GmailModifyScope}, []string{gmail.GmailModifyScope}},
+		{"exact", []string{gmail.GmailModifyScope}, []string{gmail.GmailModifyScope}, nil},
+		{"nothing required", []string{gmail.GmailReadonlyScope}, nil, nil},
+		{"full access implies modify", []string{gmail.MailGoogleComScope}, trashOperation.scopes, nil},
+		{"full access implies send", []string{gmail.MailGoogleComScope}, unsubscribeOperation.scopes, nil},
+		{"modify implies readonly and send", []string{gmail.GmailModifyScope}, unsubscribeOperation.scopes, nil},
+		{"modify implies compose", []string{gmail.GmailModifyScope}, unsubscribeDraftOperation.scopes, nil},
+		{"compose implies send", []string{gmail.GmailReadonlyScope, gmail.GmailComposeScope}, unsubscribeOperation.scopes, nil},
+		{"send does not imply compose", []string{gmail.GmailReadonlyScope, gmail.GmailSendScope}, unsubscribeDraftOperation.scopes, []string{gmail.GmailComposeScope}},
+		{"modify does not imply full access", []string{gmail.GmailModifyScope}, deleteOperation.scopes, []string{gmail.MailGoogleComScope}},
+		{"readonly does not imply modify", []string{gmail.GmailReadonlyScope}, trashOperation.scopes, []string{gmail.GmailModifyScope}},
+		{"readonly does not imply send", []string{gmail.GmailReadonlyScope}, unsubscribeOperation.scopes, []string{gmail.GmailSendScope}},
+		// filters are settings, which no mail scope covers
+		{"full access does not imply settings", []string{gmail.MailGoogleComScope}, trashListOperation.scopes, []string{gmail.GmailSettingsBasicScope}},
+		{"readonly implies metadata", []string{gmail.GmailReadonlyScope}, []string{gmail.GmailMetadataScope}, nil},
+		{"metadata does not imply readonly", []string{gmail.GmailMetadataScope}, webDriverOperation.scopes, []string{gmail.GmailReadonlyScope}},
+		{"only the missing ones", []string{gmail.GmailSendScope}, unsubscribeOperation.scopes, []string{gmail.GmailReadonlyScope}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if got := missingScopes(test.granted, test.required); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("missingScopes(%q, %q) = %q, want %q", test.granted, test.required, got, test.want)
+			}
+		})
+	}
+}
+
+func TestUnionScopes(t *testing.T) {
+	for _, test := range []struct {
+		a, b, want []string
+	}{
+		{nil, nil, []string{}},
+		{[]string{"b", "a"}, nil, []string{"a", "b"}},
+		{[]string{"a", "c"}, []string{"c", "b", "a"}, []string{"a", "b", "c"}},
+	} {
+		if got := unionScopes(test.a, test.b); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("unionScopes(%q, %q) = %q, want %q", test.a, test.b, got, test.want)
+		}
+	}
+
+	// the inputs are left alone
+	a := make([]string, 1, 4)
+	a[0] = "z"
+	unionScopes(a, []string{"y"})
+	if a[:2][1] != "" {
+		t.Error("unionScopes wrote into its first argument")
+	}
+}
+
+func TestStoredTokenKeepsScopes(t *testing.T) {
+	tok := withScopes(testToken(), []string{gmail.GmailModifyScope, gmail.GmailSendScope})
+	data, err := marshalToken(tok)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := unmarshalToken(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := tokenScopes(again); !reflect.DeepEqual(got, []string{gmail.GmailModifyScope, gmail.GmailSendScope}) {
+		t.Errorf("scopes after a round trip = %q", got)
+	}
+	if again.AccessToken != tok.AccessToken || again.RefreshToken != tok.RefreshToken {
+		t.Errorf("token after a round trip = %+v", again)
+	}
+}
+
+func TestLookupTokenScopes(t *testing.T) {
+	var seen *http.Request
+	var form string
+	client := &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		seen = req
+		body, _ := io.ReadAll(req.Body)
+		form = string(body)
+		return &http.Response{
+			StatusCode: 200,
+			Header:     http.Header{"Content-Type": {"application/json"}},
+			Body:       io.NopCloser(strings.NewReader(`{"azp":"client","scope":"` + gmail.GmailModifyScope + " " + gmail.GmailSendScope + `","expires_in":"3599"}`)),
+			Request:    req,
+		}, nil
+	})}
+
+	scopes, err := lookupTokenScopes(client, testToken())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(scopes, []string{gmail.GmailModifyScope, gmail.GmailSendScope}) {
+		t.Errorf("scopes = %q", scopes)
+	}
+
+	// the token goes in the body, never the URL
+	if seen.Method != "POST" || seen.URL.String() != tokenInfoUrl {
+		t.Errorf("request = %v %v, want a POST to %v", seen.Method, seen.URL, tokenInfoUrl)
+	}
+	if seen.Header.Get("Content-Type") != "application/x-www-form-urlencoded" || form != "access_token=ya29.access-secret" {
+		t.Errorf("request body = %q (%v)", form, seen.Header.Get("Content-Type"))
+	}
+}
+
+func TestLookupTokenScopesInvalidToken(t *testing.T) {
+	client := &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		return &http.Response{
+			StatusCode: 400,
+			Header:     http.Header{"Content-Type": {"application/json"}},
+			Body:       io.NopCloser(strings.NewReader(`{"error":"invalid_token","error_description":"Invalid Value"}`)),
+			Request:    req,
+		}, nil
+	})}
+
+	_, err := lookupTokenScopes(client, testToken())
+	var apiErr *ApiError
+	if !errors.As(err, &apiErr) || apiErr.Reason != "invalid_token" {
+		t.Fatalf("error = %v, want the invalid_token ApiError", err)
+	}
+	if strings.Contains(err.Error(), "ya29") {
+		t.Errorf("error %q contains the token", err)
+	}
+}
+
+// Answers the confirmation prompt with the given input.
+func withStdin(t *testing.T, input string) {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.WriteString(input)
+	w.Close()
+
+	stdin := os.Stdin
+	os.Stdin = r
+	t.Cleanup(func() {
+		os.Stdin = stdin
+		r.Close()
+	})
+}
+
+func scopedStore(scopes ...string) *memoryStore {
+	tok := &oauth2.Token{AccessToken: "access", RefreshToken: "refresh", TokenType: "Bearer", Expiry: time.Now().Add(time.Hour)}
+	return &memoryStore{token: withScopes(tok, scopes)}
+}
+
+func TestGetClientRefusesTooNarrowToken(t *testing.T) {
+	withStdin(t, "n\n")
+	store := scopedStore(gmail.GmailModifyScope)
+
+	_, err := getClient(&oauth2.Config{}, store, deleteOperation)
+	var scopeErr *insufficientScopeError
+	if !errors.As(err, &scopeErr) {
+		t.Fatalf("error = %v, want an insufficientScopeError", err)
+	}
+	if scopeErr.operation != deleteOperation.name || !reflect.DeepEqual(scopeErr.missing, []string{gmail.MailGoogleComScope}) {
+		t.Errorf("error = %+v", scopeErr)
+	}
+	if store.saves != 0 {
+		t.Error("a refused consent replaced the stored token")
+	}
+}
+
+func TestGetClientAcceptsBroaderToken(t *testing.T) {
+	// nothing to confirm, so reading the prompt fails the test
+	withStdin(t, "")
+	config := &oauth2.Config{}
+	store := scopedStore(gmail.GmailModifyScope)
+
+	client, err := getClient(config, store, unsubscribeOperation)
+	if err != nil || client == nil {
+		t.Fatalf("getClient = %v, %v", client, err)
+	}
+	// a later consent flow asks for what is held plus what the operation needs
+	if want := unionScopes([]string{gmail.GmailModifyScope}, unsubscribeOperation.scopes); !reflect.DeepEqual(config.Scopes, want) {
+		t.Errorf("config.Scopes = %q, want %q", config.Scopes, want)
+	}
+}
@@ -0,0 +1,76 @@
+package gmail
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Impersonated users share the deletion list, but neither their unsubscribe
+// ledgers nor their journals.
+func TestServiceAccountProfilesKeepUsersApart(t *testing.T) {
+	inTempDir(t)
+	profiles, err := ServiceAccountProfiles("key.json", []string{"Alice@Corp.example", "bob@corp.example"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice, bob := profiles[0], profiles[1]
+
+	if alice.Dir != filepath.Join(impersonatedDir, "alice@corp.example") || alice.Dir == bob.Dir {
+		t.Errorf("directories %v and %v, want one per user", alice.Dir, bob.Dir)
+	}
+	if info, err := os.Stat(alice.Dir); err != nil || !info.IsDir() {
+		t.Errorf("%v was not created: %v", alice.Dir, err)
+	}
+	if alice.DeletionListPath() != deletionListFile || bob.DeletionListPath() != deletionListFile {
+		t.Errorf("deletion lists %v and %v, want the working directory's", alice.DeletionListPath(), bob.DeletionListPath())
+	}
+	if alice.Settings.Address != "Alice@Corp.example" || alice.Settings.ServiceAccountKey != "key.json" {
+		t.Errorf("settings = %+v", alice.Settings)
+	}
+
+	l, err := openLedger(alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.recordAttempt("news@shop.example", "m1", unsubscribeByOneClick, "https://shop.example/u", "HTTP 200", unsubscribeConfirmed)
+
+	l, err = openLedger(bob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var summary Summary
+	if pending := l.pending([]string{"news@shop.example"}, &summary); len(pending) != 1 || summary.Skipped != 0 {
+		t.Errorf("bob's pending = %q, skipped %d; alice's unsubscribe leaked", pending, summary.Skipped)
+	}
+
+	journal := &Journal{RunId: "20260101-000000", Account: alice.Name, MessageIds: []string{"1"}, CreatedAt: time.Now()}
+	if err := journal.save(alice); err != nil {
+		t.Fatal(err)
+	}
+	if journals, err := ListJournals(bob); err != nil || len(journals) != 0 {
+		t.Errorf("bob's journals = %+v, %v; want none", journals, err)
+	}
+	if journals, err := ListJournals(alice); err != nil || len(journals) != 1 {
+		t.Errorf("alice's journals = %+v, %v; want hers", journals, err)
+	}
+}
+
+func TestServiceAccountProfilesRejectsBadUsers(t *testing.T) {
+	inTempDir(t)
+	for _, users := range [][]string{
+		nil,
+		{"../../etc@example.com"},
+		{"a/b@example.com"},
+		{".hidden@example.com"},
+		{"not-an-address"},
+	} {
+		if _, err := ServiceAccountProfiles("key.json", users); err == nil {
+			t.Errorf("ServiceAccountProfiles(%q) succeeded", users)
+		}
+	}
+	if _, err := os.Stat(impersonatedDir); err == nil {
+		t.Error("a directory was created for a rejected user")
+	}
+}
@@ -0,0 +1,361 @@
+package gmail
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/scrypt"
+	"golang.org/x/oauth2"
+	"golang.org/x/term"
+)
+
+const (
+	credentialsFile = "credentials.json"
+	tokenFile       = "token.json"
+	encryptedSuffix = ".enc"
+
+	plaintextStore = "plaintext"
+	encryptedStore = "encrypted"
+
+	revokeUrl = "https://oauth2.googleapis.com/revoke"
+)
+
+// file layout: magic | salt | nonce | AES-256-GCM ciphertext
+var encryptedMagic = []byte("GOENC1")
+
+const (
+	saltLength = 16
+	keyLength  = 32
+	scryptN    = 1 << 15
+	scryptR    = 8
+	scryptP    = 1
+)
+
+// CredentialStore persists the OAuth client secret and the user's token.
+type CredentialStore interface {
+	LoadCredentials() ([]byte, error)
+	LoadToken() (*oauth2.Token, error)
+	SaveToken(token *oauth2.Token) error
+	DeleteToken() error
+}
+
+type plaintextFileStore struct {
+	credentialsPath, tokenPath string
+}
+
+type encryptedFileStore struct {
+	credentialsPath, tokenPath string
+	passphrase                 []byte
+}
+
+// Returns the store selected by CREDENTIAL_STORE ("encrypted" by default, or
+// "plaintext") for the given profile. The OAuth client secret is shared by all
+// profiles; the token is kept in the profile's directory. The encrypted store
+// migrates any plaintext files it finds.
+func newCredentialStore(profile *Profile) (CredentialStore, error) {
+	kind := strings.ToLower(strings.TrimSpace(os.Getenv("CREDENTIAL_STORE")))
+	profileTokenFile := profile.path(tokenFile)
+
+	switch kind {
+	case plaintextStore:
+		return &plaintextFileStore{credentialsFile, profileTokenFile}, nil
+	case "", encryptedStore:
+		passphrase, err := readPassphrase()
+		if err != nil {
+			return nil, err
+		}
+
+		store := &encryptedFileStore{credentialsFile + encryptedSuffix, profileTokenFile + encryptedSuffix, passphrase}
+		if err := store.migrate(credentialsFile, profileTokenFile); err != nil {
+			return nil, err
+		}
+		return store, nil
+	default:
+		return nil, fmt.Errorf("unknown CREDENTIAL_STORE \"%v\", expected \"%v\" or \"%v\"", kind, encryptedStore, plaintextStore)
+	}
+}
+
+// passphrase entered at the prompt, reused for every profile in the same run
+var cachedPassphrase []byte
+
+func readPassphrase() ([]byte, error) {
+	if passphrase := os.Getenv("CREDENTIAL_PASSPHRASE"); passphrase != "" {
+		return []byte(passphrase), nil
+	}
+	if cachedPassphrase != nil {
+		return cachedPassphrase, nil
+	}
+
+	fmt.Printf("Enter the passphrase protecting your stored credentials: ")
+	passphrase, err := readSecretLine(os.Stdin)
+	if err != nil {
+		return nil, fmt.Errorf("error reading passphrase: %v", err.Error())
+	}
+
+	if passphrase == "" {
+		return nil, errors.New("an empty passphrase is not allowed for the encrypted credential store")
+	}
+	cachedPassphrase = []byte(passphrase)
+	return cachedPassphrase, nil
+}
+
+// Reads a line from the terminal without echoing it, or from whatever stdin is
+// when it is not a terminal, e.g. a pipe.
+func readSecretLine(f *os.File) (string, error) {
+	if fd := int(f.Fd()); term.IsTerminal(fd) {
+		input, err := term.ReadPassword(fd)
+		// the newline typed by the user was not echoed either
+		fmt.Println()
+		return string(input), err
+	}
+
+	input, err := bufio.NewReader(f).ReadString('\n')
+	if err != nil && input == "" {
+		return "", err
+	}
+	return strings.TrimRight(input, "\r\n"), nil
+}
+
+func (s *plaintextFileStore) LoadCredentials() ([]byte, error) {
+	return os.ReadFile(s.credentialsPath)
+}
+
+func (s *plaintextFileStore) LoadToken() (*oauth2.Token, error) {
+	return tokenFromFile(s.tokenPath)
+}
+
+func (s *plaintextFileStore) SaveToken(token *oauth2.Token) error {
+	return writeToken(s.tokenPath, token)
+}
+
+func (s *plaintextFileStore) DeleteToken() error {
+	return wipeFile(s.tokenPath)
+}
+
+func (s *encryptedFileStore) LoadCredentials() ([]byte, error) {
+	return s.read(s.credentialsPath)
+}
+
+func (s *encryptedFileStore) LoadToken() (*oauth2.Token, error) {
+	data, err := s.read(s.tokenPath)
+	if err != nil {
+		return nil, err
+	}
+
+	return unmarshalToken(data)
+}
+
+func (s *encryptedFileStore) SaveToken(token *oauth2.Token) error {
+	data, err := marshalToken(token)
+	if err != nil {
+		return fmt.Errorf("error marshalling token: %v", err.Error())
+	}
+	return s.write(s.tokenPath, data)
+}
+
+func (s *encryptedFileStore) DeleteToken() error {
+	return wipeFile(s.tokenPath)
+}
+
+// Encrypts plaintext credential and token files that have no encrypted
+// counterpart yet, then wipes the plaintext copies.
+func (s *encryptedFileStore) migrate(plainCredentialsPath, plainTokenPath string) error {
+	migrations := [][2]string{
+		{plainCredentialsPath, s.credentialsPath},
+		{plainTokenPath, s.tokenPath},
+	}
+
+	for _, migration := range migrations {
+		plainPath, encryptedPath := migration[0], migration[1]
+
+		data, err := os.ReadFile(plainPath)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return fmt.Errorf("error reading %v for migration: %v", plainPath, err.Error())
+		}
+
+		if _, err := os.Stat(encryptedPath); err == nil {
+			fmt.Printf("Both %v and %v exist; leaving the plaintext file untouched.\n", plainPath, encryptedPath)
+			continue
+		}
+
+		if err := s.write(encryptedPath, data); err != nil {
+			return fmt.Errorf("error encrypting %v: %v", plainPath, err.Error())
+		}
+		if err := wipeFile(plainPath); err != nil {
+			return fmt.Errorf("encrypted %v but could not remove the plaintext copy: %v", plainPath, err.Error())
+		}
+		fmt.Printf("Migrated %v to encrypted storage at %v\n", plainPath, encryptedPath)
+	}
+
+	return nil
+}
+
+func (s *encryptedFileStore) read(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) < len(encryptedMagic)+saltLength || !bytes.Equal(data[:len(encryptedMagic)], encryptedMagic) {
+		return nil, fmt.Errorf("%v is not an encrypted credential file", path)
+	}
+	data = data[len(encryptedMagic):]
+	salt, data := data[:saltLength], data[saltLength:]
+
+	gcm, err := s.cipher(salt)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < gcm.NonceSize() {
+		return nil, fmt.Errorf("%v is truncated", path)
+	}
+	nonce, ciphertext := data[:gcm.NonceSize()], data[gcm.NonceSize():]
+
+	plaintext, err := gcm.Open(nil, nonce, ciphertext, encryptedMagic)
+	if err != nil {
+		return nil, fmt.Errorf("could not decrypt %v: wrong passphrase or corrupted file", path)
+	}
+	return plaintext, nil
+}
+
+func (s *encryptedFileStore) write(path string, plaintext []byte) error {
+	salt := make([]byte, saltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return fmt.Errorf("error generating salt: %v", err.Error())
+	}
+
+	gcm, err := s.cipher(salt)
+	if err != nil {
+		return err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return fmt.Errorf("error generating nonce: %v", err.Error())
+	}
+
+	var out bytes.Buffer
+	out.Write(encryptedMagic)
+	out.Write(salt)
+	out.Write(nonce)
+	out.Write(gcm.Seal(nil, nonce, plaintext, encryptedMagic))
+
+	return os.WriteFile(path, out.Bytes(), 0600)
+}
+
+func (s *encryptedFileStore) cipher(salt []byte) (cipher.AEAD, error) {
+	key, err := scrypt.Key(s.passphrase, salt, scryptN, scryptR, scryptP, keyLength)
+	if err != nil {
+		return nil, fmt.Errorf("error deriving key: %v", err.Error())
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("error creating cipher: %v", err.Error())
+	}
+	return cipher.NewGCM(block)
+}
+
+// Overwrites a file with zeros before removing it. Missing files are ignored.
+func wipeFile(path string) error {
+	info, err := os.Stat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(make([]byte, info.Size()))
+	if err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err != nil {
+		return fmt.Errorf("error overwriting %v: %v", path, err.Error())
+	}
+
+	return os.Remove(path)
+}
+
+// Revokes the profile's stored grant with Google and wipes the local token.
+func Logout(profile *Profile) error {
+	if profile.Settings.ServiceAccountKey != "" {
+		return fmt.Errorf("profile \"%v\" uses a service account; revoke its key in the Google Cloud console instead", profile.Name)
+	}
+
+	store, err := newCredentialStore(profile)
+	if err != nil {
+		return err
+	}
+
+	tok, err := store.LoadToken()
+	if errors.Is(err, os.ErrNotExist) {
+		fmt.Printf("No stored token found for profile \"%v\", nothing to log out of.\n", profile.Name)
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("error loading stored token: %v", err.Error())
+	}
+
+	revokeErr := revokeToken(http.DefaultClient, tok)
+
+	// wipe even when revocation fails so the token cannot be reused from disk
+	if err := store.DeleteToken(); err != nil {
+		return fmt.Errorf("error wiping stored token: %v", err.Error())
+	}
+
+	if revokeErr != nil {
+		return fmt.Errorf("stored token was wiped, but revoking it failed: %v", revokeErr.Error())
+	}
+
+	fmt.Printf("Token for profile \"%v\" revoked and removed from local storage.\n", profile.Name)
+	return nil
+}
+
+func revokeToken(client *http.Client, tok *oauth2.Token) error {
+	// revoking the refresh token also invalidates every access token issued from it
+	value := tok.RefreshToken
+	if value == "" {
+		value = tok.AccessToken
+	}
+
+	reqMethod := "POST"
+	form := url.Values{"token": {value}}
+
+	req, err := http.NewRequest(reqMethod, revokeUrl, strings.NewReader(form.Encode()))
+	if err != nil {
+		return &requestCreationError{reqMethod, revokeUrl, err.Error()}
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	res, err := client.Do(req)
+	if err != nil {
+		return &requestExecutionError{reqMethod, revokeUrl, err.Error()}
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		apiErr := newApiError(res)
+		// Google answers invalid_token for grants that are already revoked
+		if apiErr.StatusCode == http.StatusBadRequest && apiErr.Reason == "invalid_token" {
+			return nil
+		}
+		return apiErr
+	}
+
+	return nil
+}
@@ -0,0 +1,257 @@
+package gmail
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func testToken() *oauth2.Token {
+	return &oauth2.Token{AccessToken: "ya29.access-secret", RefreshToken: "1//refresh-secret", TokenType: "Bearer", Expiry: time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)}
+}
+
+// Runs the test from an empty directory, since the OAuth client secret is
+// looked up in the working directory.
+func inTempDir(t *testing.T) string {
+	dir := t.TempDir()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+	return dir
+}
+
+func TestEncryptedStoreRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	store := &encryptedFileStore{filepath.Join(dir, "credentials.json.enc"), filepath.Join(dir, "token.json.enc"), []byte("correct horse")}
+
+	if _, err := store.LoadToken(); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("LoadToken before saving: error = %v, want os.ErrNotExist", err)
+	}
+
+	want := testToken()
+	if err := store.SaveToken(want); err != nil {
+		t.Fatalf("SaveToken: %v", err)
+	}
+
+	data, err := os.ReadFile(store.tokenPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(data, encryptedMagic) || bytes.Contains(data, []byte("secret")) {
+		t.Errorf("token file is not encrypted: %q", data)
+	}
+	if info, _ := os.Stat(store.tokenPath); info.Mode().Perm() != 0600 {
+		t.Errorf("token file mode = %v, want 0600", info.Mode().Perm())
+	}
+
+	got, err := store.LoadToken()
+	if err != nil {
+		t.Fatalf("LoadToken: %v", err)
+	}
+	if got.AccessToken != want.AccessToken || got.RefreshToken != want.RefreshToken || !got.Expiry.Equal(want.Expiry) {
+		t.Errorf("LoadToken = %+v, want %+v", got, want)
+	}
+
+	// every write gets a fresh salt and nonce
+	store.SaveToken(want)
+	again, _ := os.ReadFile(store.tokenPath)
+	if bytes.Equal(data, again) {
+		t.Error("saving the same token twice produced the same ciphertext")
+	}
+}
+
+func TestEncryptedStoreRejectsWrongPassphraseAndCorruption(t *testing.T) {
+	dir := t.TempDir()
+	store := &encryptedFileStore{"", filepath.Join(dir, "token.json.enc"), []byte("correct horse")}
+	if err := store.SaveToken(testToken()); err != nil {
+		t.Fatal(err)
+	}
+
+	wrong := &encryptedFileStore{"", store.tokenPath, []byte("battery staple")}
+	if _, err := wrong.LoadToken(); err == nil || errors.Is(err, os.ErrNotExist) {
+		t.Errorf("LoadToken with the wrong passphrase: error = %v, want a decryption error", err)
+	}
+
+	data, _ := os.ReadFile(store.tokenPath)
+	data[len(data)-1] ^= 0xff
+	os.WriteFile(store.tokenPath, data, 0600)
+	if _, err := store.LoadToken(); err == nil || errors.Is(err, os.ErrNotExist) {
+		t.Errorf("LoadToken of a corrupted file: error = %v, want a decryption error", err)
+	}
+
+	os.WriteFile(store.tokenPath, []byte(`{"access_token":"plain"}`), 0600)
+	if _, err := store.LoadToken(); err == nil || !strings.Contains(err.Error(), "not an encrypted credential file") {
+		t.Errorf("LoadToken of a plaintext file: error = %v", err)
+	}
+}
+
+// A token that cannot be read must fail the run instead of being replaced
+// through a new consent flow.
+func TestGetClientKeepsUnreadableToken(t *testing.T) {
+	dir := t.TempDir()
+	tokenPath := filepath.Join(dir, "token.json.enc")
+	(&encryptedFileStore{"", tokenPath, []byte("correct horse")}).SaveToken(testToken())
+	before, _ := os.ReadFile(tokenPath)
+
+	store := &encryptedFileStore{"", tokenPath, []byte("battery staple")}
+	_, err := getClient(&oauth2.Config{}, store, operation{"Test", []string{"scope"}})
+	if err == nil || !strings.Contains(err.Error(), "unable to load stored token") {
+		t.Fatalf("getClient: error = %v, want the load error", err)
+	}
+
+	after, _ := os.ReadFile(tokenPath)
+	if !bytes.Equal(before, after) {
+		t.Error("the stored token was overwritten")
+	}
+}
+
+func TestEncryptedStoreMigratesPlaintext(t *testing.T) {
+	dir := inTempDir(t)
+	t.Setenv("CREDENTIAL_STORE", "encrypted")
+	t.Setenv("CREDENTIAL_PASSPHRASE", "correct horse")
+
+	profile := &Profile{Name: "default", Dir: dir}
+	credentials := []byte(`{"installed":{"client_id":"id"}}`)
+	os.WriteFile(credentialsFile, credentials, 0600)
+	if err := writeToken(profile.path(tokenFile), testToken()); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := newCredentialStore(profile)
+	if err != nil {
+		t.Fatalf("newCredentialStore: %v", err)
+	}
+
+	for _, plain := range []string{credentialsFile, profile.path(tokenFile)} {
+		if _, err := os.Stat(plain); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("plaintext %v still exists after migration", plain)
+		}
+	}
+
+	gotCredentials, err := store.LoadCredentials()
+	if err != nil || !bytes.Equal(gotCredentials, credentials) {
+		t.Errorf("LoadCredentials = %q, %v; want the migrated file", gotCredentials, err)
+	}
+	tok, err := store.LoadToken()
+	if err != nil || tok.RefreshToken != testToken().RefreshToken {
+		t.Errorf("LoadToken = %+v, %v; want the migrated token", tok, err)
+	}
+}
+
+func TestEncryptedStoreMigrationKeepsPlaintextBesideEncrypted(t *testing.T) {
+	dir := inTempDir(t)
+	t.Setenv("CREDENTIAL_STORE", "encrypted")
+	t.Setenv("CREDENTIAL_PASSPHRASE", "correct horse")
+
+	profile := &Profile{Name: "default", Dir: dir}
+	encrypted := &encryptedFileStore{"", profile.path(tokenFile + encryptedSuffix), []byte("correct horse")}
+	encrypted.SaveToken(testToken())
+	os.WriteFile(profile.path(tokenFile), []byte(`{"access_token":"other"}`), 0600)
+
+	store, err := newCredentialStore(profile)
+	if err != nil {
+		t.Fatalf("newCredentialStore: %v", err)
+	}
+	if _, err := os.Stat(profile.path(tokenFile)); err != nil {
+		t.Errorf("plaintext token was removed although an encrypted one existed: %v", err)
+	}
+	if tok, err := store.LoadToken(); err != nil || tok.AccessToken != testToken().AccessToken {
+		t.Errorf("LoadToken = %+v, %v; want the encrypted token, not the plaintext one", tok, err)
+	}
+}
+
+func TestLogoutRevokesAndWipes(t *testing.T) {
+	for _, test := range []struct {
+		name      string
+		status    int
+		body      string
+		wantError bool
+	}{
+		{"revoked", http.StatusOK, `{}`, false},
+		{"already revoked", http.StatusBadRequest, `{"error":"invalid_token"}`, false},
+		{"revocation failed", http.StatusInternalServerError, `{"error":"backend"}`, true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			dir := inTempDir(t)
+			t.Setenv("CREDENTIAL_STORE", "encrypted")
+			t.Setenv("CREDENTIAL_PASSPHRASE", "correct horse")
+
+			profile := &Profile{Name: "default", Dir: dir}
+			tokenPath := profile.path(tokenFile + encryptedSuffix)
+			(&encryptedFileStore{"", tokenPath, []byte("correct horse")}).SaveToken(testToken())
+
+			var revoked url.Values
+			defaultClient := http.DefaultClient
+			http.DefaultClient = &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+				if req.URL.String() != revokeUrl {
+					t.Errorf("logout called %v, want %v", req.URL, revokeUrl)
+				}
+				body, _ := io.ReadAll(req.Body)
+				revoked, _ = url.ParseQuery(string(body))
+				return &http.Response{
+					StatusCode: test.status,
+					Header:     http.Header{"Content-Type": {"application/json"}},
+					Body:       io.NopCloser(strings.NewReader(test.body)),
+					Request:    req,
+				}, nil
+			})}
+			t.Cleanup(func() { http.DefaultClient = defaultClient })
+
+			err := Logout(profile)
+			if (err != nil) != test.wantError {
+				t.Errorf("Logout: error = %v, want error %v", err, test.wantError)
+			}
+			if revoked.Get("token") != testToken().RefreshToken {
+				t.Errorf("revoked token = %q, want the refresh token", revoked.Get("token"))
+			}
+			// wiped whether or not Google accepted the revocation
+			if _, err := os.Stat(tokenPath); !errors.Is(err, os.ErrNotExist) {
+				t.Errorf("token file still exists after logout")
+			}
+		})
+	}
+}
+
+func TestLogoutWithoutToken(t *testing.T) {
+	dir := inTempDir(t)
+	t.Setenv("CREDENTIAL_STORE", "plaintext")
+
+	if err := Logout(&Profile{Name: "default", Dir: dir}); err != nil {
+		t.Errorf("Logout without a token: %v", err)
+	}
+}
+
+func TestWipeFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "token.json")
+	os.WriteFile(path, []byte("secret"), 0600)
+
+	if err := wipeFile(path); err != nil {
+		t.Fatalf("wipeFile: %v", err)
+	}
+	if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+		t.Error("file still exists after wiping")
+	}
+	if err := wipeFile(path); err != nil {
+		t.Errorf("wipeFile of a missing file: %v", err)
+	}
+}
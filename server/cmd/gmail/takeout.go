@@ -0,0 +1,354 @@
+package gmail
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Takeout labels of messages that were not received from the sender in From
+var skippedTakeoutLabels = []string{"Sent", "Drafts", "Chat"}
+
+// The "From " line that starts every message in an mbox, e.g.
+// "From 1784512345678901234@xxx Tue Jan 02 10:00:00 +0000 2024". Lines in a
+// body that start with "From " are escaped as ">From " by Takeout, and the
+// weekday keeps the rare unescaped one from splitting a message.
+var mboxSeparatorPattern = regexp.MustCompile(`^From \S+ +(Mon|Tue|Wed|Thu|Fri|Sat|Sun) `)
+
+// A body line escaped by the mbox writer. Each escape adds one ">", including
+// to lines that already started with ">From " (mboxrd).
+var mboxEscapedFromPattern = regexp.MustCompile(`^>+From `)
+
+// SenderStats summarizes the messages one sender has in an export.
+type SenderStats struct {
+	Address  string
+	Messages int
+	Unread   int
+	Bytes    int64
+	First    time.Time
+	Last     time.Time
+	// targets in the List-Unsubscribe header of the sender's latest message
+	// that had one
+	UnsubscribeMailto string
+	UnsubscribeHttp   string
+
+	unsubscribeDate time.Time
+}
+
+func (s *SenderStats) hasUnsubscribe() bool {
+	return s.UnsubscribeMailto != "" || s.UnsubscribeHttp != ""
+}
+
+// Reads a Google Takeout mbox export and returns the statistics of every
+// sender in it, most messages first. Messages the account sent itself, drafts
+// and chats are skipped. Nothing is sent to Gmail, so no access or quota is
+// needed.
+func AnalyzeMbox(ctx context.Context, profile *Profile, path string) ([]*SenderStats, Summary) {
+	summary := Summary{Account: profile.Name, Operation: analyzeOperation.name}
+
+	file, err := os.Open(path)
+	if err != nil {
+		summary.Err = fmt.Errorf("could not open export: %v", err.Error())
+		return nil, summary
+	}
+	defer file.Close()
+
+	owner := normalizeAddress(profile.Settings.Address)
+	senders := make(map[string]*SenderStats)
+	reader := newMboxReader(file)
+
+	for ctx.Err() == nil {
+		header, size, err := reader.next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			summary.Err = fmt.Errorf("could not read export: %v", err.Error())
+			break
+		}
+
+		summary.Processed++
+		if summary.Processed%1000 == 0 {
+			fmt.Printf("\rRead %v messages", summary.Processed)
+		}
+
+		message, err := parseMboxHeader(header)
+		if err != nil || message.from == "" {
+			summary.Failed++
+			continue
+		}
+		if message.skipped() || message.from == owner {
+			summary.Skipped++
+			continue
+		}
+		summary.Succeeded++
+
+		stats, found := senders[message.from]
+		if !found {
+			stats = &SenderStats{Address: message.from}
+			senders[message.from] = stats
+		}
+		stats.add(message, size)
+	}
+	if summary.Processed >= 1000 {
+		fmt.Println()
+	}
+	if ctx.Err() != nil {
+		summary.Err = ctx.Err()
+	}
+
+	stats := make([]*SenderStats, 0, len(senders))
+	for _, sender := range senders {
+		stats = append(stats, sender)
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Messages != stats[j].Messages {
+			return stats[i].Messages > stats[j].Messages
+		}
+		return stats[i].Address < stats[j].Address
+	})
+	return stats, summary
+}
+
+func (s *SenderStats) add(message *mboxMessage, size int64) {
+	s.Messages++
+	s.Bytes += size
+	if message.hasLabel("Unread") {
+		s.Unread++
+	}
+
+	if !message.date.IsZero() {
+		if s.First.IsZero() || message.date.Before(s.First) {
+			s.First = message.date
+		}
+		if message.date.After(s.Last) {
+			s.Last = message.date
+		}
+	}
+
+	if message.unsubscribe != "" && (!s.hasUnsubscribe() || !message.date.Before(s.unsubscribeDate)) {
+		mailto, link := firstUnsubscribeTargets(parseListUnsubscribe(message.unsubscribe))
+		s.UnsubscribeMailto, s.UnsubscribeHttp = "", ""
+		if mailto != nil {
+			s.UnsubscribeMailto = mailto.uri
+		}
+		if link != nil {
+			s.UnsubscribeHttp = link.uri
+		}
+		s.unsubscribeDate = message.date
+	}
+}
+
+// Returns the senders worth adding to a deletion list: those with at least
+// minMessages messages whose mail carries a List-Unsubscribe header, which
+// bulk mail has and personal mail does not.
+func CandidateSenders(stats []*SenderStats, minMessages int) []string {
+	var candidates []string
+	for _, sender := range stats {
+		if sender.Messages >= minMessages && sender.hasUnsubscribe() {
+			candidates = append(candidates, sender.Address)
+		}
+	}
+	return candidates
+}
+
+// Prints the top senders by message count, followed by the unsubscribe targets
+// of those that have any. A top of 0 or less prints every sender.
+func PrintSenderStats(stats []*SenderStats, top int) {
+	if top > 0 && len(stats) > top {
+		stats = stats[:top]
+	}
+
+	fmt.Printf("\n%-40s %8s %8s %10s %-10s %-10s %v\n", "Sender", "Messages", "Unread", "Size", "First", "Last", "Unsubscribe")
+	for _, sender := range stats {
+		var targets []string
+		if sender.UnsubscribeMailto != "" {
+			targets = append(targets, "mailto")
+		}
+		if sender.UnsubscribeHttp != "" {
+			targets = append(targets, "http")
+		}
+		if len(targets) == 0 {
+			targets = []string{"-"}
+		}
+		fmt.Printf("%-40s %8d %8d %10v %-10v %-10v %v\n", sender.Address, sender.Messages, sender.Unread, formatSize(sender.Bytes), formatDay(sender.First), formatDay(sender.Last), strings.Join(targets, ", "))
+	}
+
+	fmt.Println("\nList-Unsubscribe targets:")
+	for _, sender := range stats {
+		if !sender.hasUnsubscribe() {
+			continue
+		}
+		fmt.Printf("- %v", sender.Address)
+		if sender.UnsubscribeMailto != "" {
+			fmt.Printf("\n    %v", sender.UnsubscribeMailto)
+		}
+		if sender.UnsubscribeHttp != "" {
+			fmt.Printf("\n    %v", sender.UnsubscribeHttp)
+		}
+		fmt.Println()
+	}
+}
+
+// Writes senders as the profile's deletionList.json, replacing any list there.
+func WriteDeletionList(profile *Profile, senders []string) error {
+	if senders == nil {
+		senders = []string{}
+	}
+
+	data, err := json.MarshalIndent(senders, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error marshalling deletion list: %v", err.Error())
+	}
+
+	if err := os.WriteFile(profile.DeletionListPath(), append(data, '\n'), 0600); err != nil {
+		return fmt.Errorf("error writing deletion list: %v", err.Error())
+	}
+	return nil
+}
+
+func formatSize(bytes int64) string {
+	switch {
+	case bytes >= 1<<30:
+		return fmt.Sprintf("%.1fG", float64(bytes)/(1<<30))
+	case bytes >= 1<<20:
+		return fmt.Sprintf("%.1fM", float64(bytes)/(1<<20))
+	case bytes >= 1<<10:
+		return fmt.Sprintf("%.1fK", float64(bytes)/(1<<10))
+	}
+	return fmt.Sprintf("%d", bytes)
+}
+
+func formatDay(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Format(time.DateOnly)
+}
+
+// The headers of an exported message that the analysis uses.
+type mboxMessage struct {
+	from        string
+	date        time.Time
+	labels      []string
+	unsubscribe string
+}
+
+func (m *mboxMessage) hasLabel(label string) bool {
+	for _, l := range m.labels {
+		if strings.EqualFold(l, label) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *mboxMessage) skipped() bool {
+	for _, label := range skippedTakeoutLabels {
+		if m.hasLabel(label) {
+			return true
+		}
+	}
+	return false
+}
+
+func parseMboxHeader(header []byte) (*mboxMessage, error) {
+	// the reader needs the blank line that ends a header
+	reader := textproto.NewReader(bufio.NewReader(io.MultiReader(bytes.NewReader(header), strings.NewReader("\r\n"))))
+	fields, err := reader.ReadMIMEHeader()
+	if err != nil && len(fields) == 0 {
+		return nil, err
+	}
+
+	decoder := new(mime.WordDecoder)
+	decode := func(value string) string {
+		if decoded, err := decoder.DecodeHeader(value); err == nil {
+			return decoded
+		}
+		return value
+	}
+
+	message := &mboxMessage{unsubscribe: decode(fields.Get("List-Unsubscribe"))}
+	if from := fields.Get("From"); from != "" {
+		message.from = fromAddress(from)
+	}
+	if date, err := mail.ParseDate(fields.Get("Date")); err == nil {
+		message.date = date
+	}
+	for _, label := range strings.Split(decode(fields.Get("X-Gmail-Labels")), ",") {
+		if label = strings.TrimSpace(label); label != "" {
+			message.labels = append(message.labels, label)
+		}
+	}
+	return message, nil
+}
+
+// mboxReader splits an mbox file into messages, keeping only their headers.
+type mboxReader struct {
+	r       *bufio.Reader
+	started bool
+	done    bool
+}
+
+func newMboxReader(r io.Reader) *mboxReader {
+	return &mboxReader{r: bufio.NewReaderSize(r, 64*1024)}
+}
+
+// Returns the header block of the next message and the size of the whole
+// message as it was received, without the escaping of "From " lines, or io.EOF
+// once there are no more.
+func (m *mboxReader) next() ([]byte, int64, error) {
+	// skip to the first message
+	for !m.started {
+		line, err := m.r.ReadBytes('\n')
+		if mboxSeparatorPattern.Match(line) {
+			m.started = true
+		} else if err == io.EOF {
+			return nil, 0, io.EOF
+		} else if err != nil {
+			return nil, 0, err
+		}
+	}
+	if m.done {
+		return nil, 0, io.EOF
+	}
+
+	var header []byte
+	var size int64
+	inHeader := true
+	for {
+		line, err := m.r.ReadBytes('\n')
+		if mboxSeparatorPattern.Match(line) {
+			return header, size, nil
+		}
+
+		size += int64(len(line))
+		if !inHeader && mboxEscapedFromPattern.Match(line) {
+			size--
+		}
+		if inHeader {
+			if len(bytes.TrimRight(line, "\r\n")) == 0 {
+				inHeader = false
+			} else {
+				header = append(header, line...)
+			}
+		}
+
+		if err == io.EOF {
+			m.done = true
+			return header, size, nil
+		} else if err != nil {
+			return nil, 0, err
+		}
+	}
+}
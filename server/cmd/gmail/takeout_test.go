@@ -0,0 +1,195 @@
+package gmail
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+type mboxEntry struct {
+	header string
+	size   int64
+}
+
+func readMbox(t *testing.T, mbox string) []mboxEntry {
+	t.Helper()
+	var entries []mboxEntry
+	reader := newMboxReader(strings.NewReader(mbox))
+	for {
+		header, size, err := reader.next()
+		if err == io.EOF {
+			return entries
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, mboxEntry{string(header), size})
+	}
+}
+
+func TestMboxReader(t *testing.T) {
+	const separator = "From 1784512345678901234@xxx Tue Jan 02 10:00:00 +0000 2024\n"
+
+	for _, test := range []struct {
+		name string
+		mbox string
+		want []mboxEntry
+	}{
+		{"empty", "", nil},
+		{"no separator", "From: a@example.com\n\nhello\n", nil},
+		{"one message", separator + "From: a@example.com\n\nhello\n", []mboxEntry{{"From: a@example.com\n", 27}}},
+		{"text before the first message", "garbage\n\n" + separator + "From: a@example.com\n\nhi\n", []mboxEntry{{"From: a@example.com\n", 24}}},
+		{
+			"two messages",
+			separator + "From: a@example.com\nSubject: one\n\nfirst\n\n" + separator + "From: b@example.com\n\nsecond\n",
+			[]mboxEntry{{"From: a@example.com\nSubject: one\n", 41}, {"From: b@example.com\n", 28}},
+		},
+		{
+			"folded header",
+			separator + "From: a@example.com\nList-Unsubscribe: <mailto:x@example.com>,\n <https://example.com/u>\n\nbody\n",
+			[]mboxEntry{{"From: a@example.com\nList-Unsubscribe: <mailto:x@example.com>,\n <https://example.com/u>\n", 93}},
+		},
+		// without a date after it, a "From " line in a body is text
+		{"unescaped From in the body", separator + "From: a@example.com\n\nFrom here on\nFrom me to you\n", []mboxEntry{{"From: a@example.com\n", 49}}},
+		{"escaped From in the body", separator + "From: a@example.com\n\n>From the archive\n", []mboxEntry{{"From: a@example.com\n", 38}}},
+		{"escaped twice", separator + "From: a@example.com\n\n>>From the archive\n", []mboxEntry{{"From: a@example.com\n", 39}}},
+		{"quoted text is not an escape", separator + "From: a@example.com\n\n> From a reply\n>Fromage\n", []mboxEntry{{"From: a@example.com\n", 45}}},
+		{"separator inside a body splits", separator + "From: a@example.com\n\n" + separator + "From: b@example.com\n", []mboxEntry{{"From: a@example.com\n", 21}, {"From: b@example.com\n", 20}}},
+		{"no newline at the end", separator + "From: a@example.com\n\nlast line", []mboxEntry{{"From: a@example.com\n", 30}}},
+		{"header only", separator + "From: a@example.com", []mboxEntry{{"From: a@example.com", 19}}},
+		{"separator only", separator, []mboxEntry{{"", 0}}},
+		{
+			"crlf",
+			strings.ReplaceAll(separator+"From: a@example.com\n\nbody\n"+separator+"From: b@example.com\n\n", "\n", "\r\n"),
+			[]mboxEntry{{"From: a@example.com\r\n", 29}, {"From: b@example.com\r\n", 23}},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if got := readMbox(t, test.mbox); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("messages = %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestParseMboxHeader(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		header string
+		want   mboxMessage
+	}{
+		{
+			"all fields",
+			"From: \"Shop\" <News@Shop.example>\nDate: Fri, 01 Mar 2024 09:00:00 +0000\nX-Gmail-Labels: Inbox, Unread\nList-Unsubscribe: <https://shop.example/u>\n",
+			mboxMessage{"news@shop.example", time.Date(2024, 3, 1, 9, 0, 0, 0, time.UTC), []string{"Inbox", "Unread"}, "<https://shop.example/u>"},
+		},
+		{
+			"encoded words",
+			"From: =?UTF-8?Q?L=C3=A9a?= <lea@example.com>\nX-Gmail-Labels: =?UTF-8?Q?Inbox,=C3=89t=C3=A9?=\n",
+			mboxMessage{from: "lea@example.com", labels: []string{"Inbox", "Été"}},
+		},
+		{"bare address", "From: a@example.com\n", mboxMessage{from: "a@example.com"}},
+		{"unparsable sender kept", "From: <not an address\n", mboxMessage{from: "not an address"}},
+		{"bad date ignored", "From: a@example.com\nDate: yesterday\n", mboxMessage{from: "a@example.com"}},
+		{"no sender", "Subject: hi\n", mboxMessage{}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := parseMboxHeader([]byte(test.header))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.from != test.want.from || !got.date.Equal(test.want.date) || !reflect.DeepEqual(got.labels, test.want.labels) || got.unsubscribe != test.want.unsubscribe {
+				t.Errorf("parseMboxHeader = %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestAnalyzeMbox(t *testing.T) {
+	profile := &Profile{Name: "default", Dir: t.TempDir(), Settings: ProfileSettings{Address: "Me@Example.com"}}
+	stats, summary := AnalyzeMbox(context.Background(), profile, "testdata/takeout.mbox")
+	if summary.Err != nil {
+		t.Fatal(summary.Err)
+	}
+	// the sent message and the draft are skipped, the one without a sender failed
+	if summary.Processed != 8 || summary.Succeeded != 5 || summary.Skipped != 2 || summary.Failed != 1 {
+		t.Errorf("summary = %+v", summary)
+	}
+
+	day := func(month time.Month, d int) time.Time { return time.Date(2024, month, d, 9, 0, 0, 0, time.UTC) }
+	want := []SenderStats{
+		// the latest message's header wins, even when an older one is read later
+		{Address: "news@shop.example", Messages: 3, Unread: 2, Bytes: 797, First: day(time.January, 1), Last: day(time.March, 1), UnsubscribeHttp: "https://shop.example/u?m=2"},
+		{Address: "digest@list.example", Messages: 1, Unread: 1, Bytes: 305, First: day(time.March, 5).Add(time.Hour), Last: day(time.March, 5).Add(time.Hour), UnsubscribeHttp: "https://list.example/u?id=8"},
+		{Address: "friend@example.com", Messages: 1, Bytes: 146, First: day(time.March, 2).Add(time.Hour), Last: day(time.March, 2).Add(time.Hour)},
+	}
+	if len(stats) != len(want) {
+		t.Fatalf("got %d senders, want %d: %+v", len(stats), len(want), stats)
+	}
+	for i, got := range stats {
+		w := want[i]
+		if got.Address != w.Address || got.Messages != w.Messages || got.Unread != w.Unread || got.Bytes != w.Bytes ||
+			!got.First.Equal(w.First) || !got.Last.Equal(w.Last) || got.UnsubscribeMailto != w.UnsubscribeMailto || got.UnsubscribeHttp != w.UnsubscribeHttp {
+			t.Errorf("sender %d = %+v, want %+v", i, *got, w)
+		}
+	}
+
+	if got := CandidateSenders(stats, 1); !reflect.DeepEqual(got, []string{"news@shop.example", "digest@list.example"}) {
+		t.Errorf("candidates with 1 message = %q", got)
+	}
+	if got := CandidateSenders(stats, 2); !reflect.DeepEqual(got, []string{"news@shop.example"}) {
+		t.Errorf("candidates with 2 messages = %q", got)
+	}
+	if got := CandidateSenders(stats, 4); got != nil {
+		t.Errorf("candidates with 4 messages = %q", got)
+	}
+}
+
+func TestAnalyzeMboxErrors(t *testing.T) {
+	profile := &Profile{Name: "default", Dir: t.TempDir()}
+	if _, summary := AnalyzeMbox(context.Background(), profile, "testdata/missing.mbox"); summary.Err == nil {
+		t.Error("a missing export was analyzed")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	stats, summary := AnalyzeMbox(ctx, profile, "testdata/takeout.mbox")
+	if summary.Err != context.Canceled || summary.Processed != 0 || len(stats) != 0 {
+		t.Errorf("cancelled analysis = %+v, %+v", stats, summary)
+	}
+}
+
+func TestWriteDeletionList(t *testing.T) {
+	profile := &Profile{Name: "default", Dir: t.TempDir()}
+	read := func() []string {
+		t.Helper()
+		data, err := os.ReadFile(profile.DeletionListPath())
+		if err != nil {
+			t.Fatal(err)
+		}
+		var senders []string
+		if err := json.Unmarshal(data, &senders); err != nil {
+			t.Fatalf("deletion list %q: %v", data, err)
+		}
+		return senders
+	}
+
+	if err := WriteDeletionList(profile, []string{"news@shop.example", "digest@list.example"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := read(); !reflect.DeepEqual(got, []string{"news@shop.example", "digest@list.example"}) {
+		t.Errorf("deletion list = %q", got)
+	}
+
+	// replaced, and written as an empty list rather than null
+	if err := WriteDeletionList(profile, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := read(); got == nil || len(got) != 0 {
+		t.Errorf("deletion list = %#v, want empty", got)
+	}
+}
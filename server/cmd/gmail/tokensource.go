@@ -0,0 +1,104 @@
+package gmail
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"gmail-organizer/utils"
+	"net/http"
+	"sync"
+
+	"golang.org/x/oauth2"
+)
+
+// Wraps the oauth2 token source so that refreshed tokens are written back to
+// the credential store, and so that a revoked refresh token sends the user
+// through the consent flow again instead of failing every request that follows.
+type persistingTokenSource struct {
+	ctx    context.Context
+	config *oauth2.Config
+	store  CredentialStore
+	// opens the consent page when the grant has to be renewed
+	openURL func(string) error
+
+	mu   sync.Mutex
+	src  oauth2.TokenSource
+	last *oauth2.Token
+}
+
+func newPersistingTokenSource(ctx context.Context, config *oauth2.Config, store CredentialStore, tok *oauth2.Token) *persistingTokenSource {
+	return &persistingTokenSource{
+		ctx:     ctx,
+		config:  config,
+		store:   store,
+		openURL: utils.OpenURL,
+		src:     config.TokenSource(ctx, tok),
+		last:    tok,
+	}
+}
+
+func (s *persistingTokenSource) Token() (*oauth2.Token, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tok, err := s.src.Token()
+	if isRevokedGrant(err) {
+		fmt.Printf("The stored refresh token has expired or been revoked. Authorization is required again.\n")
+
+		tok, err = tokenFromLoopback(s.ctx, s.config, s.openURL, loopbackTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("error re-authorizing after revoked grant: %v", err.Error())
+		}
+		s.src = s.config.TokenSource(s.ctx, tok)
+	} else if err != nil {
+		return nil, err
+	}
+
+	// the token endpoint does not always repeat the scopes on refresh
+	if len(tokenScopes(tok)) == 0 && s.last != nil {
+		tok = withScopes(tok, tokenScopes(s.last))
+	}
+
+	if s.last == nil || tok.AccessToken != s.last.AccessToken || tok.RefreshToken != s.last.RefreshToken {
+		// a failed write only costs a refresh on the next run, so keep going
+		if err := s.store.SaveToken(tok); err != nil {
+			fmt.Printf("Could not persist refreshed token: %v\n", err.Error())
+		}
+		s.last = tok
+	}
+
+	return tok, nil
+}
+
+// Reports whether err is the token endpoint rejecting the refresh token itself,
+// as opposed to a transient network or server failure.
+func isRevokedGrant(err error) bool {
+	var retrieveErr *oauth2.RetrieveError
+	return errors.As(err, &retrieveErr) && retrieveErr.ErrorCode == "invalid_grant"
+}
+
+// Scopes the current token was granted, asking Google when the token was saved
+// before scopes were recorded alongside it.
+func (s *persistingTokenSource) grantedScopes() ([]string, error) {
+	tok, err := s.Token()
+	if err != nil {
+		return nil, err
+	}
+	if scopes := tokenScopes(tok); len(scopes) > 0 {
+		return scopes, nil
+	}
+
+	scopes, err := lookupTokenScopes(http.DefaultClient, tok)
+	if err != nil {
+		return nil, fmt.Errorf("error looking up granted scopes: %v", err.Error())
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.last = withScopes(tok, scopes)
+	if err := s.store.SaveToken(s.last); err != nil {
+		fmt.Printf("Could not persist granted scopes: %v\n", err.Error())
+	}
+
+	return scopes, nil
+}
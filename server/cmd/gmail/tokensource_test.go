@@ -0,0 +1,154 @@
+package gmail
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// Keeps the token in memory and counts how often it is written.
+type memoryStore struct {
+	mu    sync.Mutex
+	token *oauth2.Token
+	saves int
+}
+
+func (s *memoryStore) LoadCredentials() ([]byte, error) {
+	return nil, errors.New("no credentials")
+}
+
+func (s *memoryStore) LoadToken() (*oauth2.Token, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.token, nil
+}
+
+func (s *memoryStore) SaveToken(token *oauth2.Token) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.token = token
+	s.saves++
+	return nil
+}
+
+func (s *memoryStore) DeleteToken() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.token = nil
+	return nil
+}
+
+func expiredToken() *oauth2.Token {
+	tok := &oauth2.Token{AccessToken: "expired", RefreshToken: "refresh", TokenType: "Bearer", Expiry: time.Now().Add(-time.Hour)}
+	return withScopes(tok, []string{"scope"})
+}
+
+func TestPersistingTokenSourceSavesRefreshedToken(t *testing.T) {
+	server := newFakeAuthServer(t)
+	store := &memoryStore{}
+	src := newPersistingTokenSource(context.Background(), server.config(), store, expiredToken())
+	src.openURL = func(string) error {
+		t.Error("a refresh asked for consent")
+		return errors.New("no browser")
+	}
+
+	tok, err := src.Token()
+	if err != nil {
+		t.Fatalf("Token: %v", err)
+	}
+	if tok.AccessToken != "refreshed" {
+		t.Errorf("access token = %q, want the refreshed one", tok.AccessToken)
+	}
+
+	saved, _ := store.LoadToken()
+	if store.saves != 1 || saved == nil || saved.AccessToken != "refreshed" {
+		t.Fatalf("store holds %+v after %d saves, want the refreshed token", saved, store.saves)
+	}
+	// the refresh response left out the scopes, so they are carried over
+	if scopes := tokenScopes(saved); len(scopes) != 1 || scopes[0] != "scope" {
+		t.Errorf("saved scopes = %q, want those of the old token", scopes)
+	}
+	// the oauth2 package keeps the refresh token the response left out
+	if saved.RefreshToken != "refresh" {
+		t.Errorf("saved refresh token = %q", saved.RefreshToken)
+	}
+
+	// a token that is still valid is neither refreshed nor written again
+	if _, err := src.Token(); err != nil {
+		t.Fatal(err)
+	}
+	if store.saves != 1 || server.refreshes != 1 {
+		t.Errorf("%d saves and %d refreshes, want 1 each", store.saves, server.refreshes)
+	}
+}
+
+func TestPersistingTokenSourceReconsentsOnRevokedGrant(t *testing.T) {
+	server := newFakeAuthServer(t)
+	server.refreshStatus = http.StatusBadRequest
+	store := &memoryStore{}
+	src := newPersistingTokenSource(context.Background(), server.config(), store, expiredToken())
+	src.openURL, _ = server.browser(t, grantCode)
+
+	tok, err := src.Token()
+	if err != nil {
+		t.Fatalf("Token: %v", err)
+	}
+	if tok.AccessToken != "access" {
+		t.Errorf("access token = %q, want the one the consent flow issued", tok.AccessToken)
+	}
+	if saved, _ := store.LoadToken(); saved == nil || saved.AccessToken != "access" || saved.RefreshToken != "refresh" {
+		t.Errorf("store holds %+v, want the newly granted token", saved)
+	}
+
+	// the new grant serves later calls without another refresh
+	refreshes := server.refreshes
+	if _, err := src.Token(); err != nil {
+		t.Fatal(err)
+	}
+	if server.refreshes != refreshes {
+		t.Error("the revoked refresh token was tried again")
+	}
+}
+
+// Only a rejected grant means consent is needed; a failing token endpoint is
+// reported and the stored token kept.
+func TestPersistingTokenSourceKeepsTokenOnServerError(t *testing.T) {
+	server := newFakeAuthServer(t)
+	server.refreshStatus = http.StatusInternalServerError
+	store := &memoryStore{}
+	src := newPersistingTokenSource(context.Background(), server.config(), store, expiredToken())
+	src.openURL = func(string) error {
+		t.Error("a server error asked for consent")
+		return errors.New("no browser")
+	}
+
+	if _, err := src.Token(); err == nil || !strings.Contains(err.Error(), "internal_failure") {
+		t.Errorf("error = %v, want the token endpoint's", err)
+	}
+	if store.saves != 0 {
+		t.Errorf("store was written %d times", store.saves)
+	}
+}
+
+func TestIsRevokedGrant(t *testing.T) {
+	for _, test := range []struct {
+		err  error
+		want bool
+	}{
+		{&oauth2.RetrieveError{ErrorCode: "invalid_grant"}, true},
+		{&oauth2.RetrieveError{ErrorCode: "invalid_client"}, false},
+		{&oauth2.RetrieveError{Response: &http.Response{StatusCode: 500}}, false},
+		{errors.New("invalid_grant"), false},
+		{nil, false},
+	} {
+		if got := isRevokedGrant(test.err); got != test.want {
+			t.Errorf("isRevokedGrant(%v) = %v, want %v", test.err, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,370 @@
+package gmail
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	maxAttempts  = 6
+	baseBackoff  = 500 * time.Millisecond
+	maxBackoff   = 32 * time.Second
+	maxErrorPeek = 64 << 10
+
+	// Gmail allows 250 quota units per user per second as a moving average
+	defaultQuotaPerSecond = 250
+	defaultQuotaUnits     = 5
+)
+
+// Quota cost of each Gmail method, matched against the path below users/{userId}/.
+// https://developers.google.com/gmail/api/reference/quota
+var quotaCosts = []struct {
+	method  string
+	pattern *regexp.Regexp
+	name    string
+	units   int
+}{
+	{"GET", regexp.MustCompile(`^messages$`), "messages.list", 5},
+	{"GET", regexp.MustCompile(`^messages/[^/]+$`), "messages.get", 5},
+	{"POST", regexp.MustCompile(`^messages/batchDelete$`), "messages.batchDelete", 50},
+	{"POST", regexp.MustCompile(`^messages/batchModify$`), "messages.batchModify", 50},
+	{"POST", regexp.MustCompile(`^messages/send$`), "messages.send", 100},
+	{"POST", regexp.MustCompile(`^messages/[^/]+/trash$`), "messages.trash", 5},
+	{"POST", regexp.MustCompile(`^messages/[^/]+/untrash$`), "messages.untrash", 5},
+	{"POST", regexp.MustCompile(`^drafts$`), "drafts.create", 10},
+	{"GET", regexp.MustCompile(`^labels$`), "labels.list", 1},
+	{"GET", regexp.MustCompile(`^profile$`), "getProfile", 1},
+	{"GET", regexp.MustCompile(`^settings/filters$`), "settings.filters.list", 1},
+	{"POST", regexp.MustCompile(`^settings/filters$`), "settings.filters.create", 5},
+	{"GET", regexp.MustCompile(`^settings/sendAs$`), "settings.sendAs.list", 1},
+}
+
+var userPathPattern = regexp.MustCompile(`^/gmail/v1/users/[^/]+/(.*)$`)
+
+// POST methods that can be repeated without changing the outcome: modifying or
+// deleting the same messages twice leaves them as doing so once.
+var idempotentMethods = map[string]bool{
+	"messages.batchModify": true,
+	"messages.batchDelete": true,
+}
+
+// Sits between the Client and the authorized transport: every Gmail request
+// first waits for enough quota, and idempotent requests that fail with a rate
+// limit or a server error are retried with exponential backoff and jitter.
+type retryTransport struct {
+	base    http.RoundTripper
+	limiter *quotaLimiter
+	// host of the Gmail API; requests to any other host are refused, so the
+	// credentials the base transport adds never leave it
+	host string
+}
+
+func newRetryTransport(base http.RoundTripper, limiter *quotaLimiter, host string) *retryTransport {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &retryTransport{base, limiter, host}
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Host != t.host {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, fmt.Errorf("refusing to send an authorized request to %v; only %v is allowed", req.URL.Host, t.host)
+	}
+
+	name, units := quotaCost(req)
+
+	for attempt := 1; ; attempt++ {
+		if err := t.limiter.wait(req.Context(), name, units); err != nil {
+			return nil, err
+		}
+
+		attemptReq, err := rewindRequest(req, attempt)
+		if err != nil {
+			return nil, err
+		}
+
+		res, err := t.base.RoundTrip(attemptReq)
+		retry, wait := shouldRetry(req, res, err, attempt)
+		if !retry || attempt == maxAttempts {
+			return res, err
+		}
+
+		if res != nil {
+			io.Copy(io.Discard, io.LimitReader(res.Body, maxErrorPeek))
+			res.Body.Close()
+		}
+
+		fmt.Printf("%v %v failed (%v), retrying in %v\n", req.Method, name, retryReason(res, err), wait.Round(time.Millisecond))
+		select {
+		case <-time.After(wait):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+	}
+}
+
+// Returns a fresh copy of the request for another attempt, with its body
+// rewound.
+func rewindRequest(req *http.Request, attempt int) (*http.Request, error) {
+	if attempt == 1 || req.Body == nil || req.Body == http.NoBody {
+		return req, nil
+	}
+	if req.GetBody == nil {
+		return nil, errors.New("request body cannot be replayed for a retry")
+	}
+
+	body, err := req.GetBody()
+	if err != nil {
+		return nil, fmt.Errorf("error rewinding request body: %v", err.Error())
+	}
+
+	clone := req.Clone(req.Context())
+	clone.Body = body
+	return clone, nil
+}
+
+// Decides whether an attempt should be retried and how long to wait first.
+// A request that may already have taken effect, such as sending an email or
+// creating a filter, is only repeated when doing so is harmless.
+func shouldRetry(req *http.Request, res *http.Response, err error, attempt int) (bool, time.Duration) {
+	if req.Context().Err() != nil || !isIdempotent(req) {
+		return false, 0
+	}
+	if err != nil {
+		return true, backoff(attempt)
+	}
+
+	switch {
+	case res.StatusCode == http.StatusTooManyRequests, res.StatusCode >= 500:
+	case res.StatusCode == http.StatusForbidden && isRateLimitBody(res):
+	default:
+		return false, 0
+	}
+
+	if wait, ok := retryAfter(res); ok {
+		return true, wait
+	}
+	return true, backoff(attempt)
+}
+
+func isIdempotent(req *http.Request) bool {
+	if req.Method == "GET" || req.Method == "HEAD" {
+		return true
+	}
+	name, _ := quotaCost(req)
+	// batches only ever carry GET calls
+	return idempotentMethods[name] || strings.HasPrefix(name, "batch ")
+}
+
+// Gmail reports per-user rate limits as 403 rather than 429. The body is read
+// here and put back so callers still see the full error.
+func isRateLimitBody(res *http.Response) bool {
+	body, err := io.ReadAll(io.LimitReader(res.Body, maxErrorPeek))
+	res.Body.Close()
+	res.Body = io.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		return false
+	}
+	_, reason, _ := decodeErrorBody(body)
+	return reason == "rateLimitExceeded" || reason == "userRateLimitExceeded"
+}
+
+// Exponential backoff with full jitter.
+func backoff(attempt int) time.Duration {
+	ceiling := baseBackoff << (attempt - 1)
+	if ceiling > maxBackoff || ceiling <= 0 {
+		ceiling = maxBackoff
+	}
+	return time.Duration(rand.Int63n(int64(ceiling))) + time.Millisecond
+}
+
+// Parses a Retry-After header given either in seconds or as an HTTP date.
+func retryAfter(res *http.Response) (time.Duration, bool) {
+	value := strings.TrimSpace(res.Header.Get("Retry-After"))
+	if value == "" {
+		return 0, false
+	}
+
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		if wait := time.Until(date); wait > 0 {
+			return wait, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+func retryReason(res *http.Response, err error) string {
+	if err != nil {
+		return err.Error()
+	}
+	return res.Status
+}
+
+type quotaCostKey struct{}
+
+type quotaOverride struct {
+	name  string
+	units int
+}
+
+// Sets the quota cost of a request whose path does not identify the method,
+// such as a batch request.
+func withQuotaCost(ctx context.Context, name string, units int) context.Context {
+	return context.WithValue(ctx, quotaCostKey{}, quotaOverride{name, units})
+}
+
+// Returns the quota units of a Gmail method by name, e.g. "messages.get".
+func quotaUnitsOf(name string) int {
+	for _, cost := range quotaCosts {
+		if cost.name == name {
+			return cost.units
+		}
+	}
+	return defaultQuotaUnits
+}
+
+func quotaCost(req *http.Request) (string, int) {
+	if override, ok := req.Context().Value(quotaCostKey{}).(quotaOverride); ok {
+		return override.name, override.units
+	}
+
+	match := userPathPattern.FindStringSubmatch(req.URL.Path)
+	if match != nil {
+		for _, cost := range quotaCosts {
+			if cost.method == req.Method && cost.pattern.MatchString(match[1]) {
+				return cost.name, cost.units
+			}
+		}
+	}
+	return req.Method + " " + req.URL.Path, defaultQuotaUnits
+}
+
+// Token bucket holding one second's worth of per-user quota units. Calls that
+// cost more than the whole bucket are let through once it is full and leave
+// it in debt, which later calls then wait out.
+type quotaLimiter struct {
+	mu       sync.Mutex
+	rate     float64
+	capacity float64
+	tokens   float64
+	last     time.Time
+	usage    map[string]int
+}
+
+func newQuotaLimiter(perSecond int) *quotaLimiter {
+	return &quotaLimiter{
+		rate:     float64(perSecond),
+		capacity: float64(perSecond),
+		tokens:   float64(perSecond),
+		last:     time.Now(),
+		usage:    make(map[string]int),
+	}
+}
+
+func (l *quotaLimiter) wait(ctx context.Context, name string, units int) error {
+	for {
+		l.mu.Lock()
+		now := time.Now()
+		l.tokens += now.Sub(l.last).Seconds() * l.rate
+		if l.tokens > l.capacity {
+			l.tokens = l.capacity
+		}
+		l.last = now
+
+		need := float64(units)
+		if need > l.capacity {
+			need = l.capacity
+		}
+		if l.tokens >= need {
+			l.tokens -= float64(units)
+			l.usage[name] += units
+			l.mu.Unlock()
+			return nil
+		}
+		wait := time.Duration((need - l.tokens) / l.rate * float64(time.Second))
+		l.mu.Unlock()
+
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+var (
+	limitersMu sync.Mutex
+	// one limiter per mailbox, shared by every client built for it in this run
+	limiters = make(map[string]*quotaLimiter)
+)
+
+func limiterFor(profile *Profile) *quotaLimiter {
+	limitersMu.Lock()
+	defer limitersMu.Unlock()
+
+	key := profile.Name + "/" + profile.userId()
+	if limiter, found := limiters[key]; found {
+		return limiter
+	}
+
+	perSecond := defaultQuotaPerSecond
+	if value, err := strconv.Atoi(os.Getenv("GMAIL_QUOTA_PER_SECOND")); err == nil && value > 0 {
+		perSecond = value
+	}
+
+	limiter := newQuotaLimiter(perSecond)
+	limiters[key] = limiter
+	return limiter
+}
+
+// Prints the quota units spent per Gmail method for every mailbox used so far.
+func PrintQuotaUsage() {
+	limitersMu.Lock()
+	defer limitersMu.Unlock()
+
+	keys := make([]string, 0, len(limiters))
+	for key := range limiters {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		limiter := limiters[key]
+		limiter.mu.Lock()
+
+		methods := make([]string, 0, len(limiter.usage))
+		total := 0
+		for method, units := range limiter.usage {
+			methods = append(methods, method)
+			total += units
+		}
+		sort.Strings(methods)
+
+		if total > 0 {
+			fmt.Printf("\nQuota units used by %v: %v\n", key, total)
+			for _, method := range methods {
+				fmt.Printf("- %-28s %v\n", method, limiter.usage[method])
+			}
+		}
+		limiter.mu.Unlock()
+	}
+}
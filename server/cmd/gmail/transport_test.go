@@ -0,0 +1,369 @@
+package gmail
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const rateLimitBody = `{"error":{"code":403,"message":"User-rate limit exceeded","errors":[{"reason":"userRateLimitExceeded"}]}}`
+
+func userRequest(t *testing.T, method, path string) *http.Request {
+	var body io.Reader
+	if method == "POST" {
+		body = strings.NewReader(`{"ids":["1"]}`)
+	}
+	req, err := http.NewRequest(method, "https://gmail.googleapis.com/gmail/v1/users/me/"+path, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return req
+}
+
+func batchRequest(t *testing.T) *http.Request {
+	req, err := http.NewRequest("POST", "https://gmail.googleapis.com"+batchPath, strings.NewReader("--b--"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return req.WithContext(withQuotaCost(req.Context(), "batch messages.get", 5))
+}
+
+func response(status int, body string) *http.Response {
+	return &http.Response{StatusCode: status, Status: http.StatusText(status), Header: http.Header{}, Body: io.NopCloser(strings.NewReader(body))}
+}
+
+func TestShouldRetry(t *testing.T) {
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	for _, test := range []struct {
+		name string
+		req  *http.Request
+		res  *http.Response
+		err  error
+		want bool
+	}{
+		{"get 503", userRequest(t, "GET", "messages"), response(503, ""), nil, true},
+		{"get 500", userRequest(t, "GET", "messages/1"), response(500, ""), nil, true},
+		{"get 429", userRequest(t, "GET", "messages"), response(429, ""), nil, true},
+		{"get rate limit 403", userRequest(t, "GET", "messages"), response(403, rateLimitBody), nil, true},
+		{"get permission 403", userRequest(t, "GET", "messages"), response(403, `{"error":{"code":403,"errors":[{"reason":"insufficientPermissions"}]}}`), nil, false},
+		{"get 404", userRequest(t, "GET", "messages/1"), response(404, ""), nil, false},
+		{"get 200", userRequest(t, "GET", "messages"), response(200, "{}"), nil, false},
+		{"get network error", userRequest(t, "GET", "messages"), nil, errors.New("connection reset"), true},
+		{"head 503", userRequest(t, "HEAD", "profile"), response(503, ""), nil, true},
+		{"batchModify 503", userRequest(t, "POST", "messages/batchModify"), response(503, ""), nil, true},
+		{"batchDelete 429", userRequest(t, "POST", "messages/batchDelete"), response(429, ""), nil, true},
+		{"batchModify network error", userRequest(t, "POST", "messages/batchModify"), nil, errors.New("connection reset"), true},
+		{"batch of gets 503", batchRequest(t), response(503, ""), nil, true},
+		{"send 503", userRequest(t, "POST", "messages/send"), response(503, ""), nil, false},
+		{"send 429", userRequest(t, "POST", "messages/send"), response(429, ""), nil, false},
+		{"send rate limit 403", userRequest(t, "POST", "messages/send"), response(403, rateLimitBody), nil, false},
+		{"send network error", userRequest(t, "POST", "messages/send"), nil, errors.New("connection reset"), false},
+		{"draft 500", userRequest(t, "POST", "drafts"), response(500, ""), nil, false},
+		{"filter 503", userRequest(t, "POST", "settings/filters"), response(503, ""), nil, false},
+		{"trash 503", userRequest(t, "POST", "messages/1/trash"), response(503, ""), nil, false},
+		{"cancelled", userRequest(t, "GET", "messages").WithContext(cancelled), nil, context.Canceled, false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			retry, wait := shouldRetry(test.req, test.res, test.err, 1)
+			if retry != test.want {
+				t.Errorf("shouldRetry = %v, want %v", retry, test.want)
+			}
+			if retry && (wait <= 0 || wait > baseBackoff+time.Millisecond) {
+				t.Errorf("first retry waits %v, want up to %v", wait, baseBackoff)
+			}
+		})
+	}
+}
+
+// The body of a 403 is read to tell a rate limit apart; callers must still
+// see all of it.
+func TestShouldRetryKeepsErrorBody(t *testing.T) {
+	res := response(403, rateLimitBody)
+	shouldRetry(userRequest(t, "GET", "messages"), res, nil, 1)
+
+	body, _ := io.ReadAll(res.Body)
+	if string(body) != rateLimitBody {
+		t.Errorf("body after shouldRetry = %q, want it unchanged", body)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	for attempt := 1; attempt <= 12; attempt++ {
+		ceiling := baseBackoff << (attempt - 1)
+		if ceiling > maxBackoff {
+			ceiling = maxBackoff
+		}
+
+		var longest time.Duration
+		for i := 0; i < 200; i++ {
+			wait := backoff(attempt)
+			if wait <= 0 || wait > ceiling+time.Millisecond {
+				t.Fatalf("backoff(%d) = %v, want within (0, %v]", attempt, wait, ceiling)
+			}
+			if wait > longest {
+				longest = wait
+			}
+		}
+		// full jitter spreads waits over the whole range
+		if longest < ceiling/2 {
+			t.Errorf("backoff(%d) never exceeded %v in 200 draws, want up to %v", attempt, longest, ceiling)
+		}
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		value  string
+		want   time.Duration
+		slack  time.Duration
+		wantOk bool
+	}{
+		{"absent", "", 0, 0, false},
+		{"seconds", "7", 7 * time.Second, 0, true},
+		{"zero seconds", "0", 0, 0, true},
+		{"padded seconds", " 3 ", 3 * time.Second, 0, true},
+		{"negative seconds", "-1", 0, 0, false},
+		{"http date", time.Now().Add(10 * time.Second).UTC().Format(http.TimeFormat), 10 * time.Second, 2 * time.Second, true},
+		{"past http date", time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat), 0, 0, true},
+		{"rfc 850 date", time.Now().Add(20 * time.Second).UTC().Format("Monday, 02-Jan-06 15:04:05 GMT"), 20 * time.Second, 2 * time.Second, true},
+		{"garbage", "soon", 0, 0, false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			res := response(429, "")
+			if test.value != "" {
+				res.Header.Set("Retry-After", test.value)
+			}
+
+			got, ok := retryAfter(res)
+			if ok != test.wantOk || got < test.want-test.slack || got > test.want {
+				t.Errorf("retryAfter(%q) = %v, %v; want %v (within %v), %v", test.value, got, ok, test.want, test.slack, test.wantOk)
+			}
+		})
+	}
+}
+
+// fakeGmail answers each request with the next status in its script and
+// records what it received.
+type fakeGmail struct {
+	mu       sync.Mutex
+	statuses []int
+	header   http.Header
+	bodies   []string
+}
+
+func (f *fakeGmail) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+
+	f.mu.Lock()
+	f.bodies = append(f.bodies, string(body))
+	status := http.StatusOK
+	if len(f.bodies) <= len(f.statuses) {
+		status = f.statuses[len(f.bodies)-1]
+	}
+	f.mu.Unlock()
+
+	for name, values := range f.header {
+		w.Header()[name] = values
+	}
+	w.WriteHeader(status)
+}
+
+func (f *fakeGmail) attempts() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string{}, f.bodies...)
+}
+
+func newTestRetryTransport(t *testing.T, handler http.Handler) (*http.Client, string) {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	serverUrl, _ := url.Parse(server.URL)
+	transport := newRetryTransport(server.Client().Transport, newQuotaLimiter(defaultQuotaPerSecond), serverUrl.Host)
+	return &http.Client{Transport: transport}, server.URL
+}
+
+func TestRetryTransportRetriesIdempotentRequests(t *testing.T) {
+	gmail := &fakeGmail{statuses: []int{503, 429}, header: http.Header{"Retry-After": {"0"}}}
+	client, serverUrl := newTestRetryTransport(t, gmail)
+
+	body := `{"ids":["1","2"],"addLabelIds":["TRASH"]}`
+	res, err := client.Post(serverUrl+"/gmail/v1/users/me/messages/batchModify", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("Post: %v", err)
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("status = %v, want 200 after retries", res.StatusCode)
+	}
+	attempts := gmail.attempts()
+	if len(attempts) != 3 {
+		t.Fatalf("server saw %d attempts, want 3", len(attempts))
+	}
+	for i, got := range attempts {
+		if got != body {
+			t.Errorf("attempt %d sent body %q, want it rewound to %q", i+1, got, body)
+		}
+	}
+}
+
+func TestRetryTransportDoesNotRepeatSend(t *testing.T) {
+	for _, path := range []string{"messages/send", "drafts", "settings/filters"} {
+		t.Run(path, func(t *testing.T) {
+			gmail := &fakeGmail{statuses: []int{503}, header: http.Header{"Retry-After": {"0"}}}
+			client, serverUrl := newTestRetryTransport(t, gmail)
+
+			res, err := client.Post(serverUrl+"/gmail/v1/users/me/"+path, "application/json", strings.NewReader(`{"raw":"x"}`))
+			if err != nil {
+				t.Fatalf("Post: %v", err)
+			}
+			res.Body.Close()
+
+			if res.StatusCode != http.StatusServiceUnavailable {
+				t.Errorf("status = %v, want the 503 passed on", res.StatusCode)
+			}
+			if attempts := len(gmail.attempts()); attempts != 1 {
+				t.Errorf("server saw %d attempts, want 1", attempts)
+			}
+		})
+	}
+}
+
+func TestRetryTransportGivesUp(t *testing.T) {
+	statuses := make([]int, maxAttempts+2)
+	for i := range statuses {
+		statuses[i] = http.StatusInternalServerError
+	}
+	gmail := &fakeGmail{statuses: statuses, header: http.Header{"Retry-After": {"0"}}}
+	client, serverUrl := newTestRetryTransport(t, gmail)
+
+	res, err := client.Get(serverUrl + "/gmail/v1/users/me/messages")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusInternalServerError {
+		t.Errorf("status = %v, want the last 500", res.StatusCode)
+	}
+	if attempts := len(gmail.attempts()); attempts != maxAttempts {
+		t.Errorf("server saw %d attempts, want %d", attempts, maxAttempts)
+	}
+}
+
+func TestRetryTransportStopsOnCancel(t *testing.T) {
+	gmail := &fakeGmail{statuses: []int{503, 503, 503}, header: http.Header{"Retry-After": {"60"}}}
+	client, serverUrl := newTestRetryTransport(t, gmail)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, "GET", serverUrl+"/gmail/v1/users/me/messages", nil)
+
+	start := time.Now()
+	_, err := client.Do(req)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("error = %v, want the context's", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("cancelled request returned after %v, want promptly", elapsed)
+	}
+}
+
+func TestRetryTransportRefusesOtherHosts(t *testing.T) {
+	gmail := &fakeGmail{}
+	client, _ := newTestRetryTransport(t, gmail)
+
+	_, err := client.Get("https://unsubscribe.example.com/u")
+	if err == nil || !strings.Contains(err.Error(), "refusing to send an authorized request") {
+		t.Errorf("error = %v, want the request refused", err)
+	}
+	if attempts := len(gmail.attempts()); attempts != 0 {
+		t.Errorf("server saw %d requests, want none", attempts)
+	}
+}
+
+func TestQuotaCost(t *testing.T) {
+	for _, test := range []struct {
+		req   *http.Request
+		name  string
+		units int
+	}{
+		{userRequest(t, "GET", "messages"), "messages.list", 5},
+		{userRequest(t, "GET", "messages/abc"), "messages.get", 5},
+		{userRequest(t, "POST", "messages/batchDelete"), "messages.batchDelete", 50},
+		{userRequest(t, "POST", "messages/send"), "messages.send", 100},
+		{userRequest(t, "POST", "messages/abc/untrash"), "messages.untrash", 5},
+		{userRequest(t, "GET", "labels"), "labels.list", 1},
+		{batchRequest(t), "batch messages.get", 5},
+		{userRequest(t, "GET", "history"), "GET /gmail/v1/users/me/history", defaultQuotaUnits},
+	} {
+		name, units := quotaCost(test.req)
+		if name != test.name || units != test.units {
+			t.Errorf("quotaCost(%v %v) = %v, %v; want %v, %v", test.req.Method, test.req.URL.Path, name, units, test.name, test.units)
+		}
+	}
+}
+
+func TestQuotaLimiterDebt(t *testing.T) {
+	limiter := newQuotaLimiter(100)
+	ctx := context.Background()
+
+	// a call larger than the bucket goes through once it is full...
+	start := time.Now()
+	if err := limiter.wait(ctx, "messages.batchDelete", 150); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Errorf("oversized call on a full bucket waited %v, want no wait", elapsed)
+	}
+
+	// ...and leaves 50 units of debt, which the next call waits out at 100/s
+	start = time.Now()
+	if err := limiter.wait(ctx, "messages.get", 1); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("call after the debt waited %v, want about 510ms", elapsed)
+	}
+
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+	if limiter.usage["messages.batchDelete"] != 150 || limiter.usage["messages.get"] != 1 {
+		t.Errorf("usage = %v, want every unit counted", limiter.usage)
+	}
+}
+
+func TestQuotaLimiterCancel(t *testing.T) {
+	limiter := newQuotaLimiter(1)
+	limiter.wait(context.Background(), "messages.get", 1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := limiter.wait(ctx, "messages.get", 1); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("wait on an empty bucket: error = %v, want the context's", err)
+	}
+}
+
+func TestQuotaLimiterRefillsUpToCapacity(t *testing.T) {
+	limiter := newQuotaLimiter(1000)
+	limiter.last = time.Now().Add(-time.Hour)
+
+	limiter.wait(context.Background(), "messages.list", 5)
+
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+	if limiter.tokens > limiter.capacity {
+		t.Errorf("tokens = %v after an idle hour, want at most the capacity %v", limiter.tokens, limiter.capacity)
+	}
+}
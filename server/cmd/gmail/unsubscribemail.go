@@ -0,0 +1,101 @@
+package gmail
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"mime"
+	"mime/quotedprintable"
+	"net/mail"
+	"strings"
+	"time"
+)
+
+// what is sent to mailto targets that do not say what they expect
+const (
+	defaultUnsubscribeSubject = "Unsubscribe Request"
+	defaultUnsubscribeBody    = "Please unsubscribe me from this mailing list."
+)
+
+// When set, mailto unsubscribe requests are saved as drafts for the user to
+// review and send, instead of being sent.
+var draftUnsubscribeEmails bool
+
+func SetDraftUnsubscribeEmails(draft bool) {
+	draftUnsubscribeEmails = draft
+}
+
+// The operation InitUnsubscribe runs as, which needs to compose rather than
+// only send when drafts are created.
+func unsubscribeOp() operation {
+	if draftUnsubscribeEmails {
+		return unsubscribeDraftOperation
+	}
+	return unsubscribeOperation
+}
+
+// Builds the RFC 5322 message a mailto unsubscribe target asks for (RFC 6068):
+// to its recipients, with its subject and body when it has them. Any other
+// header fields in the URI, such as cc, are ignored so that a sender cannot
+// have the request copied to someone else.
+func buildUnsubscribeEmail(from *mail.Address, mailto unsubscribeTarget, date time.Time) ([]byte, error) {
+	var to []string
+	for _, address := range mailto.addresses {
+		parsed, err := mail.ParseAddress(address)
+		if err != nil {
+			continue
+		}
+		to = append(to, (&mail.Address{Address: parsed.Address}).String())
+	}
+	if len(to) == 0 {
+		return nil, fmt.Errorf("mailto target %v has no valid recipient", mailto.uri)
+	}
+
+	// header values must stay on one line
+	subject := strings.Join(strings.Fields(mailto.params.Get("subject")), " ")
+	if subject == "" {
+		subject = defaultUnsubscribeSubject
+	}
+	body := mailto.params.Get("body")
+	if strings.TrimSpace(body) == "" {
+		body = defaultUnsubscribeBody
+	}
+
+	var message bytes.Buffer
+	header := func(name, value string) {
+		fmt.Fprintf(&message, "%s: %s\r\n", name, value)
+	}
+	header("From", from.String())
+	header("To", strings.Join(to, ", "))
+	header("Subject", mime.QEncoding.Encode("utf-8", subject))
+	header("Date", date.Format(time.RFC1123Z))
+	header("Message-ID", newMessageId(from.Address))
+	header("MIME-Version", "1.0")
+	header("Content-Type", `text/plain; charset="utf-8"`)
+	header("Content-Transfer-Encoding", "quoted-printable")
+	message.WriteString("\r\n")
+
+	// also turns the body's line breaks into CRLF
+	writer := quotedprintable.NewWriter(&message)
+	if _, err := writer.Write([]byte(body)); err != nil {
+		return nil, fmt.Errorf("error encoding unsubscribe email: %v", err.Error())
+	}
+	if err := writer.Close(); err != nil {
+		return nil, fmt.Errorf("error encoding unsubscribe email: %v", err.Error())
+	}
+
+	return message.Bytes(), nil
+}
+
+// A globally unique Message-ID in the sender's domain.
+func newMessageId(from string) string {
+	random := make([]byte, 16)
+	rand.Read(random)
+
+	domain := "localhost"
+	if i := strings.LastIndex(from, "@"); i >= 0 && i < len(from)-1 {
+		domain = from[i+1:]
+	}
+	return fmt.Sprintf("<%v@%v>", hex.EncodeToString(random), domain)
+}
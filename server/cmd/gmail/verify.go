@@ -0,0 +1,96 @@
+package gmail
+
+import (
+	"fmt"
+	"net/mail"
+	"strings"
+)
+
+// A listed message whose From header is not one of the requested senders.
+type senderMismatch struct {
+	id, from string
+}
+
+// Checks the From header of every candidate message against the sender list,
+// where "@domain" entries accept any address at exactly that domain.
+// Searches also match display names and similar looking addresses, so
+// anything that does not match exactly is excluded before a destructive action
+// and returned for reporting.
+func verifySenders(provider Provider, messageIds []string, senderAddresses []string) ([]string, []senderMismatch, error) {
+	addresses, domains := splitSenders(senderAddresses)
+
+	senders := make(map[string]struct{}, len(addresses))
+	for _, address := range addresses {
+		senders[normalizeAddress(address)] = struct{}{}
+	}
+	senderDomains := make(map[string]struct{}, len(domains))
+	for _, domain := range domains {
+		senderDomains[normalizeAddress(domain)] = struct{}{}
+	}
+
+	var verified []string
+	var mismatches []senderMismatch
+	progress := newProgress("Verified sender of", len(messageIds))
+
+	for _, result := range provider.FetchHeaders(messageIds, "From") {
+		id, data, err := result.id, result.message, result.err
+		if IsNotFound(err) {
+			// deleted since it was listed, so there is nothing left to remove
+			mismatches = append(mismatches, senderMismatch{id, "(message no longer exists)"})
+			progress.add(1)
+			continue
+		} else if err != nil {
+			return nil, nil, fmt.Errorf("error retrieving headers of message %v: %v", id, err.Error())
+		}
+
+		from := headerValue(data, "From")
+		address := fromAddress(from)
+		_, addressFound := senders[address]
+		_, domainFound := senderDomains[address[strings.LastIndex(address, "@")+1:]]
+
+		if addressFound || (domainFound && strings.Contains(address, "@")) {
+			verified = append(verified, id)
+		} else {
+			mismatches = append(mismatches, senderMismatch{id, from})
+		}
+		progress.add(1)
+	}
+
+	return verified, mismatches, nil
+}
+
+func printSenderMismatches(mismatches []senderMismatch) {
+	if len(mismatches) == 0 {
+		return
+	}
+
+	fmt.Printf("Excluded %v messages whose From header did not match the sender list:", len(mismatches))
+	for _, mismatch := range mismatches {
+		fmt.Printf("\n- %v (From: %v)", mismatch.id, mismatch.from)
+	}
+	fmt.Println()
+}
+
+// Returns the value of the first header with the given name, or "".
+func headerValue(data *messagePayload, name string) string {
+	for _, header := range data.Payload.Headers {
+		if strings.EqualFold(header.Name, name) {
+			return header.Value
+		}
+	}
+	return ""
+}
+
+// Extracts the bare address from a From header such as "Name <a@b.com>".
+func fromAddress(header string) string {
+	address, err := mail.ParseAddress(header)
+	if err != nil {
+		// fall back to the raw value so odd headers can still match exactly
+		return normalizeAddress(strings.Trim(header, " <>"))
+	}
+	return normalizeAddress(address.Address)
+}
+
+func normalizeAddress(address string) string {
+	return strings.ToLower(strings.TrimSpace(address))
+}
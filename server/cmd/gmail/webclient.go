@@ -0,0 +1,140 @@
+package gmail
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"syscall"
+	"time"
+)
+
+const (
+	// bounds a whole third-party request, redirects included
+	webTimeout = 30 * time.Second
+	// redirects an unsubscribe link may go through
+	webMaxRedirects = 5
+)
+
+// Ranges that are not on the public internet, besides those netip already
+// classifies (loopback, private, link-local, multicast, unspecified).
+var nonPublicPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("192.0.2.0/24"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("198.51.100.0/24"),
+	netip.MustParsePrefix("203.0.113.0/24"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+	// NAT64, which could reach any IPv4 address behind the gateway
+	netip.MustParsePrefix("64:ff9b::/96"),
+	netip.MustParsePrefix("64:ff9b:1::/48"),
+	netip.MustParsePrefix("100::/64"),
+	netip.MustParsePrefix("2001:db8::/32"),
+}
+
+// Builds the client for every request to a host other than Gmail's, such as
+// unsubscribe links found in a sender's mail. It carries no credentials or
+// cookies, only speaks HTTPS, follows at most webMaxRedirects redirects and
+// refuses to connect to loopback, private and other non-public addresses, so
+// a List-Unsubscribe header cannot aim requests at the local network.
+// Recording and replaying fixtures apply to it as they do to Gmail calls.
+func newWebClient(profile *Profile) (*http.Client, error) {
+	endpoint := currentEndpoint()
+
+	var transport http.RoundTripper = guardedTransport()
+	if endpoint.WebTransport != nil {
+		transport = endpoint.WebTransport
+	}
+
+	if endpoint.Replay != "" {
+		replay, err := newReplayTransport(endpoint.Replay, profile)
+		if err != nil {
+			return nil, err
+		}
+		transport = replay
+	}
+	if endpoint.Record != "" {
+		rec, err := recorderFor(endpoint.Record, profile)
+		if err != nil {
+			return nil, err
+		}
+		transport = &recordingTransport{transport, rec}
+	}
+
+	return webClient(transport), nil
+}
+
+// Wraps transport with the limits every third-party request is held to.
+func webClient(transport http.RoundTripper) *http.Client {
+	return &http.Client{
+		Transport: &httpsOnlyTransport{transport},
+		Timeout:   webTimeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) > webMaxRedirects {
+				return fmt.Errorf("stopped after %d redirects", webMaxRedirects)
+			}
+			return nil
+		},
+	}
+}
+
+// A transport that checks every address it connects to, after name
+// resolution, so a host cannot resolve to a public address when checked and a
+// private one when dialed. Proxies are not used, as they would do the dialing.
+func guardedTransport() *http.Transport {
+	dialer := &net.Dialer{
+		Timeout: 10 * time.Second,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			addrPort, err := netip.ParseAddrPort(address)
+			if err != nil {
+				return fmt.Errorf("refusing to connect to %v: %v", address, err.Error())
+			}
+			if !isPublicAddr(addrPort.Addr()) {
+				return fmt.Errorf("refusing to connect to non-public address %v", addrPort.Addr())
+			}
+			return nil
+		},
+	}
+
+	return &http.Transport{
+		Proxy:                 nil,
+		DialContext:           dialer.DialContext,
+		TLSClientConfig:       &tls.Config{MinVersion: tls.VersionTLS12},
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: webTimeout,
+		MaxIdleConns:          10,
+		IdleConnTimeout:       30 * time.Second,
+	}
+}
+
+func isPublicAddr(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if !addr.IsValid() || addr.IsLoopback() || addr.IsPrivate() || addr.IsUnspecified() ||
+		addr.IsLinkLocalUnicast() || addr.IsLinkLocalMulticast() || addr.IsInterfaceLocalMulticast() || addr.IsMulticast() {
+		return false
+	}
+	for _, prefix := range nonPublicPrefixes {
+		if prefix.Contains(addr) {
+			return false
+		}
+	}
+	return true
+}
+
+// Refuses plain HTTP, for the first request and every redirect alike.
+type httpsOnlyTransport struct {
+	base http.RoundTripper
+}
+
+func (t *httpsOnlyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme != "https" {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, fmt.Errorf("refusing to send a request over %v; only HTTPS is allowed", req.URL.Scheme)
+	}
+	return t.base.RoundTrip(req)
+}
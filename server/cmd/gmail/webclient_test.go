@@ -0,0 +1,251 @@
+package gmail
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"sync"
+	"testing"
+
+	"gmail-organizer/cmd/gmail/gmailtest"
+)
+
+func TestIsPublicAddr(t *testing.T) {
+	for _, test := range []struct {
+		addr string
+		want bool
+	}{
+		{"93.184.216.34", true},
+		{"8.8.8.8", true},
+		{"2606:2800:220:1:248:1893:25c8:1946", true},
+		// loopback
+		{"127.0.0.1", false},
+		{"127.1.2.3", false},
+		{"::1", false},
+		// RFC 1918
+		{"10.0.0.1", false},
+		{"172.16.5.4", false},
+		{"172.31.255.255", false},
+		{"192.168.1.1", false},
+		{"172.32.0.1", true},
+		// link-local, including cloud metadata endpoints
+		{"169.254.169.254", false},
+		{"fe80::1", false},
+		// CGNAT
+		{"100.64.0.1", false},
+		{"100.127.255.254", false},
+		{"100.128.0.1", true},
+		// NAT64, which would reach 127.0.0.1 or 10.0.0.1 through the gateway
+		{"64:ff9b::7f00:1", false},
+		{"64:ff9b::a00:1", false},
+		{"64:ff9b:1::1", false},
+		// IPv4-mapped IPv6
+		{"::ffff:127.0.0.1", false},
+		{"::ffff:10.0.0.1", false},
+		{"::ffff:169.254.169.254", false},
+		{"::ffff:93.184.216.34", true},
+		// unique local, unspecified, multicast, reserved and documentation
+		{"fd00::1", false},
+		{"0.0.0.0", false},
+		{"::", false},
+		{"0.1.2.3", false},
+		{"224.0.0.1", false},
+		{"ff02::1", false},
+		{"240.0.0.1", false},
+		{"255.255.255.255", false},
+		{"192.0.2.1", false},
+		{"198.18.0.1", false},
+		{"2001:db8::1", false},
+	} {
+		if got := isPublicAddr(netip.MustParseAddr(test.addr)); got != test.want {
+			t.Errorf("isPublicAddr(%v) = %v, want %v", test.addr, got, test.want)
+		}
+	}
+	if isPublicAddr(netip.Addr{}) {
+		t.Error("the zero address is public")
+	}
+}
+
+// A third-party site that records the headers of every request it receives.
+type recordingSite struct {
+	*httptest.Server
+	mu      sync.Mutex
+	headers map[string]http.Header
+}
+
+func newRecordingSite(t *testing.T, handler http.HandlerFunc) *recordingSite {
+	site := &recordingSite{headers: make(map[string]http.Header)}
+	site.Server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		site.mu.Lock()
+		site.headers[r.URL.Path] = r.Header.Clone()
+		site.mu.Unlock()
+		handler(w, r)
+	}))
+	t.Cleanup(site.Close)
+	return site
+}
+
+func (s *recordingSite) received(path string) (http.Header, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	header, found := s.headers[path]
+	return header, found
+}
+
+// Sends requests for public.example to the site, as if it were on the
+// internet, and everything else through the guarded transport.
+func publicSiteTransport(site *recordingSite) http.RoundTripper {
+	guarded := guardedTransport()
+	return roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		if req.URL.Hostname() != "public.example" {
+			return guarded.RoundTrip(req)
+		}
+		req = req.Clone(req.Context())
+		req.URL.Host = site.Listener.Addr().String()
+		return site.Client().Transport.RoundTrip(req)
+	})
+}
+
+func TestGuardedTransportRefusesNonPublicHosts(t *testing.T) {
+	site := newRecordingSite(t, func(w http.ResponseWriter, r *http.Request) {})
+	client := webClient(guardedTransport())
+	_, port, _ := strings.Cut(site.Listener.Addr().String(), ":")
+
+	for _, target := range []string{
+		"https://127.0.0.1:" + port + "/u",
+		"https://localhost:" + port + "/u",
+		"https://[::1]:" + port + "/u",
+		"https://10.0.0.1/u",
+		"https://169.254.169.254/latest/meta-data/",
+		"https://[::ffff:127.0.0.1]:" + port + "/u",
+		"https://[64:ff9b::7f00:1]:" + port + "/u",
+	} {
+		res, err := client.Get(target)
+		if err == nil {
+			res.Body.Close()
+			t.Errorf("GET %v succeeded", target)
+		} else if !strings.Contains(err.Error(), "refusing to connect") {
+			t.Errorf("GET %v: error = %v, want it refused before connecting", target, err)
+		}
+	}
+	if _, found := site.received("/u"); found {
+		t.Error("the loopback site was reached")
+	}
+}
+
+func TestWebClientRefusesHttpAndPrivateRedirects(t *testing.T) {
+	site := newRecordingSite(t, func(w http.ResponseWriter, r *http.Request) {
+		if target := r.URL.Query().Get("to"); target != "" {
+			http.Redirect(w, r, target, http.StatusFound)
+		}
+	})
+	client := webClient(publicSiteTransport(site))
+	_, port, _ := strings.Cut(site.Listener.Addr().String(), ":")
+
+	if res, err := client.Get("https://public.example/ok"); err != nil {
+		t.Fatalf("GET of a public HTTPS link: %v", err)
+	} else {
+		res.Body.Close()
+	}
+
+	for _, test := range []struct {
+		name    string
+		link    string
+		wantErr string
+	}{
+		{"plain http link", "http://public.example/u", "only HTTPS"},
+		{"redirect to http", "https://public.example/r?to=http://public.example/u", "only HTTPS"},
+		{"redirect to loopback", "https://public.example/r?to=https://127.0.0.1:" + port + "/private", "refusing to connect"},
+		{"redirect to localhost", "https://public.example/r?to=https://localhost:" + port + "/private", "refusing to connect"},
+		{"redirect to a private network", "https://public.example/r?to=https://192.168.1.1/admin", "refusing to connect"},
+		{"redirect to metadata", "https://public.example/r?to=https://169.254.169.254/", "refusing to connect"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := unsubscribeByHttpAddress(context.Background(), client, unsubscribeTarget{scheme: "https", uri: test.link}, false)
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("error = %v, want one containing %q", err, test.wantErr)
+			}
+		})
+	}
+	if _, found := site.received("/private"); found {
+		t.Error("a redirect reached the private path")
+	}
+}
+
+func TestWebClientRedirectLimit(t *testing.T) {
+	hops := 0
+	site := newRecordingSite(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/loop" {
+			hops++
+			http.Redirect(w, r, "/loop", http.StatusFound)
+		}
+	})
+	client := webClient(publicSiteTransport(site))
+
+	if _, err := client.Get("https://public.example/loop"); err == nil || !strings.Contains(err.Error(), "stopped after") {
+		t.Errorf("error = %v, want the redirects stopped", err)
+	}
+	if hops != webMaxRedirects+1 {
+		t.Errorf("followed %d requests, want %d", hops, webMaxRedirects+1)
+	}
+}
+
+// The account's credentials must stay with Gmail: a one-click unsubscribe,
+// and the redirect it is answered with, carry neither the OAuth token nor
+// cookies.
+func TestUnsubscribeSendsNoCredentialsToThirdParties(t *testing.T) {
+	srv, profile := useFakeGmail(t)
+	site := newRecordingSite(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/u" {
+			http.SetCookie(w, &http.Cookie{Name: "session", Value: "tracking"})
+			http.Redirect(w, r, "/done", http.StatusSeeOther)
+		}
+	})
+
+	authorized := roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		req = req.Clone(req.Context())
+		req.Header.Set("Authorization", "Bearer ya29.secret")
+		req.Header.Set("Cookie", "SID=secret")
+		return srv.Client().Transport.RoundTrip(req)
+	})
+	UseEndpoint(Endpoint{Url: srv.URL, Transport: authorized, WebTransport: site.Client().Transport})
+
+	srv.AddMessage(gmailtest.Message{Headers: []gmailtest.Header{
+		{Name: "From", Value: "news@shop.example"},
+		{Name: "List-Unsubscribe", Value: "<" + site.URL + "/u?id=1>"},
+		{Name: "List-Unsubscribe-Post", Value: "List-Unsubscribe=One-Click"},
+	}})
+
+	summary := InitUnsubscribe(context.Background(), profile, []string{"news@shop.example"})
+	checkSummary(t, summary, 1, 1, 0, 0)
+
+	for _, path := range []string{"/u", "/done"} {
+		header, found := site.received(path)
+		if !found {
+			t.Fatalf("the site never received %v", path)
+		}
+		for _, name := range []string{"Authorization", "Cookie", "Proxy-Authorization"} {
+			if value := header.Get(name); value != "" {
+				t.Errorf("%v carried %v: %q", path, name, value)
+			}
+		}
+	}
+}
+
+// The Gmail client refuses to send its authorized requests anywhere but the
+// API host, so an unsubscribe link cannot be fetched through it by mistake.
+func TestRetryTransportKeepsCredentialsOnApiHost(t *testing.T) {
+	site := newRecordingSite(t, func(w http.ResponseWriter, r *http.Request) {})
+	transport := newRetryTransport(site.Client().Transport, newQuotaLimiter(100), "gmail.googleapis.com")
+
+	req, _ := http.NewRequest("GET", site.URL+"/u", nil)
+	req.Header.Set("Authorization", "Bearer ya29.secret")
+	if _, err := transport.RoundTrip(req); err == nil {
+		t.Error("an authorized request was sent to a third-party host")
+	}
+	if _, found := site.received("/u"); found {
+		t.Error("the third-party host was reached")
+	}
+}
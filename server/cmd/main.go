@@ -1,19 +1,23 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"gmail-organizer/cmd/gmail"
 	"gmail-organizer/utils"
 	"io"
 	"log"
 	"os"
+	"os/signal"
+	"strings"
 
 	"github.com/joho/godotenv"
 )
 
 const (
-	deletion = "Delete emails"
+	deletion = "Remove emails"
 	updateTrash = "Update TRASH list"
 	unsubscribe = "Unsubscribe script"
 	exit =  "Exit"
@@ -21,6 +25,39 @@ const (
 
 type deletionList []string
 
+var (
+	account = flag.String("account", "", "name of the profile in profiles/ to use (defaults to the working directory)")
+	allAccounts = flag.Bool("all-accounts", false, "run the selected operation against every profile and print a combined summary")
+	serviceAccount = flag.String("service-account", "", "path to a service account key with domain-wide delegation")
+	impersonate = flag.String("impersonate", "", "comma-separated Workspace users to impersonate with --service-account")
+	permanent = flag.Bool("permanent", false, "permanently delete messages instead of moving them to the trash; this cannot be undone")
+	impersonateFile = flag.String("impersonate-file", "", "file listing one Workspace user per line to impersonate with --service-account")
+
+	// narrow which messages from the listed senders are deleted
+	category = flag.String("category", "", "only messages in this category (primary, social, promotions, updates, forums, purchases)")
+	olderThan = flag.String("older-than", "", "only messages older than a period such as 90d, 6m or 1y")
+	newerThan = flag.String("newer-than", "", "only messages newer than a period such as 90d, 6m or 1y")
+	label = flag.String("label", "", "only messages with this label")
+	excludeLabel = flag.String("exclude-label", "", "skip messages with this label")
+	subject = flag.String("subject", "", "only messages whose subject contains this phrase")
+	largerThan = flag.String("larger-than", "", "only messages larger than a size such as 500K or 10M")
+	smallerThan = flag.String("smaller-than", "", "only messages smaller than a size such as 500K or 10M")
+	hasAttachment = flag.Bool("has-attachment", false, "only messages with attachments")
+	unread = flag.Bool("unread", false, "only unread messages")
+	excludeStarred = flag.Bool("exclude-starred", false, "skip starred messages")
+
+	drafts = flag.Bool("drafts", false, "save unsubscribe emails as drafts to review and send yourself instead of sending them")
+
+	workers = flag.Int("workers", gmail.DefaultWorkers, "maximum number of senders or messages processed concurrently")
+	record = flag.String("record", "", "record every HTTP exchange, scrubbed of credentials and personal addresses, to this fixture file")
+	replay = flag.String("replay", "", "answer every HTTP request from this fixture file instead of the network")
+
+	// analyze a Takeout export instead of the live mailbox
+	top = flag.Int("top", 50, "number of senders analyze prints, or 0 for all")
+	minMessages = flag.Int("min-messages", 5, "fewest messages a sender needs before analyze suggests it for the deletion list")
+	writeDeletionList = flag.Bool("write-deletion-list", false, "have analyze write its suggested senders to the profile's deletionList.json")
+)
+
 func init() {
 	err := godotenv.Load(".env")
 	if err != nil {
@@ -29,55 +66,276 @@ func init() {
 }
 
 func main() {
-	var deletionList deletionList
+	flag.Parse()
+	gmail.SetWorkers(*workers)
+	gmail.SetDraftUnsubscribeEmails(*drafts)
+	if *record != "" || *replay != "" {
+		gmail.UseEndpoint(gmail.Endpoint{Record: *record, Replay: *replay})
+	}
+
+	// Ctrl+C stops handing out new work and cancels requests in flight
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
 
-	jsonFile, err := os.Open("deletionList.json") // relative path?
+	profiles, err := selectProfiles()
 	if err != nil {
-		fmt.Printf("could not open json list: %v", err.Error())
-		return
+		log.Fatalf("Could not load profile: %v", err)
 	}
-	defer jsonFile.Close()
 
-	data, err := io.ReadAll(jsonFile)
-	if err != nil {
-		fmt.Printf("could not read json list: %v", err.Error())
+	switch flag.Arg(0) {
+	case "logout":
+		for _, profile := range profiles {
+			if err := gmail.Logout(profile); err != nil {
+				log.Fatalf("Could not log out: %v", err)
+			}
+		}
+		return
+	case "undo":
+		runId := flag.Arg(1)
+		if runId == "" {
+			// without a run ID, list what can be undone
+			for _, profile := range profiles {
+				journals, err := gmail.ListJournals(profile)
+				if err != nil {
+					log.Fatalf("Could not list runs: %v", err)
+				}
+				gmail.PrintJournals(profile, journals)
+			}
+			return
+		}
+
+		var summaries []gmail.Summary
+		for _, profile := range profiles {
+			summaries = append(summaries, gmail.Undo(ctx, profile, runId))
+		}
+		gmail.PrintSummaries(summaries)
+		gmail.PrintQuotaUsage()
+		return
+	case "analyze":
+		analyzeExport(ctx, profiles, flag.Arg(1))
+		return
+	case "history":
+		for _, profile := range profiles {
+			entries, err := gmail.ListLedger(profile)
+			if err != nil {
+				log.Fatalf("Could not read unsubscribe history: %v", err)
+			}
+			gmail.PrintLedger(profile, entries)
+		}
 		return
 	}
 
-	err = json.Unmarshal(data, &deletionList)
+	filter, err := buildFilter()
 	if err != nil {
-		fmt.Printf("could not unmarshal json list: %v", err.Error())
-		return
+		log.Fatalf("Invalid message filter: %v", err)
 	}
 
 	options := utils.Options{deletion, updateTrash, unsubscribe, exit}
+	if *serviceAccount != "" {
+		// unsubscribing needs a browser session, which impersonated users do not have
+		options = utils.Options{deletion, updateTrash, exit}
+	}
 	selectedOption, err := options.SelectOption()
 	if err != nil {
 		log.Fatalf("There was an error selecting an option: %v", err)
 	}
+	if selectedOption == exit {
+		return
+	}
+
+	var summaries []gmail.Summary
+
+	for _, profile := range profiles {
+		deletionList, err := loadDeletionList(profile.DeletionListPath())
+		if err != nil {
+			summaries = append(summaries, gmail.Summary{Account: profile.Name, Operation: selectedOption, Err: err})
+			continue
+		}
+
+		if selectedOption == deletion {
+			var senderBulletPointList string
+			for _, senderAddress := range deletionList {
+				senderBulletPointList += fmt.Sprintf("\n- %v", senderAddress)
+			}
+
+			var filterDescription string
+			if filterQuery := filter.String(); filterQuery != "" {
+				filterDescription = fmt.Sprintf(" matching \"%v\"", filterQuery)
+			}
+
+			action := "move all emails"
+			if *permanent {
+				action = "PERMANENTLY delete all emails"
+			}
+
+			confirmationMsg := utils.ConfirmationMsg(fmt.Sprintf("Are you sure you would like to %v%v in account \"%v\" from the following senders: %v?", action, filterDescription, profile.Name, senderBulletPointList))
+			isConfirmed, err := confirmationMsg.AskForConfirmation()
+			if err != nil {
+				log.Fatalf("There was an error selection an option: %v", err)
+			} else if (isConfirmed) {
+				summaries = append(summaries, gmail.InitMessageRemoval(ctx, profile, deletionList, filter, *permanent))
+			}
+		} else if selectedOption == updateTrash {
+			summaries = append(summaries, gmail.InitTrashListUpdate(ctx, profile, deletionList))
+		} else if selectedOption == unsubscribe {
+			summaries = append(summaries, gmail.InitUnsubscribe(ctx, profile, deletionList))
+		}
+	}
+
+	gmail.PrintSummaries(summaries)
+	gmail.PrintQuotaUsage()
+}
+
+// Prints the sender statistics of a Takeout mbox export and, when asked to,
+// writes the senders worth removing as the profile's deletion list.
+func analyzeExport(ctx context.Context, profiles []*gmail.Profile, path string) {
+	if path == "" {
+		log.Fatalf("Usage: analyze <path to Takeout .mbox file>")
+	}
+	if len(profiles) != 1 {
+		log.Fatalf("analyze works on one profile at a time")
+	}
+	profile := profiles[0]
+
+	stats, summary := gmail.AnalyzeMbox(ctx, profile, path)
+	gmail.PrintSenderStats(stats, *top)
+
+	candidates := gmail.CandidateSenders(stats, *minMessages)
+	fmt.Printf("\n%v senders have at least %v messages and a List-Unsubscribe header\n", len(candidates), *minMessages)
 
-	if selectedOption == deletion {
-		var senderBulletPointList string
-		for _, senderAddress := range deletionList {
-			senderBulletPointList += fmt.Sprintf("\n- %v", senderAddress)
+	if *writeDeletionList && summary.Err == nil {
+		isConfirmed := true
+		if _, err := os.Stat(profile.DeletionListPath()); err == nil {
+			confirmationMsg := utils.ConfirmationMsg(fmt.Sprintf("Replace %v with these %v senders?", profile.DeletionListPath(), len(candidates)))
+			isConfirmed, err = confirmationMsg.AskForConfirmation()
+			if err != nil {
+				log.Fatalf("There was an error selection an option: %v", err)
+			}
 		}
 
-		confirmationMsg := utils.ConfirmationMsg(fmt.Sprintf("Are you sure you would like to permanently delete all emails from the following senders: %v?", senderBulletPointList))
-		isConfirmed, err := confirmationMsg.AskForConfirmation()
+		if isConfirmed {
+			if err := gmail.WriteDeletionList(profile, candidates); err != nil {
+				summary.Err = err
+			} else {
+				fmt.Printf("Wrote %v senders to %v\n", len(candidates), profile.DeletionListPath())
+			}
+		}
+	}
+
+	gmail.PrintSummaries([]gmail.Summary{summary})
+}
+
+func selectProfiles() ([]*gmail.Profile, error) {
+	if *serviceAccount != "" {
+		if *account != "" || *allAccounts {
+			return nil, fmt.Errorf("--service-account cannot be combined with --account or --all-accounts")
+		}
+
+		var users []string
+		for _, user := range strings.Split(*impersonate, ",") {
+			if user = strings.TrimSpace(user); user != "" {
+				users = append(users, user)
+			}
+		}
+		if *impersonateFile != "" {
+			fileUsers, err := gmail.ReadUserList(*impersonateFile)
+			if err != nil {
+				return nil, err
+			}
+			users = append(users, fileUsers...)
+		}
+
+		return gmail.ServiceAccountProfiles(*serviceAccount, users)
+	}
+
+	if *allAccounts {
+		if *account != "" {
+			return nil, fmt.Errorf("--account and --all-accounts cannot be combined")
+		}
+		return gmail.ListProfiles()
+	}
+
+	profile, err := gmail.LoadProfile(*account)
+	if err != nil {
+		return nil, err
+	}
+	return []*gmail.Profile{profile}, nil
+}
+
+// Builds the search terms that narrow a sender-based deletion from the flags.
+func buildFilter() (*gmail.Query, error) {
+	filter := gmail.NewQuery()
+
+	if *category != "" {
+		parsedCategory, err := gmail.ParseCategory(*category)
+		if err != nil {
+			return nil, err
+		}
+		filter.Category(parsedCategory)
+	}
+	if *olderThan != "" {
+		filter.OlderThan(*olderThan)
+	}
+	if *newerThan != "" {
+		filter.NewerThan(*newerThan)
+	}
+	if *label != "" {
+		filter.Label(*label)
+	}
+	if *excludeLabel != "" {
+		filter.Not().Label(*excludeLabel)
+	}
+	if *subject != "" {
+		filter.Subject(*subject)
+	}
+	if *largerThan != "" {
+		size, err := gmail.ParseSize(*largerThan)
+		if err != nil {
+			return nil, err
+		}
+		filter.LargerThan(size)
+	}
+	if *smallerThan != "" {
+		size, err := gmail.ParseSize(*smallerThan)
 		if err != nil {
-			log.Fatalf("There was an error selection an option: %v", err)
-		} else if (isConfirmed) {
-			gmail.InitMessageRemoval(deletionList);
+			return nil, err
 		}
-	} else if selectedOption == updateTrash {
-		gmail.InitTrashListUpdate(deletionList);
-	} else if selectedOption == unsubscribe {
-		gmail.InitUnsubscribe(deletionList)
-	}
-
-	// if len(os.Args) < 2 {
-	// 	fmt.Println("Please provide an email address to search your inbox for")
-	// 	return
-	// }
-	// senderAddress := os.Args[1]
-}
\ No newline at end of file
+		filter.SmallerThan(size)
+	}
+	if *hasAttachment {
+		filter.HasAttachment()
+	}
+	if *unread {
+		filter.IsUnread()
+	}
+	if *excludeStarred {
+		filter.Not().IsStarred()
+	}
+
+	if _, err := filter.Build(); err != nil {
+		return nil, err
+	}
+	return filter, nil
+}
+
+func loadDeletionList(path string) (deletionList, error) {
+	var deletionList deletionList
+
+	jsonFile, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not open json list: %v", err.Error())
+	}
+	defer jsonFile.Close()
+
+	data, err := io.ReadAll(jsonFile)
+	if err != nil {
+		return nil, fmt.Errorf("could not read json list: %v", err.Error())
+	}
+
+	err = json.Unmarshal(data, &deletionList)
+	if err != nil {
+		return nil, fmt.Errorf("could not unmarshal json list: %v", err.Error())
+	}
+
+	return deletionList, nil
+}
@@ -0,0 +1,58 @@
+package utils
+
+import (
+	"context"
+	"sync"
+)
+
+// Result is the outcome of one item handed to RunPool.
+type Result[R any] struct {
+	Value R
+	Err   error
+}
+
+// Calls fn for every item with at most workers calls running at once and
+// returns the results in the order of items, however the calls interleave.
+// Once ctx is cancelled no further calls are started, and the items that were
+// never started get ctx's error.
+func RunPool[T, R any](ctx context.Context, items []T, workers int, fn func(context.Context, T) (R, error)) []Result[R] {
+	results := make([]Result[R], len(items))
+	if workers < 1 {
+		workers = 1
+	}
+	if workers > len(items) {
+		workers = len(items)
+	}
+
+	indices := make(chan int)
+	var wg sync.WaitGroup
+
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indices {
+				value, err := fn(ctx, items[i])
+				results[i] = Result[R]{value, err}
+			}
+		}()
+	}
+
+	next := 0
+feed:
+	for ; next < len(items); next++ {
+		select {
+		case indices <- next:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(indices)
+	wg.Wait()
+
+	for i := next; i < len(items); i++ {
+		results[i].Err = ctx.Err()
+	}
+
+	return results
+}
@@ -0,0 +1,178 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Tracks how many calls run at once.
+type concurrency struct {
+	mu         sync.Mutex
+	running    int
+	maxRunning int
+	calls      int
+}
+
+func (c *concurrency) enter() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.running++
+	c.calls++
+	if c.running > c.maxRunning {
+		c.maxRunning = c.running
+	}
+}
+
+func (c *concurrency) leave() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.running--
+}
+
+func TestRunPoolKeepsOrder(t *testing.T) {
+	items := make([]int, 200)
+	for i := range items {
+		items[i] = i
+	}
+
+	var c concurrency
+	results := RunPool(context.Background(), items, 16, func(ctx context.Context, item int) (string, error) {
+		c.enter()
+		defer c.leave()
+		// later items finish first, so completion order is reversed
+		time.Sleep(time.Duration(len(items)-item) * 10 * time.Microsecond)
+		if item%7 == 0 {
+			return "", fmt.Errorf("item %d failed", item)
+		}
+		return fmt.Sprint(item), nil
+	})
+
+	if len(results) != len(items) {
+		t.Fatalf("got %d results, want %d", len(results), len(items))
+	}
+	for i, result := range results {
+		if i%7 == 0 {
+			if result.Err == nil || result.Err.Error() != fmt.Sprintf("item %d failed", i) {
+				t.Errorf("result %d: error = %v, want its own", i, result.Err)
+			}
+		} else if result.Err != nil || result.Value != fmt.Sprint(i) {
+			t.Errorf("result %d = %+v, want %d", i, result, i)
+		}
+	}
+	if c.calls != len(items) {
+		t.Errorf("fn was called %d times, want %d", c.calls, len(items))
+	}
+	if c.maxRunning > 16 || c.maxRunning < 2 {
+		t.Errorf("%d calls ran at once, want between 2 and 16", c.maxRunning)
+	}
+}
+
+func TestRunPoolWorkerBounds(t *testing.T) {
+	for _, workers := range []int{0, -3, 1} {
+		var c concurrency
+		results := RunPool(context.Background(), []int{1, 2, 3, 4}, workers, func(ctx context.Context, item int) (int, error) {
+			c.enter()
+			defer c.leave()
+			time.Sleep(time.Millisecond)
+			return item * 10, nil
+		})
+		if c.maxRunning != 1 {
+			t.Errorf("workers = %d: %d calls ran at once, want 1", workers, c.maxRunning)
+		}
+		for i, result := range results {
+			if result.Value != (i+1)*10 || result.Err != nil {
+				t.Errorf("workers = %d: result %d = %+v", workers, i, result)
+			}
+		}
+	}
+
+	// more workers than items
+	results := RunPool(context.Background(), []string{"a", "b"}, 50, func(ctx context.Context, item string) (string, error) {
+		return item + item, nil
+	})
+	if len(results) != 2 || results[0].Value != "aa" || results[1].Value != "bb" {
+		t.Errorf("results = %+v", results)
+	}
+}
+
+func TestRunPoolEmpty(t *testing.T) {
+	for _, items := range [][]int{nil, {}} {
+		results := RunPool(context.Background(), items, 4, func(ctx context.Context, item int) (int, error) {
+			t.Error("fn was called without items")
+			return 0, nil
+		})
+		if len(results) != 0 {
+			t.Errorf("results = %+v, want none", results)
+		}
+	}
+}
+
+func TestRunPoolStopsWhenCancelled(t *testing.T) {
+	items := make([]int, 1000)
+	for i := range items {
+		items[i] = i
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var calls atomic.Int32
+	results := RunPool(ctx, items, 2, func(ctx context.Context, item int) (int, error) {
+		calls.Add(1)
+		if item == 5 {
+			cancel()
+		}
+		return item, nil
+	})
+
+	if n := int(calls.Load()); n >= len(items) {
+		t.Fatalf("fn was called %d times after the context was cancelled", n)
+	}
+
+	// every item was either started and kept its result, or got ctx's error
+	var started, skipped int
+	for i, result := range results {
+		switch {
+		case result.Err == nil && result.Value == i:
+			started++
+		case errors.Is(result.Err, context.Canceled):
+			skipped++
+		default:
+			t.Errorf("result %d = %+v", i, result)
+		}
+	}
+	if started != int(calls.Load()) || skipped == 0 || started+skipped != len(items) {
+		t.Errorf("%d started and %d skipped of %d, with %d calls", started, skipped, len(items), calls.Load())
+	}
+	// the items handed out before the cancel all ran
+	for i := 0; i <= 5; i++ {
+		if results[i].Err != nil {
+			t.Errorf("item %d, started before the cancel, got %v", i, results[i].Err)
+		}
+	}
+}
+
+func TestRunPoolCancelledBeforeStart(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	items := make([]int, 1000)
+	var calls atomic.Int32
+	results := RunPool(ctx, items, 4, func(ctx context.Context, item int) (int, error) {
+		calls.Add(1)
+		return 0, nil
+	})
+
+	// a worker may still be handed an item while the feed notices the cancel
+	if n := int(calls.Load()); n >= len(items) {
+		t.Errorf("fn was called %d times on a cancelled context", n)
+	}
+	if !errors.Is(results[len(results)-1].Err, context.Canceled) {
+		t.Errorf("last result = %+v, want context.Canceled", results[len(results)-1])
+	}
+}